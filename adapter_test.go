@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	adapter_library "github.com/clearblade/adapter-go-library"
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const testTopicRoot = "eip"
+
+var testTime = time.Date(2022, time.September, 1, 12, 30, 0, 0, time.UTC)
+
+type publishedMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// memoryTransport is an in-memory mqttTransport. Requests are delivered
+// straight to the subscribed handler and every publish is captured so tests
+// can assert on the exact payloads the adapter produced.
+type memoryTransport struct {
+	handler   adapter_library.MQTTMessageReceived
+	published chan publishedMessage
+}
+
+func newMemoryTransport() *memoryTransport {
+	return &memoryTransport{published: make(chan publishedMessage, 100)}
+}
+
+func (m *memoryTransport) Subscribe(topic string, handler adapter_library.MQTTMessageReceived) error {
+	m.handler = handler
+	return nil
+}
+
+func (m *memoryTransport) Publish(topic string, payload []byte) error {
+	m.published <- publishedMessage{topic: topic, payload: payload}
+	return nil
+}
+
+func (m *memoryTransport) PublishRetained(topic string, payload []byte) error {
+	m.published <- publishedMessage{topic: topic, payload: payload, retained: true}
+	return nil
+}
+
+// send delivers a request to the adapter as if it arrived from the broker
+func (m *memoryTransport) send(topic string, payload string) {
+	path, _ := mqttTypes.NewTopicPath(topic)
+	m.handler(&mqttTypes.Publish{Topic: path, Payload: []byte(payload)})
+}
+
+// next waits for the next published message and asserts its topic
+func (m *memoryTransport) next(t *testing.T, topic string) publishedMessage {
+	t.Helper()
+
+	select {
+	case msg := <-m.published:
+		if msg.topic != topic {
+			t.Fatalf("expected publish to %s, got %s: %s", topic, msg.topic, msg.payload)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for publish to %s", topic)
+	}
+	return publishedMessage{}
+}
+
+// expect waits for the next published message and asserts its topic and JSON
+func (m *memoryTransport) expect(t *testing.T, topic string, expected string) {
+	t.Helper()
+
+	msg := m.next(t, topic)
+	compact := new(bytes.Buffer)
+	if err := json.Compact(compact, []byte(expected)); err != nil {
+		t.Fatalf("invalid expected JSON: %s", err.Error())
+	}
+	if string(msg.payload) != compact.String() {
+		t.Fatalf("unexpected payload on %s\nexpected: %s\n     got: %s", topic, compact.String(), msg.payload)
+	}
+}
+
+// expectNone asserts nothing is published within a short window
+func (m *memoryTransport) expectNone(t *testing.T) {
+	t.Helper()
+
+	select {
+	case msg := <-m.published:
+		t.Fatalf("unexpected publish to %s: %s", msg.topic, msg.payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// startTestAdapter points the adapter at the simulated controller, connects
+// to it and subscribes the message handler to an in-memory transport
+func startTestAdapter(t *testing.T, sim *simController) *memoryTransport {
+	t.Helper()
+
+	transport := newMemoryTransport()
+	prevSettings, prevConfig, prevClient, prevNow, prevTagConfigs := adapterSettings, adapterConfig, mqttClient, timeNow, tagConfigs
+	t.Cleanup(func() {
+		adapterSettings, adapterConfig, mqttClient, timeNow, tagConfigs = prevSettings, prevConfig, prevClient, prevNow, prevTagConfigs
+	})
+
+	adapterSettings = &ethernetIpAdapterSettings{EndpointIp: "127.0.0.1", EndpointPort: sim.port()}
+	adapterConfig = &adapter_library.AdapterConfig{TopicRoot: testTopicRoot}
+	mqttClient = transport
+	timeNow = func() time.Time { return testTime }
+
+	initializeEIP()
+	if err := mqttClient.Subscribe(adapterConfig.TopicRoot+"/#", cbMessageHandler); err != nil {
+		t.Fatalf("failed to subscribe: %s", err.Error())
+	}
+
+	return transport
+}
+
+func TestReadRequest(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addDINT("Setpoint", -7)
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Counter", "Setpoint"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"Counter": {"value": 42, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Setpoint": {"value": -7, "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+}
+
+func TestReadRequestIntegerTypes(t *testing.T) {
+	sim := newSimController(t)
+	sim.addTag("Small", 0xc2, []byte{0xff})
+	sim.addTag("Byte", 0xc6, []byte{0xff})
+	sim.addTag("Word", 0xc3, []byte{0x2c, 0x01})
+	sim.addTag("Negative", 0xc3, []byte{0x18, 0xfc})
+	sim.addTag("Unsigned", 0xc7, []byte{0xff, 0xff})
+	sim.addTag("Total", 0xc8, []byte{0xff, 0xff, 0xff, 0xff})
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Small", "Byte", "Word", "Negative", "Unsigned", "Total"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"Byte": {"value": 255, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Negative": {"value": -1000, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Small": {"value": -1, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Total": {"value": 4294967295, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Unsigned": {"value": 65535, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Word": {"value": 300, "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+}
+
+func TestReadRequestUnknownTag(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Missing"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {},
+		"success": false,
+		"status_code": 0,
+		"error_message": "tag does not exist: Missing"
+	}`)
+}
+
+func TestReadRequestUnsupportedType(t *testing.T) {
+	sim := newSimController(t)
+	sim.addTag("Temperature", 0xca, []byte{0x00, 0x00, 0xc8, 0x41})
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Temperature"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {},
+		"success": false,
+		"status_code": 0,
+		"error_message": "unsupported data type: 202"
+	}`)
+}
+
+func TestReadRequestInvalidPayload(t *testing.T) {
+	sim := newSimController(t)
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/read", `{"tags": "Counter"}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {},
+		"success": false,
+		"status_code": 0,
+		"error_message": "json: cannot unmarshal string into Go struct field ethernetIpReadRequestMQTTMessage.tags of type []string"
+	}`)
+}
+
+func TestResponseTopicsAreIgnored(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/read/response", `{"tags": ["Counter"]}`)
+	transport.send(testTopicRoot+"/unknown", `{}`)
+	transport.expectNone(t)
+}
+
+func TestWriteRequest(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Setpoint", 10)
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Setpoint", "value": -250}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{
+		"node_id": "Setpoint",
+		"timestamp": "2022-09-01T12:30:00Z",
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	if got := sim.value("Setpoint"); !bytes.Equal(got, []byte{0x06, 0xff, 0xff, 0xff}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+}
+
+func TestWriteRequestInvalidValue(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Setpoint", 10)
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Setpoint", "value": 1.5}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{
+		"node_id": "Setpoint",
+		"timestamp": "2022-09-01T12:30:00Z",
+		"success": false,
+		"status_code": 0,
+		"error_message": "invalid value for DINT tag: 1.5"
+	}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Missing", "value": 1}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{
+		"node_id": "Missing",
+		"timestamp": "2022-09-01T12:30:00Z",
+		"success": false,
+		"status_code": 0,
+		"error_message": "tag does not exist: Missing"
+	}`)
+
+	if got := sim.value("Setpoint"); !bytes.Equal(got, []byte{0x0a, 0x00, 0x00, 0x00}) {
+		t.Fatalf("controller value changed to % x", got)
+	}
+}
+
+func TestBrowseRequest(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addString("Recipe", "IPA")
+	transport := startTestAdapter(t, sim)
+
+	transport.send(testTopicRoot+"/browse", `{}`)
+	transport.expect(t, testTopicRoot+"/browse/response", `{
+		"timestamp": "2022-09-01T12:30:00Z",
+		"tags": [
+			{"name": "Counter", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0},
+			{"name": "Recipe", "data_type": "STRING", "type_code": 36814, "structure": true, "dimensions": 0}
+		],
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+}
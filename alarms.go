@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	eventsTopic   = "events"
+	alarmAckTopic = "alarms/ack"
+
+	alarmHiHi    = "HiHi"
+	alarmHi      = "Hi"
+	alarmLo      = "Lo"
+	alarmLoLo    = "LoLo"
+	alarmDigital = "Alarm"
+
+	alarmEventActive       = "alarm_active"
+	alarmEventCleared      = "alarm_cleared"
+	alarmEventAcknowledged = "alarm_acknowledged"
+
+	alarmStateNormal         = "normal"
+	alarmStateActiveUnacked  = "active_unacked"
+	alarmStateActiveAcked    = "active_acked"
+	alarmStateClearedUnacked = "cleared_unacked"
+)
+
+var errAlarmNotAcknowledgeable = errors.New("alarm has nothing to acknowledge")
+
+// alarmSeverities are the default event severities of the alarm conditions,
+// on the OPC UA 1-1000 scale
+var alarmSeverities = map[string]uint32{
+	alarmHiHi:    800,
+	alarmLoLo:    800,
+	alarmHi:      500,
+	alarmLo:      500,
+	alarmDigital: 500,
+}
+
+// alarm tracks the condition and acknowledgement of a single tag. The alarm
+// is active while condition is set, last is the most recent active condition.
+// A new or more severe condition must be acknowledged. An alarm that clears
+// before it is acknowledged stays cleared_unacked until it is.
+type alarm struct {
+	tag      string
+	settings *alarmSettings
+
+	condition    string
+	last         string
+	acked        bool
+	pending      string
+	pendingSince time.Time
+	value        interface{}
+}
+
+// alarmManager evaluates the alarms after every poll and publishes their
+// transitions to {topic_root}/events
+type alarmManager struct {
+	mu     sync.Mutex
+	alarms map[string]*alarm
+}
+
+var (
+	alarms   *alarmManager
+	eventSeq uint64
+)
+
+// initializeAlarms validates the alarm settings and registers the alarm
+// manager with the poller
+func initializeAlarms() error {
+	manager := &alarmManager{alarms: map[string]*alarm{}}
+	for tag, settings := range adapterSettings.Alarms {
+		if !isTagName(resolveTagName(tag)) {
+			return fmt.Errorf("alarm for %s: %w", tag, errTagNotFound)
+		}
+		if err := settings.validate(); err != nil {
+			return fmt.Errorf("invalid alarm for %s: %w", tag, err)
+		}
+		manager.alarms[tag] = &alarm{tag: tag, settings: settings, acked: true}
+	}
+
+	if len(adapterSettings.PollTags) > 0 {
+		for tag := range manager.alarms {
+			if !containsString(adapterSettings.PollTags, tag) {
+				log.Printf("[ERROR] initializeAlarms - Alarm tag %s is not in poll_tags and will not be evaluated\n", tag)
+			}
+		}
+	}
+
+	log.Printf("[INFO] initializeAlarms - Monitoring %d alarms, publishing events to %s/%s\n", len(manager.alarms), adapterConfig.TopicRoot, eventsTopic)
+	poller.addListener(manager.handlePoll)
+	alarms = manager
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *alarmSettings) validate() error {
+	limits := []*float64{s.LoLo, s.Lo, s.Hi, s.HiHi}
+	var previous *float64
+	for _, limit := range limits {
+		if limit == nil {
+			continue
+		}
+		if previous != nil && *limit < *previous {
+			return fmt.Errorf("limits must be ordered lolo <= lo <= hi <= hihi")
+		}
+		previous = limit
+	}
+
+	switch {
+	case previous == nil && s.Condition == nil:
+		return fmt.Errorf("no limits or condition")
+	case previous != nil && s.Condition != nil:
+		return fmt.Errorf("condition cannot be combined with limits")
+	case s.Deadband < 0:
+		return fmt.Errorf("deadband must not be negative")
+	}
+	return nil
+}
+
+// evaluate returns the condition the value is in, "" when normal. Limits of
+// the current condition, and of the less severe conditions on the same side,
+// only clear once the value is back past them by the deadband.
+func (s *alarmSettings) evaluate(value interface{}, current string) string {
+	if s.Condition != nil {
+		if exprToBool(toAlarmValue(value)) == *s.Condition {
+			return alarmDigital
+		}
+		return ""
+	}
+
+	v := exprToNumber(toAlarmValue(value))
+	high := func(limit *float64, latched bool) bool {
+		if limit == nil {
+			return false
+		}
+		if latched {
+			return v > *limit-s.Deadband
+		}
+		return v >= *limit
+	}
+	low := func(limit *float64, latched bool) bool {
+		if limit == nil {
+			return false
+		}
+		if latched {
+			return v < *limit+s.Deadband
+		}
+		return v <= *limit
+	}
+
+	switch {
+	case high(s.HiHi, current == alarmHiHi):
+		return alarmHiHi
+	case high(s.Hi, current == alarmHi || current == alarmHiHi):
+		return alarmHi
+	case low(s.LoLo, current == alarmLoLo):
+		return alarmLoLo
+	case low(s.Lo, current == alarmLo || current == alarmLoLo):
+		return alarmLo
+	}
+	return ""
+}
+
+// toAlarmValue converts a polled value to the float64 or bool expected by
+// the condition checks
+func toAlarmValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v
+	case int32:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	}
+	return float64(0)
+}
+
+func (a *alarm) state() string {
+	switch {
+	case a.condition != "" && !a.acked:
+		return alarmStateActiveUnacked
+	case a.condition != "":
+		return alarmStateActiveAcked
+	case !a.acked:
+		return alarmStateClearedUnacked
+	}
+	return alarmStateNormal
+}
+
+func (a *alarm) severity(condition string) uint32 {
+	if a.settings.Severity != 0 {
+		return a.settings.Severity
+	}
+	return alarmSeverities[condition]
+}
+
+// update moves the alarm to the condition of the polled value, it returns
+// the event type of the transition or "" when nothing changed
+func (a *alarm) update(value interface{}, now time.Time) string {
+	a.value = value
+	condition := a.settings.evaluate(value, a.condition)
+	if condition == a.condition {
+		a.pending = ""
+		return ""
+	}
+
+	if condition == "" {
+		a.condition, a.pending = "", ""
+		return alarmEventCleared
+	}
+
+	// a new condition has to persist for delay_ms before it activates
+	if a.pending != condition {
+		a.pending, a.pendingSince = condition, now
+	}
+	if now.Sub(a.pendingSince) < time.Duration(a.settings.Delay)*time.Millisecond {
+		return ""
+	}
+
+	if a.condition == "" || a.severity(condition) > a.severity(a.condition) {
+		a.acked = false
+	}
+	a.condition, a.last, a.pending = condition, condition, ""
+	return alarmEventActive
+}
+
+func (m *alarmManager) handlePoll(result pollResult) {
+	if result.err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tags := make([]string, 0, len(m.alarms))
+	for tag := range m.alarms {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		value, ok := result.values[tag]
+		if !ok {
+			value, ok = result.values[resolveTagName(tag)]
+		}
+		if !ok {
+			continue
+		}
+
+		a := m.alarms[tag]
+		previous := a.condition
+		switch a.update(value, result.timestamp) {
+		case alarmEventActive:
+			m.publish(a, alarmEventActive, a.condition, alarmName(tag, a.condition))
+		case alarmEventCleared:
+			m.publish(a, alarmEventCleared, previous, alarmName(tag, previous)+" cleared")
+		}
+	}
+}
+
+// alarmName describes an alarm condition, e.g. "Level HiHi alarm"
+func alarmName(tag string, condition string) string {
+	if condition == alarmDigital {
+		return tag + " alarm"
+	}
+	return tag + " " + condition + " alarm"
+}
+
+// acknowledge acknowledges the alarm of a tag, a cleared alarm returns to normal
+func (m *alarmManager) acknowledge(tag string, user string, comment string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.alarms[tag]
+	if !ok {
+		return fmt.Errorf("%w: no alarm configured for %s", errTagNotFound, tag)
+	}
+	if a.acked {
+		return fmt.Errorf("%w: %s is %s", errAlarmNotAcknowledgeable, tag, a.state())
+	}
+
+	a.acked = true
+	message := fmt.Sprintf("%s alarm acknowledged", tag)
+	if user != "" {
+		message += " by " + user
+	}
+	if comment != "" {
+		message += ": " + comment
+	}
+	m.publish(a, alarmEventAcknowledged, a.last, message)
+	return nil
+}
+
+// publish sends an alarm event, the caller holds m.mu
+func (m *alarmManager) publish(a *alarm, eventType string, condition string, message string) {
+	if a.settings.Message != "" {
+		message = a.settings.Message + " - " + message
+	}
+
+	log.Printf("[INFO] publish - Alarm event %s for %s: %s\n", eventType, a.tag, a.state())
+	publishEvent(ethernetIpEventMessage{
+		EventType:  eventType,
+		Severity:   a.severity(condition),
+		Message:    message,
+		SourceName: a.tag,
+		Condition:  condition,
+		State:      a.state(),
+		Value:      a.value,
+	})
+}
+
+// publishEvent assigns the event id and time and publishes the event to
+// {topic_root}/events
+func publishEvent(event ethernetIpEventMessage) {
+	now := timeNow()
+	event.EventID = fmt.Sprintf("%d-%d", now.UnixMilli(), atomic.AddUint64(&eventSeq, 1))
+	event.Time = now.UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+eventsTopic, event)
+}
+
+// acknowledgeAlarm acknowledges a threshold alarm or an ALMD/ALMA tag
+func acknowledgeAlarm(ackReq ethernetIpAlarmAckMQTTMessage) error {
+	if alarms != nil {
+		if _, ok := alarms.alarms[ackReq.Tag]; ok {
+			return alarms.acknowledge(ackReq.Tag, ackReq.User, ackReq.Comment)
+		}
+	}
+	if logixAlarms != nil {
+		if _, ok := logixAlarms.alarms[ackReq.Tag]; ok {
+			log.Printf("[INFO] acknowledgeAlarm - Acknowledging %s for %q: %s\n", ackReq.Tag, ackReq.User, ackReq.Comment)
+			return logixAlarms.acknowledge(ackReq.Tag, ackReq.Condition, ackReq.ProgAck, ackReq.User)
+		}
+	}
+	return fmt.Errorf("%w: no alarm configured for %s", errTagNotFound, ackReq.Tag)
+}
+
+// handleAlarmAckRequest acknowledges an alarm on request from {topic_root}/alarms/ack
+func handleAlarmAckRequest(message *mqttTypes.Publish) {
+	mqttResp := ethernetIpAlarmAckResponseMQTTMessage{
+		Success: true,
+	}
+
+	ackReq := ethernetIpAlarmAckMQTTMessage{}
+	err := decodePayload(message.Topic.Whole, message.Payload, &ackReq)
+	if err == nil {
+		mqttResp.Tag = ackReq.Tag
+		err = acknowledgeAlarm(ackReq)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to acknowledge alarm %s: %s\n", ackReq.Tag, err.Error())
+		mqttResp.Success = false
+		mqttResp.ErrorMessage = err.Error()
+	}
+
+	mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+alarmAckTopic+"/response", mqttResp)
+}
+
+// rejectAlarmAckRequest answers an acknowledgement the scheduler rejected
+func rejectAlarmAckRequest(message *mqttTypes.Publish, err error) {
+	ackReq := ethernetIpAlarmAckMQTTMessage{}
+	decodePayload(message.Topic.Whole, message.Payload, &ackReq)
+	publishPayload(adapterConfig.TopicRoot+"/"+alarmAckTopic+"/response", ethernetIpAlarmAckResponseMQTTMessage{
+		Tag:          ackReq.Tag,
+		Timestamp:    timeNow().UTC().Format(time.RFC3339),
+		ErrorMessage: err.Error(),
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAlarms(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Level", 50)
+	sim.addDINT("Pump", 0)
+	transport := startTestAdapter(t, sim)
+
+	prevPoller, prevAlarms := poller, alarms
+	t.Cleanup(func() { poller, alarms = prevPoller, prevAlarms })
+	poller = &tagPoller{}
+	eventSeq = 0
+
+	limit := func(v float64) *float64 { return &v }
+	on := true
+	adapterSettings.Alarms = map[string]*alarmSettings{
+		"Level": {HiHi: limit(90), Hi: limit(80), Lo: limit(20), Deadband: 5},
+		"Pump":  {Condition: &on, Delay: 2000, Severity: 300, Message: "Pump tripped"},
+	}
+	if err := initializeAlarms(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	write := func(name string, value float64) {
+		t.Helper()
+		if err := writeTagByName(name, value); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	poller.poll()
+	transport.expectNone(t)
+
+	write("Level", 85)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-1", "event_type": "alarm_active", "severity": 500, "time": "2022-09-01T12:30:00Z", "message": "Level Hi alarm", "source_name": "Level", "condition": "Hi", "state": "active_unacked", "value": 85}`)
+
+	// escalating needs a new acknowledgement, falling back to Hi does not
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Level", "user": "operator"}`)
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-2", "event_type": "alarm_acknowledged", "severity": 500, "time": "2022-09-01T12:30:00Z", "message": "Level alarm acknowledged by operator", "source_name": "Level", "condition": "Hi", "state": "active_acked", "value": 85}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Level", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+
+	write("Level", 95)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-3", "event_type": "alarm_active", "severity": 800, "time": "2022-09-01T12:30:00Z", "message": "Level HiHi alarm", "source_name": "Level", "condition": "HiHi", "state": "active_unacked", "value": 95}`)
+
+	// within the deadband of HiHi
+	write("Level", 87)
+	poller.poll()
+	transport.expectNone(t)
+
+	write("Level", 84)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-4", "event_type": "alarm_active", "severity": 500, "time": "2022-09-01T12:30:00Z", "message": "Level Hi alarm", "source_name": "Level", "condition": "Hi", "state": "active_unacked", "value": 84}`)
+
+	write("Level", 50)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-5", "event_type": "alarm_cleared", "severity": 500, "time": "2022-09-01T12:30:00Z", "message": "Level Hi alarm cleared", "source_name": "Level", "condition": "Hi", "state": "cleared_unacked", "value": 50}`)
+
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Level"}`)
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-6", "event_type": "alarm_acknowledged", "severity": 500, "time": "2022-09-01T12:30:00Z", "message": "Level alarm acknowledged", "source_name": "Level", "condition": "Hi", "state": "normal", "value": 50}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Level", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Level"}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Level", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "alarm has nothing to acknowledge: Level is normal"}`)
+
+	// the digital alarm activates once the condition held for delay_ms
+	now := time.Date(2022, 9, 1, 12, 30, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	write("Pump", 1)
+	poller.poll()
+	now = now.Add(time.Second)
+	poller.poll()
+	transport.expectNone(t)
+	now = now.Add(time.Second)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035402000-7", "event_type": "alarm_active", "severity": 300, "time": "2022-09-01T12:30:02Z", "message": "Pump tripped - Pump alarm", "source_name": "Pump", "condition": "Alarm", "state": "active_unacked", "value": 1}`)
+
+	// the adapter ignores its own events
+	transport.send(testTopicRoot+"/events", `{}`)
+	transport.expectNone(t)
+}
+
+func TestAlarmSettings(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Level", 50)
+	startTestAdapter(t, sim)
+
+	prevPoller, prevAlarms := poller, alarms
+	t.Cleanup(func() { poller, alarms = prevPoller, prevAlarms })
+	poller = &tagPoller{}
+
+	limit := func(v float64) *float64 { return &v }
+	on := true
+	invalid := []*alarmSettings{
+		{},
+		{Hi: limit(80), HiHi: limit(70)},
+		{Hi: limit(80), Condition: &on},
+		{Hi: limit(80), Deadband: -1},
+	}
+	for _, settings := range invalid {
+		adapterSettings.Alarms = map[string]*alarmSettings{"Level": settings}
+		if err := initializeAlarms(); err == nil {
+			t.Fatalf("expected an error for %+v", settings)
+		}
+	}
+
+	adapterSettings.Alarms = map[string]*alarmSettings{"Missing": {Hi: limit(80)}}
+	if err := initializeAlarms(); !errors.Is(err, errTagNotFound) {
+		t.Fatalf("expected an error for an unknown tag, got %v", err)
+	}
+}
+
+func TestAlarmReacknowledgeSeverity(t *testing.T) {
+	limit := func(v float64) *float64 { return &v }
+	now := testTime
+
+	// the default severities make HiHi more severe than Hi
+	a := &alarm{tag: "Level", settings: &alarmSettings{Hi: limit(80), HiHi: limit(90)}}
+	a.update(float64(85), now)
+	a.acked = true
+	if a.update(float64(95), now); a.acked {
+		t.Fatal("expected HiHi to require a new acknowledgement")
+	}
+
+	// with a configured severity every condition is reported as equally severe
+	a = &alarm{tag: "Level", settings: &alarmSettings{Hi: limit(80), HiHi: limit(90), Severity: 700}}
+	a.update(float64(85), now)
+	a.acked = true
+	if a.update(float64(95), now); !a.acked || a.condition != alarmHiHi {
+		t.Fatalf("expected HiHi to stay acknowledged, got condition %s acked %t", a.condition, a.acked)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// tagAliases maps the friendly names from tag_aliases and the
+// tag_aliases_collection to controller or virtual tag names, aliasesByTag
+// holds the sorted aliases of each tag
+var (
+	tagAliases   map[string]string
+	aliasesByTag map[string][]string
+)
+
+// initializeTagAliases merges the tag_aliases_collection rows with the
+// tag_aliases adapter setting, the adapter setting wins for aliases in both.
+// It runs once the controller and virtual tags are known.
+func initializeTagAliases() error {
+	aliases := map[string]string{}
+
+	if adapterSettings.TagAliasesCollection != "" {
+		rows, err := fetchCollection(adapterSettings.TagAliasesCollection)
+		if err != nil {
+			return fmt.Errorf("failed to fetch tag_aliases_collection %s: %w", adapterSettings.TagAliasesCollection, err)
+		}
+		for alias, name := range parseTagAliasRows(rows) {
+			aliases[alias] = name
+		}
+	}
+
+	for alias, name := range adapterSettings.TagAliases {
+		aliases[alias] = name
+	}
+
+	for alias, name := range aliases {
+		if isTagName(alias) {
+			return fmt.Errorf("alias %s has the name of a tag", alias)
+		}
+		if !isTagName(name) {
+			return fmt.Errorf("alias %s: %w: %s", alias, errTagNotFound, name)
+		}
+	}
+
+	byTag := map[string][]string{}
+	for alias, name := range aliases {
+		byTag[name] = append(byTag[name], alias)
+	}
+	for _, names := range byTag {
+		sort.Strings(names)
+	}
+
+	if len(aliases) > 0 {
+		log.Printf("[INFO] initializeTagAliases - Loaded %d tag aliases\n", len(aliases))
+	}
+	tagAliases, aliasesByTag = aliases, byTag
+	return nil
+}
+
+// parseTagAliasRows reads tag_aliases_collection rows, each with an alias
+// and a tag_name column
+func parseTagAliasRows(rows []interface{}) map[string]string {
+	aliases := map[string]string{}
+	for _, row := range rows {
+		columns, _ := row.(map[string]interface{})
+		alias, _ := columns["alias"].(string)
+		name, _ := columns["tag_name"].(string)
+		if alias == "" || name == "" {
+			log.Printf("[ERROR] parseTagAliasRows - Ignoring row without an alias or tag_name: %v\n", row)
+			continue
+		}
+		aliases[alias] = name
+	}
+	return aliases
+}
+
+// isTagName reports whether name is a controller or virtual tag, or a bit
+// of an integer tag
+func isTagName(name string) bool {
+	if _, ok := eipTagMap[name]; ok {
+		return true
+	}
+	if _, ok := virtualTags[name]; ok {
+		return true
+	}
+	_, _, ok := splitBitAddress(name)
+	return ok
+}
+
+// resolveTagName translates an alias to the tag it names, other names are
+// returned unchanged
+func resolveTagName(name string) string {
+	if symbol, ok := tagAliases[name]; ok {
+		return symbol
+	}
+	return name
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTagAliases(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("N7_12_FLT", 42)
+	sim.addDINT("N7_13_SP", 10)
+	transport := startTestAdapter(t, sim)
+
+	prevAliases, prevByTag := tagAliases, aliasesByTag
+	t.Cleanup(func() { tagAliases, aliasesByTag = prevAliases, prevByTag })
+
+	adapterSettings.TagAliases = map[string]string{
+		"line1/filler/speed":    "N7_12_FLT",
+		"line1/filler/setpoint": "N7_13_SP",
+		"FillerSpeed":           "N7_12_FLT",
+	}
+	if err := initializeTagAliases(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["line1/filler/speed", "N7_13_SP"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"N7_13_SP": {"value": 10, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"line1/filler/speed": {"value": 42, "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "line1/filler/setpoint", "value": 25}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{
+		"node_id": "line1/filler/setpoint",
+		"timestamp": "2022-09-01T12:30:00Z",
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+	if got := sim.value("N7_13_SP"); !bytes.Equal(got, []byte{0x19, 0x00, 0x00, 0x00}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+
+	transport.send(testTopicRoot+"/browse", `{}`)
+	transport.expect(t, testTopicRoot+"/browse/response", `{
+		"timestamp": "2022-09-01T12:30:00Z",
+		"tags": [
+			{"name": "N7_12_FLT", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0, "aliases": ["FillerSpeed", "line1/filler/speed"]},
+			{"name": "N7_13_SP", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0, "aliases": ["line1/filler/setpoint"]}
+		],
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	adapterSettings.TagAliases = map[string]string{"N7_13_SP": "N7_12_FLT"}
+	if err := initializeTagAliases(); err == nil {
+		t.Fatal("expected an error for an alias with the name of a tag")
+	}
+	adapterSettings.TagAliases = map[string]string{"line1/filler/level": "N7_14"}
+	if err := initializeTagAliases(); !errors.Is(err, errTagNotFound) {
+		t.Fatalf("expected an error for an alias of an unknown tag, got %v", err)
+	}
+}
+
+func TestTagAliasRows(t *testing.T) {
+	rows := []interface{}{
+		map[string]interface{}{"alias": "line1/filler/speed", "tag_name": "N7_12_FLT", "item_id": "1"},
+		map[string]interface{}{"alias": "line1/filler/level", "tag_name": nil},
+	}
+	expected := map[string]string{"line1/filler/speed": "N7_12_FLT"}
+	if got := parseTagAliasRows(rows); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected aliases %v", got)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	auditTopic = "audit"
+
+	auditSourceMQTT      = "mqtt"
+	auditSourceHTTP      = "http"
+	auditSourceOPCUA     = "opcua"
+	auditSourceSparkplug = "sparkplug"
+	auditSourceTagTopic  = "tag_topic"
+	auditSourceRecipe    = "recipe"
+)
+
+// writeAuditor records every write in the append-only audit_log file, one
+// JSON record per line, and publishes the records to {topic_root}/audit
+type writeAuditor struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var auditLog *writeAuditor
+
+// initializeAuditLog opens the audit_log file, writes are not audited when
+// the setting is empty
+func initializeAuditLog() error {
+	if adapterSettings.AuditLog == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(adapterSettings.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit_log: %w", err)
+	}
+
+	log.Printf("[INFO] initializeAuditLog - Recording writes in %s and publishing them to %s/%s\n", adapterSettings.AuditLog, adapterConfig.TopicRoot, auditTopic)
+	auditLog = &writeAuditor{file: file}
+	return nil
+}
+
+// auditedWrite writes a tag on behalf of user, received through source, and
+// records the value before the write, the new value and the outcome. The
+// previous value is left empty when the tag cannot be read.
+func auditedWrite(name string, value interface{}, user string, source string) error {
+	return audited(name, value, user, source, writeTagByName)
+}
+
+// audited records a write done by the write function
+func audited(name string, value interface{}, user string, source string, write func(string, interface{}) error) error {
+	if auditLog == nil {
+		return write(name, value)
+	}
+
+	record := ethernetIpAuditRecord{
+		User:     user,
+		Source:   source,
+		Tag:      name,
+		NewValue: value,
+	}
+	previous := map[string]ethernetIpReadResponseData{}
+	if err := readTags([]string{name}, previous); err == nil {
+		record.PreviousValue = previous[name].Value
+	}
+
+	err := write(name, value)
+	record.Success = err == nil
+	if err != nil {
+		record.ErrorMessage = err.Error()
+	}
+	record.Timestamp = timeNow().UTC().Format(time.RFC3339)
+
+	auditLog.record(record)
+	return err
+}
+
+// auditedBatchWrite is auditedWrite for writeTagBatch, every tag of the
+// batch is recorded on its own
+func auditedBatchWrite(values map[string]interface{}, atomic bool, user string, source string) (map[string]ethernetIpWriteResult, error) {
+	if auditLog == nil {
+		return writeTagBatch(values, atomic)
+	}
+
+	previous := map[string]ethernetIpReadResponseData{}
+	for name := range values {
+		readTags([]string{name}, previous)
+	}
+
+	results, err := writeTagBatch(values, atomic)
+	timestamp := timeNow().UTC().Format(time.RFC3339)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		auditLog.record(ethernetIpAuditRecord{
+			Timestamp:     timestamp,
+			User:          user,
+			Source:        source,
+			Tag:           name,
+			PreviousValue: previous[name].Value,
+			NewValue:      values[name],
+			Success:       results[name].Success,
+			ErrorMessage:  results[name].ErrorMessage,
+		})
+	}
+	return results, err
+}
+
+func (a *writeAuditor) record(record ethernetIpAuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("[ERROR] record - Failed to encode audit record: %s\n", err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	_, err = a.file.Write(append(line, '\n'))
+	if err == nil {
+		err = a.file.Sync()
+	}
+	a.mu.Unlock()
+	if err != nil {
+		log.Printf("[ERROR] record - Failed to write audit record for %s: %s\n", record.Tag, err.Error())
+	}
+
+	publishPayload(adapterConfig.TopicRoot+"/"+auditTopic, record)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Setpoint", 10)
+	transport := startTestAdapter(t, sim)
+
+	prevAuditLog := auditLog
+	t.Cleanup(func() { auditLog = prevAuditLog })
+
+	adapterSettings.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	if err := initializeAuditLog(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	t.Cleanup(func() { auditLog.file.Close() })
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Setpoint", "value": 25, "user": "jsmith"}`)
+	transport.expect(t, testTopicRoot+"/audit", `{"timestamp": "2022-09-01T12:30:00Z", "user": "jsmith", "source": "mqtt", "tag": "Setpoint", "previous_value": 10, "new_value": 25, "success": true, "error_message": ""}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Setpoint", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Missing", "value": 1}`)
+	transport.expect(t, testTopicRoot+"/audit", `{"timestamp": "2022-09-01T12:30:00Z", "user": "", "source": "mqtt", "tag": "Missing", "previous_value": null, "new_value": 1, "success": false, "error_message": "tag does not exist: Missing"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Missing", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "tag does not exist: Missing"}`)
+
+	// the adapter ignores its own audit records
+	transport.send(testTopicRoot+"/audit", `{}`)
+	transport.expectNone(t)
+
+	// records are appended to the file of a previous run
+	auditLog.file.Close()
+	if err := initializeAuditLog(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := auditedWrite("Setpoint", float64(30), "", auditSourceHTTP); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	transport.next(t, testTopicRoot+"/audit")
+
+	data, err := os.ReadFile(adapterSettings.AuditLog)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := `{"timestamp":"2022-09-01T12:30:00Z","user":"jsmith","source":"mqtt","tag":"Setpoint","previous_value":10,"new_value":25,"success":true,"error_message":""}
+{"timestamp":"2022-09-01T12:30:00Z","user":"","source":"mqtt","tag":"Missing","previous_value":null,"new_value":1,"success":false,"error_message":"tag does not exist: Missing"}
+{"timestamp":"2022-09-01T12:30:00Z","user":"","source":"http","tag":"Setpoint","previous_value":25,"new_value":30,"success":true,"error_message":""}
+`
+	if string(data) != expected {
+		t.Fatalf("unexpected audit log:\n%s", strings.TrimSpace(string(data)))
+	}
+}
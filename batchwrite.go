@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+)
+
+var errBatchAborted = errors.New("batch write aborted")
+
+// batchWrite is a single tag of a batch write, value and previous are the
+// raw values written and read before the batch. layout is set for string
+// tags, whose values are the bytes of the string structure.
+type batchWrite struct {
+	name       string
+	tag        *eip.Tag
+	layout     *stringLayout
+	value      []byte
+	previous   []byte
+	err        error
+	rolledBack bool
+}
+
+// requests encodes the writes of a raw value, DATA and LEN for string tags
+func (w *batchWrite) requests(value []byte) []cipRequest {
+	if w.layout != nil {
+		return w.layout.writeRequests(w.tag.Name(), value)
+	}
+	return []cipRequest{writeRequest(w.tag.Name(), w.tag.Type, value)}
+}
+
+// writeTagBatch writes several tags with Multiple Service Packets and returns
+// the outcome for every tag. In atomic mode no tag is written unless every
+// value is accepted, and the tags already written are restored to the values
+// read before the batch when one of the writes fails.
+func writeTagBatch(values map[string]interface{}, atomic bool) (map[string]ethernetIpWriteResult, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writes := make([]*batchWrite, 0, len(names))
+	for _, name := range names {
+		w := &batchWrite{name: name}
+		w.err = prepareBatchWrite(w, values[name])
+		writes = append(writes, w)
+	}
+
+	if atomic {
+		if failed := countFailed(writes); failed > 0 {
+			return abortBatch(writes, fmt.Errorf("%w: %d of %d tags were rejected, no tags were written", errBatchAborted, failed, len(writes)))
+		}
+		readPrevious(writes)
+		if failed := countFailed(writes); failed > 0 {
+			return abortBatch(writes, fmt.Errorf("%w: %d of %d tags could not be read, no tags were written", errBatchAborted, failed, len(writes)))
+		}
+	}
+
+	// a tag can take several requests, owners maps each one back to its tag
+	var owners []*batchWrite
+	var requests []cipRequest
+	for _, w := range writes {
+		if w.err == nil {
+			for _, r := range w.requests(w.value) {
+				owners = append(owners, w)
+				requests = append(requests, r)
+			}
+		}
+	}
+	for i, reply := range sendMultipleCIP(requests) {
+		w := owners[i]
+		readCache.invalidate(w.tag.Name())
+		if reply.err != nil && w.err == nil {
+			w.err = fmt.Errorf("failed to write %s: %w", w.name, reply.err)
+		}
+	}
+	// only the tags written count towards their rate limit
+	for _, w := range writes {
+		if w.err == nil {
+			writePolicy.record(w.name)
+		}
+	}
+
+	failed := countFailed(writes)
+	if failed == 0 {
+		log.Printf("[INFO] writeTagBatch - Wrote %d tags\n", len(writes))
+		return batchResults(writes), nil
+	}
+	if !atomic {
+		return batchResults(writes), fmt.Errorf("%d of %d tags failed to write", failed, len(writes))
+	}
+	return rollbackBatch(writes, failed)
+}
+
+// prepareBatchWrite applies the write policy and converts the value the way
+// writeTagByName would. Batches take BOOL, integer and string tags.
+func prepareBatchWrite(w *batchWrite, value interface{}) error {
+	if writePolicy.selectRequired(w.name) {
+		return fmt.Errorf("%w: %s is critical", errSelectRequired, w.name)
+	}
+	if err := writePolicy.check(w.name, value); err != nil {
+		return err
+	}
+	if _, ok := virtualTags[resolveTagName(w.name)]; ok {
+		return fmt.Errorf("%w: %s is a virtual tag", errReadOnlyTag, w.name)
+	}
+
+	tag, err := lookupTag(w.name)
+	if err != nil {
+		return err
+	}
+	w.tag = tag
+
+	if layout, ok := stringLayoutFor(tag.Type); ok {
+		w.layout = layout
+		w.value, err = encodeStringStructure(tag, layout, value)
+		return err
+	}
+
+	value, err = scaleWriteValue(tag, value)
+	if err != nil {
+		return err
+	}
+	switch {
+	case tag.Type == eip.BOOL:
+		v, err := getConvertedBool(value)
+		if err != nil {
+			return err
+		}
+		w.value = []byte{v}
+	case integerWidth(tag.Type) > 0:
+		w.value, err = encodeInteger(tag.Type, value)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w in batch writes: %d", errUnsupportedType, tag.Type)
+	}
+	return nil
+}
+
+// readPrevious reads the raw values the tags are restored to on rollback
+func readPrevious(writes []*batchWrite) {
+	requests := make([]cipRequest, len(writes))
+	for i, w := range writes {
+		requests[i] = cipRequest{service: cipReadTag, path: symbolPath(w.tag.Name()), data: []byte{1, 0}}
+	}
+	for i, reply := range sendMultipleCIP(requests) {
+		w := writes[i]
+		_, data, err := decodeReadReply(reply.data)
+		switch {
+		case reply.err != nil:
+			w.err = fmt.Errorf("failed to read %s: %w", w.name, reply.err)
+		case err != nil:
+			w.err = fmt.Errorf("failed to read %s: %w", w.name, err)
+		case w.layout != nil && len(data) < w.layout.size():
+			w.err = fmt.Errorf("failed to read %s: short read reply", w.name)
+		default:
+			w.previous = data
+		}
+	}
+}
+
+// rollbackBatch restores the tags written by a failed atomic batch
+func rollbackBatch(writes []*batchWrite, failed int) (map[string]ethernetIpWriteResult, error) {
+	var written, owners []*batchWrite
+	var requests []cipRequest
+	for _, w := range writes {
+		if w.err == nil {
+			written = append(written, w)
+			for _, r := range w.requests(w.previous) {
+				owners = append(owners, w)
+				requests = append(requests, r)
+			}
+		}
+	}
+
+	for i, reply := range sendMultipleCIP(requests) {
+		w := owners[i]
+		readCache.invalidate(w.tag.Name())
+		if reply.err != nil && w.err == nil {
+			log.Printf("[ERROR] rollbackBatch - Failed to restore %s: %s\n", w.name, reply.err.Error())
+			w.err = fmt.Errorf("%w: failed to restore %s: %s", errBatchAborted, w.name, reply.err.Error())
+		}
+	}
+	restored := 0
+	for _, w := range written {
+		if w.err != nil {
+			continue
+		}
+		w.err = fmt.Errorf("%w: %s was restored", errBatchAborted, w.name)
+		w.rolledBack = true
+		restored++
+	}
+
+	log.Printf("[ERROR] rollbackBatch - %d tags failed to write, restored %d of %d written tags\n", failed, restored, len(written))
+	if restored < len(written) {
+		return batchResults(writes), fmt.Errorf("%w: %d tags failed to write and %d of %d written tags could not be restored", errBatchAborted, failed, len(written)-restored, len(written))
+	}
+	return batchResults(writes), fmt.Errorf("%w: %d tags failed to write, the written tags were restored", errBatchAborted, failed)
+}
+
+// abortBatch fails the tags of an atomic batch that is not written
+func abortBatch(writes []*batchWrite, err error) (map[string]ethernetIpWriteResult, error) {
+	for _, w := range writes {
+		if w.err == nil {
+			w.err = fmt.Errorf("%w: %s was not written", errBatchAborted, w.name)
+		}
+	}
+	return batchResults(writes), err
+}
+
+func countFailed(writes []*batchWrite) int {
+	failed := 0
+	for _, w := range writes {
+		if w.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+func batchResults(writes []*batchWrite) map[string]ethernetIpWriteResult {
+	results := make(map[string]ethernetIpWriteResult, len(writes))
+	for _, w := range writes {
+		result := ethernetIpWriteResult{Success: w.err == nil, RolledBack: w.rolledBack}
+		if w.err != nil {
+			result.ErrorMessage = w.err.Error()
+		}
+		results[w.name] = result
+	}
+	return results
+}
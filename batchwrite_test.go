@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBatchWrite(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Speed_SP", 10)
+	sim.addDINT("Temp_SP", 20)
+	sim.addDINT("Locked_SP", 30)
+	sim.addString("Batch", "B-1")
+	sim.addTag("Temperature", 0xca, []byte{0x00, 0x00, 0xc8, 0x41})
+	sim.setReadOnly("Locked_SP")
+	var setpoints []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("Recipe_Setpoint_%02d", i)
+		sim.addDINT(name, 0)
+		setpoints = append(setpoints, fmt.Sprintf(`"%s": %d`, name, i+100))
+	}
+	transport := startTestAdapter(t, sim)
+
+	adapterSettings.TagConfig = map[string]*tagConfig{"Temp_SP": {Offset: -40}}
+	if err := initializeTagConfig(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expectValue := func(name string, value int32) {
+		t.Helper()
+		expected := make([]byte, 4)
+		binary.LittleEndian.PutUint32(expected, uint32(value))
+		if got := sim.value(name); !bytes.Equal(got, expected) {
+			t.Fatalf("unexpected controller value for %s: % x", name, got)
+		}
+	}
+
+	// the 40 writes do not fit in one unconnected message
+	transport.send(testTopicRoot+"/write", `{"values": {`+strings.Join(setpoints, ", ")+`}}`)
+	response := transport.next(t, testTopicRoot+"/write/response").payload
+	if !bytes.Contains(response, []byte(`"success":true,"status_code":0,"error_message":"","results":{"Recipe_Setpoint_00":{"success":true,"error_message":""}`)) {
+		t.Fatalf("unexpected response %s", response)
+	}
+	expectValue("Recipe_Setpoint_00", 100)
+	expectValue("Recipe_Setpoint_39", 139)
+
+	// without atomic the other tags are written when one fails
+	transport.send(testTopicRoot+"/write", `{"values": {"Speed_SP": 55, "Temp_SP": 25, "Locked_SP": 1, "Batch": "B-2", "Temperature": 25}}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "2 of 5 tags failed to write", "results": {
+		"Batch": {"success": true, "error_message": ""},
+		"Locked_SP": {"success": false, "error_message": "failed to write Locked_SP: CIP service 0x4d failed with general status 0x0f"},
+		"Speed_SP": {"success": true, "error_message": ""},
+		"Temp_SP": {"success": true, "error_message": ""},
+		"Temperature": {"success": false, "error_message": "unsupported data type in batch writes: 202"}
+	}}`)
+	expectValue("Speed_SP", 55)
+	expectValue("Temp_SP", 65)
+	expectBatch := func(value string) {
+		t.Helper()
+		got := sim.value("Batch")
+		if int(binary.LittleEndian.Uint32(got)) != len(value) || string(got[4:4+len(value)]) != value {
+			t.Fatalf("unexpected controller value for Batch: % x", got)
+		}
+	}
+	expectBatch("B-2")
+
+	// atomic batches are validated before anything is written
+	transport.send(testTopicRoot+"/write", `{"values": {"Speed_SP": 60, "Missing": 1}, "atomic": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "batch write aborted: 1 of 2 tags were rejected, no tags were written", "results": {
+		"Missing": {"success": false, "error_message": "tag does not exist: Missing"},
+		"Speed_SP": {"success": false, "error_message": "batch write aborted: Speed_SP was not written"}
+	}}`)
+	expectValue("Speed_SP", 55)
+
+	// and the written tags are restored when a write fails
+	transport.send(testTopicRoot+"/write", `{"values": {"Speed_SP": 70, "Temp_SP": 30, "Locked_SP": 1, "Batch": "B-300"}, "atomic": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "batch write aborted: 1 tags failed to write, the written tags were restored", "results": {
+		"Batch": {"success": false, "error_message": "batch write aborted: Batch was restored", "rolled_back": true},
+		"Locked_SP": {"success": false, "error_message": "failed to write Locked_SP: CIP service 0x4d failed with general status 0x0f"},
+		"Speed_SP": {"success": false, "error_message": "batch write aborted: Speed_SP was restored", "rolled_back": true},
+		"Temp_SP": {"success": false, "error_message": "batch write aborted: Temp_SP was restored", "rolled_back": true}
+	}}`)
+	expectValue("Speed_SP", 55)
+	expectBatch("B-2")
+	expectValue("Temp_SP", 65)
+	expectValue("Locked_SP", 30)
+
+	transport.send(testTopicRoot+"/write", `{"values": {"Speed_SP": 70, "Temp_SP": 30}, "atomic": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "results": {
+		"Speed_SP": {"success": true, "error_message": ""},
+		"Temp_SP": {"success": true, "error_message": ""}
+	}}`)
+	expectValue("Speed_SP", 70)
+	expectValue("Temp_SP", 70)
+}
+
+func TestBatchWriteRateLimit(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Speed_SP", 10)
+	sim.addDINT("Temp_SP", 20)
+	transport := startTestAdapter(t, sim)
+
+	prevPolicy := writePolicy
+	t.Cleanup(func() { writePolicy = prevPolicy })
+	adapterSettings.WritePolicy = &writePolicySettings{TagLimits: map[string]*tagWriteLimits{"*_SP": {MinInterval: 1000}}}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// a batch that is not written leaves the rate limits for the corrected retry
+	transport.send(testTopicRoot+"/write", `{"values": {"Speed_SP": 55, "Temp_SP": "hot"}, "atomic": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "batch write aborted: 1 of 2 tags were rejected, no tags were written", "results": {
+		"Speed_SP": {"success": false, "error_message": "batch write aborted: Speed_SP was not written"},
+		"Temp_SP": {"success": false, "error_message": "invalid value for DINT tag: hot"}
+	}}`)
+	transport.send(testTopicRoot+"/write", `{"values": {"Speed_SP": 55, "Temp_SP": 80}, "atomic": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "results": {
+		"Speed_SP": {"success": true, "error_message": ""},
+		"Temp_SP": {"success": true, "error_message": ""}
+	}}`)
+
+	transport.send(testTopicRoot+"/write", `{"values": {"Speed_SP": 60}}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "1 of 1 tags failed to write", "results": {
+		"Speed_SP": {"success": false, "error_message": "write rate limit exceeded: Speed_SP was written less than 1000 ms ago"}
+	}}`)
+	if got := sim.value("Speed_SP"); !bytes.Equal(got, []byte{55, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+// bitAddress splits a Word.N address, or an alias of one, into the integer
+// tag and the bit number. The bit is not checked against the tag's width.
+func bitAddress(name string) (*eip.Tag, uint, bool) {
+	return splitBitAddress(resolveTagName(name))
+}
+
+func splitBitAddress(symbol string) (*eip.Tag, uint, bool) {
+	if _, ok := eipTagMap[symbol]; ok {
+		return nil, 0, false
+	}
+
+	i := strings.LastIndex(symbol, ".")
+	if i < 0 {
+		return nil, 0, false
+	}
+	bit, err := strconv.ParseUint(symbol[i+1:], 10, 8)
+	if err != nil {
+		return nil, 0, false
+	}
+	tag, ok := eipTagMap[symbol[:i]]
+	if !ok || integerWidth(tag.Type) == 0 {
+		return nil, 0, false
+	}
+	return tag, uint(bit), true
+}
+
+// integerWidth is the size in bytes of the integer types bits are addressed
+// in, 0 for the other types
+func integerWidth(tagType types.UInt) int {
+	switch tagType {
+	case eip.SINT, eip.USINT:
+		return 1
+	case eip.INT, eip.UINT:
+		return 2
+	case eip.DINT, eip.UDINT:
+		return 4
+	}
+	return 0
+}
+
+func checkBit(tag *eip.Tag, bit uint) error {
+	if bit >= uint(integerWidth(tag.Type))*8 {
+		return fmt.Errorf("%w: %s has no bit %d", errTagNotFound, tag.Name(), bit)
+	}
+	return nil
+}
+
+// readBit reads the word and returns the bit as a bool
+func readBit(tag *eip.Tag, bit uint) (ethernetIpReadResponseData, error) {
+	readResp := ethernetIpReadResponseData{}
+	if err := checkBit(tag, bit); err != nil {
+		return readResp, err
+	}
+
+	_, data, err := readSymbol(tag.Name())
+	if err != nil {
+		return readResp, err
+	}
+	if int(bit/8) >= len(data) {
+		return readResp, fmt.Errorf("short read reply for %s", tag.Name())
+	}
+	readResp.Value = data[bit/8]&(1<<(bit%8)) != 0
+	readResp.SourceTimestamp = timeNow().UTC().Format(time.RFC3339)
+	return readResp, nil
+}
+
+// writeBit sets or clears a single bit with the Read Modify Write Tag
+// service, the controller applies the OR and AND masks to the word so the
+// other bits are left as they are even when they change meanwhile
+func writeBit(tag *eip.Tag, bit uint, value interface{}) error {
+	if err := checkBit(tag, bit); err != nil {
+		return err
+	}
+	v, err := getConvertedBool(value)
+	if err != nil {
+		return err
+	}
+
+	width := integerWidth(tag.Type)
+	orMask := make([]byte, width)
+	andMask := make([]byte, width)
+	for i := range andMask {
+		andMask[i] = 0xff
+	}
+	if v == 1 {
+		orMask[bit/8] |= 1 << (bit % 8)
+	} else {
+		andMask[bit/8] &^= 1 << (bit % 8)
+	}
+
+	request := make([]byte, 2, 2+2*width)
+	binary.LittleEndian.PutUint16(request, uint16(width))
+	request = append(append(request, orMask...), andMask...)
+	if _, err := sendCIP(cipReadModifyWrite, symbolPath(tag.Name()), request); err != nil {
+		return fmt.Errorf("failed to write %s.%d: %w", tag.Name(), bit, err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitAddresses(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Flags", 0x0a)
+	sim.addTag("Status", 0xc3, []byte{0x00, 0x00})
+	transport := startTestAdapter(t, sim)
+
+	prevAliases, prevByTag := tagAliases, aliasesByTag
+	prevPolicy := writePolicy
+	t.Cleanup(func() {
+		tagAliases, aliasesByTag = prevAliases, prevByTag
+		writePolicy = prevPolicy
+	})
+
+	// only the addressed bit changes
+	transport.send(testTopicRoot+"/write", `{"node_id": "Flags.0", "value": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Flags.0", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Flags"); !bytes.Equal(got, []byte{0x0b, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Flags.3", "value": 0}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Flags.3", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Flags"); !bytes.Equal(got, []byte{0x03, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Status.9", "value": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Status.9", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Status"); !bytes.Equal(got, []byte{0x00, 0x02}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Flags.1", "Flags.2", "Status.9"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"Flags.1": {"value": true, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Flags.2": {"value": false, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Status.9": {"value": true, "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Flags.2", "operation": "toggle"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Flags.2", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "value": true}`)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Flags.2", "operation": "toggle"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Flags.2", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "value": false}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Status.16", "value": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Status.16", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "tag does not exist: Status has no bit 16"}`)
+
+	// aliases can name a bit
+	adapterSettings.TagAliases = map[string]string{"line1/running": "Flags.1"}
+	if err := initializeTagAliases(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "line1/running", "value": false}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "line1/running", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Flags"); !bytes.Equal(got, []byte{0x01, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+
+	// the write policy of the word covers its bits
+	adapterSettings.WritePolicy = &writePolicySettings{Deny: []string{"Flags"}}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Flags.2", "value": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Flags.2", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "tag is read only: writes to Flags.2 are denied"}`)
+	if got := sim.value("Flags"); !bytes.Equal(got, []byte{0x01, 0, 0, 0}) {
+		t.Fatalf("denied bit was written: % x", got)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CBOR, https://www.rfc-editor.org/rfc/rfc8949
+//
+// Messages are encoded from the same maps and values as their JSON encoding,
+// map keys are sorted so the output is deterministic.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+var errCBORTruncated = errors.New("cbor payload truncated")
+
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &cborEncoder{}
+	if err := e.encode(generic); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	d := &cborDecoder{buf: data}
+	generic := d.decode()
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = errors.New("unexpected data after cbor payload")
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return fromGeneric(generic, v)
+}
+
+type cborEncoder struct {
+	buf []byte
+}
+
+func (e *cborEncoder) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, major<<5|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, major<<5|27)
+		for i := 56; i >= 0; i -= 8 {
+			e.buf = append(e.buf, byte(n>>i))
+		}
+	}
+}
+
+func (e *cborEncoder) encode(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xf6)
+	case bool:
+		if v {
+			e.buf = append(e.buf, 0xf5)
+		} else {
+			e.buf = append(e.buf, 0xf4)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			e.int(i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		e.float(f)
+	case int64:
+		e.int(v)
+	case float64:
+		e.float(v)
+	case string:
+		e.head(cborText, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	case []interface{}:
+		e.head(cborArray, uint64(len(v)))
+		for _, item := range v {
+			if err := e.encode(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.head(cborMap, uint64(len(v)))
+		for _, key := range keys {
+			e.head(cborText, uint64(len(key)))
+			e.buf = append(e.buf, key...)
+			if err := e.encode(v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode %T as cbor", v)
+	}
+	return nil
+}
+
+func (e *cborEncoder) int(i int64) {
+	if i < 0 {
+		e.head(cborNegInt, uint64(-1-i))
+	} else {
+		e.head(cborUint, uint64(i))
+	}
+}
+
+func (e *cborEncoder) float(f float64) {
+	e.buf = append(e.buf, cborSimple<<5|27)
+	b := math.Float64bits(f)
+	for i := 56; i >= 0; i -= 8 {
+		e.buf = append(e.buf, byte(b>>i))
+	}
+}
+
+// cborDecoder decodes a single data item into maps, slices and scalars.
+// Errors are sticky, indefinite length items are not supported.
+type cborDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *cborDecoder) take(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < n {
+		d.err = errCBORTruncated
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *cborDecoder) uint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+func (d *cborDecoder) decode() interface{} {
+	initial := d.take(1)
+	if d.err != nil {
+		return nil
+	}
+	major, info := initial[0]>>5, initial[0]&0x1f
+
+	if major == cborSimple {
+		switch info {
+		case 20:
+			return false
+		case 21:
+			return true
+		case 22, 23:
+			return nil
+		case 25:
+			return halfFloat(uint16(d.uint(d.take(2))))
+		case 26:
+			return float64(math.Float32frombits(uint32(d.uint(d.take(4)))))
+		case 27:
+			return math.Float64frombits(d.uint(d.take(8)))
+		}
+		d.err = fmt.Errorf("unsupported cbor simple value %d", info)
+		return nil
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		n = d.uint(d.take(1 << (info - 24)))
+	default:
+		d.err = errors.New("indefinite length cbor items are not supported")
+		return nil
+	}
+
+	switch major {
+	case cborUint:
+		return n
+	case cborNegInt:
+		return -1 - int64(n)
+	case cborBytes:
+		return d.take(n)
+	case cborText:
+		return string(d.take(n))
+	case cborArray:
+		items := make([]interface{}, 0)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			items = append(items, d.decode())
+		}
+		return items
+	case cborMap:
+		m := make(map[string]interface{})
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			key, ok := d.decode().(string)
+			if !ok && d.err == nil {
+				d.err = errors.New("cbor map keys must be text strings")
+			}
+			m[key] = d.decode()
+		}
+		return m
+	case cborTag: // the tag number is ignored
+		return d.decode()
+	}
+	return nil
+}
+
+// halfFloat converts an IEEE 754 half precision float
+func halfFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/loki-os/go-ethernet-ip/messages/packet"
+	"github.com/loki-os/go-ethernet-ip/path"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+// CIP services and general status codes used beyond what
+// github.com/loki-os/go-ethernet-ip exposes on its tags
+const (
+	cipReadTag           types.USInt = 0x4c
+	cipWriteTag          types.USInt = 0x4d
+	cipReadTagFragmented types.USInt = 0x52
+	cipMultipleService   types.USInt = 0x0a
+	cipReadModifyWrite   types.USInt = 0x4e
+
+	cipStatusPartialTransfer   = 0x06
+	cipStatusEmbeddedListError = 0x1e
+
+	cipStructHandle = 0x02a0
+
+	// cipMaxRequestSize keeps Multiple Service Packets within the 504 byte
+	// limit of unconnected messages, leaving room for the route
+	cipMaxRequestSize = 480
+)
+
+// cipStatusError is returned for replies with a general status other than
+// success, the reply data is returned alongside it
+type cipStatusError struct {
+	service types.USInt
+	status  types.USInt
+}
+
+func (e *cipStatusError) Error() string {
+	return fmt.Sprintf("CIP service %#02x failed with general status %#02x", uint8(e.service), uint8(e.status))
+}
+
+func isCIPStatus(err error, status types.USInt) bool {
+	var statusErr *cipStatusError
+	return errors.As(err, &statusErr) && statusErr.status == status
+}
+
+// controllerSession records whether the last request reached the controller,
+// it is disconnected from a failed send until a request or reconnect succeeds
+var controllerSession = struct {
+	mu        sync.Mutex
+	connected bool
+}{}
+
+func setControllerConnected(connected bool) {
+	controllerSession.mu.Lock()
+	controllerSession.connected = connected
+	controllerSession.mu.Unlock()
+}
+
+func controllerConnected() bool {
+	controllerSession.mu.Lock()
+	defer controllerSession.mu.Unlock()
+	return controllerSession.connected
+}
+
+// sendCIP sends an unconnected explicit message to the controller and returns
+// the reply data
+func sendCIP(service types.USInt, requestPath []byte, data []byte) ([]byte, error) {
+	var res *packet.SpecificData
+	err := callController(func() error {
+		var err error
+		res, err = eipClient.Send(packet.NewMessageRouter(service, requestPath, data))
+		setControllerConnected(err == nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Packet.Items) < 2 {
+		return nil, fmt.Errorf("CIP service %#02x: malformed reply", uint8(service))
+	}
+
+	reply := new(packet.MessageRouterResponse)
+	reply.Decode(res.Packet.Items[1].Data)
+	if reply.GeneralStatus != 0 {
+		return reply.ResponseData, &cipStatusError{service: service, status: reply.GeneralStatus}
+	}
+	return reply.ResponseData, nil
+}
+
+// symbolPath encodes a tag or member name such as Pump1_Alarm.OperAck as
+// ANSI extended symbol segments
+func symbolPath(name string) []byte {
+	var segments [][]byte
+	for _, part := range strings.Split(name, ".") {
+		segments = append(segments, path.DataBuild(path.DataTypeANSI, []byte(part), true))
+	}
+	return packet.Paths(segments...)
+}
+
+// readSymbol reads a tag or member by name and returns its type code and
+// raw value. Values too large for a single reply are read in fragments.
+func readSymbol(name string) (types.UInt, []byte, error) {
+	requestPath := symbolPath(name)
+	reply, err := sendCIP(cipReadTag, requestPath, []byte{1, 0})
+
+	var value []byte
+	dataType, chunk, decodeErr := decodeReadReply(reply)
+	for isCIPStatus(err, cipStatusPartialTransfer) && decodeErr == nil {
+		value = append(value, chunk...)
+		request := make([]byte, 6)
+		binary.LittleEndian.PutUint16(request, 1)
+		binary.LittleEndian.PutUint32(request[2:], uint32(len(value)))
+		reply, err = sendCIP(cipReadTagFragmented, requestPath, request)
+		_, chunk, decodeErr = decodeReadReply(reply)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if decodeErr != nil {
+		return 0, nil, fmt.Errorf("failed to read %s: %w", name, decodeErr)
+	}
+	return dataType, append(value, chunk...), nil
+}
+
+// decodeReadReply splits a read tag reply into the type code and the value,
+// structures are returned with the type code 0x02a0
+func decodeReadReply(reply []byte) (types.UInt, []byte, error) {
+	if len(reply) < 2 {
+		return 0, nil, fmt.Errorf("short read reply")
+	}
+	dataType := types.UInt(binary.LittleEndian.Uint16(reply))
+	if dataType == cipStructHandle {
+		if len(reply) < 4 {
+			return 0, nil, fmt.Errorf("short read reply")
+		}
+		return dataType, reply[4:], nil
+	}
+	return dataType, reply[2:], nil
+}
+
+// writeSymbol writes a single atomic value to a tag or member by name
+func writeSymbol(name string, dataType types.UInt, value []byte) error {
+	request := writeRequest(name, dataType, value)
+	if _, err := sendCIP(request.service, request.path, request.data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// cipRequest is a single service of a Multiple Service Packet
+type cipRequest struct {
+	service types.USInt
+	path    []byte
+	data    []byte
+}
+
+// cipReply is the reply data and outcome of a single cipRequest
+type cipReply struct {
+	data []byte
+	err  error
+}
+
+// writeRequest encodes a write of a single atomic value to a tag or member
+func writeRequest(name string, dataType types.UInt, value []byte) cipRequest {
+	return writeArrayRequest(name, dataType, 1, value)
+}
+
+// writeArrayRequest encodes a write of count atomic elements to a tag or member
+func writeArrayRequest(name string, dataType types.UInt, count uint16, value []byte) cipRequest {
+	data := make([]byte, 4, 4+len(value))
+	binary.LittleEndian.PutUint16(data, uint16(dataType))
+	binary.LittleEndian.PutUint16(data[2:], count)
+	return cipRequest{service: cipWriteTag, path: symbolPath(name), data: append(data, value...)}
+}
+
+// sendMultipleCIP sends the requests in as few Multiple Service Packets as
+// the message size allows, in order, and returns a reply for every request.
+// A packet that cannot be sent fails each of its requests.
+func sendMultipleCIP(requests []cipRequest) []cipReply {
+	replies := make([]cipReply, 0, len(requests))
+	for len(requests) > 0 {
+		var encoded [][]byte
+		size := 2
+		for _, r := range requests {
+			e := packet.NewMessageRouter(r.service, r.path, r.data).Encode()
+			if len(encoded) > 0 && size+2+len(e) > cipMaxRequestSize {
+				break
+			}
+			encoded = append(encoded, e)
+			size += 2 + len(e)
+		}
+		replies = append(replies, sendMultipleServicePacket(encoded)...)
+		requests = requests[len(encoded):]
+	}
+	return replies
+}
+
+func sendMultipleServicePacket(encoded [][]byte) []cipReply {
+	replies := make([]cipReply, len(encoded))
+	fail := func(err error) []cipReply {
+		for i := range replies {
+			replies[i].err = err
+		}
+		return replies
+	}
+
+	data := make([]byte, 2+2*len(encoded))
+	binary.LittleEndian.PutUint16(data, uint16(len(encoded)))
+	for i, e := range encoded {
+		binary.LittleEndian.PutUint16(data[2+2*i:], uint16(len(data)))
+		data = append(data, e...)
+	}
+
+	reply, err := sendCIP(cipMultipleService, packet.Paths(
+		path.LogicalBuild(path.LogicalTypeClassID, 0x02, true),
+		path.LogicalBuild(path.LogicalTypeInstanceID, 0x01, true),
+	), data)
+	if err != nil && !isCIPStatus(err, cipStatusEmbeddedListError) {
+		return fail(err)
+	}
+	if len(reply) < 2+2*len(encoded) || int(binary.LittleEndian.Uint16(reply)) != len(encoded) {
+		return fail(fmt.Errorf("CIP service %#02x: malformed reply", uint8(cipMultipleService)))
+	}
+
+	for i := range encoded {
+		start := int(binary.LittleEndian.Uint16(reply[2+2*i:]))
+		end := len(reply)
+		if i+1 < len(encoded) {
+			end = int(binary.LittleEndian.Uint16(reply[4+2*i:]))
+		}
+		if start > end || end > len(reply) {
+			return fail(fmt.Errorf("CIP service %#02x: malformed reply", uint8(cipMultipleService)))
+		}
+
+		r := new(packet.MessageRouterResponse)
+		r.Decode(reply[start:end])
+		replies[i].data = r.ResponseData
+		if r.GeneralStatus != 0 {
+			replies[i].err = &cipStatusError{service: r.ReplyService &^ 0x80, status: r.GeneralStatus}
+		}
+	}
+	return replies
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/loki-os/go-ethernet-ip/bufferx"
+	"github.com/loki-os/go-ethernet-ip/messages/listIdentity"
+	"github.com/loki-os/go-ethernet-ip/messages/packet"
+)
+
+const (
+	defaultEIPPort         = 44818
+	defaultDiscoverTimeout = 2 * time.Second
+)
+
+// cliCommands are the ad-hoc debugging subcommands. They connect straight to
+// a controller and do not require ClearBlade credentials or an MQTT broker.
+var cliCommands = map[string]func(*cliOptions, []string) error{
+	"tags":     runTagsCommand,
+	"read":     runReadCommand,
+	"write":    runWriteCommand,
+	"identity": runIdentityCommand,
+	"discover": runDiscoverCommand,
+}
+
+var cliUsage = map[string]string{
+	"tags":     "tags -ip <address> [-port 44818] [-output table|json]",
+	"read":     "read -ip <address> [-port 44818] [-output table|json] <tag> [<tag>...]",
+	"write":    "write -ip <address> [-port 44818] [-output table|json] <tag> <value>",
+	"identity": "identity -ip <address> [-port 44818] [-output table|json]",
+	"discover": "discover [-broadcast 255.255.255.255] [-port 44818] [-timeout 2s] [-output table|json]",
+}
+
+type cliOptions struct {
+	ip        string
+	port      uint
+	output    string
+	broadcast string
+	timeout   time.Duration
+	out       io.Writer
+}
+
+func runCLICommand(name string, command func(*cliOptions, []string) error, args []string) {
+	opts := &cliOptions{out: os.Stdout}
+
+	flags := flag.NewFlagSet(adapterName+" "+name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s\n", adapterName, cliUsage[name])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.ip, "ip", "", "EtherNet/IP server address")
+	flags.UintVar(&opts.port, "port", defaultEIPPort, "EtherNet/IP server TCP/UDP port")
+	flags.StringVar(&opts.output, "output", "table", "output format, table or json")
+	flags.StringVar(&opts.broadcast, "broadcast", "255.255.255.255", "broadcast address used by discover")
+	flags.DurationVar(&opts.timeout, "timeout", defaultDiscoverTimeout, "how long discover waits for replies")
+	logLevel := flags.String("logLevel", "error", "The level of logging to use. Available levels are 'debug, 'info', 'error', 'fatal' (optional)")
+	flags.Parse(args)
+
+	setLogLevel(*logLevel, os.Stderr)
+
+	if err := command(opts, flags.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+		flags.Usage()
+		os.Exit(1)
+	}
+}
+
+// connect points the adapter settings at the controller given on the command
+// line and connects to it, optionally retrieving the tag list
+func (o *cliOptions) connect(withTags bool) error {
+	if o.ip == "" {
+		return fmt.Errorf("-ip is required")
+	}
+
+	adapterSettings = &ethernetIpAdapterSettings{EndpointIp: o.ip, EndpointPort: o.port}
+	if withTags {
+		initializeEIP()
+	} else {
+		connectEIP()
+	}
+	return nil
+}
+
+func (o *cliOptions) print(data interface{}, header []string, rows [][]string) error {
+	switch o.output {
+	case "json":
+		enc := json.NewEncoder(o.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	case "table":
+		w := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format %s", o.output)
+	}
+}
+
+func runTagsCommand(opts *cliOptions, args []string) error {
+	if err := opts.connect(true); err != nil {
+		return err
+	}
+
+	tags := browseTags()
+	rows := make([][]string, 0, len(tags))
+	for _, tag := range tags {
+		rows = append(rows, []string{
+			tag.Name,
+			tag.DataType,
+			fmt.Sprintf("%#04x", tag.TypeCode),
+			fmt.Sprint(tag.Structure),
+			fmt.Sprint(tag.Dimensions),
+		})
+	}
+	return opts.print(tags, []string{"NAME", "TYPE", "TYPE CODE", "STRUCTURE", "DIMENSIONS"}, rows)
+}
+
+func runReadCommand(opts *cliOptions, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("at least one tag name is required")
+	}
+	if err := opts.connect(true); err != nil {
+		return err
+	}
+
+	data := make(map[string]ethernetIpReadResponseData)
+	if err := readTags(args, data); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(args))
+	for _, name := range args {
+		rows = append(rows, []string{name, fmt.Sprint(data[name].Value), data[name].SourceTimestamp})
+	}
+	return opts.print(data, []string{"NAME", "VALUE", "TIMESTAMP"}, rows)
+}
+
+func runWriteCommand(opts *cliOptions, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("a tag name and a value are required")
+	}
+	if err := opts.connect(true); err != nil {
+		return err
+	}
+
+	name, value := args[0], parseCLIValue(args[1])
+	if err := writeTagByName(name, value); err != nil {
+		return err
+	}
+
+	resp := ethernetIpWriteResponseMQTTMessage{
+		NodeID:    name,
+		Timestamp: timeNow().UTC().Format(time.RFC3339),
+		Success:   true,
+	}
+	return opts.print(resp, []string{"NAME", "VALUE", "TIMESTAMP"}, [][]string{{name, args[1], resp.Timestamp}})
+}
+
+// parseCLIValue interprets a command line value the same way as the value in
+// a JSON write request, falling back to a plain string
+func parseCLIValue(arg string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(arg), &value); err != nil {
+		return arg
+	}
+	return value
+}
+
+func runIdentityCommand(opts *cliOptions, args []string) error {
+	if err := opts.connect(false); err != nil {
+		return err
+	}
+
+	identities, err := eipClient.ListIdentity()
+	if err != nil {
+		return err
+	}
+	return opts.printIdentities(toIdentities(identities))
+}
+
+// runDiscoverCommand broadcasts a ListIdentity request over UDP and lists
+// every device that answers before the timeout
+func runDiscoverCommand(opts *cliOptions, args []string) error {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request, err := listIdentity.New(0)
+	if err != nil {
+		return err
+	}
+	b, err := request.Encode()
+	if err != nil {
+		return err
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP(opts.broadcast), Port: int(opts.port)}
+	if _, err := conn.WriteToUDP(b, addr); err != nil {
+		return err
+	}
+
+	identities := []ethernetIpIdentity{}
+	buf := make([]byte, 1024*64)
+	conn.SetReadDeadline(time.Now().Add(opts.timeout))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return err
+		}
+
+		reply, err := decodeListIdentity(buf[:n])
+		if err != nil {
+			continue
+		}
+		identities = append(identities, toIdentities(reply)...)
+	}
+
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Address < identities[j].Address })
+	return opts.printIdentities(identities)
+}
+
+func decodeListIdentity(b []byte) (*listIdentity.ListIdentity, error) {
+	if len(b) < 24 {
+		return nil, fmt.Errorf("invalid packet, length < 24")
+	}
+
+	p := &packet.Packet{SpecificData: b[24:]}
+	header := bufferx.New(b[:24])
+	header.RL(&p.Header)
+	if header.Error() != nil {
+		return nil, header.Error()
+	}
+	return listIdentity.Decode(p)
+}
+
+func toIdentities(list *listIdentity.ListIdentity) []ethernetIpIdentity {
+	identities := make([]ethernetIpIdentity, 0, len(list.Items))
+	for _, item := range list.Items {
+		addr := uint32(item.SinAddr)
+		identities = append(identities, ethernetIpIdentity{
+			Address:      fmt.Sprintf("%d.%d.%d.%d", byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr)),
+			VendorID:     uint16(item.VendorID),
+			DeviceType:   uint16(item.DeviceType),
+			ProductCode:  uint16(item.ProductCode),
+			Revision:     fmt.Sprintf("%d.%03d", item.Major, item.Minor),
+			Status:       uint16(item.Status),
+			SerialNumber: fmt.Sprintf("%#08x", uint32(item.SerialNumber)),
+			ProductName:  string(item.ProductName),
+			State:        uint8(item.State),
+		})
+	}
+	return identities
+}
+
+func (o *cliOptions) printIdentities(identities []ethernetIpIdentity) error {
+	rows := make([][]string, 0, len(identities))
+	for _, id := range identities {
+		rows = append(rows, []string{
+			id.Address,
+			id.ProductName,
+			fmt.Sprint(id.VendorID),
+			fmt.Sprint(id.ProductCode),
+			id.Revision,
+			id.SerialNumber,
+		})
+	}
+	return o.print(identities, []string{"ADDRESS", "PRODUCT", "VENDOR", "PRODUCT CODE", "REVISION", "SERIAL"}, rows)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCLICommands(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addString("Recipe", "IPA")
+
+	prevSettings, prevNow := adapterSettings, timeNow
+	t.Cleanup(func() { adapterSettings, timeNow = prevSettings, prevNow })
+	timeNow = func() time.Time { return testTime }
+
+	tests := []struct {
+		name     string
+		command  string
+		output   string
+		args     []string
+		expected string
+	}{
+		{
+			name:    "tags table",
+			command: "tags",
+			output:  "table",
+			expected: `
+NAME     TYPE    TYPE CODE  STRUCTURE  DIMENSIONS
+Counter  DINT    0x00c4     false      0
+Recipe   STRING  0x8fce     true       0
+`,
+		},
+		{
+			name:    "read json",
+			command: "read",
+			output:  "json",
+			args:    []string{"Counter"},
+			expected: `
+{
+  "Counter": {
+    "value": 42,
+    "source_timestamp": "2022-09-01T12:30:00Z"
+  }
+}
+`,
+		},
+		{
+			name:    "write table",
+			command: "write",
+			output:  "table",
+			args:    []string{"Counter", "7"},
+			expected: `
+NAME     VALUE  TIMESTAMP
+Counter  7      2022-09-01T12:30:00Z
+`,
+		},
+		{
+			name:    "identity table",
+			command: "identity",
+			output:  "table",
+			expected: `
+ADDRESS    PRODUCT                VENDOR  PRODUCT CODE  REVISION  SERIAL
+127.0.0.1  1756-L83E/B Simulated  1       166           33.011    0x00c0ffee
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			opts := &cliOptions{ip: "127.0.0.1", port: sim.port(), output: test.output, out: out}
+
+			if err := cliCommands[test.command](opts, test.args); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if expected := strings.TrimPrefix(test.expected, "\n"); out.String() != expected {
+				t.Fatalf("unexpected output\nexpected:\n%s\n     got:\n%s", expected, out.String())
+			}
+		})
+	}
+
+	if got := sim.value("Counter"); !bytes.Equal(got, []byte{0x07, 0x00, 0x00, 0x00}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+}
+
+func TestCLICommandErrors(t *testing.T) {
+	opts := &cliOptions{output: "table", out: new(bytes.Buffer)}
+
+	if err := runTagsCommand(opts, nil); err == nil || err.Error() != "-ip is required" {
+		t.Errorf("expected missing -ip error, got %v", err)
+	}
+	if err := runReadCommand(opts, nil); err == nil {
+		t.Error("expected an error when no tags are given")
+	}
+	if err := runWriteCommand(opts, []string{"Counter"}); err == nil {
+		t.Error("expected an error when no value is given")
+	}
+}
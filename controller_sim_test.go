@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// CIP general status codes returned by the simulated controller
+const (
+	simStatusSuccess         = 0x00
+	simStatusPathUnknown     = 0x05
+	simStatusServiceNotSupp  = 0x08
+	simStatusPrivilege       = 0x0f
+	simStatusEmbeddedListErr = 0x1e
+	simStatusTypeMismatch    = 0xff
+)
+
+const (
+	simStringType       = 0x8fce
+	simStringDataLength = 82
+)
+
+// simTag is a single symbol in the simulated controller's tag database
+type simTag struct {
+	instance uint32
+	name     string
+	dataType uint16
+	data     []byte
+	readOnly bool
+}
+
+// simTemplate is a structure data type, members are listed in the order of
+// the template definition
+type simTemplate struct {
+	name    string
+	size    uint32
+	members []simMember
+}
+
+type simMember struct {
+	name     string
+	dataType uint16
+	info     uint16
+	offset   uint32
+}
+
+// simController is a minimal EtherNet/IP (CIP over TCP) server that behaves
+// like a Logix controller for the services used by the adapter: session
+// registration, the symbol object instance list, and tag read/write.
+type simController struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	tags     map[string]*simTag
+	nextInst uint32
+	conns    map[net.Conn]struct{}
+	offline  bool
+
+	templates map[uint16]*simTemplate
+	status    uint16
+}
+
+func newSimController(t *testing.T) *simController {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start simulated controller: %s", err.Error())
+	}
+
+	sim := &simController{
+		listener: l,
+		tags:     make(map[string]*simTag),
+		nextInst: 1,
+		conns:    make(map[net.Conn]struct{}),
+
+		templates: make(map[uint16]*simTemplate),
+	}
+	go sim.serve()
+	t.Cleanup(func() { l.Close() })
+
+	return sim
+}
+
+func (s *simController) port() uint {
+	return uint(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// addTag creates a tag with the raw little endian value supplied
+func (s *simController) addTag(name string, dataType uint16, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[name] = &simTag{instance: s.nextInst, name: name, dataType: dataType, data: data}
+	s.nextInst++
+}
+
+func (s *simController) addDINT(name string, value int32) {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(value))
+	s.addTag(name, 0xc4, buf)
+}
+
+func (s *simController) addString(name string, value string) {
+	buf := make([]byte, 4+simStringDataLength+2)
+	binary.LittleEndian.PutUint32(buf, uint32(len(value)))
+	copy(buf[4:], value)
+	s.addTag(name, simStringType, buf)
+}
+
+// addTemplate defines a structure type, tags of the type are added with
+// addTag and the type 0x8000|instance
+func (s *simController) addTemplate(instance uint16, name string, size uint32, members ...simMember) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.templates[instance] = &simTemplate{name: name, size: size, members: members}
+}
+
+// setValue replaces the raw bytes of a tag, like the controller's logic would
+func (s *simController) setValue(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.tags[name].data, data)
+}
+
+// setReadOnly rejects writes to a tag, like a tag with read only external
+// access
+func (s *simController) setReadOnly(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[name].readOnly = true
+}
+
+// setStatus sets the identity object status word, e.g. 0x0400 for a
+// recoverable major fault
+func (s *simController) setStatus(status uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// value returns a copy of the raw bytes currently stored in a tag
+func (s *simController) value(name string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.tags[name].data...)
+}
+
+// setOffline drops the open connections and, while offline, closes new
+// connections as soon as they are accepted, like an unreachable controller
+func (s *simController) setOffline(offline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offline = offline
+	if offline {
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+}
+
+func (s *simController) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.offline {
+			conn.Close()
+		} else {
+			s.conns[conn] = struct{}{}
+			go s.handleConn(conn)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *simController) handleConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	header := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint16(header[2:4]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		var reply []byte
+		switch binary.LittleEndian.Uint16(header[0:2]) {
+		case 0x65: // RegisterSession
+			binary.LittleEndian.PutUint32(header[4:8], 0x1234)
+			reply = body
+		case 0x66: // UnRegisterSession
+			return
+		case 0x63: // ListIdentity
+			reply = s.listIdentity()
+		case 0x6f: // SendRRData
+			reply = s.sendRRData(body)
+		default:
+			binary.LittleEndian.PutUint32(header[8:12], 0x01)
+		}
+
+		binary.LittleEndian.PutUint16(header[2:4], uint16(len(reply)))
+		if _, err := conn.Write(append(append([]byte(nil), header...), reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *simController) listIdentity() []byte {
+	name := "1756-L83E/B Simulated"
+	item := new(bytes.Buffer)
+	binary.Write(item, binary.LittleEndian, uint16(1))        // encapsulation version
+	binary.Write(item, binary.BigEndian, int16(2))            // sin_family
+	binary.Write(item, binary.BigEndian, uint16(s.port()))    // sin_port
+	binary.Write(item, binary.BigEndian, uint32(0x7f000001))  // sin_addr
+	binary.Write(item, binary.BigEndian, uint64(0))           // sin_zero
+	binary.Write(item, binary.LittleEndian, uint16(1))        // vendor
+	binary.Write(item, binary.LittleEndian, uint16(0x0e))     // device type
+	binary.Write(item, binary.LittleEndian, uint16(166))      // product code
+	item.Write([]byte{33, 11})                                // revision
+	binary.Write(item, binary.LittleEndian, uint16(0x3060))   // status
+	binary.Write(item, binary.LittleEndian, uint32(0xc0ffee)) // serial
+	item.WriteByte(byte(len(name)))
+	item.WriteString(name)
+	item.WriteByte(3) // state
+
+	out := new(bytes.Buffer)
+	binary.Write(out, binary.LittleEndian, uint16(1))
+	binary.Write(out, binary.LittleEndian, uint16(0x0c))
+	binary.Write(out, binary.LittleEndian, uint16(item.Len()))
+	out.Write(item.Bytes())
+	return out.Bytes()
+}
+
+// sendRRData unwraps the unconnected send carried in the common packet format
+// and answers with the reply of the embedded message router request
+func (s *simController) sendRRData(body []byte) []byte {
+	r := bytes.NewReader(body[6:])
+	var count uint16
+	binary.Read(r, binary.LittleEndian, &count)
+
+	var mr []byte
+	for i := uint16(0); i < count; i++ {
+		var typeID, length uint16
+		binary.Read(r, binary.LittleEndian, &typeID)
+		binary.Read(r, binary.LittleEndian, &length)
+		data := make([]byte, length)
+		io.ReadFull(r, data)
+		if typeID == 0xb2 {
+			mr = data
+		}
+	}
+
+	service, path, data := splitRequest(mr)
+	if service == 0x52 {
+		size := binary.LittleEndian.Uint16(data[2:4])
+		service, path, data = splitRequest(data[4 : 4+size])
+	}
+
+	out := new(bytes.Buffer)
+	out.Write(body[:6])
+	binary.Write(out, binary.LittleEndian, uint16(2))
+	binary.Write(out, binary.LittleEndian, uint16(0))
+	binary.Write(out, binary.LittleEndian, uint16(0))
+	reply := s.execute(service, path, data)
+	binary.Write(out, binary.LittleEndian, uint16(0xb2))
+	binary.Write(out, binary.LittleEndian, uint16(len(reply)))
+	out.Write(reply)
+	return out.Bytes()
+}
+
+func splitRequest(mr []byte) (byte, []byte, []byte) {
+	pathLen := int(mr[1]) * 2
+	return mr[0], mr[2 : 2+pathLen], mr[2+pathLen:]
+}
+
+func (s *simController) execute(service byte, path []byte, data []byte) []byte {
+	switch service {
+	case 0x55:
+		return s.instanceAttributeList(path)
+	case 0x4c:
+		if parsePath(path).class == 0x6c {
+			return s.readTemplate(path, data)
+		}
+		return s.readTag(path)
+	case 0x4d:
+		return s.writeTag(path, data)
+	case 0x0a:
+		return s.multipleService(data)
+	case 0x4e:
+		return s.readModifyWrite(path, data)
+	case 0x03:
+		return s.templateAttributes(path)
+	case 0x0e:
+		return s.attributeSingle(path)
+	default:
+		return simReply(service, simStatusServiceNotSupp, nil)
+	}
+}
+
+func simReply(service byte, status byte, data []byte) []byte {
+	return append([]byte{service | 0x80, 0, status, 0}, data...)
+}
+
+// simPath is the decoded form of a request path
+type simPath struct {
+	class     uint32
+	instance  uint32
+	attribute uint32
+	symbols   []string
+}
+
+func parsePath(path []byte) simPath {
+	p := simPath{}
+	for i := 0; i < len(path); {
+		seg := path[i]
+		switch seg {
+		case 0x20:
+			p.class = uint32(path[i+1])
+			i += 2
+		case 0x21:
+			p.class = uint32(binary.LittleEndian.Uint16(path[i+2:]))
+			i += 4
+		case 0x24:
+			p.instance = uint32(path[i+1])
+			i += 2
+		case 0x25:
+			p.instance = uint32(binary.LittleEndian.Uint16(path[i+2:]))
+			i += 4
+		case 0x26:
+			p.instance = binary.LittleEndian.Uint32(path[i+2:])
+			i += 6
+		case 0x30:
+			p.attribute = uint32(path[i+1])
+			i += 2
+		case 0x91:
+			l := int(path[i+1])
+			p.symbols = append(p.symbols, string(path[i+2:i+2+l]))
+			i += 2 + l + l%2
+		default:
+			return simPath{}
+		}
+	}
+	return p
+}
+
+// lookup resolves a path to a tag and an optional structure member name
+func (s *simController) lookup(path []byte) (*simTag, string) {
+	p := parsePath(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tag *simTag
+	symbols := p.symbols
+	if p.class == 0x6b && p.instance != 0 {
+		for _, t := range s.tags {
+			if t.instance == p.instance {
+				tag = t
+			}
+		}
+	} else if len(symbols) > 0 {
+		tag = s.tags[symbols[0]]
+		symbols = symbols[1:]
+	}
+
+	if tag == nil || len(symbols) > 1 {
+		return nil, ""
+	}
+	if len(symbols) == 1 {
+		return tag, symbols[0]
+	}
+	return tag, ""
+}
+
+func (s *simController) instanceAttributeList(path []byte) []byte {
+	start := parsePath(path).instance
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tags := make([]*simTag, 0, len(s.tags))
+	for _, t := range s.tags {
+		if t.instance >= start {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].instance < tags[j].instance })
+
+	out := new(bytes.Buffer)
+	for _, t := range tags {
+		binary.Write(out, binary.LittleEndian, t.instance)
+		binary.Write(out, binary.LittleEndian, uint16(len(t.name)))
+		out.WriteString(t.name)
+		binary.Write(out, binary.LittleEndian, t.dataType)
+		out.Write(make([]byte, 12))
+	}
+	return simReply(0x55, simStatusSuccess, out.Bytes())
+}
+
+func (s *simController) readTag(path []byte) []byte {
+	tag, member := s.lookup(path)
+	if tag == nil {
+		return simReply(0x4c, simStatusPathUnknown, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := new(bytes.Buffer)
+	switch {
+	case member == "LEN" && tag.dataType == simStringType:
+		binary.Write(out, binary.LittleEndian, uint16(0xc4))
+		out.Write(tag.data[:4])
+	case member == "DATA" && tag.dataType == simStringType:
+		binary.Write(out, binary.LittleEndian, uint16(0xc2))
+		out.Write(tag.data[4 : 4+simStringDataLength])
+	case member != "":
+		return simReply(0x4c, simStatusPathUnknown, nil)
+	case tag.dataType&0x8000 != 0:
+		binary.Write(out, binary.LittleEndian, uint16(0x02a0))
+		binary.Write(out, binary.LittleEndian, tag.dataType&0x0fff)
+		out.Write(tag.data)
+	default:
+		binary.Write(out, binary.LittleEndian, tag.dataType)
+		out.Write(tag.data)
+	}
+	return simReply(0x4c, simStatusSuccess, out.Bytes())
+}
+
+func (s *simController) writeTag(path []byte, data []byte) []byte {
+	tag, member := s.lookup(path)
+	if tag == nil {
+		return simReply(0x4d, simStatusPathUnknown, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dataType := binary.LittleEndian.Uint16(data[0:2])
+	value := data[4:]
+	switch {
+	case tag.readOnly:
+		return simReply(0x4d, simStatusPrivilege, nil)
+	case member == "LEN" && tag.dataType == simStringType:
+		copy(tag.data[:4], value)
+	case member == "DATA" && tag.dataType == simStringType:
+		copy(tag.data[4:4+simStringDataLength], value)
+	case member != "" && s.templates[tag.dataType&0x0fff] != nil:
+		return s.writeMember(tag, member, dataType, value)
+	case member != "":
+		return simReply(0x4d, simStatusPathUnknown, nil)
+	case dataType != tag.dataType || len(value) != len(tag.data):
+		return simReply(0x4d, simStatusTypeMismatch, nil)
+	default:
+		copy(tag.data, value)
+	}
+	return simReply(0x4d, simStatusSuccess, nil)
+}
+
+// readModifyWrite applies the OR and AND masks to an integer tag
+func (s *simController) readModifyWrite(path []byte, data []byte) []byte {
+	tag, member := s.lookup(path)
+	if tag == nil || member != "" {
+		return simReply(0x4e, simStatusPathUnknown, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := int(binary.LittleEndian.Uint16(data[0:2]))
+	if tag.readOnly {
+		return simReply(0x4e, simStatusPrivilege, nil)
+	}
+	if size > len(tag.data) || len(data) != 2+2*size {
+		return simReply(0x4e, simStatusTypeMismatch, nil)
+	}
+	for i := 0; i < size; i++ {
+		tag.data[i] = (tag.data[i] | data[2+i]) & data[2+size+i]
+	}
+	return simReply(0x4e, simStatusSuccess, nil)
+}
+
+func (s *simController) multipleService(data []byte) []byte {
+	count := int(binary.LittleEndian.Uint16(data[0:2]))
+	offsets := make([]int, count+1)
+	for i := 0; i < count; i++ {
+		offsets[i] = int(binary.LittleEndian.Uint16(data[2+i*2:]))
+	}
+	offsets[count] = len(data)
+
+	replies := make([][]byte, count)
+	status := byte(simStatusSuccess)
+	for i := 0; i < count; i++ {
+		service, path, reqData := splitRequest(data[offsets[i]:offsets[i+1]])
+		replies[i] = s.execute(service, path, reqData)
+		if replies[i][2] != simStatusSuccess {
+			status = simStatusEmbeddedListErr
+		}
+	}
+
+	out := new(bytes.Buffer)
+	binary.Write(out, binary.LittleEndian, uint16(count))
+	offset := 2 + 2*count
+	for _, r := range replies {
+		binary.Write(out, binary.LittleEndian, uint16(offset))
+		offset += len(r)
+	}
+	for _, r := range replies {
+		out.Write(r)
+	}
+	return simReply(0x0a, status, out.Bytes())
+}
+
+// writeMember writes an atomic member of a structure tag, the caller holds s.mu
+func (s *simController) writeMember(tag *simTag, name string, dataType uint16, value []byte) []byte {
+	for _, m := range s.templates[tag.dataType&0x0fff].members {
+		switch {
+		case m.name != name:
+			continue
+		case m.dataType != dataType:
+			return simReply(0x4d, simStatusTypeMismatch, nil)
+		case dataType == 0xc1 && value[0] != 0:
+			tag.data[m.offset] |= 1 << m.info
+		case dataType == 0xc1:
+			tag.data[m.offset] &^= 1 << m.info
+		default:
+			copy(tag.data[m.offset:], value)
+		}
+		return simReply(0x4d, simStatusSuccess, nil)
+	}
+	return simReply(0x4d, simStatusPathUnknown, nil)
+}
+
+// definition encodes the member descriptions and names the way the
+// read template service returns them
+func (t *simTemplate) definition() []byte {
+	out := new(bytes.Buffer)
+	for _, m := range t.members {
+		binary.Write(out, binary.LittleEndian, m.info)
+		binary.Write(out, binary.LittleEndian, m.dataType)
+		binary.Write(out, binary.LittleEndian, m.offset)
+	}
+	out.WriteString(t.name + ";n\x00")
+	for _, m := range t.members {
+		out.WriteString(m.name + "\x00")
+	}
+	return out.Bytes()
+}
+
+func (s *simController) templateAttributes(path []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.templates[uint16(parsePath(path).instance)]
+	if t == nil {
+		return simReply(0x03, simStatusPathUnknown, nil)
+	}
+
+	out := new(bytes.Buffer)
+	binary.Write(out, binary.LittleEndian, uint16(3))
+	binary.Write(out, binary.LittleEndian, []uint16{4, 0})
+	binary.Write(out, binary.LittleEndian, uint32((len(t.definition())+23+3)/4))
+	binary.Write(out, binary.LittleEndian, []uint16{5, 0})
+	binary.Write(out, binary.LittleEndian, t.size)
+	binary.Write(out, binary.LittleEndian, []uint16{2, 0, uint16(len(t.members))})
+	return simReply(0x03, simStatusSuccess, out.Bytes())
+}
+
+func (s *simController) readTemplate(path []byte, data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.templates[uint16(parsePath(path).instance)]
+	if t == nil {
+		return simReply(0x4c, simStatusPathUnknown, nil)
+	}
+
+	definition := t.definition()
+	offset := int(binary.LittleEndian.Uint32(data))
+	end := offset + int(binary.LittleEndian.Uint16(data[4:]))
+	if end > len(definition) {
+		end = len(definition)
+	}
+	return simReply(0x4c, simStatusSuccess, definition[offset:end])
+}
+
+func (s *simController) attributeSingle(path []byte) []byte {
+	p := parsePath(path)
+	if p.class != 0x01 || p.attribute != 0x05 {
+		return simReply(0x0e, simStatusPathUnknown, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return simReply(0x0e, simStatusSuccess, []byte{byte(s.status), byte(s.status >> 8)})
+}
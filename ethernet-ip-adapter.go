@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/signal"
-	"strconv"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -14,6 +17,7 @@ import (
 	adapter_library "github.com/clearblade/adapter-go-library"
 	mqttTypes "github.com/clearblade/mqtt_parsing"
 	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/types"
 )
 
 const (
@@ -21,6 +25,7 @@ const (
 	appuri         = "urn:cb-opc-ua-adapter:client"
 	readTopic      = "read"
 	writeTopic     = "write"
+	browseTopic    = "browse"
 	methodTopic    = "method"
 	subscribeTopic = "subscribe"
 	publishTopic   = "publish"
@@ -32,33 +37,116 @@ var (
 	eipClient       *eip.EIPTCP
 	eipConfig       *eip.Config
 	eipTagMap       map[string]*eip.Tag
+	mqttClient      mqttTransport = &clearBladeTransport{}
+	timeNow                       = time.Now
+
+	errTagNotFound     = errors.New("tag does not exist")
+	errUnsupportedType = errors.New("unsupported data type")
+	errInvalidValue    = errors.New("invalid value")
+	errReadOnlyTag     = errors.New("tag is read only")
 )
 
 func main() {
-	err := adapter_library.ParseArguments(adapterName)
-	if err != nil {
-		log.Fatalf("[FATAL] Failed to parse arguments: %s\n", err.Error())
+	if len(os.Args) > 1 {
+		if command, ok := cliCommands[os.Args[1]]; ok {
+			runCLICommand(os.Args[1], command, os.Args[2:])
+			return
+		}
 	}
 
-	adapterConfig, err = adapter_library.Initialize()
-	if err != nil {
-		log.Fatalf("[FATAL] Failed to initialize: %s\n", err.Error())
+	if len(os.Args) > 1 && os.Args[1] == standaloneCommand {
+		err := initializeStandalone(os.Args[2:])
+		if err != nil {
+			log.Fatalf("[FATAL] Failed to initialize standalone mode: %s\n", err.Error())
+		}
+	} else {
+		initializeClearBlade()
 	}
 
-	adapterSettings = &ethernetIpAdapterSettings{}
-	err = json.Unmarshal([]byte(adapterConfig.AdapterSettings), adapterSettings)
-	if err != nil {
-		log.Fatalf("[FATAL] Failed to parse Adapter Settings %s\n", err.Error())
+	if err := validatePayloadEncodings(); err != nil {
+		log.Fatalf("[FATAL] Invalid Adapter Settings: %s\n", err.Error())
+	}
+
+	if err := validateStringEncoding(); err != nil {
+		log.Fatalf("[FATAL] Invalid Adapter Settings: %s\n", err.Error())
+	}
+
+	if err := validateOPCUASettings(); err != nil {
+		log.Fatalf("[FATAL] Invalid Adapter Settings: %s\n", err.Error())
+	}
+
+	initializeScheduler()
+
+	if err := initializeTagConfig(); err != nil {
+		log.Fatalf("[FATAL] Failed to load tag configuration: %s\n", err.Error())
+	}
+
+	if err := initializeWritePolicy(); err != nil {
+		log.Fatalf("[FATAL] Invalid Adapter Settings: %s\n", err.Error())
+	}
+
+	if err := initializeAuditLog(); err != nil {
+		log.Fatalf("[FATAL] %s\n", err.Error())
+	}
+
+	if err := initializeRecipes(); err != nil {
+		log.Fatalf("[FATAL] Invalid Adapter Settings: %s\n", err.Error())
 	}
 
-	err = adapter_library.ConnectMQTT(adapterConfig.TopicRoot+"/#", cbMessageHandler)
+	if adapterSettings.Sparkplug != nil {
+		initializeSparkplug()
+	}
+
+	if adapterSettings.TagTopics {
+		initializeTagTopics()
+	}
+
+	err := mqttClient.Subscribe(adapterConfig.TopicRoot+"/#", cbMessageHandler)
 	if err != nil {
 		log.Fatalf("[FATAL] Failed to connect MQTT: %s\n", err.Error())
 	}
 
+	if sparkplugEdgeNode != nil {
+		startSparkplug()
+	}
+
+	initializeStoreAndForward()
+
 	// initialize ethernet IP connection
 	initializeEIP()
 
+	if err := initializeVirtualTags(); err != nil {
+		log.Fatalf("[FATAL] Invalid Adapter Settings: %s\n", err.Error())
+	}
+
+	if err := initializeTagAliases(); err != nil {
+		log.Fatalf("[FATAL] Failed to load tag aliases: %s\n", err.Error())
+	}
+
+	if len(adapterSettings.Alarms) > 0 {
+		if err := initializeAlarms(); err != nil {
+			log.Fatalf("[FATAL] Invalid Adapter Settings: %s\n", err.Error())
+		}
+	}
+
+	if adapterSettings.LogixAlarms {
+		if err := initializeLogixAlarms(); err != nil {
+			log.Fatalf("[FATAL] Failed to read the alarm instruction tags: %s\n", err.Error())
+		}
+	}
+
+	if adapterSettings.HTTPPort != 0 {
+		go startHTTPServer()
+	}
+
+	if adapterSettings.OPCUAPort != 0 {
+		go startOPCUAServer()
+	}
+
+	if len(poller.listeners) > 0 {
+		go startPoller()
+	}
+
 	//TODO - Add an interval to refresh the tags
 
 	// wait for signal to stop/kill process to allow for graceful shutdown
@@ -67,11 +155,48 @@ func main() {
 	sig := <-c
 
 	log.Printf("[INFO] OS signal %s received, gracefully shutting down adapter.\n", sig)
+	if sparkplugEdgeNode != nil {
+		sparkplugEdgeNode.shutdown()
+	}
 	os.Exit(0)
 
 }
 
+func initializeClearBlade() {
+	err := adapter_library.ParseArguments(adapterName)
+	if err != nil {
+		log.Fatalf("[FATAL] Failed to parse arguments: %s\n", err.Error())
+	}
+
+	adapterConfig, err = adapter_library.Initialize()
+	if err != nil {
+		log.Fatalf("[FATAL] Failed to initialize: %s\n", err.Error())
+	}
+
+	adapterSettings = &ethernetIpAdapterSettings{}
+	err = json.Unmarshal([]byte(adapterConfig.AdapterSettings), adapterSettings)
+	if err != nil {
+		log.Fatalf("[FATAL] Failed to parse Adapter Settings %s\n", err.Error())
+	}
+}
+
 func initializeEIP() {
+	connectEIP()
+
+	//Retrieve all tags and populate tag map
+	log.Printf("[INFO] Retrieving device tags\n")
+	var err error
+	eipTagMap, err = eipClient.AllTags()
+	if err != nil {
+		// cannot get tags
+		log.Fatalln(err)
+	}
+	log.Printf("[DEBUG] Tags retrieved: %#v\n", eipTagMap)
+	resetStringLayouts()
+	readCache = newTagReadCache()
+}
+
+func connectEIP() {
 	var err error
 
 	//Create the default config
@@ -95,27 +220,53 @@ func initializeEIP() {
 		// cannot connect to host
 		log.Fatalln(err)
 	}
+	setControllerConnected(true)
+}
 
-	//Retrieve all tags and populate tag map
-	log.Printf("[INFO] Retrieving device tags\n")
-	eipTagMap, err = eipClient.AllTags()
-	if err != nil {
-		// cannot get tags
-		log.Fatalln(err)
-	}
-	log.Printf("[DEBUG] Tags retrieved: %#v\n", eipTagMap)
+// reconnectEIP re-establishes the session after the connection to the
+// controller was lost. The tag map is kept, the tags reference eipClient.
+func reconnectEIP() error {
+	log.Printf("[INFO] reconnectEIP - Reconnecting to EtherNet-IP server\n")
+	return callController(func() error {
+		err := eipClient.Connect()
+		setControllerConnected(err == nil)
+		return err
+	})
 }
 
 func cbMessageHandler(message *mqttTypes.Publish) {
 	//Determine the type of request that was received
-	if strings.Contains(message.Topic.Whole, "response") {
+	if isSparkplugTopic(message.Topic.Whole) {
+		log.Println("[INFO] cbMessageHandler - Received Sparkplug B command")
+		scheduleRequest(priorityWrite, message, handleSparkplugCommand, nil)
+	} else if isTagTopic(message.Topic.Whole) {
+		if strings.HasSuffix(message.Topic.Whole, tagSetTopicEnd) {
+			log.Println("[INFO] cbMessageHandler - Received tag set request")
+			scheduleRequest(priorityWrite, message, handleTagSetRequest, nil)
+		} else {
+			log.Println("[DEBUG] cbMessageHandler - Received tag value, ignoring")
+		}
+	} else if strings.Contains(message.Topic.Whole, "response") {
 		log.Println("[DEBUG] cbMessageHandler - Received response, ignoring")
+	} else if message.Topic.Whole == adapterConfig.TopicRoot+"/"+eventsTopic {
+		log.Println("[DEBUG] cbMessageHandler - Received alarm event, ignoring")
+	} else if message.Topic.Whole == adapterConfig.TopicRoot+"/"+auditTopic {
+		log.Println("[DEBUG] cbMessageHandler - Received audit record, ignoring")
+	} else if message.Topic.Whole == adapterConfig.TopicRoot+"/"+alarmAckTopic {
+		log.Println("[INFO] cbMessageHandler - Received alarm acknowledgement")
+		scheduleRequest(priorityWrite, message, handleAlarmAckRequest, rejectAlarmAckRequest)
+	} else if strings.HasPrefix(message.Topic.Whole, adapterConfig.TopicRoot+"/"+recipesTopic+"/") {
+		log.Println("[INFO] cbMessageHandler - Received recipe request")
+		scheduleRequest(recipePriority(message), message, handleRecipeRequest, rejectRecipeRequest)
 	} else if strings.Contains(message.Topic.Whole, readTopic) {
 		log.Println("[INFO] cbMessageHandler - Received Ethernet-IP read request")
-		go handleReadRequest(message)
+		scheduleRequest(priorityRead, message, handleReadRequest, rejectReadRequest)
 	} else if strings.Contains(message.Topic.Whole, writeTopic) {
 		log.Println("[INFO] cbMessageHandler - Received Ethernet-IP write request")
-		go handleWriteRequest(message)
+		scheduleRequest(priorityWrite, message, handleWriteRequest, rejectWriteRequest)
+	} else if strings.Contains(message.Topic.Whole, browseTopic) {
+		log.Println("[INFO] cbMessageHandler - Received Ethernet-IP browse request")
+		scheduleRequest(priorityRead, message, handleBrowseRequest, rejectBrowseRequest)
 	} else {
 		log.Printf("[ERROR] cbMessageHandler - Unknown request received: topic = %s, payload = %#v\n", message.Topic.Whole, message.Payload)
 	}
@@ -133,65 +284,104 @@ func handleReadRequest(message *mqttTypes.Publish) {
 	}
 
 	readReq := ethernetIpReadRequestMQTTMessage{}
-	err := json.Unmarshal(message.Payload, &readReq)
+	err := decodePayload(message.Topic.Whole, message.Payload, &readReq)
 	if err != nil {
-		log.Printf("[ERROR] Failed to unmarshal request JSON: %s\n", err.Error())
+		log.Printf("[ERROR] Failed to decode request payload: %s\n", err.Error())
 		returnReadError(err.Error(), &mqttResp)
 		return
 	}
 
-	mqttResp.ServerTimestamp = time.Now().Format(time.RFC3339)
+	mqttResp.ServerTimestamp = timeNow().UTC().Format(time.RFC3339)
 
-	for _, tag := range readReq.Tags {
-		if _, ok := eipTagMap[tag]; ok {
-			mqttResp.Data[tag], err = readTag(eipTagMap[tag])
+	err = readTagsMaxAge(readReq.Tags, mqttResp.Data, time.Duration(readReq.MaxAge)*time.Millisecond)
+	if err != nil {
+		returnReadError(err.Error(), &mqttResp)
+		return
+	}
+
+	publishPayload(adapterConfig.TopicRoot+"/"+readTopic+"/response", mqttResp)
+}
+
+// readTags reads each of the named tags into data, stopping at the first failure
+func readTags(names []string, data map[string]ethernetIpReadResponseData) error {
+	return readTagsMaxAge(names, data, 0)
+}
+
+// readTagsMaxAge reads the tags like readTags, the values of controller tags
+// read no more than maxAge ago are taken from the read cache
+func readTagsMaxAge(names []string, data map[string]ethernetIpReadResponseData, maxAge time.Duration) error {
+	for _, name := range names {
+		if symbol := resolveTagName(name); virtualTags[symbol] != nil {
+			value, err := readVirtualTag(symbol)
 			if err != nil {
-				log.Printf("[ERROR] Error reading tag: %s\n", err.Error())
-				returnReadError(err.Error(), &mqttResp)
+				log.Printf("[ERROR] Error evaluating virtual tag %s: %s\n", name, err.Error())
+				return err
 			}
-		} else {
-			log.Printf("[ERROR] Cannot read tag, tag does not exist %s", tag)
-			returnReadError(err.Error(), &mqttResp)
-			return
+			data[name] = value
+			continue
+		}
+
+		if tag, bit, ok := bitAddress(name); ok {
+			value, err := readCache.read(resolveTagName(name), maxAge, func() (ethernetIpReadResponseData, error) {
+				return readBit(tag, bit)
+			})
+			if err != nil {
+				log.Printf("[ERROR] Error reading bit %s: %s\n", name, err.Error())
+				return err
+			}
+			data[name] = value
+			continue
+		}
+
+		tag, err := lookupTag(name)
+		if err != nil {
+			log.Printf("[ERROR] Cannot read tag, tag does not exist %s", name)
+			return err
 		}
+
+		value, err := cachedReadTag(tag, maxAge)
+		if err != nil {
+			log.Printf("[ERROR] Error reading tag: %s\n", err.Error())
+			return err
+		}
+		data[name] = value
 	}
+	return nil
+}
 
-	// 	opcuaResp, err := opcuaClient.Read(opcuaReadReq)
-	// 	if err != nil {
-	// 		log.Printf("[ERROR] Read request failed: %s\n", err.Error())
-	// 		returnReadError(err.Error(), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	for idx, result := range opcuaResp.Results {
-	// 		if result.Status == ua.StatusOK {
-	// 			mqttResp.ServerTimestamp = result.ServerTimestamp.Format(time.RFC3339)
-	// 			mqttResp.Data[readReq.NodeIDs[idx]] = opcuaReadResponseData{
-	// 				Value:           result.Value.Value(),
-	// 				SourceTimestamp: result.SourceTimestamp.Format(time.RFC3339),
-	// 			}
-	// 		} else {
-	// 			log.Printf("[ERROR] Read Status not OK for node id %s: %+v\n", readReq.NodeIDs[idx], result.Status)
-	// 			returnReadError(fmt.Sprintf("Read Status not OK for node id %s: %+v\n", readReq.NodeIDs[idx], result.Status), &mqttResp)
-	// 			return
-	// 		}
-	// 	}
-
-	// 	if len(mqttResp.Data) == 0 {
-	// 		log.Println("[IFNO] No data received, nothing to publish")
-	// 		return
-	// 	}
-
-	// 	publishJson(adapterConfig.TopicRoot+"/"+readTopic+"/response", mqttResp)
+// lookupTag returns the controller tag with the given name or alias
+func lookupTag(name string) (*eip.Tag, error) {
+	tag, ok := eipTagMap[resolveTagName(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errTagNotFound, name)
+	}
+	return tag, nil
 }
 
 func readTag(tag *eip.Tag) (ethernetIpReadResponseData, error) {
 	readResp := ethernetIpReadResponseData{}
 
-	err := tag.Read()
-	if err != nil {
-		// cannot read tag
-		return readResp, err
+	// the library decodes values as 32 bit integers, which fails for the
+	// single byte of a BOOL
+	if tag.Type == eip.BOOL {
+		_, data, err := readSymbol(tag.Name())
+		if err != nil {
+			return readResp, err
+		}
+		readResp.Value = len(data) > 0 && data[0] != 0
+		readResp.SourceTimestamp = timeNow().UTC().Format(time.RFC3339)
+		return readResp, nil
+	}
+
+	if layout, ok := stringLayoutFor(tag.Type); ok {
+		v, err := readString(tag, layout)
+		if err != nil {
+			return readResp, err
+		}
+		readResp.Value = v
+		readResp.Units = tagConfigs[tag.Name()].units()
+		readResp.SourceTimestamp = timeNow().UTC().Format(time.RFC3339)
+		return readResp, nil
 	}
 
 	// From https://www.odva.org/wp-content/uploads/2020/06/PUB00123R1_Common-Industrial_Protocol_and_Family_of_CIP_Networks.pdf
@@ -220,257 +410,321 @@ func readTag(tag *eip.Tag) (ethernetIpReadResponseData, error) {
 	switch tag.Type {
 	case eip.NULL:
 		readResp.Value = nil
-	case eip.BOOL:
-		readResp.Value, _ = strconv.ParseBool(string(tag.Int32()))
-	case eip.SINT:
-	case eip.INT:
-	case eip.DINT:
-	case eip.USINT: //unsigned small int (1 byte)
-	case eip.UINT: //unsigned int (2 bytes)
-	case eip.UDINT: //unsigned double integer (4 bytes)
-		readResp.Value = tag.Int32()
+	case eip.SINT, eip.INT, eip.DINT,
+		eip.USINT, //unsigned small int (1 byte)
+		eip.UINT,  //unsigned int (2 bytes)
+		eip.UDINT: //unsigned double integer (4 bytes)
+		// the library decodes every integer as 4 bytes, which fails for
+		// the shorter types and turns large UDINT values negative
+		_, data, err := readSymbol(tag.Name())
+		if err != nil {
+			// cannot read tag
+			return readResp, err
+		}
+		readResp.Value, err = decodeInteger(tag.Type, data)
+		if err != nil {
+			return readResp, fmt.Errorf("%s: %w", tag.Name(), err)
+		}
 	//case eip.LINT:
 	// case eip.ULINT: //unsigned long int (8 bytes)
 	// case eip.REAL: //Real number (4 bytes)
 	// case eip.LREAL:
-	case eip.STRING:
-		readResp.Value = tag.String()
 	default:
-		return readResp, fmt.Errorf("unsupported data type: %d", tag.Type)
+		return readResp, fmt.Errorf("%w: %d", errUnsupportedType, tag.Type)
 	}
 
-	readResp.SourceTimestamp = time.Now().UTC().Format(time.RFC3339) //time.Now().Format(JavascriptISOString)
+	readResp.Value = scaleReadValue(tag, readResp.Value)
+	readResp.Units = tagConfigs[tag.Name()].units()
+	readResp.SourceTimestamp = timeNow().UTC().Format(time.RFC3339) //time.Now().Format(JavascriptISOString)
 	return readResp, nil
 }
 
 //OPC UA Attribute Service Set - write
 func handleWriteRequest(message *mqttTypes.Publish) {
 
-	// 	mqttResp := opcuaWriteResponseMQTTMessage{
-	// 		NodeID:       "",
-	// 		Timestamp:    "",
-	// 		Success:      true,
-	// 		StatusCode:   0,
-	// 		ErrorMessage: "",
-	// 	}
-
-	// 	writeReq := opcuaWriteRequestMQTTMessage{}
-	// 	err := json.Unmarshal(message.Payload, &writeReq)
-	// 	if err != nil {
-	// 		log.Printf("[ERROR] Failed to unmarshal request JSON: %s\n", err.Error())
-	// 		returnWriteError(err.Error(), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	id, err := ua.ParseNodeID(writeReq.NodeID)
-	// 	if err != nil {
-	// 		log.Printf("[ERROR] Failed to parse OPC UA Node ID: %s\n", err.Error())
-	// 		returnWriteError(err.Error(), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	nodeType, err := getTagDataType(id)
-	// 	if err != nil {
-	// 		log.Printf("[ERROR] Failed to get type for Node ID %s: %s\n", id.String(), err.Error())
-	// 		returnWriteError(err.Error(), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	switch val := writeReq.Value.(type) {
-	// 	case []interface{}:
-	// 		switch *nodeType {
-	// 		case ua.TypeIDBoolean:
-	// 			convertedArray := make([]bool, 0)
-	// 			for _, i := range val {
-	// 				v, err := getConvertedValue(nodeType, i)
-	// 				if err != nil {
-	// 					log.Println("[ERROR] " + err.Error())
-	// 					returnWriteError(err.Error(), &mqttResp)
-	// 					return
-	// 				}
-	// 				convertedArray = append(convertedArray, v.(bool))
-	// 			}
-	// 			writeReq.Value = convertedArray
-	// 		case ua.TypeIDDouble:
-	// 			convertedArray := make([]float64, 0)
-	// 			for _, i := range val {
-	// 				v, err := getConvertedValue(nodeType, i)
-	// 				if err != nil {
-	// 					log.Println("[ERROR] " + err.Error())
-	// 					returnWriteError(err.Error(), &mqttResp)
-	// 					return
-	// 				}
-	// 				convertedArray = append(convertedArray, v.(float64))
-	// 			}
-	// 			writeReq.Value = convertedArray
-	// 		case ua.TypeIDInt16:
-	// 			convertedArray := make([]int16, 0)
-	// 			for _, i := range val {
-	// 				v, err := getConvertedValue(nodeType, i)
-	// 				if err != nil {
-	// 					log.Println("[ERROR] " + err.Error())
-	// 					returnWriteError(err.Error(), &mqttResp)
-	// 					return
-	// 				}
-	// 				convertedArray = append(convertedArray, v.(int16))
-	// 			}
-	// 			writeReq.Value = convertedArray
-	// 		case ua.TypeIDInt32:
-	// 			convertedArray := make([]int32, 0)
-	// 			for _, i := range val {
-	// 				v, err := getConvertedValue(nodeType, i)
-	// 				if err != nil {
-	// 					log.Println("[ERROR] " + err.Error())
-	// 					returnWriteError(err.Error(), &mqttResp)
-	// 					return
-	// 				}
-	// 				convertedArray = append(convertedArray, v.(int32))
-	// 			}
-	// 			writeReq.Value = convertedArray
-	// 		case ua.TypeIDInt64:
-	// 			convertedArray := make([]int64, 0)
-	// 			for _, i := range val {
-	// 				v, err := getConvertedValue(nodeType, i)
-	// 				if err != nil {
-	// 					log.Println("[ERROR] " + err.Error())
-	// 					returnWriteError(err.Error(), &mqttResp)
-	// 					return
-	// 				}
-	// 				convertedArray = append(convertedArray, v.(int64))
-	// 			}
-	// 			writeReq.Value = convertedArray
-	// 		case ua.TypeIDString:
-	// 			convertedArray := make([]string, 0)
-	// 			for _, i := range val {
-	// 				v, err := getConvertedValue(nodeType, i)
-	// 				if err != nil {
-	// 					log.Println("[ERROR] " + err.Error())
-	// 					returnWriteError(err.Error(), &mqttResp)
-	// 					return
-	// 				}
-	// 				convertedArray = append(convertedArray, v.(string))
-	// 			}
-	// 			writeReq.Value = convertedArray
-	// 		case ua.TypeIDFloat:
-	// 			convertedArray := make([]float32, 0)
-	// 			for _, i := range val {
-	// 				v, err := getConvertedValue(nodeType, i)
-	// 				if err != nil {
-	// 					log.Println("[ERROR] " + err.Error())
-	// 					returnWriteError(err.Error(), &mqttResp)
-	// 					return
-	// 				}
-	// 				convertedArray = append(convertedArray, v.(float32))
-	// 			}
-	// 			writeReq.Value = convertedArray
-	// 		default:
-	// 			log.Printf("[ERROR] Unhandled node type: " + nodeType.String())
-	// 			return
-	// 		}
-	// 	case interface{}:
-	// 		_, err = getConvertedValue(nodeType, val)
-	// 		if err != nil {
-	// 			log.Println("[ERROR] " + err.Error())
-	// 			returnWriteError(err.Error(), &mqttResp)
-	// 			return
-	// 		}
-	// 	default:
-	// 		log.Printf("[ERROR] Unexpected type for write value: %T\n", val)
-	// 		returnWriteError(fmt.Sprintf("Unexpected type for write value: %T", val), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	variant, err := ua.NewVariant(writeReq.Value)
-	// 	if err != nil {
-	// 		log.Printf("[ERROR] Failed to create new variant: %s\n", err.Error())
-	// 		returnWriteError(err.Error(), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	req := &ua.WriteRequest{
-	// 		NodesToWrite: []*ua.WriteValue{
-	// 			{
-	// 				NodeID:      id,
-	// 				AttributeID: ua.AttributeIDValue,
-	// 				Value: &ua.DataValue{
-	// 					EncodingMask: ua.DataValueValue,
-	// 					Value:        variant,
-	// 				},
-	// 			},
-	// 		},
-	// 	}
-
-	// 	resp, err := opcuaClient.Write(req)
-	// 	if err != nil {
-	// 		log.Printf("[ERROR] Failed to write OPC UA tag %s: %s\n", writeReq.NodeID, err.Error())
-	// 		returnWriteError(err.Error(), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	if resp.Results[0] != ua.StatusOK {
-	// 		log.Printf("[ERROR] non ok status returned from write: %s\n", resp.Results[0].Error())
-	// 		mqttResp.StatusCode = uint32(resp.Results[0])
-	// 		returnWriteError(fmt.Sprintf("Non OK status code returned from write: %s\n", resp.Results[0].Error()), &mqttResp)
-	// 		return
-	// 	}
-
-	// 	mqttResp.NodeID = writeReq.NodeID
-	// 	mqttResp.Timestamp = resp.ResponseHeader.Timestamp.UTC().Format(time.RFC3339)
-	// 	mqttResp.StatusCode = uint32(resp.ResponseHeader.ServiceResult)
-
-	// 	log.Printf("[INFO] OPC UA write successful: %+v\n", resp.Results[0])
-
-	// 	publishJson(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
+	mqttResp := ethernetIpWriteResponseMQTTMessage{
+		NodeID:       "",
+		Timestamp:    "",
+		Success:      true,
+		StatusCode:   0,
+		ErrorMessage: "",
+	}
+
+	writeReq := ethernetIpWriteRequestMQTTMessage{}
+	err := decodePayload(message.Topic.Whole, message.Payload, &writeReq)
+	if err != nil {
+		log.Printf("[ERROR] Failed to decode request payload: %s\n", err.Error())
+		returnWriteError(err.Error(), &mqttResp)
+		return
+	}
+
+	mqttResp.NodeID = writeReq.NodeID
+
+	if len(writeReq.Values) > 0 {
+		mqttResp.Results, err = auditedBatchWrite(writeReq.Values, writeReq.Atomic, writeReq.User, auditSourceMQTT)
+		if err != nil {
+			log.Printf("[ERROR] Failed to write tags: %s\n", err.Error())
+			returnWriteError(err.Error(), &mqttResp)
+			return
+		}
+		log.Printf("[INFO] Ethernet-IP batch write successful: %d tags\n", len(writeReq.Values))
+		mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+		publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
+		return
+	}
+
+	if writeReq.Operation != "" {
+		handleWriteOperation(writeReq, &mqttResp)
+		return
+	}
+
+	if writeReq.Token != "" || writePolicy.selectRequired(writeReq.NodeID) {
+		handleSelectBeforeOperate(writeReq, &mqttResp)
+		return
+	}
+
+	err = auditedWrite(writeReq.NodeID, writeReq.Value, writeReq.User, auditSourceMQTT)
+	if err != nil {
+		log.Printf("[ERROR] Failed to write tag %s: %s\n", writeReq.NodeID, err.Error())
+		returnWriteError(err.Error(), &mqttResp)
+		return
+	}
+
+	log.Printf("[INFO] Ethernet-IP write successful: %s\n", writeReq.NodeID)
+
+	if writeReq.Verify {
+		// the read back is scheduled once the request released its slot
+		go func() {
+			verified, observed := verifyWrite(writeReq.NodeID, writeReq.Value)
+			mqttResp.Verified, mqttResp.ObservedValue = &verified, observed
+			mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+			publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
+		}()
+		return
+	}
+
+	mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
 }
 
-func writeTag(tag *eip.Tag) {
-	err := tag.Read()
+func writeTagByName(name string, value interface{}) error {
+	if writePolicy.selectRequired(name) {
+		return fmt.Errorf("%w: %s is critical", errSelectRequired, name)
+	}
+	return operateTag(name, value)
+}
+
+// operateTag writes a tag without the select before operate check
+func operateTag(name string, value interface{}) error {
+	if err := writePolicy.check(name, value); err != nil {
+		return err
+	}
+	if err := writeTagValue(name, value); err != nil {
+		return err
+	}
+	writePolicy.record(name)
+	return nil
+}
+
+// writeTagValue writes a tag or bit the write policy accepted
+func writeTagValue(name string, value interface{}) error {
+	if _, ok := virtualTags[resolveTagName(name)]; ok {
+		return fmt.Errorf("%w: %s is a virtual tag", errReadOnlyTag, name)
+	}
+
+	if tag, bit, ok := bitAddress(name); ok {
+		defer readCache.invalidate(tag.Name())
+		return writeBit(tag, bit, value)
+	}
+
+	tag, err := lookupTag(name)
 	if err != nil {
-		// cannot read tag
-		log.Fatalln(err)
+		log.Printf("[ERROR] Cannot write tag, tag does not exist %s", name)
+		return err
 	}
+	defer readCache.invalidate(tag.Name())
+	return writeTag(tag, value)
 }
 
-// func getConvertedValue(nodeType *ua.TypeID, value interface{}) (interface{}, error) {
-// 	switch *nodeType {
-// 	case ua.TypeIDBoolean:
-// 		return value.(bool), nil
-// 	case ua.TypeIDDateTime:
-// 		return value.(string), nil
-// 	case ua.TypeIDDouble:
-// 		return value.(float64), nil
-// 	case ua.TypeIDFloat:
-// 		return float32(value.(float64)), nil
-// 	case ua.TypeIDGUID:
-// 		return value.(string), nil
-// 	case ua.TypeIDInt16:
-// 		return int16(value.(float64)), nil
-// 	case ua.TypeIDInt32:
-// 		return int32(value.(float64)), nil
-// 	case ua.TypeIDInt64:
-// 		return int64(value.(float64)), nil
-// 	case ua.TypeIDLocalizedText:
-// 		return value.(string), nil
-// 	case ua.TypeIDNodeID:
-// 		return value.(string), nil
-// 	case ua.TypeIDQualifiedName:
-// 		return value.(string), nil
-// 	case ua.TypeIDString:
-// 		return value.(string), nil
-// 	case ua.TypeIDUint16:
-// 		return uint16(value.(float64)), nil
-// 	case ua.TypeIDUint32:
-// 		return uint32(value.(float64)), nil
-// 	case ua.TypeIDUint64:
-// 		return uint64(value.(float64)), nil
-// 	case ua.TypeIDVariant:
-// 		return value.(bool), nil
-// 	case ua.TypeIDXMLElement:
-// 		return value.(string), nil
-// 	default:
-// 		return nil, fmt.Errorf("Unhandled node type: " + nodeType.String())
-// 	}
-// }
+// writeTag converts the JSON value supplied in a write request to the tag's
+// data type and writes it to the controller.
+//
+// github.com/loki-os/go-ethernet-ip can only encode 32 bit integers, so
+// every type is encoded here and written by name
+func writeTag(tag *eip.Tag, value interface{}) error {
+	if layout, ok := stringLayoutFor(tag.Type); ok {
+		return writeString(tag, layout, value)
+	}
+
+	value, err := scaleWriteValue(tag, value)
+	if err != nil {
+		return err
+	}
+
+	switch tag.Type {
+	case eip.BOOL:
+		v, err := getConvertedBool(value)
+		if err != nil {
+			return err
+		}
+		return writeSymbol(tag.Name(), tag.Type, []byte{v})
+	case eip.SINT, eip.INT, eip.DINT,
+		eip.USINT, eip.UINT, eip.UDINT:
+		data, err := encodeInteger(tag.Type, value)
+		if err != nil {
+			return err
+		}
+		return writeSymbol(tag.Name(), tag.Type, data)
+	default:
+		return fmt.Errorf("%w: %d", errUnsupportedType, tag.Type)
+	}
+}
+
+// getConvertedBool accepts true/false or the numbers 0 and 1 for BOOL tags
+func getConvertedBool(value interface{}) (byte, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case float64:
+		if v == 0 || v == 1 {
+			return byte(v), nil
+		}
+	}
+	return 0, fmt.Errorf("%w for BOOL tag: %v", errInvalidValue, value)
+}
+
+// integerRanges are the values each integer type holds
+var integerRanges = map[types.UInt][2]float64{
+	eip.SINT:  {math.MinInt8, math.MaxInt8},
+	eip.USINT: {0, math.MaxUint8},
+	eip.INT:   {math.MinInt16, math.MaxInt16},
+	eip.UINT:  {0, math.MaxUint16},
+	eip.DINT:  {math.MinInt32, math.MaxInt32},
+	eip.UDINT: {0, math.MaxUint32},
+}
+
+// encodeInteger converts a JSON number to the little endian bytes of an
+// integer tag, checking it is a whole number in the type's range
+func encodeInteger(dataType types.UInt, value interface{}) ([]byte, error) {
+	f, ok := value.(float64)
+	if !ok || f != math.Trunc(f) {
+		return nil, fmt.Errorf("%w for %s tag: %v", errInvalidValue, eip.TypeMap[dataType], value)
+	}
+	limits, ok := integerRanges[dataType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedType, dataType)
+	}
+	if f < limits[0] || f > limits[1] {
+		return nil, fmt.Errorf("%w for %s tag, out of range: %v", errInvalidValue, eip.TypeMap[dataType], value)
+	}
+
+	data := make([]byte, 4)
+	if limits[0] < 0 {
+		binary.LittleEndian.PutUint32(data, uint32(int32(f)))
+	} else {
+		binary.LittleEndian.PutUint32(data, uint32(f))
+	}
+	return data[:integerWidth(dataType)], nil
+}
+
+// decodeInteger decodes the value of an integer tag at the type's width and
+// signedness. UDINT values are uint32, the other types fit in an int32.
+func decodeInteger(dataType types.UInt, data []byte) (interface{}, error) {
+	width := integerWidth(dataType)
+	if width == 0 {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedType, dataType)
+	}
+	if len(data) < width {
+		return nil, fmt.Errorf("short read reply, %d bytes for %s", len(data), eip.TypeMap[dataType])
+	}
+
+	switch dataType {
+	case eip.SINT:
+		return int32(int8(data[0])), nil
+	case eip.USINT:
+		return int32(data[0]), nil
+	case eip.INT:
+		return int32(int16(binary.LittleEndian.Uint16(data))), nil
+	case eip.UINT:
+		return int32(binary.LittleEndian.Uint16(data)), nil
+	case eip.UDINT:
+		return binary.LittleEndian.Uint32(data), nil
+	default:
+		return int32(binary.LittleEndian.Uint32(data)), nil
+	}
+}
+
+// tagDataType returns the CIP type of a controller or virtual tag, by name
+// or alias, bits of integer tags are BOOL
+func tagDataType(name string) (types.UInt, bool) {
+	if _, _, ok := bitAddress(name); ok {
+		return eip.BOOL, true
+	}
+	name = resolveTagName(name)
+	if tag, ok := eipTagMap[name]; ok {
+		return tag.Type, true
+	}
+	if expr, ok := virtualTags[name]; ok {
+		return expr.dataType(), true
+	}
+	return 0, false
+}
+
+// browseTags describes every tag retrieved from the controller and the
+// virtual tags, sorted by name
+func browseTags() []ethernetIpTagInfo {
+	tags := make([]ethernetIpTagInfo, 0, len(eipTagMap))
+	for name, tag := range eipTagMap {
+		tags = append(tags, ethernetIpTagInfo{
+			Name:       name,
+			DataType:   eip.TypeMap[tag.Type&0x0fff],
+			TypeCode:   uint16(tag.Type),
+			Structure:  tag.Type&0x8000 != 0,
+			Dimensions: uint8((tag.Type & 0x6000) >> 13),
+			Units:      tagConfigs[name].units(),
+			Aliases:    aliasesByTag[name],
+		})
+	}
+	tags = append(tags, browseVirtualTags()...)
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags
+}
+
+func handleBrowseRequest(message *mqttTypes.Publish) {
+	mqttResp := ethernetIpBrowseResponseMQTTMessage{
+		Timestamp:    timeNow().UTC().Format(time.RFC3339),
+		Tags:         browseTags(),
+		Success:      true,
+		StatusCode:   0,
+		ErrorMessage: "",
+	}
+
+	publishPayload(adapterConfig.TopicRoot+"/"+browseTopic+"/response", mqttResp)
+}
+
+// rejectReadRequest answers a read request the scheduler rejected
+func rejectReadRequest(message *mqttTypes.Publish, err error) {
+	returnReadError(err.Error(), &ethernetIpReadResponseMQTTMessage{Data: make(map[string]ethernetIpReadResponseData)})
+}
+
+// rejectWriteRequest answers a write request the scheduler rejected
+func rejectWriteRequest(message *mqttTypes.Publish, err error) {
+	writeReq := ethernetIpWriteRequestMQTTMessage{}
+	decodePayload(message.Topic.Whole, message.Payload, &writeReq)
+	returnWriteError(err.Error(), &ethernetIpWriteResponseMQTTMessage{NodeID: writeReq.NodeID})
+}
+
+// rejectBrowseRequest answers a browse request the scheduler rejected
+func rejectBrowseRequest(message *mqttTypes.Publish, err error) {
+	publishPayload(adapterConfig.TopicRoot+"/"+browseTopic+"/response", ethernetIpBrowseResponseMQTTMessage{
+		Timestamp:    timeNow().UTC().Format(time.RFC3339),
+		Success:      false,
+		ErrorMessage: err.Error(),
+	})
+}
 
 // func getTagDataType(nodeid *ua.NodeID) (*ua.TypeID, error) {
 // 	log.Printf("[INFO] getTagDataType - checking type for node id: %s\n", nodeid.String())
@@ -505,27 +759,27 @@ func writeTag(tag *eip.Tag) {
 func returnReadError(errMsg string, resp *ethernetIpReadResponseMQTTMessage) {
 	resp.Success = false
 	resp.ErrorMessage = errMsg
-	resp.ServerTimestamp = time.Now().UTC().Format(time.RFC3339)
-	publishJson(adapterConfig.TopicRoot+"/"+readTopic+"/response", resp)
+	resp.ServerTimestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+readTopic+"/response", resp)
 }
 
 func returnWriteError(errMsg string, resp *ethernetIpWriteResponseMQTTMessage) {
 	resp.Success = false
 	resp.ErrorMessage = errMsg
-	resp.Timestamp = time.Now().UTC().Format(time.RFC3339)
-	publishJson(adapterConfig.TopicRoot+"/"+writeTopic+"/response", resp)
+	resp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", resp)
 }
 
-// Publishes data to a topic
-func publishJson(topic string, data interface{}) {
-	b, err := json.Marshal(data)
+// Publishes data to a topic using the payload encoding configured for it
+func publishPayload(topic string, data interface{}) {
+	b, err := codecForTopic(topic).Marshal(data)
 	if err != nil {
-		log.Printf("[ERROR] Failed to stringify JSON: %s\n", err.Error())
+		log.Printf("[ERROR] Failed to encode payload: %s\n", err.Error())
 		return
 	}
 
 	log.Printf("[DEBUG] publish - Publishing to topic %s\n", topic)
-	err = adapter_library.Publish(topic, b)
+	err = mqttClient.Publish(topic, b)
 	if err != nil {
 		log.Printf("[ERROR] Failed to publish MQTT message to topic %s: %s\n", topic, err.Error())
 	}
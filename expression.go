@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+)
+
+// Expressions combine controller tag values with
+//
+//	|| && ! == != < <= > >= + - * / % ( )
+//	min(a, b, ...) max(a, b, ...) avg(a, b, ...) abs(x) round(x)
+//	true false and numeric literals
+//
+// Values are either float64 or bool. Numbers are true when non-zero and
+// booleans count as 1 or 0 in arithmetic. Tag names may contain letters,
+// digits, _ . : [ and ]. They must name a whole controller tag, such as the
+// program scoped Program:Main.Speed, structure members and array elements
+// like Program:Main.Pump[2].Speed are rejected by initializeVirtualTags.
+
+var errDivisionByZero = errors.New("division by zero")
+
+// tagExpression is a parsed virtual tag expression
+type tagExpression struct {
+	source string
+	root   exprNode
+	tags   []string
+}
+
+// exprLookup returns the current value of a controller tag
+type exprLookup func(name string) (interface{}, error)
+
+type exprNode interface {
+	eval(lookup exprLookup) (interface{}, error)
+	// boolean reports whether the node evaluates to a bool
+	boolean() bool
+}
+
+func parseExpression(source string) (*tagExpression, error) {
+	p := &exprParser{src: source}
+	p.next()
+	root, err := p.parseOr()
+	if p.err != nil {
+		err = p.err
+	} else if err == nil && p.tok.kind != exprEOF {
+		err = p.errorf("unexpected %q", p.tok.text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0, len(p.tags))
+	for name := range p.tags {
+		tags = append(tags, name)
+	}
+	sort.Strings(tags)
+	return &tagExpression{source: source, root: root, tags: tags}, nil
+}
+
+// eval returns a bool for boolean expressions and a float64 otherwise
+func (e *tagExpression) eval(lookup exprLookup) (interface{}, error) {
+	v, err := e.root.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	if e.boolean() {
+		return exprToBool(v), nil
+	}
+	return exprToNumber(v), nil
+}
+
+func (e *tagExpression) boolean() bool {
+	return e.root.boolean()
+}
+
+const (
+	exprEOF = iota
+	exprNumberToken
+	exprIdent
+	exprOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+type exprParser struct {
+	src  string
+	pos  int
+	tok  exprToken
+	err  error
+	tags map[string]bool
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("expression %q at %d: %s", p.src, p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9' || c == '.' || c == ':' || c == '[' || c == ']'
+}
+
+// next advances to the following token, p.err is set on invalid input
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = exprToken{kind: exprEOF, pos: start}
+		return
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.' ||
+			p.src[p.pos] == 'e' || p.src[p.pos] == 'E' ||
+			(p.src[p.pos] == '-' || p.src[p.pos] == '+') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')) {
+			p.pos++
+		}
+		p.tok = exprToken{kind: exprNumberToken, text: p.src[start:p.pos], pos: start}
+	case isIdentStart(c):
+		for p.pos < len(p.src) && isIdentPart(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = exprToken{kind: exprIdent, text: p.src[start:p.pos], pos: start}
+	default:
+		op := p.src[p.pos : p.pos+1]
+		if p.pos+1 < len(p.src) && exprOperators[p.src[p.pos:p.pos+2]] {
+			op = p.src[p.pos : p.pos+2]
+		}
+		p.tok = exprToken{kind: exprOp, text: op, pos: start}
+		if !exprOperators[op] {
+			p.err = p.errorf("unexpected %q", op)
+			p.tok.kind = exprEOF
+			p.pos = len(p.src)
+			return
+		}
+		p.pos += len(op)
+	}
+}
+
+var exprOperators = map[string]bool{
+	"||": true, "&&": true, "==": true, "!=": true, "<=": true, ">=": true,
+	"!": true, "<": true, ">": true, "+": true, "-": true, "*": true, "/": true, "%": true,
+	"(": true, ")": true, ",": true,
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	if p.tok.kind != exprOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBinary parses a left associative chain of the operators ops
+func (p *exprParser) parseBinary(operand func() (exprNode, error), ops ...string) (exprNode, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(ops...) {
+		op := p.tok.text
+		p.next()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		x = &exprBinary{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinary(p.parseEquality, "&&")
+}
+
+func (p *exprParser) parseEquality() (exprNode, error) {
+	return p.parseBinary(p.parseComparison, "==", "!=")
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	return p.parseBinary(p.parseSum, "<", "<=", ">", ">=")
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!", "-") {
+		op := p.tok.text
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op: op, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	tok := p.tok
+	switch tok.kind {
+	case exprNumberToken:
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", tok.text)
+		}
+		p.next()
+		return exprNumber(v), nil
+	case exprIdent:
+		p.next()
+		switch {
+		case tok.text == "true" || tok.text == "false":
+			return exprBool(tok.text == "true"), nil
+		case p.isOp("("):
+			return p.parseCall(tok)
+		}
+		if p.tags == nil {
+			p.tags = map[string]bool{}
+		}
+		p.tags[tok.text] = true
+		return exprTag(tok.text), nil
+	case exprOp:
+		if tok.text == "(" {
+			p.next()
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOp(")") {
+				return nil, p.errorf("missing )")
+			}
+			p.next()
+			return x, nil
+		}
+	}
+
+	if tok.kind == exprEOF {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	arity, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("expression %q at %d: unknown function %s", p.src, name.pos, name.text)
+	}
+
+	call := &exprCall{fn: name.text}
+	p.next()
+	for !p.isOp(")") {
+		if len(call.args) > 0 {
+			if !p.isOp(",") {
+				return nil, p.errorf("expected , or )")
+			}
+			p.next()
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.next()
+
+	if arity > 0 && len(call.args) != arity || arity == 0 && len(call.args) == 0 {
+		return nil, fmt.Errorf("expression %q at %d: wrong number of arguments for %s", p.src, name.pos, name.text)
+	}
+	return call, nil
+}
+
+// exprFunctions maps the function names to their number of arguments, 0 for
+// one or more
+var exprFunctions = map[string]int{
+	"min":   0,
+	"max":   0,
+	"avg":   0,
+	"abs":   1,
+	"round": 1,
+}
+
+type exprNumber float64
+
+func (n exprNumber) eval(exprLookup) (interface{}, error) { return float64(n), nil }
+func (n exprNumber) boolean() bool                        { return false }
+
+type exprBool bool
+
+func (b exprBool) eval(exprLookup) (interface{}, error) { return bool(b), nil }
+func (b exprBool) boolean() bool                        { return true }
+
+type exprTag string
+
+func (t exprTag) eval(lookup exprLookup) (interface{}, error) {
+	value, err := lookup(string(t))
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		return v, nil
+	case int32:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	}
+	return nil, fmt.Errorf("%w: tag %s value %v is not a number or bool", errInvalidValue, t, value)
+}
+
+func (t exprTag) boolean() bool {
+	tag, ok := eipTagMap[string(t)]
+	return ok && tag.Type == eip.BOOL
+}
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+func (u *exprUnary) eval(lookup exprLookup) (interface{}, error) {
+	x, err := u.x.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	if u.op == "!" {
+		return !exprToBool(x), nil
+	}
+	return -exprToNumber(x), nil
+}
+
+func (u *exprUnary) boolean() bool { return u.op == "!" }
+
+type exprBinary struct {
+	op   string
+	x, y exprNode
+}
+
+func (b *exprBinary) eval(lookup exprLookup) (interface{}, error) {
+	x, err := b.x.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || do not evaluate the right hand side when not needed
+	switch b.op {
+	case "&&":
+		if !exprToBool(x) {
+			return false, nil
+		}
+	case "||":
+		if exprToBool(x) {
+			return true, nil
+		}
+	}
+
+	y, err := b.y.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b.op {
+	case "&&", "||":
+		return exprToBool(y), nil
+	case "==", "!=":
+		var equal bool
+		if xb, ok := x.(bool); ok {
+			equal = xb == exprToBool(y)
+		} else if yb, ok := y.(bool); ok {
+			equal = yb == exprToBool(x)
+		} else {
+			equal = exprToNumber(x) == exprToNumber(y)
+		}
+		return equal == (b.op == "=="), nil
+	}
+
+	xf, yf := exprToNumber(x), exprToNumber(y)
+	switch b.op {
+	case "<":
+		return xf < yf, nil
+	case "<=":
+		return xf <= yf, nil
+	case ">":
+		return xf > yf, nil
+	case ">=":
+		return xf >= yf, nil
+	case "+":
+		return xf + yf, nil
+	case "-":
+		return xf - yf, nil
+	case "*":
+		return xf * yf, nil
+	case "/":
+		if yf == 0 {
+			return nil, errDivisionByZero
+		}
+		return xf / yf, nil
+	default: // %
+		if yf == 0 {
+			return nil, errDivisionByZero
+		}
+		return math.Mod(xf, yf), nil
+	}
+}
+
+func (b *exprBinary) boolean() bool {
+	switch b.op {
+	case "+", "-", "*", "/", "%":
+		return false
+	}
+	return true
+}
+
+type exprCall struct {
+	fn   string
+	args []exprNode
+}
+
+func (c *exprCall) eval(lookup exprLookup) (interface{}, error) {
+	values := make([]float64, len(c.args))
+	for i, arg := range c.args {
+		v, err := arg.eval(lookup)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = exprToNumber(v)
+	}
+
+	switch c.fn {
+	case "abs":
+		return math.Abs(values[0]), nil
+	case "round":
+		return math.Round(values[0]), nil
+	case "avg":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), nil
+	}
+
+	result := values[0]
+	for _, v := range values[1:] {
+		if c.fn == "min" {
+			result = math.Min(result, v)
+		} else {
+			result = math.Max(result, v)
+		}
+	}
+	return result, nil
+}
+
+func (c *exprCall) boolean() bool { return false }
+
+func exprToBool(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return v.(float64) != 0
+}
+
+func exprToNumber(v interface{}) float64 {
+	if b, ok := v.(bool); ok {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	return v.(float64)
+}
@@ -3,17 +3,20 @@ module ethernet-ip-go-adapter
 go 1.18
 
 require (
+	github.com/clearblade/Go-SDK v0.0.0-20220811134357-78291979ad51
 	github.com/clearblade/adapter-go-library v0.0.3-0.20220923194251-ad52825a6f7c
 	github.com/clearblade/mqtt_parsing v0.0.0-20160301165118-6ae49eac0961
-	github.com/gopcua/opcua v0.3.5
+	github.com/clearblade/paho.mqtt.golang v1.1.1
+	github.com/eclipse/paho.golang v0.11.0
+	github.com/hashicorp/logutils v1.0.0
 	github.com/loki-os/go-ethernet-ip v0.0.0-20220811072340-e18e9c6def34
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/clearblade/Go-SDK v0.0.0-20220811134357-78291979ad51 // indirect
 	github.com/clearblade/go-utils v1.1.4 // indirect
-	github.com/clearblade/paho.mqtt.golang v1.1.1 // indirect
-	github.com/hashicorp/logutils v1.0.0 // indirect
+	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	golang.org/x/net v0.0.0-20211101193420-4a448f8816b3 // indirect
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a // indirect
 )
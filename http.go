@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// startHTTPServer serves the local REST API used during commissioning
+func startHTTPServer() {
+	if adapterSettings.HTTPBearerToken == "" {
+		log.Fatalln("[FATAL] startHTTPServer - http_bearer_token is required when http_port is set")
+	}
+
+	addr := fmt.Sprintf(":%d", adapterSettings.HTTPPort)
+	log.Printf("[INFO] startHTTPServer - Starting REST API on %s\n", addr)
+
+	err := http.ListenAndServe(addr, newHTTPHandler(adapterSettings.HTTPBearerToken))
+	if err != nil {
+		log.Fatalf("[FATAL] startHTTPServer - REST API stopped: %s\n", err.Error())
+	}
+}
+
+// newHTTPHandler routes the REST API:
+//
+//	GET  /tags         - browse the controller tags
+//	GET  /tags/{name}  - read a tag
+//	PUT  /tags/{name}  - write a tag, body {"value": ...}
+//	POST /read         - read multiple tags, body {"tags": [...]}
+//	GET  /status       - adapter and controller connection status
+func newHTTPHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tags", httpMethod(http.MethodGet, handleHTTPBrowse))
+	mux.HandleFunc("/tags/", handleHTTPTag)
+	mux.HandleFunc("/read", httpMethod(http.MethodPost, handleHTTPRead))
+	mux.HandleFunc("/status", httpMethod(http.MethodGet, handleHTTPStatus))
+	return requireBearerToken(token, mux)
+}
+
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeHTTPError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func httpMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func handleHTTPTag(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/tags/")
+	switch r.Method {
+	case http.MethodGet:
+		var maxAge uint64
+		if v := r.URL.Query().Get("max_age_ms"); v != "" {
+			var err error
+			if maxAge, err = strconv.ParseUint(v, 10, 32); err != nil {
+				writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("invalid max_age_ms %q", v))
+				return
+			}
+		}
+		httpReadTags(w, []string{name}, time.Duration(maxAge)*time.Millisecond)
+	case http.MethodPut:
+		handleHTTPWrite(w, r, name)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func handleHTTPBrowse(w http.ResponseWriter, r *http.Request) {
+	writeHTTPJson(w, http.StatusOK, ethernetIpBrowseResponseMQTTMessage{
+		Timestamp:    timeNow().UTC().Format(time.RFC3339),
+		Tags:         browseTags(),
+		Success:      true,
+		StatusCode:   0,
+		ErrorMessage: "",
+	})
+}
+
+func handleHTTPRead(w http.ResponseWriter, r *http.Request) {
+	readReq := ethernetIpReadRequestMQTTMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&readReq); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpReadTags(w, readReq.Tags, time.Duration(readReq.MaxAge)*time.Millisecond)
+}
+
+func httpReadTags(w http.ResponseWriter, names []string, maxAge time.Duration) {
+	resp := ethernetIpReadResponseMQTTMessage{
+		ServerTimestamp: timeNow().UTC().Format(time.RFC3339),
+		Data:            make(map[string]ethernetIpReadResponseData),
+		Success:         true,
+	}
+
+	err := scheduler.do(priorityRead, func() error {
+		return readTagsMaxAge(names, resp.Data, maxAge)
+	})
+	if err != nil {
+		resp.Success = false
+		resp.ErrorMessage = err.Error()
+		writeHTTPJson(w, httpErrorStatus(err), resp)
+		return
+	}
+	writeHTTPJson(w, http.StatusOK, resp)
+}
+
+func handleHTTPWrite(w http.ResponseWriter, r *http.Request, name string) {
+	resp := ethernetIpWriteResponseMQTTMessage{
+		NodeID:    name,
+		Timestamp: timeNow().UTC().Format(time.RFC3339),
+		Success:   true,
+	}
+
+	writeReq := ethernetIpWriteRequestMQTTMessage{}
+	err := json.NewDecoder(r.Body).Decode(&writeReq)
+	if err == nil {
+		err = scheduler.do(priorityWrite, func() error {
+			return auditedWrite(name, writeReq.Value, writeReq.User, auditSourceHTTP)
+		})
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] handleHTTPWrite - Failed to write tag %s: %s\n", name, err.Error())
+		resp.Success = false
+		resp.ErrorMessage = err.Error()
+		writeHTTPJson(w, httpErrorStatus(err), resp)
+		return
+	}
+
+	if writeReq.Verify {
+		verified, observed := verifyWrite(name, writeReq.Value)
+		resp.Verified, resp.ObservedValue = &verified, observed
+	}
+	writeHTTPJson(w, http.StatusOK, resp)
+}
+
+func handleHTTPStatus(w http.ResponseWriter, r *http.Request) {
+	status := ethernetIpStatusResponse{
+		Timestamp: timeNow().UTC().Format(time.RFC3339),
+		Endpoint:  fmt.Sprintf("%s:%d", adapterSettings.EndpointIp, adapterSettings.EndpointPort),
+		Connected: controllerConnected(),
+		TagCount:  len(eipTagMap),
+	}
+	if outboundQueue != nil {
+		status.OutboundQueue = outboundQueue.status()
+	}
+	writeHTTPJson(w, http.StatusOK, status)
+}
+
+func httpErrorStatus(err error) int {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, errTagNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errUnsupportedType):
+		return http.StatusNotImplemented
+	case errors.Is(err, errReadOnlyTag), errors.Is(err, errSelectRequired):
+		return http.StatusForbidden
+	case errors.Is(err, errWriteRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errQueueFull), errors.Is(err, errRequestTimeout):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errInvalidValue), errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, errMsg string) {
+	writeHTTPJson(w, status, map[string]interface{}{"success": false, "error_message": errMsg})
+}
+
+func writeHTTPJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("[ERROR] Failed to write HTTP response: %s\n", err.Error())
+	}
+}
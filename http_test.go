@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testBearerToken = "commissioning"
+
+func httpRequest(t *testing.T, server *httptest.Server, method string, path string, token string, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func compactJSON(t *testing.T, s string) string {
+	t.Helper()
+
+	b := new(bytes.Buffer)
+	if err := json.Compact(b, []byte(s)); err != nil {
+		t.Fatalf("invalid expected JSON: %s", err.Error())
+	}
+	return b.String()
+}
+
+func TestHTTPAPI(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addDINT("Setpoint", 10)
+	startTestAdapter(t, sim)
+
+	server := httptest.NewServer(newHTTPHandler(testBearerToken))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		status   int
+		expected string
+	}{
+		{
+			name: "missing token", method: http.MethodGet, path: "/tags", token: "",
+			status: http.StatusUnauthorized, expected: `{"error_message":"missing or invalid bearer token","success":false}`,
+		},
+		{
+			name: "wrong token", method: http.MethodGet, path: "/status", token: "guess",
+			status: http.StatusUnauthorized, expected: `{"error_message":"missing or invalid bearer token","success":false}`,
+		},
+		{
+			name: "browse", method: http.MethodGet, path: "/tags", token: testBearerToken,
+			status: http.StatusOK, expected: `{"timestamp":"2022-09-01T12:30:00Z","tags":[
+				{"name":"Counter","data_type":"DINT","type_code":196,"structure":false,"dimensions":0},
+				{"name":"Setpoint","data_type":"DINT","type_code":196,"structure":false,"dimensions":0}
+			],"success":true,"status_code":0,"error_message":""}`,
+		},
+		{
+			name: "read tag", method: http.MethodGet, path: "/tags/Counter", token: testBearerToken,
+			status: http.StatusOK, expected: `{"server_timestamp":"2022-09-01T12:30:00Z","data":{
+				"Counter":{"value":42,"source_timestamp":"2022-09-01T12:30:00Z"}
+			},"success":true,"status_code":0,"error_message":""}`,
+		},
+		{
+			name: "read unknown tag", method: http.MethodGet, path: "/tags/Missing", token: testBearerToken,
+			status: http.StatusNotFound, expected: `{"server_timestamp":"2022-09-01T12:30:00Z","data":{},
+				"success":false,"status_code":0,"error_message":"tag does not exist: Missing"}`,
+		},
+		{
+			name: "write tag", method: http.MethodPut, path: "/tags/Setpoint", token: testBearerToken, body: `{"value": 99}`,
+			status: http.StatusOK, expected: `{"node_id":"Setpoint","timestamp":"2022-09-01T12:30:00Z",
+				"success":true,"status_code":0,"error_message":""}`,
+		},
+		{
+			name: "write invalid value", method: http.MethodPut, path: "/tags/Setpoint", token: testBearerToken, body: `{"value": "high"}`,
+			status: http.StatusBadRequest, expected: `{"node_id":"Setpoint","timestamp":"2022-09-01T12:30:00Z",
+				"success":false,"status_code":0,"error_message":"invalid value for DINT tag: high"}`,
+		},
+		{
+			name: "batch read", method: http.MethodPost, path: "/read", token: testBearerToken, body: `{"tags": ["Counter", "Setpoint"]}`,
+			status: http.StatusOK, expected: `{"server_timestamp":"2022-09-01T12:30:00Z","data":{
+				"Counter":{"value":42,"source_timestamp":"2022-09-01T12:30:00Z"},
+				"Setpoint":{"value":99,"source_timestamp":"2022-09-01T12:30:00Z"}
+			},"success":true,"status_code":0,"error_message":""}`,
+		},
+		{
+			name: "batch read wrong method", method: http.MethodGet, path: "/read", token: testBearerToken,
+			status: http.StatusMethodNotAllowed, expected: `{"error_message":"method not allowed","success":false}`,
+		},
+		{
+			name: "status", method: http.MethodGet, path: "/status", token: testBearerToken,
+			status: http.StatusOK, expected: fmt.Sprintf(`{"timestamp":"2022-09-01T12:30:00Z",
+				"endpoint":"127.0.0.1:%d","connected":true,"tag_count":2}`, sim.port()),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := httpRequest(t, server, test.method, test.path, test.token, test.body)
+			if status != test.status {
+				t.Errorf("expected status %d, got %d", test.status, status)
+			}
+			if expected := compactJSON(t, test.expected); body != expected {
+				t.Errorf("unexpected body\nexpected: %s\n     got: %s", expected, body)
+			}
+		})
+	}
+}
+
+func TestHTTPStatusDisconnected(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	startTestAdapter(t, sim)
+
+	server := httptest.NewServer(newHTTPHandler(testBearerToken))
+	defer server.Close()
+
+	expectConnected := func(connected bool) {
+		t.Helper()
+		expected := compactJSON(t, fmt.Sprintf(`{"timestamp":"2022-09-01T12:30:00Z",
+			"endpoint":"127.0.0.1:%d","connected":%t,"tag_count":1}`, sim.port(), connected))
+		if _, body := httpRequest(t, server, http.MethodGet, "/status", testBearerToken, ""); body != expected {
+			t.Fatalf("unexpected body\nexpected: %s\n     got: %s", expected, body)
+		}
+	}
+
+	expectConnected(true)
+	sim.setOffline(true)
+	if status, _ := httpRequest(t, server, http.MethodGet, "/tags/Counter", testBearerToken, ""); status != http.StatusBadGateway {
+		t.Fatalf("expected the read to fail, got status %d", status)
+	}
+	expectConnected(false)
+
+	sim.setOffline(false)
+	if err := reconnectEIP(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expectConnected(true)
+}
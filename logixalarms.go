@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/messages/packet"
+	"github.com/loki-os/go-ethernet-ip/path"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+const (
+	controllerFaultEvent        = "controller_fault"
+	controllerFaultClearedEvent = "controller_fault_cleared"
+
+	controllerSourceName = "controller"
+
+	// data types of the ALMD and ALMA instruction tags
+	logixAlarmDigitalType = "ALARM_DIGITAL"
+	logixAlarmAnalogType  = "ALARM_ANALOG"
+)
+
+// logixAlarmConditions maps the member prefixes of the ALMD and ALMA
+// instructions, by data type, to the condition names used in alarm events.
+// ALMD has a single InAlarm/Acked pair, ALMA one per limit.
+var logixAlarmConditions = map[string]map[string]string{
+	logixAlarmDigitalType: {"": alarmDigital},
+	logixAlarmAnalogType: {
+		"HH":     alarmHiHi,
+		"H":      alarmHi,
+		"L":      alarmLo,
+		"LL":     alarmLoLo,
+		"ROCPos": "ROCPos",
+		"ROCNeg": "ROCNeg",
+	},
+}
+
+// controllerFaults are the fault bits of the identity object status word
+var controllerFaults = []struct {
+	mask      uint16
+	condition string
+	severity  uint32
+}{
+	{0x0100, "MinorRecoverable", 300},
+	{0x0200, "MinorUnrecoverable", 500},
+	{0x0400, "MajorRecoverable", 800},
+	{0x0800, "MajorUnrecoverable", 1000},
+}
+
+// logixAlarm is an ALMD or ALMA instruction tag, states holds the last
+// InAlarm and Acked values of each of its conditions
+type logixAlarm struct {
+	tag      string
+	template *cipTemplate
+	prefixes map[string]string
+	states   map[string]logixAlarmState
+
+	// progAck lists the ProgAck members to reset, the instruction only
+	// acknowledges on the rising edge
+	progAck []logixAlarmAck
+}
+
+// logixAlarmAck is a ProgAck member that was set on behalf of user
+type logixAlarmAck struct {
+	member string
+	user   string
+}
+
+type logixAlarmState struct {
+	inAlarm bool
+	acked   bool
+}
+
+// logixAlarmMonitor reads the alarm instruction tags and the controller
+// status after every poll and publishes their transitions as events
+type logixAlarmMonitor struct {
+	mu      sync.Mutex
+	alarms  map[string]*logixAlarm
+	faults  uint16
+	started bool
+}
+
+var logixAlarms *logixAlarmMonitor
+
+// initializeLogixAlarms finds the ALMD and ALMA tags by reading the templates
+// of the structure tags and registers the monitor with the poller
+func initializeLogixAlarms() error {
+	monitor := &logixAlarmMonitor{alarms: map[string]*logixAlarm{}}
+	templates := map[types.UInt]*cipTemplate{}
+
+	for name, tag := range eipTagMap {
+		if !isStructType(tag.Type) {
+			continue
+		}
+
+		template, ok := templates[tag.Type]
+		if !ok {
+			var err error
+			template, err = readTemplate(tag.Type)
+			if err != nil {
+				return err
+			}
+			templates[tag.Type] = template
+		}
+
+		prefixes, ok := logixAlarmConditions[template.name]
+		if !ok {
+			continue
+		}
+		monitor.alarms[name] = &logixAlarm{
+			tag:      name,
+			template: template,
+			prefixes: prefixes,
+			states:   map[string]logixAlarmState{},
+		}
+	}
+
+	log.Printf("[INFO] initializeLogixAlarms - Monitoring %d ALMD/ALMA tags and the controller status\n", len(monitor.alarms))
+	poller.addListener(monitor.handlePoll)
+	logixAlarms = monitor
+	return nil
+}
+
+func (m *logixAlarmMonitor) handlePoll(result pollResult) {
+	if result.err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checkFaults()
+
+	names := make([]string, 0, len(m.alarms))
+	for name := range m.alarms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := m.alarms[name].check(); err != nil {
+			log.Printf("[ERROR] handlePoll - Failed to read alarm %s: %s\n", name, err.Error())
+		}
+	}
+	m.started = true
+}
+
+// checkFaults publishes the changes of the fault bits in the controller's
+// identity status, the caller holds m.mu
+func (m *logixAlarmMonitor) checkFaults() {
+	status, err := readControllerStatus()
+	if err != nil {
+		log.Printf("[ERROR] checkFaults - Failed to read controller status: %s\n", err.Error())
+		return
+	}
+
+	for _, fault := range controllerFaults {
+		active, was := status&fault.mask != 0, m.faults&fault.mask != 0
+		switch {
+		case active && (!was || !m.started):
+			publishEvent(ethernetIpEventMessage{
+				EventType:  controllerFaultEvent,
+				Severity:   fault.severity,
+				Message:    fmt.Sprintf("Controller %s fault", fault.condition),
+				SourceName: controllerSourceName,
+				Condition:  fault.condition,
+			})
+		case !active && was:
+			publishEvent(ethernetIpEventMessage{
+				EventType:  controllerFaultClearedEvent,
+				Severity:   fault.severity,
+				Message:    fmt.Sprintf("Controller %s fault cleared", fault.condition),
+				SourceName: controllerSourceName,
+				Condition:  fault.condition,
+			})
+		}
+	}
+	m.faults = status
+}
+
+// readControllerStatus reads the status word of the identity object
+func readControllerStatus() (uint16, error) {
+	reply, err := sendCIP(packet.ServiceGetAttributeSingle, packet.Paths(
+		path.LogicalBuild(path.LogicalTypeClassID, 0x01, true),
+		path.LogicalBuild(path.LogicalTypeInstanceID, 0x01, true),
+		path.LogicalBuild(path.LogicalTypeAttributeID, 0x05, true),
+	), nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < 2 {
+		return 0, fmt.Errorf("short status reply")
+	}
+	return uint16(reply[0]) | uint16(reply[1])<<8, nil
+}
+
+// check reads the instruction and publishes the transitions of its
+// conditions. Alarms that are already active are published on the first
+// check after startup.
+func (a *logixAlarm) check() error {
+	for _, ack := range a.progAck {
+		if err := audited(a.tag+"."+ack.member, false, ack.user, auditSourceMQTT, ackWriter(false)); err != nil {
+			return err
+		}
+	}
+	a.progAck = nil
+
+	_, data, err := readSymbol(a.tag)
+	if err != nil {
+		return err
+	}
+
+	prefixes := make([]string, 0, len(a.prefixes))
+	for prefix := range a.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		inAlarm, ok := a.template.memberValue(data, prefix+"InAlarm")
+		if !ok {
+			continue
+		}
+		acked, _ := a.template.memberValue(data, prefix+"Acked")
+		state := logixAlarmState{}
+		state.inAlarm, _ = inAlarm.(bool)
+		state.acked, _ = acked.(bool)
+
+		previous, seen := a.states[prefix]
+		if !seen {
+			previous = logixAlarmState{acked: true}
+		}
+		a.states[prefix] = state
+
+		condition := a.prefixes[prefix]
+		severity, _ := a.template.memberValue(data, prefix+"Severity")
+		event := ethernetIpEventMessage{
+			SourceName: a.tag,
+			Condition:  condition,
+			State:      state.name(),
+		}
+		if s, ok := severity.(int32); ok && s > 0 {
+			event.Severity = uint32(s)
+		}
+
+		if state.inAlarm != previous.inAlarm {
+			event.EventType, event.Message = alarmEventActive, alarmName(a.tag, condition)
+			if !state.inAlarm {
+				event.EventType, event.Message = alarmEventCleared, alarmName(a.tag, condition)+" cleared"
+			}
+			publishEvent(event)
+		}
+		if state.acked && !previous.acked && seen {
+			event.EventType, event.Message = alarmEventAcknowledged, fmt.Sprintf("%s alarm acknowledged", a.tag)
+			publishEvent(event)
+		}
+	}
+	return nil
+}
+
+func (s logixAlarmState) name() string {
+	switch {
+	case s.inAlarm && !s.acked:
+		return alarmStateActiveUnacked
+	case s.inAlarm:
+		return alarmStateActiveAcked
+	case !s.acked:
+		return alarmStateClearedUnacked
+	}
+	return alarmStateNormal
+}
+
+// acknowledge writes the OperAck, or ProgAck, member of an ALMD. ALMA
+// conditions are acknowledged individually, e.g. HHOperAck, or all at once
+// through OperAckAll when condition is empty. ALMD only has the Alarm
+// condition. The acknowledged event is
+// published once the controller reports the alarm as acknowledged.
+func (m *logixAlarmMonitor) acknowledge(tag string, condition string, progAck bool, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.alarms[tag]
+	if !ok {
+		return fmt.Errorf("%w: no alarm configured for %s", errTagNotFound, tag)
+	}
+
+	suffix := "OperAck"
+	if progAck {
+		suffix = "ProgAck"
+	}
+
+	member := suffix
+	if a.template.name == logixAlarmAnalogType {
+		member = suffix + "All"
+	}
+	if condition != "" {
+		member = ""
+		for prefix, name := range a.prefixes {
+			if name == condition {
+				member = prefix + suffix
+			}
+		}
+	}
+	if _, ok := a.template.members[member]; !ok || member == "" {
+		return fmt.Errorf("%w: %s has no %s condition", errInvalidValue, tag, condition)
+	}
+
+	if err := audited(a.tag+"."+member, true, user, auditSourceMQTT, ackWriter(true)); err != nil {
+		return err
+	}
+	if progAck {
+		a.progAck = append(a.progAck, logixAlarmAck{member: member, user: user})
+	}
+	return nil
+}
+
+// ackWriter returns the write function for the acknowledge members, the
+// write policy applies to them as to any tag. Like the reset of a pulse, the
+// ProgAck reset is not rate limited.
+func ackWriter(rateLimited bool) func(string, interface{}) error {
+	return func(name string, value interface{}) error {
+		if err := writePolicy.checkWrite(name, value, rateLimited); err != nil {
+			return err
+		}
+		data := []byte{0}
+		if set, _ := value.(bool); set {
+			data = []byte{1}
+		}
+		if err := writeSymbol(name, eip.BOOL, data); err != nil {
+			return err
+		}
+		writePolicy.record(name)
+		return nil
+	}
+}
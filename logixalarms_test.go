@@ -0,0 +1,127 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLogixAlarms(t *testing.T) {
+	sim := newSimController(t)
+	sim.addTemplate(0x100, "ALARM_DIGITAL", 8,
+		simMember{name: "ZZZZZZZZZZALMD0", dataType: 0xc2},
+		simMember{name: "InAlarm", dataType: 0xc1, info: 0},
+		simMember{name: "Acked", dataType: 0xc1, info: 1},
+		simMember{name: "OperAck", dataType: 0xc1, info: 2},
+		simMember{name: "ProgAck", dataType: 0xc1, info: 3},
+		simMember{name: "Severity", dataType: 0xc4, offset: 4},
+	)
+	sim.addTemplate(0x101, "ALARM_ANALOG", 8,
+		simMember{name: "ZZZZZZZZZZALMA0", dataType: 0xc2},
+		simMember{name: "HHInAlarm", dataType: 0xc1, info: 0},
+		simMember{name: "HHAcked", dataType: 0xc1, info: 1},
+		simMember{name: "HHOperAck", dataType: 0xc1, info: 2},
+		simMember{name: "HHProgAck", dataType: 0xc1, info: 3},
+		simMember{name: "OperAckAll", dataType: 0xc1, info: 4},
+		simMember{name: "HHSeverity", dataType: 0xc4, offset: 4},
+	)
+	sim.addTemplate(0x102, "Recipe", 4, simMember{name: "Speed", dataType: 0xc4})
+	sim.addTag("Pump1_Alarm", 0x8100, []byte{0x01, 0, 0, 0, 0xee, 0x02, 0, 0})
+	sim.addTag("Tank_Level", 0x8101, []byte{0x02, 0, 0, 0, 0x84, 0x03, 0, 0})
+	sim.addTag("Recipe1", 0x8102, []byte{0, 0, 0, 0})
+	sim.addDINT("Counter", 1)
+	transport := startTestAdapter(t, sim)
+
+	prevPoller, prevLogixAlarms := poller, logixAlarms
+	t.Cleanup(func() { poller, logixAlarms = prevPoller, prevLogixAlarms })
+	poller = &tagPoller{}
+	eventSeq = 0
+
+	if err := initializeLogixAlarms(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(logixAlarms.alarms) != 2 {
+		t.Fatalf("unexpected alarms %v", logixAlarms.alarms)
+	}
+
+	// alarms that are active at startup are published by the first poll
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-1", "event_type": "alarm_active", "severity": 750, "time": "2022-09-01T12:30:00Z", "message": "Pump1_Alarm alarm", "source_name": "Pump1_Alarm", "condition": "Alarm", "state": "active_unacked"}`)
+	transport.expectNone(t)
+
+	// acknowledgements are written to OperAck, the event follows once the
+	// instruction reports the alarm as acknowledged
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Pump1_Alarm", "user": "operator"}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Pump1_Alarm", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Pump1_Alarm")[0]; got != 0x05 {
+		t.Fatalf("unexpected alarm bits %#02x", got)
+	}
+	sim.setValue("Pump1_Alarm", []byte{0x03})
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-2", "event_type": "alarm_acknowledged", "severity": 750, "time": "2022-09-01T12:30:00Z", "message": "Pump1_Alarm alarm acknowledged", "source_name": "Pump1_Alarm", "condition": "Alarm", "state": "active_acked"}`)
+
+	sim.setValue("Pump1_Alarm", []byte{0x02})
+	sim.setValue("Tank_Level", []byte{0x01})
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-3", "event_type": "alarm_cleared", "severity": 750, "time": "2022-09-01T12:30:00Z", "message": "Pump1_Alarm alarm cleared", "source_name": "Pump1_Alarm", "condition": "Alarm", "state": "normal"}`)
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-4", "event_type": "alarm_active", "severity": 900, "time": "2022-09-01T12:30:00Z", "message": "Tank_Level HiHi alarm", "source_name": "Tank_Level", "condition": "HiHi", "state": "active_unacked"}`)
+
+	// ProgAck is reset after the next poll, the instruction acknowledges on
+	// the rising edge
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Tank_Level", "condition": "HiHi", "prog_ack": true}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Tank_Level", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Tank_Level")[0]; got != 0x09 {
+		t.Fatalf("unexpected alarm bits %#02x", got)
+	}
+	poller.poll()
+	if got := sim.value("Tank_Level")[0]; got != 0x01 {
+		t.Fatalf("unexpected alarm bits %#02x", got)
+	}
+
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Tank_Level"}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Tank_Level", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Tank_Level")[0]; got != 0x11 {
+		t.Fatalf("unexpected alarm bits %#02x", got)
+	}
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Tank_Level", "condition": "Lo"}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Tank_Level", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "invalid value: Tank_Level has no Lo condition"}`)
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Recipe1"}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Recipe1", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "tag does not exist: no alarm configured for Recipe1"}`)
+
+	// faults are read from the controller's identity status
+	sim.setStatus(0x0400)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-5", "event_type": "controller_fault", "severity": 800, "time": "2022-09-01T12:30:00Z", "message": "Controller MajorRecoverable fault", "source_name": "controller", "condition": "MajorRecoverable"}`)
+	sim.setStatus(0)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-6", "event_type": "controller_fault_cleared", "severity": 800, "time": "2022-09-01T12:30:00Z", "message": "Controller MajorRecoverable fault cleared", "source_name": "controller", "condition": "MajorRecoverable"}`)
+	transport.expectNone(t)
+
+	// acknowledgements are audited and subject to the write policy
+	prevAuditLog, prevPolicy := auditLog, writePolicy
+	t.Cleanup(func() { auditLog, writePolicy = prevAuditLog, prevPolicy })
+	adapterSettings.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	if err := initializeAuditLog(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	t.Cleanup(func() { auditLog.file.Close() })
+
+	sim.setValue("Pump1_Alarm", []byte{0x01})
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Pump1_Alarm", "user": "operator", "prog_ack": true}`)
+	transport.expect(t, testTopicRoot+"/audit", `{"timestamp": "2022-09-01T12:30:00Z", "user": "operator", "source": "mqtt", "tag": "Pump1_Alarm.ProgAck", "previous_value": null, "new_value": true, "success": true, "error_message": ""}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Pump1_Alarm", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	poller.poll()
+	transport.expect(t, testTopicRoot+"/audit", `{"timestamp": "2022-09-01T12:30:00Z", "user": "operator", "source": "mqtt", "tag": "Pump1_Alarm.ProgAck", "previous_value": null, "new_value": false, "success": true, "error_message": ""}`)
+	transport.expect(t, testTopicRoot+"/events", `{"event_id": "1662035400000-7", "event_type": "alarm_active", "severity": 750, "time": "2022-09-01T12:30:00Z", "message": "Pump1_Alarm alarm", "source_name": "Pump1_Alarm", "condition": "Alarm", "state": "active_unacked"}`)
+
+	adapterSettings.WritePolicy = &writePolicySettings{Deny: []string{"Pump1_*"}}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	transport.send(testTopicRoot+"/alarms/ack", `{"tag": "Pump1_Alarm", "user": "operator"}`)
+	transport.expect(t, testTopicRoot+"/audit", `{"timestamp": "2022-09-01T12:30:00Z", "user": "operator", "source": "mqtt", "tag": "Pump1_Alarm.OperAck", "previous_value": null, "new_value": true, "success": false, "error_message": "tag is read only: writes to Pump1_Alarm.OperAck are denied"}`)
+	transport.expect(t, testTopicRoot+"/alarms/ack/response", `{"tag": "Pump1_Alarm", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "tag is read only: writes to Pump1_Alarm.OperAck are denied"}`)
+	if got := sim.value("Pump1_Alarm")[0]; got != 0x01 {
+		t.Fatalf("unexpected alarm bits %#02x", got)
+	}
+	transport.expectNone(t)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+)
+
+const (
+	writeOperationPulse  = "pulse"
+	writeOperationToggle = "toggle"
+	writeOperationHold   = "hold"
+	writeOperationStop   = "stop"
+
+	defaultHoldInterval = 500
+
+	holdStateHolding  = "holding"
+	holdStateStopped  = "stopped"
+	holdStateTimedOut = "timed_out"
+)
+
+// heldWrite is a value that is written repeatedly until it is stopped or
+// times out
+type heldWrite struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+// heldWrites are the running holds by tag, a tag can only be held once at a
+// time
+var heldWrites = struct {
+	mu    sync.Mutex
+	holds map[string]*heldWrite
+}{holds: map[string]*heldWrite{}}
+
+// handleWriteOperation runs the pulse, toggle and hold operations in the
+// adapter, so their timing does not depend on the MQTT client
+func handleWriteOperation(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) {
+	var err error
+	switch writeReq.Operation {
+	case writeOperationPulse:
+		err = pulseTag(writeReq)
+		if err == nil {
+			// the pulse reports once it was reset
+			return
+		}
+	case writeOperationToggle:
+		err = toggleTag(writeReq, mqttResp)
+	case writeOperationHold:
+		err = holdTag(writeReq, mqttResp)
+	case writeOperationStop:
+		err = stopHold(writeReq.NodeID)
+		if err == nil {
+			// the hold reports that it stopped
+			return
+		}
+	default:
+		err = fmt.Errorf("%w: unknown write operation %s", errInvalidValue, writeReq.Operation)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to %s tag %s: %s\n", writeReq.Operation, writeReq.NodeID, err.Error())
+		returnWriteError(err.Error(), mqttResp)
+		return
+	}
+
+	log.Printf("[INFO] Ethernet-IP %s successful: %s\n", writeReq.Operation, writeReq.NodeID)
+	mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
+}
+
+// pulseTag writes the value, and the reset value duration_ms later. The
+// request's scheduler slot is released while the pulse waits, the reset is
+// scheduled as a write of its own.
+func pulseTag(writeReq ethernetIpWriteRequestMQTTMessage) error {
+	if writeReq.Duration == 0 {
+		return fmt.Errorf("%w: a pulse requires duration_ms", errInvalidValue)
+	}
+	reset, err := resetValue(writeReq)
+	if err != nil {
+		return err
+	}
+
+	if err := auditedWrite(writeReq.NodeID, writeReq.Value, writeReq.User, auditSourceMQTT); err != nil {
+		return err
+	}
+	go resetPulse(writeReq, reset)
+	return nil
+}
+
+// resetPulse writes the reset value once the pulse's duration_ms passed and
+// publishes the response
+func resetPulse(writeReq ethernetIpWriteRequestMQTTMessage, reset interface{}) {
+	mqttResp := ethernetIpWriteResponseMQTTMessage{NodeID: writeReq.NodeID, Success: true}
+	time.Sleep(time.Duration(writeReq.Duration) * time.Millisecond)
+
+	err := scheduler.do(priorityWrite, func() error {
+		return audited(writeReq.NodeID, reset, writeReq.User, auditSourceMQTT, repeatTag)
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to reset %s after the pulse: %w", writeReq.NodeID, err)
+		log.Printf("[ERROR] resetPulse - %s\n", err.Error())
+		returnWriteError(err.Error(), &mqttResp)
+		return
+	}
+
+	log.Printf("[INFO] resetPulse - Ethernet-IP pulse successful: %s\n", writeReq.NodeID)
+	mqttResp.Value = reset
+	mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
+}
+
+// toggleTag inverts a BOOL tag or a bit and reports the value written
+func toggleTag(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) error {
+	dataType, ok := tagDataType(writeReq.NodeID)
+	if !ok {
+		return fmt.Errorf("%w: %s", errTagNotFound, writeReq.NodeID)
+	}
+	if dataType != eip.BOOL {
+		return fmt.Errorf("%w: only BOOL tags can be toggled", errUnsupportedType)
+	}
+
+	data := map[string]ethernetIpReadResponseData{}
+	if err := readTags([]string{writeReq.NodeID}, data); err != nil {
+		return err
+	}
+	current, _ := data[writeReq.NodeID].Value.(bool)
+	value := !current
+	if err := auditedWrite(writeReq.NodeID, value, writeReq.User, auditSourceMQTT); err != nil {
+		return err
+	}
+	mqttResp.Value = value
+	return nil
+}
+
+// holdTag writes the value every interval_ms until the hold is stopped or
+// duration_ms has passed, then writes the reset value. The response is
+// published once the hold started, and again when it ends.
+func holdTag(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) error {
+	if writeReq.Duration == 0 {
+		return fmt.Errorf("%w: a hold requires duration_ms", errInvalidValue)
+	}
+	reset, err := resetValue(writeReq)
+	if err != nil {
+		return err
+	}
+	interval := writeReq.Interval
+	if interval == 0 {
+		interval = defaultHoldInterval
+	}
+
+	symbol := resolveTagName(writeReq.NodeID)
+	hold := &heldWrite{stop: make(chan struct{})}
+	heldWrites.mu.Lock()
+	if _, ok := heldWrites.holds[symbol]; ok {
+		heldWrites.mu.Unlock()
+		return fmt.Errorf("%s is already held", writeReq.NodeID)
+	}
+	heldWrites.holds[symbol] = hold
+	heldWrites.mu.Unlock()
+
+	if err := auditedWrite(writeReq.NodeID, writeReq.Value, writeReq.User, auditSourceMQTT); err != nil {
+		heldWrites.mu.Lock()
+		delete(heldWrites.holds, symbol)
+		heldWrites.mu.Unlock()
+		return err
+	}
+
+	go hold.run(writeReq, reset, time.Duration(interval)*time.Millisecond)
+	mqttResp.State = holdStateHolding
+	return nil
+}
+
+func (h *heldWrite) run(writeReq ethernetIpWriteRequestMQTTMessage, reset interface{}, interval time.Duration) {
+	mqttResp := ethernetIpWriteResponseMQTTMessage{NodeID: writeReq.NodeID, Success: true}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(time.Duration(writeReq.Duration) * time.Millisecond)
+	defer timeout.Stop()
+
+	var err error
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			err = scheduler.do(priorityWrite, func() error {
+				return repeatTag(writeReq.NodeID, writeReq.Value)
+			})
+			if err != nil {
+				err = fmt.Errorf("hold of %s failed: %w", writeReq.NodeID, err)
+				break loop
+			}
+		case <-h.stop:
+			mqttResp.State = holdStateStopped
+			break loop
+		case <-timeout.C:
+			mqttResp.State = holdStateTimedOut
+			break loop
+		}
+	}
+
+	heldWrites.mu.Lock()
+	delete(heldWrites.holds, resolveTagName(writeReq.NodeID))
+	heldWrites.mu.Unlock()
+
+	resetErr := scheduler.do(priorityWrite, func() error {
+		return audited(writeReq.NodeID, reset, writeReq.User, auditSourceMQTT, repeatTag)
+	})
+	if resetErr != nil && err == nil {
+		err = fmt.Errorf("failed to reset %s after the hold: %w", writeReq.NodeID, resetErr)
+	}
+	if err != nil {
+		log.Printf("[ERROR] run - %s\n", err.Error())
+		returnWriteError(err.Error(), &mqttResp)
+		return
+	}
+
+	log.Printf("[INFO] run - Hold of %s %s\n", writeReq.NodeID, mqttResp.State)
+	mqttResp.Value = reset
+	mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
+}
+
+// stopHold ends the hold of a tag
+func stopHold(name string) error {
+	heldWrites.mu.Lock()
+	hold, ok := heldWrites.holds[resolveTagName(name)]
+	heldWrites.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s is not held", errInvalidValue, name)
+	}
+	hold.once.Do(func() { close(hold.stop) })
+	return nil
+}
+
+// repeatTag writes the value of a hold again or the reset value of a pulse
+// or hold, the write policy applies except for the rate limit
+func repeatTag(name string, value interface{}) error {
+	if writePolicy.selectRequired(name) {
+		return fmt.Errorf("%w: %s is critical", errSelectRequired, name)
+	}
+	if err := writePolicy.checkRepeat(name, value); err != nil {
+		return err
+	}
+	if err := writeTagValue(name, value); err != nil {
+		return err
+	}
+	writePolicy.record(name)
+	return nil
+}
+
+// resetValue is the reset_value of the request, false for BOOL tags and 0
+// for the others when it is not given
+func resetValue(writeReq ethernetIpWriteRequestMQTTMessage) (interface{}, error) {
+	if writeReq.ResetValue != nil {
+		return writeReq.ResetValue, nil
+	}
+	dataType, ok := tagDataType(writeReq.NodeID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errTagNotFound, writeReq.NodeID)
+	}
+	if dataType == eip.BOOL {
+		return false, nil
+	}
+	return float64(0), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWriteOperations(t *testing.T) {
+	sim := newSimController(t)
+	sim.addTag("Start_PB", 0xc1, []byte{0})
+	sim.addTag("Light", 0xc1, []byte{0})
+	sim.addDINT("Jog", 0)
+	transport := startTestAdapter(t, sim)
+
+	waitForValue := func(name string, expected []byte) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !bytes.Equal(sim.value(name), expected) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s to become % x, got % x", name, expected, sim.value(name))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// BOOL tags are written and read as true and false
+	transport.send(testTopicRoot+"/write", `{"node_id": "Light", "value": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Light", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	transport.send(testTopicRoot+"/read", `{"tags": ["Light"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{"server_timestamp": "2022-09-01T12:30:00Z", "data": {"Light": {"value": true, "source_timestamp": "2022-09-01T12:30:00Z"}}, "success": true, "status_code": 0, "error_message": ""}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Start_PB", "value": true, "operation": "pulse", "duration_ms": 100}`)
+	waitForValue("Start_PB", []byte{1})
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Start_PB", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "value": false}`)
+	if got := sim.value("Start_PB"); !bytes.Equal(got, []byte{0}) {
+		t.Fatalf("pulse was not reset: % x", got)
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Start_PB", "value": true, "operation": "pulse"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Start_PB", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "invalid value: a pulse requires duration_ms"}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Light", "operation": "toggle"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Light", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "value": false}`)
+	if got := sim.value("Light"); !bytes.Equal(got, []byte{0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "operation": "toggle"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Jog", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "unsupported data type: only BOOL tags can be toggled"}`)
+
+	// a held value is written again until the hold is stopped
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "value": 1, "operation": "hold", "duration_ms": 5000, "interval_ms": 10}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Jog", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "state": "holding"}`)
+	sim.setValue("Jog", []byte{0, 0, 0, 0})
+	waitForValue("Jog", []byte{1, 0, 0, 0})
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "value": 1, "operation": "hold", "duration_ms": 5000}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Jog", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "Jog is already held"}`)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "operation": "stop"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Jog", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "state": "stopped", "value": 0}`)
+	if got := sim.value("Jog"); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Fatalf("hold was not reset: % x", got)
+	}
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "value": 1, "reset_value": 2, "operation": "hold", "duration_ms": 50}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Jog", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "state": "holding"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Jog", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "state": "timed_out", "value": 2}`)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "operation": "stop"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Jog", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "invalid value: Jog is not held"}`)
+
+	// the reset is not rate limited, a pulse or hold never leaves the tag set
+	prevPolicy := writePolicy
+	t.Cleanup(func() { writePolicy = prevPolicy })
+	adapterSettings.WritePolicy = &writePolicySettings{TagLimits: map[string]*tagWriteLimits{
+		"Start_PB": {MinInterval: 1000},
+		"Jog":      {MinInterval: 1000},
+	}}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Start_PB", "value": true, "operation": "pulse", "duration_ms": 10}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Start_PB", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "value": false}`)
+	if got := sim.value("Start_PB"); !bytes.Equal(got, []byte{0}) {
+		t.Fatalf("pulse was not reset: % x", got)
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Start_PB", "value": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Start_PB", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "write rate limit exceeded: Start_PB was written less than 1000 ms ago"}`)
+
+	// nor are the rewrites of a hold, with the clock running
+	timeNow = time.Now
+	expectState := func(state string) {
+		t.Helper()
+		msg := transport.next(t, testTopicRoot+"/write/response")
+		resp := ethernetIpWriteResponseMQTTMessage{}
+		if err := json.Unmarshal(msg.payload, &resp); err != nil || !resp.Success || resp.State != state {
+			t.Fatalf("expected the hold to be %s, got %s", state, msg.payload)
+		}
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "value": 1, "operation": "hold", "duration_ms": 5000, "interval_ms": 20}`)
+	expectState(holdStateHolding)
+	for i := 0; i < 3; i++ {
+		sim.setValue("Jog", []byte{0, 0, 0, 0})
+		waitForValue("Jog", []byte{1, 0, 0, 0})
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Jog", "operation": "stop"}`)
+	expectState(holdStateStopped)
+	if got := sim.value("Jog"); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Fatalf("hold was not reset: % x", got)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MessagePack, https://github.com/msgpack/msgpack/blob/master/spec.md
+//
+// Like CBOR, messages are encoded from the maps and values of their JSON
+// encoding with the map keys sorted.
+
+var errMsgpackTruncated = errors.New("msgpack payload truncated")
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &msgpackEncoder{}
+	if err := e.encode(generic); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	d := &msgpackDecoder{buf: data}
+	generic := d.decode()
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = errors.New("unexpected data after msgpack payload")
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return fromGeneric(generic, v)
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+// bigEndian appends the low size bytes of n
+func (e *msgpackEncoder) bigEndian(n uint64, size int) {
+	for i := (size - 1) * 8; i >= 0; i -= 8 {
+		e.buf = append(e.buf, byte(n>>i))
+	}
+}
+
+// head appends a length prefixed type, fix is the fixed format for short
+// lengths and formats the 8, 16 and 32 bit length formats (0 when absent)
+func (e *msgpackEncoder) head(n int, fix byte, fixMax int, formats [3]byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint8 && formats[0] != 0:
+		e.buf = append(e.buf, formats[0], byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, formats[1])
+		e.bigEndian(uint64(n), 2)
+	default:
+		e.buf = append(e.buf, formats[2])
+		e.bigEndian(uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encode(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if v {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			e.int(i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		e.float(f)
+	case int64:
+		e.int(v)
+	case float64:
+		e.float(v)
+	case string:
+		e.head(len(v), 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb})
+		e.buf = append(e.buf, v...)
+	case []interface{}:
+		e.head(len(v), 0x90, 15, [3]byte{0, 0xdc, 0xdd})
+		for _, item := range v {
+			if err := e.encode(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.head(len(v), 0x80, 15, [3]byte{0, 0xde, 0xdf})
+		for _, key := range keys {
+			e.encode(key)
+			if err := e.encode(v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode %T as msgpack", v)
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) int(i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		e.buf = append(e.buf, byte(i))
+	case i < 0 && i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.bigEndian(uint64(i), 2)
+	case i >= 0 && i <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.bigEndian(uint64(i), 4)
+	case i >= 0:
+		e.buf = append(e.buf, 0xcf)
+		e.bigEndian(uint64(i), 8)
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.bigEndian(uint64(i), 2)
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.bigEndian(uint64(i), 4)
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.bigEndian(uint64(i), 8)
+	}
+}
+
+func (e *msgpackEncoder) float(f float64) {
+	e.buf = append(e.buf, 0xcb)
+	e.bigEndian(math.Float64bits(f), 8)
+}
+
+// msgpackDecoder decodes a single object into maps, slices and scalars.
+// Errors are sticky, extension types are not supported.
+type msgpackDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *msgpackDecoder) take(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < n {
+		d.err = errMsgpackTruncated
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *msgpackDecoder) uint(size uint64) uint64 {
+	var n uint64
+	for _, c := range d.take(size) {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+func (d *msgpackDecoder) decode() interface{} {
+	b := d.take(1)
+	if d.err != nil {
+		return nil
+	}
+	format := b[0]
+
+	switch {
+	case format <= 0x7f:
+		return int64(format)
+	case format >= 0xe0:
+		return int64(int8(format))
+	case format <= 0x8f:
+		return d.decodeMap(uint64(format & 0x0f))
+	case format <= 0x9f:
+		return d.decodeArray(uint64(format & 0x0f))
+	case format <= 0xbf:
+		return string(d.take(uint64(format & 0x1f)))
+	}
+
+	switch format {
+	case 0xc0:
+		return nil
+	case 0xc2:
+		return false
+	case 0xc3:
+		return true
+	case 0xc4, 0xc5, 0xc6:
+		return d.take(d.uint(1 << (format - 0xc4)))
+	case 0xca:
+		return float64(math.Float32frombits(uint32(d.uint(4))))
+	case 0xcb:
+		return math.Float64frombits(d.uint(8))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (format - 0xcc))
+	case 0xd0:
+		return int64(int8(d.uint(1)))
+	case 0xd1:
+		return int64(int16(d.uint(2)))
+	case 0xd2:
+		return int64(int32(d.uint(4)))
+	case 0xd3:
+		return int64(d.uint(8))
+	case 0xd9, 0xda, 0xdb:
+		return string(d.take(d.uint(1 << (format - 0xd9))))
+	case 0xdc, 0xdd:
+		return d.decodeArray(d.uint(2 << (format - 0xdc)))
+	case 0xde, 0xdf:
+		return d.decodeMap(d.uint(2 << (format - 0xde)))
+	}
+
+	d.err = fmt.Errorf("unsupported msgpack format %#02x", format)
+	return nil
+}
+
+func (d *msgpackDecoder) decodeArray(n uint64) []interface{} {
+	items := make([]interface{}, 0)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		items = append(items, d.decode())
+	}
+	return items
+}
+
+func (d *msgpackDecoder) decodeMap(n uint64) map[string]interface{} {
+	m := make(map[string]interface{})
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		key, ok := d.decode().(string)
+		if !ok && d.err == nil {
+			d.err = errors.New("msgpack map keys must be strings")
+		}
+		m[key] = d.decode()
+	}
+	return m
+}
@@ -0,0 +1,1275 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The embedded OPC UA server implements the UA TCP binary protocol with
+// SecurityPolicy None. Sessions are anonymous and read only, or, when writes
+// are enabled, authenticated as opcua_username and allowed to write. It
+// supports the discovery, session, view and attribute services clients need
+// to browse the tags and to read and write them. Subscriptions are not
+// supported, clients poll with Read and may pass a MaxAge to be served from
+// the read cache.
+
+const (
+	opcuaSecurityPolicyNone = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	opcuaTransportProfile   = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+	opcuaAnonymousPolicyID  = "anonymous"
+	opcuaUserNamePolicyID   = "username"
+	opcuaBufferSize         = 65535
+	opcuaMinBufferSize      = 8192
+	opcuaMaxMessageSize     = 16 * 1024 * 1024
+	opcuaChunkHeaderSize    = 24
+	opcuaDefaultLifetime    = 60 * 60 * 1000
+	opcuaMinSessionTimeout  = 10 * time.Second
+	opcuaMaxSessionTimeout  = time.Hour
+	opcuaNonceLength        = 32
+)
+
+// Binary encoding ids of the service requests and responses
+const (
+	uaIDAnonymousIdentityToken    = 321
+	uaIDUserNameIdentityToken     = 324
+	uaIDServiceFault              = 397
+	uaIDFindServersRequest        = 422
+	uaIDFindServersResponse       = 425
+	uaIDGetEndpointsRequest       = 428
+	uaIDGetEndpointsResponse      = 431
+	uaIDOpenSecureChannelRequest  = 446
+	uaIDOpenSecureChannelResponse = 449
+	uaIDCloseSecureChannelRequest = 452
+	uaIDCreateSessionRequest      = 461
+	uaIDCreateSessionResponse     = 464
+	uaIDActivateSessionRequest    = 467
+	uaIDActivateSessionResponse   = 470
+	uaIDCloseSessionRequest       = 473
+	uaIDCloseSessionResponse      = 476
+	uaIDBrowseRequest             = 527
+	uaIDBrowseResponse            = 530
+	uaIDBrowseNextRequest         = 533
+	uaIDBrowseNextResponse        = 536
+	uaIDTranslateBrowsePathsReq   = 554
+	uaIDTranslateBrowsePathsResp  = 557
+	uaIDReadRequest               = 631
+	uaIDReadResponse              = 634
+	uaIDWriteRequest              = 673
+	uaIDWriteResponse             = 676
+)
+
+// Session state a service requires
+const (
+	opcuaNoSession = iota
+	opcuaSessionCreated
+	opcuaSessionActivated
+)
+
+var errOPCUAChannelClosed = errors.New("secure channel closed")
+
+type opcuaService struct {
+	response uint32
+	session  int
+	handle   func(c *opcuaChannel, sess *opcuaSession, d *uaDecoder, e *uaEncoder) error
+}
+
+var opcuaServices = map[uint32]opcuaService{
+	uaIDFindServersRequest:      {uaIDFindServersResponse, opcuaNoSession, (*opcuaChannel).findServers},
+	uaIDGetEndpointsRequest:     {uaIDGetEndpointsResponse, opcuaNoSession, (*opcuaChannel).getEndpoints},
+	uaIDCreateSessionRequest:    {uaIDCreateSessionResponse, opcuaNoSession, (*opcuaChannel).createSession},
+	uaIDActivateSessionRequest:  {uaIDActivateSessionResponse, opcuaSessionCreated, (*opcuaChannel).activateSession},
+	uaIDCloseSessionRequest:     {uaIDCloseSessionResponse, opcuaSessionCreated, (*opcuaChannel).closeSession},
+	uaIDBrowseRequest:           {uaIDBrowseResponse, opcuaSessionActivated, (*opcuaChannel).browse},
+	uaIDBrowseNextRequest:       {uaIDBrowseNextResponse, opcuaSessionActivated, (*opcuaChannel).browseNext},
+	uaIDTranslateBrowsePathsReq: {uaIDTranslateBrowsePathsResp, opcuaSessionActivated, (*opcuaChannel).translateBrowsePaths},
+	uaIDReadRequest:             {uaIDReadResponse, opcuaSessionActivated, (*opcuaChannel).read},
+	uaIDWriteRequest:            {uaIDWriteResponse, opcuaSessionActivated, (*opcuaChannel).write},
+}
+
+type opcuaServer struct {
+	space *opcuaAddressSpace
+
+	mutex     sync.Mutex
+	sessions  map[uaNodeID]*opcuaSession
+	lastID    uint32
+	startTime time.Time
+}
+
+type opcuaSession struct {
+	id                 uaNodeID
+	activated          bool
+	user               string
+	timeout            time.Duration
+	lastUsed           time.Time
+	continuationPoints map[string]*opcuaContinuationPoint
+}
+
+type opcuaContinuationPoint struct {
+	references []uaReferenceDescription
+	max        int
+}
+
+type uaReferenceDescription struct {
+	ReferenceType  uaNodeID
+	IsForward      bool
+	Target         uaNodeID
+	BrowseName     uaQualifiedName
+	DisplayName    uaLocalizedText
+	NodeClass      uint32
+	TypeDefinition uaNodeID
+}
+
+type uaRequestHeader struct {
+	AuthenticationToken uaNodeID
+	RequestHandle       uint32
+}
+
+// validateOPCUASettings checks writes are only enabled together with the
+// credentials of the user allowed to write
+func validateOPCUASettings() error {
+	if adapterSettings.OPCUAWritesEnabled && (adapterSettings.OPCUAUsername == "" || adapterSettings.OPCUAPassword == "") {
+		return fmt.Errorf("opcua_writes_enabled requires opcua_username and opcua_password")
+	}
+	return nil
+}
+
+// startOPCUAServer serves the controller tags to OPC UA clients
+func startOPCUAServer() {
+	addr := net.JoinHostPort(adapterSettings.OPCUABindAddress, strconv.Itoa(int(adapterSettings.OPCUAPort)))
+	log.Printf("[INFO] startOPCUAServer - Starting OPC UA server on %s\n", addr)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("[FATAL] startOPCUAServer - Failed to listen on %s: %s\n", addr, err.Error())
+	}
+
+	err = newOPCUAServer().serve(listener)
+	if err != nil {
+		log.Fatalf("[FATAL] startOPCUAServer - OPC UA server stopped: %s\n", err.Error())
+	}
+}
+
+func newOPCUAServer() *opcuaServer {
+	startTime := timeNow().UTC()
+	return &opcuaServer{
+		space:     newOPCUAAddressSpace(eipTagMap, startTime),
+		sessions:  make(map[uaNodeID]*opcuaSession),
+		startTime: startTime,
+	}
+}
+
+func (s *opcuaServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *opcuaServer) nextID() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastID++
+	return s.lastID
+}
+
+// opcuaChannel is a client connection and the secure channel opened over it
+type opcuaChannel struct {
+	server         *opcuaServer
+	conn           net.Conn
+	helloReceived  bool
+	endpointURL    string
+	sendBufferSize uint32
+	id             uint32
+	tokenID        uint32
+	sequence       uint32
+	partial        []byte
+}
+
+func (s *opcuaServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	log.Printf("[INFO] handleOPCUAConnection - Client connected from %s\n", conn.RemoteAddr())
+
+	c := &opcuaChannel{server: s, conn: conn}
+	for {
+		msgType, chunkType, body, err := readOPCUAChunk(conn)
+		if err == nil {
+			err = c.handleChunk(msgType, chunkType, body)
+		}
+
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, io.EOF), errors.Is(err, errOPCUAChannelClosed):
+			log.Printf("[INFO] handleOPCUAConnection - Client %s disconnected\n", conn.RemoteAddr())
+		default:
+			log.Printf("[ERROR] handleOPCUAConnection - Closing connection from %s: %s\n", conn.RemoteAddr(), err.Error())
+			status := uaStatusBadTCPMessageTypeInvalid
+			errors.As(err, &status)
+			c.sendError(status, err.Error())
+		}
+		return
+	}
+}
+
+// readOPCUAChunk reads one message chunk, returning its type, chunk type and
+// the bytes following the 8 byte message header
+func readOPCUAChunk(r io.Reader) (string, byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[4:])
+	if size < 8 || size > opcuaBufferSize {
+		return "", 0, nil, fmt.Errorf("invalid message size %d", size)
+	}
+
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", 0, nil, err
+	}
+	return string(header[:3]), header[3], body, nil
+}
+
+func (c *opcuaChannel) handleChunk(msgType string, chunkType byte, body []byte) error {
+	d := &uaDecoder{buf: body}
+
+	switch msgType {
+	case "HEL":
+		if c.helloReceived {
+			return fmt.Errorf("unexpected hello message")
+		}
+		return c.hello(d)
+	case "OPN":
+		if !c.helloReceived {
+			return fmt.Errorf("secure channel opened before hello")
+		}
+		return c.openSecureChannel(d)
+	case "CLO":
+		return errOPCUAChannelClosed
+	case "MSG":
+		if c.id == 0 {
+			return fmt.Errorf("message received before the secure channel was opened")
+		}
+		if channelID := d.uint32(); channelID != c.id {
+			return uaStatusBadSecureChannelIDInvalid
+		}
+		d.uint32() // token id
+		d.uint32() // sequence number
+		requestID := d.uint32()
+		if d.err != nil {
+			return d.err
+		}
+
+		switch chunkType {
+		case 'C':
+			c.partial = append(c.partial, d.buf...)
+			if len(c.partial) > opcuaMaxMessageSize {
+				return fmt.Errorf("message exceeds %d bytes", opcuaMaxMessageSize)
+			}
+			return nil
+		case 'A':
+			c.partial = nil
+			return nil
+		}
+
+		message := append(c.partial, d.buf...)
+		c.partial = nil
+		return c.dispatch(requestID, message)
+	default:
+		return fmt.Errorf("%w: %s", uaStatusBadTCPMessageTypeInvalid, msgType)
+	}
+}
+
+func (c *opcuaChannel) hello(d *uaDecoder) error {
+	d.uint32() // protocol version
+	receiveBufferSize := d.uint32()
+	sendBufferSize := d.uint32()
+	d.uint32() // max message size
+	d.uint32() // max chunk count
+	c.endpointURL = d.string()
+	if d.err != nil {
+		return d.err
+	}
+
+	if receiveBufferSize < opcuaMinBufferSize || sendBufferSize < opcuaMinBufferSize {
+		return fmt.Errorf("buffer sizes must be at least %d bytes", opcuaMinBufferSize)
+	}
+
+	c.helloReceived = true
+	c.sendBufferSize = minUint32(receiveBufferSize, opcuaBufferSize)
+
+	e := &uaEncoder{}
+	e.uint32(0)
+	e.uint32(minUint32(sendBufferSize, opcuaBufferSize))
+	e.uint32(c.sendBufferSize)
+	e.uint32(opcuaMaxMessageSize)
+	e.uint32(0)
+	return c.writeChunk("ACK", 'F', e.bytes())
+}
+
+func (c *opcuaChannel) openSecureChannel(d *uaDecoder) error {
+	d.uint32() // channel id
+	policy := d.string()
+	d.byteString() // sender certificate
+	d.byteString() // receiver certificate thumbprint
+	d.uint32()     // sequence number
+	requestID := d.uint32()
+
+	typeID := d.nodeID()
+	header := decodeRequestHeader(d)
+	d.uint32() // client protocol version
+	requestType := d.uint32()
+	securityMode := d.uint32()
+	d.byteString() // client nonce
+	lifetime := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+
+	if typeID != uaNumericID(uaIDOpenSecureChannelRequest) {
+		return fmt.Errorf("%w: expected OpenSecureChannel, got %s", uaStatusBadTCPMessageTypeInvalid, typeID)
+	}
+	if policy != opcuaSecurityPolicyNone || securityMode != 1 {
+		return fmt.Errorf("%w: only %s is supported", uaStatusBadSecurityPolicyRejected, opcuaSecurityPolicyNone)
+	}
+
+	// request type 0 issues a new channel, 1 renews the token
+	if requestType == 0 {
+		c.id = c.server.nextID()
+	}
+	c.tokenID++
+	if lifetime == 0 {
+		lifetime = opcuaDefaultLifetime
+	}
+
+	e := &uaEncoder{}
+	e.uint32(c.id)
+	e.string(opcuaSecurityPolicyNone)
+	e.byteString(nil)
+	e.byteString(nil)
+	e.uint32(c.nextSequence())
+	e.uint32(requestID)
+	e.nodeID(uaNumericID(uaIDOpenSecureChannelResponse))
+	encodeResponseHeader(e, header.RequestHandle, uaStatusGood)
+	e.uint32(0) // server protocol version
+	e.uint32(c.id)
+	e.uint32(c.tokenID)
+	e.dateTime(timeNow())
+	e.uint32(lifetime)
+	e.byteString([]byte{})
+	return c.writeChunk("OPN", 'F', e.bytes())
+}
+
+// dispatch decodes a service request and sends the response, or a
+// ServiceFault when the service fails as a whole
+func (c *opcuaChannel) dispatch(requestID uint32, message []byte) error {
+	d := &uaDecoder{buf: message}
+	typeID := d.nodeID()
+	header := decodeRequestHeader(d)
+	if d.err != nil {
+		return c.sendFault(requestID, header.RequestHandle, uaStatusBadDecodingError)
+	}
+
+	if typeID == uaNumericID(uaIDCloseSecureChannelRequest) {
+		return errOPCUAChannelClosed
+	}
+
+	service, ok := opcuaServices[typeID.ID]
+	if !ok || typeID.Namespace != 0 {
+		log.Printf("[DEBUG] dispatch - Unsupported OPC UA service %s\n", typeID)
+		return c.sendFault(requestID, header.RequestHandle, uaStatusBadServiceUnsupported)
+	}
+
+	sess, err := c.server.session(header.AuthenticationToken, service.session)
+	if err == nil {
+		body := &uaEncoder{}
+		if err = service.handle(c, sess, d, body); err == nil {
+			e := &uaEncoder{}
+			e.nodeID(uaNumericID(service.response))
+			encodeResponseHeader(e, header.RequestHandle, uaStatusGood)
+			e.raw(body.bytes())
+			return c.sendMessage(requestID, e.bytes())
+		}
+	}
+
+	status := uaStatusBadInternalError
+	if !errors.As(err, &status) {
+		log.Printf("[ERROR] dispatch - OPC UA service %s failed: %s\n", typeID, err.Error())
+	}
+	return c.sendFault(requestID, header.RequestHandle, status)
+}
+
+func decodeRequestHeader(d *uaDecoder) uaRequestHeader {
+	header := uaRequestHeader{AuthenticationToken: d.nodeID()}
+	d.dateTime()
+	header.RequestHandle = d.uint32()
+	d.uint32() // return diagnostics
+	d.string() // audit entry id
+	d.uint32() // timeout hint
+	d.extensionObject()
+	return header
+}
+
+func encodeResponseHeader(e *uaEncoder, requestHandle uint32, status uaStatusCode) {
+	e.dateTime(timeNow())
+	e.uint32(requestHandle)
+	e.uint32(uint32(status))
+	e.byte(0)  // service diagnostics
+	e.int32(0) // string table
+	e.extensionObject(nil)
+}
+
+func (c *opcuaChannel) sendFault(requestID uint32, requestHandle uint32, status uaStatusCode) error {
+	e := &uaEncoder{}
+	e.nodeID(uaNumericID(uaIDServiceFault))
+	encodeResponseHeader(e, requestHandle, status)
+	return c.sendMessage(requestID, e.bytes())
+}
+
+// sendMessage splits a response into chunks that fit the client's receive buffer
+func (c *opcuaChannel) sendMessage(requestID uint32, message []byte) error {
+	maxBody := int(c.sendBufferSize) - opcuaChunkHeaderSize
+	for {
+		chunkType := byte('F')
+		body := message
+		if len(body) > maxBody {
+			chunkType = 'C'
+			body = message[:maxBody]
+		}
+		message = message[len(body):]
+
+		e := &uaEncoder{}
+		e.uint32(c.id)
+		e.uint32(c.tokenID)
+		e.uint32(c.nextSequence())
+		e.uint32(requestID)
+		e.raw(body)
+		if err := c.writeChunk("MSG", chunkType, e.bytes()); err != nil {
+			return err
+		}
+		if chunkType == 'F' {
+			return nil
+		}
+	}
+}
+
+func (c *opcuaChannel) sendError(status uaStatusCode, reason string) {
+	e := &uaEncoder{}
+	e.uint32(uint32(status))
+	e.string(reason)
+	c.writeChunk("ERR", 'F', e.bytes())
+}
+
+func (c *opcuaChannel) writeChunk(msgType string, chunkType byte, body []byte) error {
+	e := &uaEncoder{}
+	e.raw([]byte(msgType))
+	e.byte(chunkType)
+	e.uint32(uint32(len(body) + 8))
+	e.raw(body)
+	_, err := c.conn.Write(e.bytes())
+	return err
+}
+
+func (c *opcuaChannel) nextSequence() uint32 {
+	c.sequence++
+	return c.sequence
+}
+
+func (c *opcuaChannel) endpoint(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if c.endpointURL != "" {
+		return c.endpointURL
+	}
+	return "opc.tcp://" + c.conn.LocalAddr().String()
+}
+
+func encodeApplicationDescription(e *uaEncoder, discoveryURL string) {
+	e.string(opcuaApplicationURI)
+	e.string(opcuaApplicationURI)
+	e.localizedText("EtherNet/IP Adapter")
+	e.uint32(0) // server
+	e.string("")
+	e.string("")
+	e.stringArray([]string{discoveryURL})
+}
+
+func encodeEndpointDescription(e *uaEncoder, url string) {
+	e.string(url)
+	encodeApplicationDescription(e, url)
+	e.byteString(nil) // server certificate
+	e.uint32(1)       // security mode None
+	e.string(opcuaSecurityPolicyNone)
+	if adapterSettings.OPCUAWritesEnabled {
+		e.int32(2)
+		encodeUserTokenPolicy(e, opcuaAnonymousPolicyID, 0)
+		encodeUserTokenPolicy(e, opcuaUserNamePolicyID, 1)
+	} else {
+		e.int32(1)
+		encodeUserTokenPolicy(e, opcuaAnonymousPolicyID, 0)
+	}
+	e.string(opcuaTransportProfile)
+	e.byte(0)
+}
+
+// encodeUserTokenPolicy encodes a token policy of the endpoint's security
+// policy, tokenType 0 is anonymous and 1 user name
+func encodeUserTokenPolicy(e *uaEncoder, id string, tokenType uint32) {
+	e.string(id)
+	e.uint32(tokenType)
+	e.string("")
+	e.string("")
+	e.string("")
+}
+
+func (c *opcuaChannel) findServers(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	url := d.string()
+	d.stringArray() // locale ids
+	d.stringArray() // server uris
+	if d.err != nil {
+		return d.err
+	}
+
+	e.int32(1)
+	encodeApplicationDescription(e, c.endpoint(url))
+	return nil
+}
+
+func (c *opcuaChannel) getEndpoints(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	url := d.string()
+	d.stringArray() // locale ids
+	d.stringArray() // profile uris
+	if d.err != nil {
+		return d.err
+	}
+
+	e.int32(1)
+	encodeEndpointDescription(e, c.endpoint(url))
+	return nil
+}
+
+func (c *opcuaChannel) createSession(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	// client description
+	d.string()
+	d.string()
+	d.localizedText()
+	d.uint32()
+	d.string()
+	d.string()
+	d.stringArray()
+
+	d.string() // server uri
+	url := d.string()
+	name := d.string()
+	d.byteString() // client nonce
+	d.byteString() // client certificate
+	requestedTimeout := time.Duration(d.double() * float64(time.Millisecond))
+	d.uint32() // max response message size
+	if d.err != nil {
+		return d.err
+	}
+
+	sess, token := c.server.createSession(requestedTimeout)
+	log.Printf("[INFO] createSession - Created OPC UA session %q for %s\n", name, c.conn.RemoteAddr())
+
+	e.nodeID(sess.id)
+	e.nodeID(token)
+	e.double(float64(sess.timeout / time.Millisecond))
+	e.byteString(newOPCUANonce())
+	e.byteString(nil) // server certificate
+	e.int32(1)
+	encodeEndpointDescription(e, c.endpoint(url))
+	e.int32(0) // server software certificates
+	e.string("")
+	e.byteString(nil)
+	e.uint32(opcuaMaxMessageSize)
+	return nil
+}
+
+func (c *opcuaChannel) activateSession(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	d.string()     // client signature algorithm
+	d.byteString() // client signature
+	for i := d.arrayLength(); i > 0 && d.err == nil; i-- {
+		d.byteString() // software certificate
+		d.byteString()
+	}
+	d.stringArray() // locale ids
+	token := d.extensionObject()
+	d.string()     // user token signature algorithm
+	d.byteString() // user token signature
+	if d.err != nil {
+		return d.err
+	}
+
+	user, err := authenticateOPCUAUser(token)
+	if err != nil {
+		return err
+	}
+
+	c.server.mutex.Lock()
+	sess.activated = true
+	sess.user = user
+	c.server.mutex.Unlock()
+
+	e.byteString(newOPCUANonce())
+	e.int32(0) // results
+	e.emptyDiagnostics()
+	return nil
+}
+
+// authenticateOPCUAUser returns the user of a user name identity token, or
+// an empty user for an anonymous one. User names are only accepted when
+// writes are enabled. The password is sent in plain text under
+// SecurityPolicy None.
+func authenticateOPCUAUser(token *uaExtensionObject) (string, error) {
+	switch {
+	case token == nil, token.TypeID == uaNumericID(uaIDAnonymousIdentityToken):
+		return "", nil
+	case token.TypeID != uaNumericID(uaIDUserNameIdentityToken) || !adapterSettings.OPCUAWritesEnabled:
+		return "", uaStatusBadIdentityTokenInvalid
+	}
+
+	d := &uaDecoder{buf: token.Body}
+	d.string() // policy id
+	user := d.string()
+	password := d.byteString()
+	algorithm := d.string()
+	if d.err != nil || algorithm != "" {
+		return "", uaStatusBadIdentityTokenInvalid
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(adapterSettings.OPCUAUsername)) == 1
+	passwordOK := subtle.ConstantTimeCompare(password, []byte(adapterSettings.OPCUAPassword)) == 1
+	if !userOK || !passwordOK {
+		log.Printf("[ERROR] activateSession - Rejected OPC UA user %q\n", user)
+		return "", uaStatusBadUserAccessDenied
+	}
+	return user, nil
+}
+
+func (c *opcuaChannel) closeSession(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	d.boolean() // delete subscriptions
+	if d.err != nil {
+		return d.err
+	}
+	c.server.closeSession(sess)
+	return nil
+}
+
+func (c *opcuaChannel) browse(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	d.nodeID()   // view id
+	d.dateTime() // view timestamp
+	d.uint32()   // view version
+	max := int(d.uint32())
+
+	type browseDescription struct {
+		node            uaNodeID
+		direction       uint32
+		referenceType   uaNodeID
+		includeSubtypes bool
+		nodeClassMask   uint32
+		resultMask      uint32
+	}
+
+	descriptions := make([]browseDescription, d.arrayLength())
+	for i := range descriptions {
+		descriptions[i] = browseDescription{
+			node:            d.nodeID(),
+			direction:       d.uint32(),
+			referenceType:   d.nodeID(),
+			includeSubtypes: d.boolean(),
+			nodeClassMask:   d.uint32(),
+			resultMask:      d.uint32(),
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(descriptions) == 0 {
+		return uaStatusBadNothingToDo
+	}
+
+	e.int32(int32(len(descriptions)))
+	for _, desc := range descriptions {
+		references, status := c.server.browse(desc.node, desc.direction, desc.referenceType, desc.includeSubtypes, desc.nodeClassMask, desc.resultMask)
+		c.server.encodeBrowseResult(e, sess, status, references, max)
+	}
+	e.emptyDiagnostics()
+	return nil
+}
+
+func (c *opcuaChannel) browseNext(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	release := d.boolean()
+	n := d.arrayLength()
+	points := make([]string, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		points = append(points, string(d.byteString()))
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(points) == 0 {
+		return uaStatusBadNothingToDo
+	}
+
+	e.int32(int32(len(points)))
+	for _, point := range points {
+		c.server.mutex.Lock()
+		cp, ok := sess.continuationPoints[point]
+		delete(sess.continuationPoints, point)
+		c.server.mutex.Unlock()
+
+		switch {
+		case !ok:
+			c.server.encodeBrowseResult(e, sess, uaStatusBadContinuationPointInvalid, nil, 0)
+		case release:
+			c.server.encodeBrowseResult(e, sess, uaStatusGood, nil, 0)
+		default:
+			c.server.encodeBrowseResult(e, sess, uaStatusGood, cp.references, cp.max)
+		}
+	}
+	e.emptyDiagnostics()
+	return nil
+}
+
+func (c *opcuaChannel) translateBrowsePaths(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	type pathElement struct {
+		referenceType   uaNodeID
+		inverse         bool
+		includeSubtypes bool
+		name            uaQualifiedName
+	}
+	type browsePath struct {
+		start    uaNodeID
+		elements []pathElement
+	}
+
+	paths := make([]browsePath, d.arrayLength())
+	for i := range paths {
+		paths[i].start = d.nodeID()
+		paths[i].elements = make([]pathElement, d.arrayLength())
+		for j := range paths[i].elements {
+			paths[i].elements[j] = pathElement{
+				referenceType:   d.nodeID(),
+				inverse:         d.boolean(),
+				includeSubtypes: d.boolean(),
+				name:            d.qualifiedName(),
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(paths) == 0 {
+		return uaStatusBadNothingToDo
+	}
+
+	e.int32(int32(len(paths)))
+	for _, path := range paths {
+		status := uaStatusGood
+		current := []uaNodeID{path.start}
+
+		switch {
+		case c.server.space.node(path.start) == nil:
+			status, current = uaStatusBadNodeIDUnknown, nil
+		case len(path.elements) == 0:
+			status, current = uaStatusBadNothingToDo, nil
+		}
+
+		for _, element := range path.elements {
+			var next []uaNodeID
+			for _, id := range current {
+				for _, ref := range c.server.space.node(id).References {
+					target := c.server.space.node(ref.Target)
+					if ref.Forward == element.inverse || target == nil || target.BrowseName != element.name ||
+						!isReferenceSubtype(ref.Type, element.referenceType, element.includeSubtypes) {
+						continue
+					}
+					next = append(next, ref.Target)
+				}
+			}
+			current = next
+		}
+		if status == uaStatusGood && len(current) == 0 {
+			status = uaStatusBadNoMatch
+		}
+
+		e.uint32(uint32(status))
+		e.int32(int32(len(current)))
+		for _, id := range current {
+			e.expandedNodeID(id)
+			e.uint32(0xffffffff) // the whole path was followed
+		}
+	}
+	e.emptyDiagnostics()
+	return nil
+}
+
+func (c *opcuaChannel) read(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	maxAge := time.Duration(d.double() * float64(time.Millisecond))
+	timestamps := d.uint32()
+
+	type readValueID struct {
+		node       uaNodeID
+		attribute  uint32
+		indexRange string
+	}
+
+	nodes := make([]readValueID, d.arrayLength())
+	for i := range nodes {
+		nodes[i] = readValueID{node: d.nodeID(), attribute: d.uint32(), indexRange: d.string()}
+		d.qualifiedName() // data encoding
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(nodes) == 0 {
+		return uaStatusBadNothingToDo
+	}
+
+	e.int32(int32(len(nodes)))
+	for _, n := range nodes {
+		var dv uaDataValue
+		if n.indexRange != "" {
+			dv = uaDataValue{Status: uaStatusBadIndexRangeInvalid}
+		} else {
+			dv = c.server.readAttribute(sess, n.node, n.attribute, maxAge)
+		}
+
+		// TimestampsToReturn: 0 source, 1 server, 2 both, 3 neither
+		if timestamps == 1 || timestamps == 3 {
+			dv.SourceTimestamp = time.Time{}
+		}
+		if timestamps == 0 || timestamps == 3 {
+			dv.ServerTimestamp = time.Time{}
+		}
+		e.dataValue(dv)
+	}
+	e.emptyDiagnostics()
+	return nil
+}
+
+func (c *opcuaChannel) write(sess *opcuaSession, d *uaDecoder, e *uaEncoder) error {
+	type writeValue struct {
+		node       uaNodeID
+		attribute  uint32
+		indexRange string
+		value      uaDataValue
+	}
+
+	values := make([]writeValue, d.arrayLength())
+	for i := range values {
+		values[i] = writeValue{node: d.nodeID(), attribute: d.uint32(), indexRange: d.string(), value: d.dataValue()}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(values) == 0 {
+		return uaStatusBadNothingToDo
+	}
+
+	e.int32(int32(len(values)))
+	for _, v := range values {
+		status := uaStatusBadIndexRangeInvalid
+		if v.indexRange == "" {
+			status = c.server.writeAttribute(sess, v.node, v.attribute, v.value.Value)
+		}
+		e.uint32(uint32(status))
+	}
+	e.emptyDiagnostics()
+	return nil
+}
+
+func (s *opcuaServer) createSession(requestedTimeout time.Duration) (*opcuaSession, uaNodeID) {
+	timeout := requestedTimeout
+	if timeout < opcuaMinSessionTimeout {
+		timeout = opcuaMinSessionTimeout
+	} else if timeout > opcuaMaxSessionTimeout {
+		timeout = opcuaMaxSessionTimeout
+	}
+
+	id := s.nextID()
+	token := uaNodeID{Namespace: opcuaAdapterNamespace, Kind: uaNodeIDByteString, Name: hex.EncodeToString(newOPCUANonce())}
+	sess := &opcuaSession{
+		id:                 uaNodeID{Namespace: opcuaAdapterNamespace, Kind: uaNodeIDNumeric, ID: id},
+		timeout:            timeout,
+		lastUsed:           timeNow(),
+		continuationPoints: make(map[string]*opcuaContinuationPoint),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for t, existing := range s.sessions {
+		if timeNow().Sub(existing.lastUsed) > existing.timeout {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = sess
+	return sess, token
+}
+
+// session finds the session for an authentication token and checks it is in
+// the state the service requires
+func (s *opcuaServer) session(token uaNodeID, required int) (*opcuaSession, error) {
+	if required == opcuaNoSession {
+		return nil, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[token]
+	if ok && timeNow().Sub(sess.lastUsed) > sess.timeout {
+		delete(s.sessions, token)
+		ok = false
+	}
+	if !ok {
+		return nil, uaStatusBadSessionIDInvalid
+	}
+	if required == opcuaSessionActivated && !sess.activated {
+		return nil, uaStatusBadSessionNotActivated
+	}
+
+	sess.lastUsed = timeNow()
+	return sess, nil
+}
+
+func (s *opcuaServer) closeSession(sess *opcuaSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for token, existing := range s.sessions {
+		if existing == sess {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// browse lists the references of a node matching a BrowseDescription
+func (s *opcuaServer) browse(id uaNodeID, direction uint32, referenceType uaNodeID, includeSubtypes bool, nodeClassMask uint32, resultMask uint32) ([]uaReferenceDescription, uaStatusCode) {
+	node := s.space.node(id)
+	if node == nil {
+		return nil, uaStatusBadNodeIDUnknown
+	}
+
+	references := []uaReferenceDescription{}
+	for _, ref := range node.References {
+		// BrowseDirection: 0 forward, 1 inverse, 2 both
+		if direction == 0 && !ref.Forward || direction == 1 && ref.Forward {
+			continue
+		}
+		if !isReferenceSubtype(ref.Type, referenceType, includeSubtypes) {
+			continue
+		}
+
+		desc := uaReferenceDescription{Target: ref.Target}
+		target := s.space.node(ref.Target)
+		if target != nil {
+			if nodeClassMask != 0 && nodeClassMask&target.Class == 0 {
+				continue
+			}
+			if resultMask&0x04 != 0 {
+				desc.NodeClass = target.Class
+			}
+			if resultMask&0x08 != 0 {
+				desc.BrowseName = target.BrowseName
+			}
+			if resultMask&0x10 != 0 {
+				desc.DisplayName = target.DisplayName
+			}
+			if resultMask&0x20 != 0 {
+				desc.TypeDefinition = target.TypeDefinition
+			}
+		}
+		if resultMask&0x01 != 0 {
+			desc.ReferenceType = ref.Type
+		}
+		if resultMask&0x02 != 0 {
+			desc.IsForward = ref.Forward
+		}
+		references = append(references, desc)
+	}
+	return references, uaStatusGood
+}
+
+// encodeBrowseResult encodes up to max references, keeping the remainder
+// behind a continuation point for BrowseNext
+func (s *opcuaServer) encodeBrowseResult(e *uaEncoder, sess *opcuaSession, status uaStatusCode, references []uaReferenceDescription, max int) {
+	var point []byte
+	if max > 0 && len(references) > max {
+		point = newOPCUANonce()[:16]
+		s.mutex.Lock()
+		sess.continuationPoints[string(point)] = &opcuaContinuationPoint{references: references[max:], max: max}
+		s.mutex.Unlock()
+		references = references[:max]
+	}
+
+	e.uint32(uint32(status))
+	e.byteString(point)
+	if references == nil {
+		e.int32(0)
+		return
+	}
+	e.int32(int32(len(references)))
+	for _, ref := range references {
+		e.nodeID(ref.ReferenceType)
+		e.boolean(ref.IsForward)
+		e.expandedNodeID(ref.Target)
+		e.qualifiedName(ref.BrowseName)
+		e.localizedText(ref.DisplayName)
+		e.uint32(ref.NodeClass)
+		e.expandedNodeID(ref.TypeDefinition)
+	}
+}
+
+func (s *opcuaServer) readAttribute(sess *opcuaSession, id uaNodeID, attribute uint32, maxAge time.Duration) uaDataValue {
+	node := s.space.node(id)
+	if node == nil {
+		return uaDataValue{Status: uaStatusBadNodeIDUnknown}
+	}
+
+	var value interface{}
+	switch attribute {
+	case uaAttrNodeID:
+		value = node.ID
+	case uaAttrNodeClass:
+		value = int32(node.Class)
+	case uaAttrBrowseName:
+		value = node.BrowseName
+	case uaAttrDisplayName:
+		value = node.DisplayName
+	case uaAttrDescription:
+		value = uaLocalizedText("")
+	case uaAttrWriteMask, uaAttrUserWriteMask:
+		value = uint32(0)
+	}
+	if value != nil {
+		return uaDataValue{Value: value, ServerTimestamp: timeNow()}
+	}
+
+	switch node.Class {
+	case uaNodeClassObject:
+		if attribute == uaAttrEventNotifier {
+			value = byte(0)
+		}
+	case uaNodeClassObjectType, uaNodeClassVariableType, uaNodeClassReferenceType, uaNodeClassDataType:
+		if attribute == uaAttrIsAbstract {
+			value = false
+		}
+	case uaNodeClassVariable:
+		switch attribute {
+		case uaAttrValue:
+			return s.readValue(node, maxAge)
+		case uaAttrDataType:
+			value = node.DataType
+		case uaAttrValueRank:
+			value = node.ValueRank
+		case uaAttrArrayDimensions:
+			if node.ValueRank > 0 {
+				value = make([]uint32, node.ValueRank)
+			}
+		case uaAttrAccessLevel:
+			value = node.AccessLevel
+		case uaAttrUserAccessLevel:
+			value = node.AccessLevel
+			if sess.user == "" {
+				value = byte(opcuaAccessRead)
+			}
+		case uaAttrMinimumSamplingInterval:
+			value = float64(opcuaSamplingUnbounded)
+		case uaAttrHistorizing:
+			value = false
+		}
+	}
+	if value == nil {
+		return uaDataValue{Status: uaStatusBadAttributeIDInvalid}
+	}
+	return uaDataValue{Value: value, ServerTimestamp: timeNow()}
+}
+
+// readValue reads a variable, serving a tag from the last value read when it
+// is no older than the MaxAge requested by the client
+func (s *opcuaServer) readValue(node *opcuaNode, maxAge time.Duration) uaDataValue {
+	now := timeNow()
+	if node.Tag == "" {
+		return uaDataValue{Value: node.Value(), SourceTimestamp: now, ServerTimestamp: now}
+	}
+
+	dv := uaDataValue{SourceTimestamp: now, ServerTimestamp: now}
+	data := map[string]ethernetIpReadResponseData{}
+	err := scheduler.do(priorityRead, func() error {
+		return readTagsMaxAge([]string{node.Tag}, data, maxAge)
+	})
+	if err == nil {
+		dv.Value, err = uaVariantValue(node.DataType.ID, data[node.Tag].Value)
+	}
+	if err != nil {
+		log.Printf("[ERROR] readValue - Failed to read tag %s: %s\n", node.Tag, err.Error())
+		return uaDataValue{Status: opcuaStatus(err), ServerTimestamp: now}
+	}
+
+	// a cached value keeps the time it was read
+	if t, err := time.Parse(time.RFC3339, data[node.Tag].SourceTimestamp); err == nil {
+		dv.SourceTimestamp = t
+	}
+	return dv
+}
+
+// writeAttribute forwards a write of a tag variable's value to the controller,
+// only authenticated sessions may write
+func (s *opcuaServer) writeAttribute(sess *opcuaSession, id uaNodeID, attribute uint32, value interface{}) uaStatusCode {
+	node := s.space.node(id)
+	if node == nil {
+		return uaStatusBadNodeIDUnknown
+	}
+	if attribute != uaAttrValue || node.Tag == "" || node.AccessLevel&0x02 == 0 {
+		return uaStatusBadNotWritable
+	}
+	if sess.user == "" {
+		return uaStatusBadUserAccessDenied
+	}
+
+	err := scheduler.do(priorityWrite, func() error {
+		return auditedWrite(node.Tag, uaWriteValue(value), sess.user, auditSourceOPCUA)
+	})
+	if err != nil {
+		log.Printf("[ERROR] writeAttribute - Failed to write tag %s: %s\n", node.Tag, err.Error())
+		return opcuaStatus(err)
+	}
+	log.Printf("[INFO] writeAttribute - OPC UA write successful: %s\n", node.Tag)
+	return uaStatusGood
+}
+
+func opcuaStatus(err error) uaStatusCode {
+	status := uaStatusBadCommunicationError
+	switch {
+	case errors.As(err, &status):
+	case errors.Is(err, errTagNotFound):
+		status = uaStatusBadNodeIDUnknown
+	case errors.Is(err, errUnsupportedType):
+		status = uaStatusBadNotSupported
+	case errors.Is(err, errInvalidValue):
+		status = uaStatusBadTypeMismatch
+	case errors.Is(err, errReadOnlyTag), errors.Is(err, errSelectRequired):
+		status = uaStatusBadNotWritable
+	case errors.Is(err, errWriteRateLimited), errors.Is(err, errQueueFull):
+		status = uaStatusBadTooManyOperations
+	case errors.Is(err, errRequestTimeout):
+		status = uaStatusBadTimeout
+	}
+	return status
+}
+
+// uaVariantValue converts a value read from a tag to the Go type encoding the
+// variable's OPC UA data type
+func uaVariantValue(dataType uint32, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		if dataType == 1 {
+			return v, nil
+		}
+	case string:
+		if dataType == 12 {
+			return v, nil
+		}
+	default:
+		i, f, isInt, ok := uaNumber(value)
+		if !ok {
+			break
+		}
+		if !isInt {
+			i = int64(f)
+		} else {
+			f = float64(i)
+		}
+		switch dataType {
+		case 1:
+			return i != 0, nil
+		case 2:
+			return int8(i), nil
+		case 3:
+			return uint8(i), nil
+		case 4:
+			return int16(i), nil
+		case 5:
+			return uint16(i), nil
+		case 6:
+			return int32(i), nil
+		case 7:
+			return uint32(i), nil
+		case 8:
+			return i, nil
+		case 9:
+			return uint64(i), nil
+		case 10:
+			return float32(f), nil
+		case 11, uaIDBaseDataType:
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: cannot represent %T as OPC UA data type %d", errUnsupportedType, value, dataType)
+}
+
+// uaWriteValue converts a written Variant value to the JSON types writeTag accepts
+func uaWriteValue(value interface{}) interface{} {
+	if i, f, isInt, ok := uaNumber(value); ok {
+		if isInt {
+			return float64(i)
+		}
+		return f
+	}
+	return value
+}
+
+func uaNumber(value interface{}) (int64, float64, bool, bool) {
+	switch v := value.(type) {
+	case int8:
+		return int64(v), 0, true, true
+	case uint8:
+		return int64(v), 0, true, true
+	case int16:
+		return int64(v), 0, true, true
+	case uint16:
+		return int64(v), 0, true, true
+	case int32:
+		return int64(v), 0, true, true
+	case uint32:
+		return int64(v), 0, true, true
+	case int64:
+		return v, 0, true, true
+	case uint64:
+		return int64(v), 0, true, true
+	case float32:
+		return 0, float64(v), false, true
+	case float64:
+		return 0, v, false, true
+	}
+	return 0, 0, false, false
+}
+
+func newOPCUANonce() []byte {
+	nonce := make([]byte, opcuaNonceLength)
+	rand.Read(nonce)
+	return nonce
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+// OPC UA binary encoding (OPC 10000-6, 5.2) of the built-in types used by the
+// services the embedded server implements
+
+// uaStatusCode is an OPC UA status code, usable as an error so that failures
+// can be reported either per operation or as a ServiceFault
+type uaStatusCode uint32
+
+const (
+	uaStatusGood                        uaStatusCode = 0
+	uaStatusBadInternalError            uaStatusCode = 0x80020000
+	uaStatusBadCommunicationError       uaStatusCode = 0x80050000
+	uaStatusBadDecodingError            uaStatusCode = 0x80070000
+	uaStatusBadTimeout                  uaStatusCode = 0x800A0000
+	uaStatusBadServiceUnsupported       uaStatusCode = 0x800B0000
+	uaStatusBadNothingToDo              uaStatusCode = 0x800F0000
+	uaStatusBadTooManyOperations        uaStatusCode = 0x80100000
+	uaStatusBadUserAccessDenied         uaStatusCode = 0x801F0000
+	uaStatusBadIdentityTokenInvalid     uaStatusCode = 0x80200000
+	uaStatusBadSecureChannelIDInvalid   uaStatusCode = 0x80220000
+	uaStatusBadSessionIDInvalid         uaStatusCode = 0x80250000
+	uaStatusBadSessionNotActivated      uaStatusCode = 0x80270000
+	uaStatusBadNodeIDUnknown            uaStatusCode = 0x80340000
+	uaStatusBadAttributeIDInvalid       uaStatusCode = 0x80350000
+	uaStatusBadIndexRangeInvalid        uaStatusCode = 0x80360000
+	uaStatusBadNotWritable              uaStatusCode = 0x803B0000
+	uaStatusBadNotSupported             uaStatusCode = 0x803D0000
+	uaStatusBadContinuationPointInvalid uaStatusCode = 0x804A0000
+	uaStatusBadSecurityPolicyRejected   uaStatusCode = 0x80550000
+	uaStatusBadNoMatch                  uaStatusCode = 0x806F0000
+	uaStatusBadTypeMismatch             uaStatusCode = 0x80740000
+	uaStatusBadTCPMessageTypeInvalid    uaStatusCode = 0x807E0000
+)
+
+func (s uaStatusCode) Error() string {
+	return fmt.Sprintf("OPC UA status %#08x", uint32(s))
+}
+
+// uaNodeID identifies a node. Only numeric and string identifiers are used by
+// the server, other identifier types are kept so they can be echoed back.
+type uaNodeID struct {
+	Namespace uint16
+	Kind      byte
+	ID        uint32
+	Name      string
+}
+
+const (
+	uaNodeIDNumeric    = 2
+	uaNodeIDString     = 3
+	uaNodeIDGUID       = 4
+	uaNodeIDByteString = 5
+)
+
+func uaNumericID(id uint32) uaNodeID {
+	return uaNodeID{Kind: uaNodeIDNumeric, ID: id}
+}
+
+func uaStringID(namespace uint16, name string) uaNodeID {
+	return uaNodeID{Namespace: namespace, Kind: uaNodeIDString, Name: name}
+}
+
+func (n uaNodeID) isNull() bool {
+	return n == uaNodeID{} || n == uaNumericID(0)
+}
+
+func (n uaNodeID) String() string {
+	prefix := ""
+	if n.Namespace != 0 {
+		prefix = fmt.Sprintf("ns=%d;", n.Namespace)
+	}
+	switch n.Kind {
+	case uaNodeIDString:
+		return prefix + "s=" + n.Name
+	case uaNodeIDGUID:
+		return prefix + "g=" + n.Name
+	case uaNodeIDByteString:
+		return prefix + "b=" + n.Name
+	default:
+		return fmt.Sprintf("%si=%d", prefix, n.ID)
+	}
+}
+
+type uaQualifiedName struct {
+	Namespace uint16
+	Name      string
+}
+
+type uaLocalizedText string
+
+// uaExtensionObject is a binary encoded structure carried in a Variant
+type uaExtensionObject struct {
+	TypeID uaNodeID
+	Body   []byte
+}
+
+type uaDataValue struct {
+	Value           interface{}
+	Status          uaStatusCode
+	SourceTimestamp time.Time
+	ServerTimestamp time.Time
+}
+
+// uaEpochOffset is the number of seconds between the OPC UA DateTime epoch,
+// 1601-01-01 UTC, and the Unix epoch
+const uaEpochOffset = 11644473600
+
+type uaEncoder struct {
+	buf []byte
+}
+
+func (e *uaEncoder) bytes() []byte { return e.buf }
+
+func (e *uaEncoder) raw(b []byte) { e.buf = append(e.buf, b...) }
+
+func (e *uaEncoder) boolean(v bool) {
+	if v {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+func (e *uaEncoder) byte(v byte)      { e.buf = append(e.buf, v) }
+func (e *uaEncoder) int32(v int32)    { e.uint32(uint32(v)) }
+func (e *uaEncoder) int64(v int64)    { e.uint64(uint64(v)) }
+func (e *uaEncoder) float(v float32)  { e.uint32(math.Float32bits(v)) }
+func (e *uaEncoder) double(v float64) { e.uint64(math.Float64bits(v)) }
+
+func (e *uaEncoder) uint16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *uaEncoder) uint32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *uaEncoder) uint64(v uint64) {
+	e.uint32(uint32(v))
+	e.uint32(uint32(v >> 32))
+}
+
+func (e *uaEncoder) string(v string) {
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *uaEncoder) byteString(v []byte) {
+	if v == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *uaEncoder) dateTime(t time.Time) {
+	if t.IsZero() {
+		e.int64(0)
+		return
+	}
+	e.int64((t.Unix()+uaEpochOffset)*1e7 + int64(t.Nanosecond()/100))
+}
+
+func (e *uaEncoder) nodeID(n uaNodeID) {
+	e.nodeIDWithFlags(n, 0)
+}
+
+func (e *uaEncoder) nodeIDWithFlags(n uaNodeID, flags byte) {
+	switch n.Kind {
+	case uaNodeIDString:
+		e.byte(0x03 | flags)
+		e.uint16(n.Namespace)
+		e.string(n.Name)
+	case uaNodeIDGUID, uaNodeIDByteString:
+		raw, _ := hex.DecodeString(n.Name)
+		e.byte(n.Kind | flags)
+		e.uint16(n.Namespace)
+		if n.Kind == uaNodeIDGUID {
+			e.raw(raw)
+		} else {
+			e.byteString(raw)
+		}
+	default:
+		switch {
+		case n.Namespace == 0 && n.ID <= 0xff:
+			e.byte(0x00 | flags)
+			e.byte(byte(n.ID))
+		case n.Namespace <= 0xff && n.ID <= 0xffff:
+			e.byte(0x01 | flags)
+			e.byte(byte(n.Namespace))
+			e.uint16(uint16(n.ID))
+		default:
+			e.byte(0x02 | flags)
+			e.uint16(n.Namespace)
+			e.uint32(n.ID)
+		}
+	}
+}
+
+// expandedNodeID encodes a local node, the namespace URI and server index are never set
+func (e *uaEncoder) expandedNodeID(n uaNodeID) {
+	e.nodeIDWithFlags(n, 0)
+}
+
+func (e *uaEncoder) qualifiedName(q uaQualifiedName) {
+	e.uint16(q.Namespace)
+	e.string(q.Name)
+}
+
+func (e *uaEncoder) localizedText(t uaLocalizedText) {
+	if t == "" {
+		e.byte(0)
+		return
+	}
+	e.byte(0x02)
+	e.string(string(t))
+}
+
+func (e *uaEncoder) extensionObject(x *uaExtensionObject) {
+	if x == nil {
+		e.nodeID(uaNumericID(0))
+		e.byte(0)
+		return
+	}
+	e.nodeID(x.TypeID)
+	e.byte(0x01)
+	e.byteString(x.Body)
+}
+
+func (e *uaEncoder) stringArray(v []string) {
+	if v == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	for _, s := range v {
+		e.string(s)
+	}
+}
+
+// emptyDiagnostics encodes an empty DiagnosticInfo array
+func (e *uaEncoder) emptyDiagnostics() {
+	e.int32(0)
+}
+
+// variant encodes a Go value as a Variant, see uaVariantType for the mapping
+func (e *uaEncoder) variant(v interface{}) {
+	typeID := uaVariantType(v)
+	if typeID == 0 {
+		e.byte(0)
+		return
+	}
+
+	switch a := v.(type) {
+	case []string:
+		e.byte(typeID | 0x80)
+		e.int32(int32(len(a)))
+		for _, s := range a {
+			e.string(s)
+		}
+		return
+	case []uint32:
+		e.byte(typeID | 0x80)
+		e.int32(int32(len(a)))
+		for _, u := range a {
+			e.uint32(u)
+		}
+		return
+	}
+
+	e.byte(typeID)
+	e.scalar(v)
+}
+
+func (e *uaEncoder) scalar(v interface{}) {
+	switch v := v.(type) {
+	case bool:
+		e.boolean(v)
+	case int8:
+		e.byte(byte(v))
+	case uint8:
+		e.byte(v)
+	case int16:
+		e.uint16(uint16(v))
+	case uint16:
+		e.uint16(v)
+	case int32:
+		e.int32(v)
+	case uint32:
+		e.uint32(v)
+	case int64:
+		e.int64(v)
+	case uint64:
+		e.uint64(v)
+	case float32:
+		e.float(v)
+	case float64:
+		e.double(v)
+	case string:
+		e.string(v)
+	case time.Time:
+		e.dateTime(v)
+	case []byte:
+		e.byteString(v)
+	case uaNodeID:
+		e.nodeID(v)
+	case uaStatusCode:
+		e.uint32(uint32(v))
+	case uaQualifiedName:
+		e.qualifiedName(v)
+	case uaLocalizedText:
+		e.localizedText(v)
+	case *uaExtensionObject:
+		e.extensionObject(v)
+	}
+}
+
+// uaVariantType is the built-in type id used to encode a Go value
+func uaVariantType(v interface{}) byte {
+	switch v.(type) {
+	case bool:
+		return 1
+	case int8:
+		return 2
+	case uint8:
+		return 3
+	case int16:
+		return 4
+	case uint16:
+		return 5
+	case int32:
+		return 6
+	case uint32, []uint32:
+		return 7
+	case int64:
+		return 8
+	case uint64:
+		return 9
+	case float32:
+		return 10
+	case float64:
+		return 11
+	case string, []string:
+		return 12
+	case time.Time:
+		return 13
+	case []byte:
+		return 15
+	case uaNodeID:
+		return 17
+	case uaStatusCode:
+		return 19
+	case uaQualifiedName:
+		return 20
+	case uaLocalizedText:
+		return 21
+	case *uaExtensionObject:
+		return 22
+	default:
+		return 0
+	}
+}
+
+func (e *uaEncoder) dataValue(dv uaDataValue) {
+	var mask byte
+	if dv.Value != nil {
+		mask |= 0x01
+	}
+	if dv.Status != uaStatusGood {
+		mask |= 0x02
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		mask |= 0x04
+	}
+	if !dv.ServerTimestamp.IsZero() {
+		mask |= 0x08
+	}
+
+	e.byte(mask)
+	if mask&0x01 != 0 {
+		e.variant(dv.Value)
+	}
+	if mask&0x02 != 0 {
+		e.uint32(uint32(dv.Status))
+	}
+	if mask&0x04 != 0 {
+		e.dateTime(dv.SourceTimestamp)
+	}
+	if mask&0x08 != 0 {
+		e.dateTime(dv.ServerTimestamp)
+	}
+}
+
+// uaDecoder reads the binary encoding. The first failure is kept in err and
+// every later read returns a zero value, so callers check err once at the end.
+type uaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *uaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = uaStatusBadDecodingError
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *uaDecoder) boolean() bool { return d.byte() != 0 }
+
+func (d *uaDecoder) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *uaDecoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) int32() int32 { return int32(d.uint32()) }
+
+func (d *uaDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) int64() int64    { return int64(d.uint64()) }
+func (d *uaDecoder) float() float32  { return math.Float32frombits(d.uint32()) }
+func (d *uaDecoder) double() float64 { return math.Float64frombits(d.uint64()) }
+
+func (d *uaDecoder) string() string {
+	return string(d.byteString())
+}
+
+func (d *uaDecoder) byteString() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *uaDecoder) dateTime() time.Time {
+	ticks := d.int64()
+	if ticks <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(ticks/1e7-uaEpochOffset, ticks%1e7*100).UTC()
+}
+
+func (d *uaDecoder) nodeID() uaNodeID {
+	n, _ := d.nodeIDWithFlags()
+	return n
+}
+
+func (d *uaDecoder) nodeIDWithFlags() (uaNodeID, byte) {
+	encoding := d.byte()
+	n := uaNodeID{Kind: uaNodeIDNumeric}
+
+	switch encoding & 0x0f {
+	case 0x00:
+		n.ID = uint32(d.byte())
+	case 0x01:
+		n.Namespace = uint16(d.byte())
+		n.ID = uint32(d.uint16())
+	case 0x02:
+		n.Namespace = d.uint16()
+		n.ID = d.uint32()
+	case 0x03:
+		n.Namespace = d.uint16()
+		n.Kind = uaNodeIDString
+		n.Name = d.string()
+	case 0x04:
+		n.Namespace = d.uint16()
+		n.Kind = uaNodeIDGUID
+		n.Name = hex.EncodeToString(d.next(16))
+	case 0x05:
+		n.Namespace = d.uint16()
+		n.Kind = uaNodeIDByteString
+		n.Name = hex.EncodeToString(d.byteString())
+	default:
+		d.err = uaStatusBadDecodingError
+	}
+	return n, encoding & 0xf0
+}
+
+func (d *uaDecoder) expandedNodeID() uaNodeID {
+	n, flags := d.nodeIDWithFlags()
+	if flags&0x80 != 0 {
+		d.string()
+	}
+	if flags&0x40 != 0 {
+		d.uint32()
+	}
+	return n
+}
+
+func (d *uaDecoder) qualifiedName() uaQualifiedName {
+	return uaQualifiedName{Namespace: d.uint16(), Name: d.string()}
+}
+
+func (d *uaDecoder) localizedText() uaLocalizedText {
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		d.string()
+	}
+	if mask&0x02 != 0 {
+		return uaLocalizedText(d.string())
+	}
+	return ""
+}
+
+func (d *uaDecoder) extensionObject() *uaExtensionObject {
+	x := &uaExtensionObject{TypeID: d.nodeID()}
+	switch d.byte() {
+	case 0x00:
+		return nil
+	case 0x01, 0x02:
+		x.Body = d.byteString()
+	default:
+		d.err = uaStatusBadDecodingError
+	}
+	return x
+}
+
+// arrayLength reads the length of an array, -1 (null) is returned as 0
+func (d *uaDecoder) arrayLength() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.buf) {
+		d.err = uaStatusBadDecodingError
+		return 0
+	}
+	return int(n)
+}
+
+func (d *uaDecoder) stringArray() []string {
+	n := d.arrayLength()
+	v := make([]string, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		v = append(v, d.string())
+	}
+	return v
+}
+
+func (d *uaDecoder) diagnosticInfo() {
+	mask := d.byte()
+	for _, bit := range []byte{0x01, 0x02, 0x04, 0x08} {
+		if mask&bit != 0 {
+			d.int32()
+		}
+	}
+	if mask&0x10 != 0 {
+		d.string()
+	}
+	if mask&0x20 != 0 {
+		d.uint32()
+	}
+	if mask&0x40 != 0 {
+		d.diagnosticInfo()
+	}
+}
+
+func (d *uaDecoder) variant() interface{} {
+	encoding := d.byte()
+	typeID := encoding & 0x3f
+
+	if encoding&0x80 == 0 {
+		return d.scalar(typeID)
+	}
+
+	n := d.arrayLength()
+	values := make([]interface{}, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		values = append(values, d.scalar(typeID))
+	}
+	if encoding&0x40 != 0 {
+		for i := d.arrayLength(); i > 0 && d.err == nil; i-- {
+			d.int32()
+		}
+	}
+	return values
+}
+
+func (d *uaDecoder) scalar(typeID byte) interface{} {
+	switch typeID {
+	case 0:
+		return nil
+	case 1:
+		return d.boolean()
+	case 2:
+		return int8(d.byte())
+	case 3:
+		return d.byte()
+	case 4:
+		return int16(d.uint16())
+	case 5:
+		return d.uint16()
+	case 6:
+		return d.int32()
+	case 7:
+		return d.uint32()
+	case 8:
+		return d.int64()
+	case 9:
+		return d.uint64()
+	case 10:
+		return d.float()
+	case 11:
+		return d.double()
+	case 12:
+		return d.string()
+	case 13:
+		return d.dateTime()
+	case 15:
+		return d.byteString()
+	case 17:
+		return d.nodeID()
+	case 19:
+		return uaStatusCode(d.uint32())
+	case 20:
+		return d.qualifiedName()
+	case 21:
+		return d.localizedText()
+	case 22:
+		return d.extensionObject()
+	default:
+		d.err = uaStatusBadDecodingError
+		return nil
+	}
+}
+
+func (d *uaDecoder) dataValue() uaDataValue {
+	dv := uaDataValue{}
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		dv.Value = d.variant()
+	}
+	if mask&0x02 != 0 {
+		dv.Status = uaStatusCode(d.uint32())
+	}
+	if mask&0x04 != 0 {
+		dv.SourceTimestamp = d.dateTime()
+	}
+	if mask&0x10 != 0 {
+		d.uint16()
+	}
+	if mask&0x08 != 0 {
+		dv.ServerTimestamp = d.dateTime()
+	}
+	if mask&0x20 != 0 {
+		d.uint16()
+	}
+	return dv
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+const (
+	opcuaNamespaceURI      = "urn:clearblade:" + adapterName
+	opcuaApplicationURI    = opcuaNamespaceURI + ":server"
+	opcuaControllerFolder  = "Controller"
+	opcuaProgramPrefix     = "Program:"
+	opcuaAdapterNamespace  = 1
+	opcuaValueRankScalar   = -1
+	opcuaAccessRead        = 0x01
+	opcuaAccessReadWrite   = 0x03
+	opcuaSamplingUnbounded = -1
+)
+
+// OPC UA node classes
+const (
+	uaNodeClassObject        = 1
+	uaNodeClassVariable      = 2
+	uaNodeClassObjectType    = 8
+	uaNodeClassVariableType  = 16
+	uaNodeClassReferenceType = 32
+	uaNodeClassDataType      = 64
+)
+
+// Well known nodes of namespace 0
+const (
+	uaIDBaseDataType           = 24
+	uaIDReferences             = 31
+	uaIDNonHierarchical        = 32
+	uaIDHierarchicalReferences = 33
+	uaIDHasChild               = 34
+	uaIDOrganizes              = 35
+	uaIDHasTypeDefinition      = 40
+	uaIDAggregates             = 44
+	uaIDHasSubtype             = 45
+	uaIDHasProperty            = 46
+	uaIDHasComponent           = 47
+	uaIDBaseObjectType         = 58
+	uaIDFolderType             = 61
+	uaIDBaseDataVariableType   = 63
+	uaIDPropertyType           = 68
+	uaIDRootFolder             = 84
+	uaIDObjectsFolder          = 85
+	uaIDTypesFolder            = 86
+	uaIDViewsFolder            = 87
+	uaIDServerStatusDataType   = 862
+	uaIDServerStatusEncoding   = 864
+	uaIDServerType             = 2004
+	uaIDServerStatusType       = 2138
+	uaIDServer                 = 2253
+	uaIDServerArray            = 2254
+	uaIDNamespaceArray         = 2255
+	uaIDServerStatus           = 2256
+	uaIDServerStartTime        = 2257
+	uaIDServerCurrentTime      = 2258
+	uaIDServerState            = 2259
+)
+
+// OPC UA attribute ids
+const (
+	uaAttrNodeID                  = 1
+	uaAttrNodeClass               = 2
+	uaAttrBrowseName              = 3
+	uaAttrDisplayName             = 4
+	uaAttrDescription             = 5
+	uaAttrWriteMask               = 6
+	uaAttrUserWriteMask           = 7
+	uaAttrIsAbstract              = 8
+	uaAttrEventNotifier           = 12
+	uaAttrValue                   = 13
+	uaAttrDataType                = 14
+	uaAttrValueRank               = 15
+	uaAttrArrayDimensions         = 16
+	uaAttrAccessLevel             = 17
+	uaAttrUserAccessLevel         = 18
+	uaAttrMinimumSamplingInterval = 19
+	uaAttrHistorizing             = 20
+)
+
+// cipToUADataType maps elementary CIP types to the OPC UA built-in data type nodes
+var cipToUADataType = map[types.UInt]uint32{
+	eip.BOOL:   1,
+	eip.SINT:   2,
+	eip.USINT:  3,
+	eip.INT:    4,
+	eip.UINT:   5,
+	eip.DINT:   6,
+	eip.UDINT:  7,
+	eip.LINT:   8,
+	eip.ULINT:  9,
+	eip.REAL:   10,
+	eip.LREAL:  11,
+	eip.STRING: 12,
+}
+
+// uaReferenceSupertypes is the reference type hierarchy used to filter browse results
+var uaReferenceSupertypes = map[uint32]uint32{
+	uaIDNonHierarchical:        uaIDReferences,
+	uaIDHierarchicalReferences: uaIDReferences,
+	uaIDHasChild:               uaIDHierarchicalReferences,
+	uaIDOrganizes:              uaIDHierarchicalReferences,
+	uaIDAggregates:             uaIDHasChild,
+	uaIDHasSubtype:             uaIDHasChild,
+	uaIDHasProperty:            uaIDAggregates,
+	uaIDHasComponent:           uaIDAggregates,
+	uaIDHasTypeDefinition:      uaIDNonHierarchical,
+}
+
+type opcuaReference struct {
+	Type    uaNodeID
+	Forward bool
+	Target  uaNodeID
+}
+
+type opcuaNode struct {
+	ID             uaNodeID
+	Class          uint32
+	BrowseName     uaQualifiedName
+	DisplayName    uaLocalizedText
+	TypeDefinition uaNodeID
+	References     []opcuaReference
+
+	// variables only
+	DataType    uaNodeID
+	ValueRank   int32
+	AccessLevel byte
+	// Tag is the controller tag behind a variable, empty for server nodes
+	Tag string
+	// Value returns the current value of server nodes
+	Value func() interface{}
+}
+
+type opcuaAddressSpace struct {
+	nodes map[uaNodeID]*opcuaNode
+}
+
+// newOPCUAAddressSpace builds the standard server nodes and a folder per
+// program with a variable per tag retrieved from the controller
+func newOPCUAAddressSpace(tags map[string]*eip.Tag, startTime time.Time) *opcuaAddressSpace {
+	a := &opcuaAddressSpace{nodes: make(map[uaNodeID]*opcuaNode)}
+	a.addStandardNodes(startTime)
+
+	root := a.addFolder(uaStringID(opcuaAdapterNamespace, adapterName), "EtherNet/IP", uaNumericID(uaIDObjectsFolder))
+	controller := a.addFolder(uaStringID(opcuaAdapterNamespace, opcuaControllerFolder), opcuaControllerFolder, root.ID)
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Logix reports each program as a "Program:<name>" entry in the controller
+	// scope, program scoped tags are named "Program:<name>.<tag>"
+	for _, name := range names {
+		if strings.HasPrefix(name, opcuaProgramPrefix) && !strings.Contains(name, ".") {
+			a.addFolder(uaStringID(opcuaAdapterNamespace, name), strings.TrimPrefix(name, opcuaProgramPrefix), root.ID)
+		}
+	}
+
+	for _, name := range names {
+		parent, browseName := controller.ID, name
+		if strings.HasPrefix(name, opcuaProgramPrefix) {
+			dot := strings.Index(name, ".")
+			if dot < 0 {
+				continue
+			}
+			program := uaStringID(opcuaAdapterNamespace, name[:dot])
+			if _, ok := a.nodes[program]; !ok {
+				a.addFolder(program, strings.TrimPrefix(name[:dot], opcuaProgramPrefix), root.ID)
+			}
+			parent, browseName = program, name[dot+1:]
+		}
+		a.addTagVariable(name, browseName, tags[name].Type, parent)
+	}
+
+	// virtual tags are computed by the adapter, they sit next to the controller tags
+	for _, name := range virtualTagNames() {
+		a.addTagVariable(name, name, virtualTags[name].dataType(), controller.ID)
+	}
+
+	return a
+}
+
+func (a *opcuaAddressSpace) node(id uaNodeID) *opcuaNode {
+	return a.nodes[id]
+}
+
+func (a *opcuaAddressSpace) add(n *opcuaNode) *opcuaNode {
+	a.nodes[n.ID] = n
+	if !n.TypeDefinition.isNull() {
+		n.References = append(n.References, opcuaReference{Type: uaNumericID(uaIDHasTypeDefinition), Forward: true, Target: n.TypeDefinition})
+	}
+	return n
+}
+
+func (a *opcuaAddressSpace) link(parent uaNodeID, refType uint32, child uaNodeID) {
+	if parent.isNull() {
+		return
+	}
+	if p := a.nodes[parent]; p != nil {
+		p.References = append(p.References, opcuaReference{Type: uaNumericID(refType), Forward: true, Target: child})
+	}
+	if c := a.nodes[child]; c != nil {
+		c.References = append(c.References, opcuaReference{Type: uaNumericID(refType), Forward: false, Target: parent})
+	}
+}
+
+func (a *opcuaAddressSpace) addFolder(id uaNodeID, name string, parent uaNodeID) *opcuaNode {
+	n := a.add(&opcuaNode{
+		ID:             id,
+		Class:          uaNodeClassObject,
+		BrowseName:     uaQualifiedName{Namespace: id.Namespace, Name: name},
+		DisplayName:    uaLocalizedText(name),
+		TypeDefinition: uaNumericID(uaIDFolderType),
+	})
+	a.link(parent, uaIDOrganizes, id)
+	return n
+}
+
+func (a *opcuaAddressSpace) addTagVariable(tagName string, browseName string, tagType types.UInt, parent uaNodeID) {
+	// the low bits of a structure are its template id, STRING is the only
+	// structure mapped to a built-in type
+	baseType := tagType & 0x0fff
+	dataType, supported := cipToUADataType[baseType]
+	if !supported || tagType&0x8000 != 0 && baseType != eip.STRING {
+		dataType = uaIDBaseDataType
+	}
+	if scaledTag(tagName, tagType) {
+		dataType = 11 // Double
+	}
+
+	valueRank := int32(opcuaValueRankScalar)
+	if dims := int32((tagType & 0x6000) >> 13); dims > 0 {
+		valueRank = dims
+	}
+
+	access := byte(opcuaAccessRead)
+	if _, virtual := virtualTags[tagName]; !virtual && adapterSettings.OPCUAWritesEnabled && dataType != uaIDBaseDataType && valueRank == opcuaValueRankScalar {
+		access = opcuaAccessReadWrite
+	}
+
+	id := uaStringID(opcuaAdapterNamespace, tagName)
+	a.add(&opcuaNode{
+		ID:             id,
+		Class:          uaNodeClassVariable,
+		BrowseName:     uaQualifiedName{Namespace: opcuaAdapterNamespace, Name: browseName},
+		DisplayName:    uaLocalizedText(browseName),
+		TypeDefinition: uaNumericID(uaIDBaseDataVariableType),
+		DataType:       uaNumericID(dataType),
+		ValueRank:      valueRank,
+		AccessLevel:    access,
+		Tag:            tagName,
+	})
+	a.link(parent, uaIDOrganizes, id)
+}
+
+// addStandardNodes adds the namespace 0 nodes clients expect to find: the root
+// folders, the Server object and the types referenced by the adapter nodes
+func (a *opcuaAddressSpace) addStandardNodes(startTime time.Time) {
+	a.addFolder(uaNumericID(uaIDRootFolder), "Root", uaNodeID{})
+	a.addFolder(uaNumericID(uaIDObjectsFolder), "Objects", uaNumericID(uaIDRootFolder))
+	a.addFolder(uaNumericID(uaIDTypesFolder), "Types", uaNumericID(uaIDRootFolder))
+	a.addFolder(uaNumericID(uaIDViewsFolder), "Views", uaNumericID(uaIDRootFolder))
+
+	for id, name := range map[uint32]string{
+		uaIDBaseObjectType:   "BaseObjectType",
+		uaIDFolderType:       "FolderType",
+		uaIDServerType:       "ServerType",
+		uaIDServerStatusType: "ServerStatusType",
+	} {
+		a.addType(id, name, uaNodeClassObjectType)
+	}
+	for id, name := range map[uint32]string{
+		uaIDBaseDataVariableType: "BaseDataVariableType",
+		uaIDPropertyType:         "PropertyType",
+	} {
+		a.addType(id, name, uaNodeClassVariableType)
+	}
+	for id, name := range map[uint32]string{
+		uaIDReferences:             "References",
+		uaIDNonHierarchical:        "NonHierarchicalReferences",
+		uaIDHierarchicalReferences: "HierarchicalReferences",
+		uaIDHasChild:               "HasChild",
+		uaIDOrganizes:              "Organizes",
+		uaIDHasTypeDefinition:      "HasTypeDefinition",
+		uaIDAggregates:             "Aggregates",
+		uaIDHasSubtype:             "HasSubtype",
+		uaIDHasProperty:            "HasProperty",
+		uaIDHasComponent:           "HasComponent",
+	} {
+		a.addType(id, name, uaNodeClassReferenceType)
+	}
+	for id, name := range map[uint32]string{
+		1: "Boolean", 2: "SByte", 3: "Byte", 4: "Int16", 5: "UInt16", 6: "Int32",
+		7: "UInt32", 8: "Int64", 9: "UInt64", 10: "Float", 11: "Double", 12: "String",
+		13: "DateTime", uaIDBaseDataType: "BaseDataType", uaIDServerStatusDataType: "ServerStatusDataType",
+	} {
+		a.addType(id, name, uaNodeClassDataType)
+	}
+
+	server := a.add(&opcuaNode{
+		ID:             uaNumericID(uaIDServer),
+		Class:          uaNodeClassObject,
+		BrowseName:     uaQualifiedName{Name: "Server"},
+		DisplayName:    "Server",
+		TypeDefinition: uaNumericID(uaIDServerType),
+	})
+	a.link(uaNumericID(uaIDObjectsFolder), uaIDOrganizes, server.ID)
+
+	a.addServerVariable(uaIDServerArray, "ServerArray", uaIDServer, uaIDHasProperty, 12, 1, func() interface{} {
+		return []string{opcuaApplicationURI}
+	})
+	a.addServerVariable(uaIDNamespaceArray, "NamespaceArray", uaIDServer, uaIDHasProperty, 12, 1, func() interface{} {
+		return []string{"http://opcfoundation.org/UA/", opcuaNamespaceURI}
+	})
+	a.addServerVariable(uaIDServerStatus, "ServerStatus", uaIDServer, uaIDHasComponent, uaIDServerStatusDataType, opcuaValueRankScalar, func() interface{} {
+		return encodeServerStatus(startTime, timeNow())
+	})
+	a.addServerVariable(uaIDServerStartTime, "StartTime", uaIDServerStatus, uaIDHasComponent, 13, opcuaValueRankScalar, func() interface{} {
+		return startTime
+	})
+	a.addServerVariable(uaIDServerCurrentTime, "CurrentTime", uaIDServerStatus, uaIDHasComponent, 13, opcuaValueRankScalar, func() interface{} {
+		return timeNow()
+	})
+	// ServerState enumeration, 0 = Running
+	a.addServerVariable(uaIDServerState, "State", uaIDServerStatus, uaIDHasComponent, 6, opcuaValueRankScalar, func() interface{} {
+		return int32(0)
+	})
+}
+
+func (a *opcuaAddressSpace) addType(id uint32, name string, class uint32) {
+	a.add(&opcuaNode{
+		ID:          uaNumericID(id),
+		Class:       class,
+		BrowseName:  uaQualifiedName{Name: name},
+		DisplayName: uaLocalizedText(name),
+	})
+}
+
+func (a *opcuaAddressSpace) addServerVariable(id uint32, name string, parent uint32, refType uint32, dataType uint32, valueRank int32, value func() interface{}) {
+	typeDefinition := uint32(uaIDBaseDataVariableType)
+	if refType == uaIDHasProperty {
+		typeDefinition = uaIDPropertyType
+	}
+
+	a.add(&opcuaNode{
+		ID:             uaNumericID(id),
+		Class:          uaNodeClassVariable,
+		BrowseName:     uaQualifiedName{Name: name},
+		DisplayName:    uaLocalizedText(name),
+		TypeDefinition: uaNumericID(typeDefinition),
+		DataType:       uaNumericID(dataType),
+		ValueRank:      valueRank,
+		AccessLevel:    opcuaAccessRead,
+		Value:          value,
+	})
+	a.link(uaNumericID(parent), refType, uaNumericID(id))
+}
+
+// encodeServerStatus encodes the ServerStatusDataType structure
+func encodeServerStatus(startTime time.Time, now time.Time) *uaExtensionObject {
+	e := &uaEncoder{}
+	e.dateTime(startTime)
+	e.dateTime(now)
+	e.int32(0) // Running
+	// BuildInfo
+	e.string(opcuaApplicationURI)
+	e.string("ClearBlade")
+	e.string(adapterName)
+	e.string("")
+	e.string("")
+	e.dateTime(time.Time{})
+	e.uint32(0)         // SecondsTillShutdown
+	e.localizedText("") // ShutdownReason
+	return &uaExtensionObject{TypeID: uaNumericID(uaIDServerStatusEncoding), Body: e.bytes()}
+}
+
+// isReferenceSubtype reports whether refType is filter or, when subtypes are
+// included, one of its subtypes
+func isReferenceSubtype(refType uaNodeID, filter uaNodeID, includeSubtypes bool) bool {
+	if filter.isNull() || refType == filter {
+		return true
+	}
+	if !includeSubtypes || refType.Namespace != 0 || filter.Namespace != 0 {
+		return false
+	}
+	for id, ok := uaReferenceSupertypes[refType.ID]; ok; id, ok = uaReferenceSupertypes[id] {
+		if id == filter.ID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// opcuaTestClient speaks just enough of the UA TCP binary protocol to open a
+// secure channel and a session and call services on the server
+type opcuaTestClient struct {
+	t         *testing.T
+	conn      net.Conn
+	channelID uint32
+	tokenID   uint32
+	sequence  uint32
+	requestID uint32
+	token     uaNodeID
+}
+
+func startTestOPCUAServer(t *testing.T, sim *simController) string {
+	t.Helper()
+	startTestAdapter(t, sim)
+	return serveTestOPCUA(t)
+}
+
+// serveTestOPCUA starts a server with the current adapter settings
+func serveTestOPCUA(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go newOPCUAServer().serve(listener)
+	return listener.Addr().String()
+}
+
+func dialOPCUA(t *testing.T, addr string, bufferSize uint32) *opcuaTestClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &opcuaTestClient{t: t, conn: conn}
+
+	hello := &uaEncoder{}
+	hello.uint32(0)
+	hello.uint32(bufferSize)
+	hello.uint32(bufferSize)
+	hello.uint32(0)
+	hello.uint32(0)
+	hello.string("opc.tcp://" + addr)
+	c.writeChunk("HEL", 'F', hello.bytes())
+	if msgType, _, _ := c.readChunk(); msgType != "ACK" {
+		t.Fatalf("expected ACK, got %s", msgType)
+	}
+
+	open := &uaEncoder{}
+	open.uint32(0)
+	open.string(opcuaSecurityPolicyNone)
+	open.byteString(nil)
+	open.byteString(nil)
+	open.uint32(1)
+	open.uint32(1)
+	open.nodeID(uaNumericID(uaIDOpenSecureChannelRequest))
+	encodeTestRequestHeader(open, uaNodeID{})
+	open.uint32(0)
+	open.uint32(0)
+	open.uint32(1)
+	open.byteString(nil)
+	open.uint32(600000)
+	c.writeChunk("OPN", 'F', open.bytes())
+
+	msgType, _, body := c.readChunk()
+	if msgType != "OPN" {
+		t.Fatalf("expected OPN, got %s", msgType)
+	}
+	d := &uaDecoder{buf: body}
+	d.uint32()
+	d.string()
+	d.byteString()
+	d.byteString()
+	d.uint32()
+	d.uint32()
+	if typeID := d.nodeID(); typeID != uaNumericID(uaIDOpenSecureChannelResponse) {
+		t.Fatalf("unexpected open response %s", typeID)
+	}
+	skipTestResponseHeader(d)
+	d.uint32()
+	c.channelID = d.uint32()
+	c.tokenID = d.uint32()
+	return c
+}
+
+// openSession creates and activates an anonymous session
+func (c *opcuaTestClient) openSession() {
+	c.t.Helper()
+
+	identity := &uaEncoder{}
+	identity.string(opcuaAnonymousPolicyID)
+	c.activateSession(&uaExtensionObject{TypeID: uaNumericID(uaIDAnonymousIdentityToken), Body: identity.bytes()}, uaStatusGood)
+}
+
+// openUserSession creates a session and activates it with a user name token
+func (c *opcuaTestClient) openUserSession(user string, password string, status uaStatusCode) {
+	c.t.Helper()
+
+	identity := &uaEncoder{}
+	identity.string(opcuaUserNamePolicyID)
+	identity.string(user)
+	identity.byteString([]byte(password))
+	identity.string("")
+	c.activateSession(&uaExtensionObject{TypeID: uaNumericID(uaIDUserNameIdentityToken), Body: identity.bytes()}, status)
+}
+
+// activateSession creates a session and activates it with the identity token
+func (c *opcuaTestClient) activateSession(identity *uaExtensionObject, status uaStatusCode) {
+	c.t.Helper()
+
+	d := c.call(uaIDCreateSessionRequest, uaIDCreateSessionResponse, uaStatusGood, func(e *uaEncoder) {
+		e.string("urn:test")
+		e.string("urn:test")
+		e.localizedText("test")
+		e.uint32(1)
+		e.string("")
+		e.string("")
+		e.stringArray(nil)
+		e.string("")
+		e.string("")
+		e.string("test session")
+		e.byteString(nil)
+		e.byteString(nil)
+		e.double(60000)
+		e.uint32(0)
+	})
+	d.nodeID()
+	c.token = d.nodeID()
+
+	c.call(uaIDActivateSessionRequest, uaIDActivateSessionResponse, status, func(e *uaEncoder) {
+		e.string("")
+		e.byteString(nil)
+		e.int32(0)
+		e.stringArray(nil)
+		e.extensionObject(identity)
+		e.string("")
+		e.byteString(nil)
+	})
+}
+
+// call sends a request and checks the response type and service result,
+// returning a decoder positioned after the response header
+func (c *opcuaTestClient) call(request uint32, response uint32, status uaStatusCode, body func(e *uaEncoder)) *uaDecoder {
+	c.t.Helper()
+
+	e := &uaEncoder{}
+	e.nodeID(uaNumericID(request))
+	encodeTestRequestHeader(e, c.token)
+	body(e)
+
+	c.requestID++
+	c.sequence++
+	msg := &uaEncoder{}
+	msg.uint32(c.channelID)
+	msg.uint32(c.tokenID)
+	msg.uint32(c.sequence)
+	msg.uint32(c.requestID)
+	msg.raw(e.bytes())
+	c.writeChunk("MSG", 'F', msg.bytes())
+
+	var message []byte
+	for {
+		msgType, chunkType, chunk := c.readChunk()
+		if msgType != "MSG" {
+			c.t.Fatalf("expected MSG, got %s: % x", msgType, chunk)
+		}
+		message = append(message, chunk[16:]...)
+		if chunkType == 'F' {
+			break
+		}
+	}
+
+	d := &uaDecoder{buf: message}
+	typeID := d.nodeID()
+	d.dateTime()
+	d.uint32()
+	result := uaStatusCode(d.uint32())
+	d.diagnosticInfo()
+	d.stringArray()
+	d.extensionObject()
+
+	if result != status {
+		c.t.Fatalf("expected service result %#08x, got %#08x", uint32(status), uint32(result))
+	}
+	if status == uaStatusGood && typeID != uaNumericID(response) {
+		c.t.Fatalf("expected response %d, got %s", response, typeID)
+	}
+	return d
+}
+
+func (c *opcuaTestClient) writeChunk(msgType string, chunkType byte, body []byte) {
+	e := &uaEncoder{}
+	e.raw([]byte(msgType))
+	e.byte(chunkType)
+	e.uint32(uint32(len(body) + 8))
+	e.raw(body)
+	if _, err := c.conn.Write(e.bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *opcuaTestClient) readChunk() (string, byte, []byte) {
+	msgType, chunkType, body, err := readOPCUAChunk(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msgType, chunkType, body
+}
+
+func (c *opcuaTestClient) read(node uaNodeID, attribute uint32, maxAge float64) uaDataValue {
+	c.t.Helper()
+
+	d := c.call(uaIDReadRequest, uaIDReadResponse, uaStatusGood, func(e *uaEncoder) {
+		e.double(maxAge)
+		e.uint32(2)
+		e.int32(1)
+		e.nodeID(node)
+		e.uint32(attribute)
+		e.string("")
+		e.qualifiedName(uaQualifiedName{})
+	})
+	if n := d.int32(); n != 1 {
+		c.t.Fatalf("expected 1 result, got %d", n)
+	}
+	return d.dataValue()
+}
+
+func (c *opcuaTestClient) write(node uaNodeID, attribute uint32, value interface{}) uaStatusCode {
+	c.t.Helper()
+
+	d := c.call(uaIDWriteRequest, uaIDWriteResponse, uaStatusGood, func(e *uaEncoder) {
+		e.int32(1)
+		e.nodeID(node)
+		e.uint32(attribute)
+		e.string("")
+		e.dataValue(uaDataValue{Value: value})
+	})
+	if n := d.int32(); n != 1 {
+		c.t.Fatalf("expected 1 result, got %d", n)
+	}
+	return uaStatusCode(d.uint32())
+}
+
+// browse returns the display names of the forward hierarchical references of
+// a node, following continuation points
+func (c *opcuaTestClient) browse(node uaNodeID, max uint32) []string {
+	c.t.Helper()
+
+	d := c.call(uaIDBrowseRequest, uaIDBrowseResponse, uaStatusGood, func(e *uaEncoder) {
+		e.nodeID(uaNodeID{})
+		e.dateTime(time.Time{})
+		e.uint32(0)
+		e.uint32(max)
+		e.int32(1)
+		e.nodeID(node)
+		e.uint32(0)
+		e.nodeID(uaNumericID(uaIDHierarchicalReferences))
+		e.boolean(true)
+		e.uint32(0)
+		e.uint32(0x3f)
+	})
+
+	var names []string
+	for {
+		if n := d.int32(); n != 1 {
+			c.t.Fatalf("expected 1 browse result, got %d", n)
+		}
+		if status := uaStatusCode(d.uint32()); status != uaStatusGood {
+			c.t.Fatalf("browse of %s failed: %#08x", node, uint32(status))
+		}
+		point := d.byteString()
+		for i := d.int32(); i > 0; i-- {
+			d.nodeID()
+			d.boolean()
+			d.expandedNodeID()
+			d.qualifiedName()
+			names = append(names, string(d.localizedText()))
+			d.uint32()
+			d.expandedNodeID()
+		}
+		if d.err != nil {
+			c.t.Fatalf("failed to decode browse response: %s", d.err.Error())
+		}
+		if point == nil {
+			return names
+		}
+
+		d = c.call(uaIDBrowseNextRequest, uaIDBrowseNextResponse, uaStatusGood, func(e *uaEncoder) {
+			e.boolean(false)
+			e.int32(1)
+			e.byteString(point)
+		})
+	}
+}
+
+func encodeTestRequestHeader(e *uaEncoder, token uaNodeID) {
+	e.nodeID(token)
+	e.dateTime(testTime)
+	e.uint32(1)
+	e.uint32(0)
+	e.string("")
+	e.uint32(0)
+	e.extensionObject(nil)
+}
+
+func skipTestResponseHeader(d *uaDecoder) {
+	d.dateTime()
+	d.uint32()
+	d.uint32()
+	d.diagnosticInfo()
+	d.stringArray()
+	d.extensionObject()
+}
+
+func TestOPCUABrowse(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addString("Recipe", "IPA")
+	sim.addTag("Program:MainProgram", 0x1068, []byte{})
+	addr := startTestOPCUAServer(t, sim)
+
+	client := dialOPCUA(t, addr, opcuaBufferSize)
+	client.openSession()
+
+	tests := []struct {
+		node     uaNodeID
+		max      uint32
+		expected []string
+	}{
+		{uaNumericID(uaIDObjectsFolder), 0, []string{"Server", "EtherNet/IP"}},
+		{uaStringID(opcuaAdapterNamespace, adapterName), 0, []string{"Controller", "MainProgram"}},
+		{uaStringID(opcuaAdapterNamespace, opcuaControllerFolder), 0, []string{"Counter", "Recipe"}},
+		{uaStringID(opcuaAdapterNamespace, opcuaControllerFolder), 1, []string{"Counter", "Recipe"}},
+	}
+	for _, test := range tests {
+		if got := client.browse(test.node, test.max); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("browse %s: expected %v, got %v", test.node, test.expected, got)
+		}
+	}
+}
+
+func TestOPCUABrowseChunkedResponse(t *testing.T) {
+	sim := newSimController(t)
+	expected := []string{}
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("Tag%03d", i)
+		sim.addDINT(name, int32(i))
+		expected = append(expected, name)
+	}
+	addr := startTestOPCUAServer(t, sim)
+
+	client := dialOPCUA(t, addr, opcuaMinBufferSize)
+	client.openSession()
+
+	if got := client.browse(uaStringID(opcuaAdapterNamespace, opcuaControllerFolder), 0); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %d tags, got %v", len(expected), got)
+	}
+}
+
+func TestOPCUAReadWrite(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addTag("Temperature", 0xca, []byte{0x00, 0x00, 0xc8, 0x41})
+	startTestAdapter(t, sim)
+	adapterSettings.OPCUAWritesEnabled = true
+	if err := validateOPCUASettings(); err == nil {
+		t.Fatal("expected an error for writes without credentials")
+	}
+	adapterSettings.OPCUAUsername, adapterSettings.OPCUAPassword = "operator", "secret"
+	if err := validateOPCUASettings(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	addr := serveTestOPCUA(t)
+
+	client := dialOPCUA(t, addr, opcuaBufferSize)
+	client.openUserSession("operator", "wrong", uaStatusBadUserAccessDenied)
+	client.openUserSession("operator", "secret", uaStatusGood)
+	counter := uaStringID(opcuaAdapterNamespace, "Counter")
+
+	reads := []struct {
+		node      uaNodeID
+		attribute uint32
+		expected  uaDataValue
+	}{
+		{counter, uaAttrValue, uaDataValue{Value: int32(42), SourceTimestamp: testTime, ServerTimestamp: testTime}},
+		{counter, uaAttrDataType, uaDataValue{Value: uaNumericID(6), ServerTimestamp: testTime}},
+		{counter, uaAttrAccessLevel, uaDataValue{Value: byte(opcuaAccessReadWrite), ServerTimestamp: testTime}},
+		{counter, uaAttrUserAccessLevel, uaDataValue{Value: byte(opcuaAccessReadWrite), ServerTimestamp: testTime}},
+		{counter, uaAttrBrowseName, uaDataValue{Value: uaQualifiedName{Namespace: opcuaAdapterNamespace, Name: "Counter"}, ServerTimestamp: testTime}},
+		{counter, uaAttrEventNotifier, uaDataValue{Status: uaStatusBadAttributeIDInvalid}},
+		{uaStringID(opcuaAdapterNamespace, "Temperature"), uaAttrValue, uaDataValue{Status: uaStatusBadNotSupported, ServerTimestamp: testTime}},
+		{uaStringID(opcuaAdapterNamespace, "Missing"), uaAttrValue, uaDataValue{Status: uaStatusBadNodeIDUnknown}},
+		{uaNumericID(uaIDNamespaceArray), uaAttrValue, uaDataValue{Value: []interface{}{"http://opcfoundation.org/UA/", opcuaNamespaceURI}, SourceTimestamp: testTime, ServerTimestamp: testTime}},
+	}
+	for _, test := range reads {
+		if got := client.read(test.node, test.attribute, 0); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("read %s attribute %d: expected %+v, got %+v", test.node, test.attribute, test.expected, got)
+		}
+	}
+
+	if status := client.write(counter, uaAttrValue, int32(-250)); status != uaStatusGood {
+		t.Fatalf("write failed: %#08x", uint32(status))
+	}
+	if got := sim.value("Counter"); !bytes.Equal(got, []byte{0x06, 0xff, 0xff, 0xff}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+
+	writes := []struct {
+		node      uaNodeID
+		attribute uint32
+		value     interface{}
+		expected  uaStatusCode
+	}{
+		{counter, uaAttrValue, "text", uaStatusBadTypeMismatch},
+		{counter, uaAttrDisplayName, uaLocalizedText("Renamed"), uaStatusBadNotWritable},
+		{uaNumericID(uaIDNamespaceArray), uaAttrValue, []string{"urn:other"}, uaStatusBadNotWritable},
+		{uaStringID(opcuaAdapterNamespace, "Missing"), uaAttrValue, int32(1), uaStatusBadNodeIDUnknown},
+	}
+	for _, test := range writes {
+		if got := client.write(test.node, test.attribute, test.value); got != test.expected {
+			t.Errorf("write %s attribute %d: expected %#08x, got %#08x", test.node, test.attribute, uint32(test.expected), uint32(got))
+		}
+	}
+
+	// anonymous sessions only read
+	anonymous := dialOPCUA(t, addr, opcuaBufferSize)
+	anonymous.openSession()
+	expected := uaDataValue{Value: byte(opcuaAccessRead), ServerTimestamp: testTime}
+	if got := anonymous.read(counter, uaAttrUserAccessLevel, 0); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	if status := anonymous.write(counter, uaAttrValue, int32(7)); status != uaStatusBadUserAccessDenied {
+		t.Errorf("expected BadUserAccessDenied, got %#08x", uint32(status))
+	}
+	if got := sim.value("Counter"); !bytes.Equal(got, []byte{0x06, 0xff, 0xff, 0xff}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+}
+
+func TestOPCUAReadMaxAge(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	addr := startTestOPCUAServer(t, sim)
+
+	client := dialOPCUA(t, addr, opcuaBufferSize)
+	client.openSession()
+	counter := uaStringID(opcuaAdapterNamespace, "Counter")
+
+	client.read(counter, uaAttrValue, 0)
+	sim.setValue("Counter", []byte{43, 0, 0, 0})
+
+	if got := client.read(counter, uaAttrValue, 5000); got.Value != int32(42) {
+		t.Errorf("expected the last value read to be served, got %v", got.Value)
+	}
+	if got := client.read(counter, uaAttrValue, 0); got.Value != int32(43) {
+		t.Errorf("expected a live read, got %v", got.Value)
+	}
+
+	// writes through the adapter drop the cached value
+	if err := writeTagByName("Counter", float64(44)); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.read(counter, uaAttrValue, 5000); got.Value != int32(44) {
+		t.Errorf("expected the written value, got %v", got.Value)
+	}
+}
+
+func TestOPCUAReadOnly(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	addr := startTestOPCUAServer(t, sim)
+
+	// the server is read only unless writes are enabled, user names are
+	// refused
+	client := dialOPCUA(t, addr, opcuaBufferSize)
+	client.openUserSession("operator", "secret", uaStatusBadIdentityTokenInvalid)
+	client.openSession()
+	counter := uaStringID(opcuaAdapterNamespace, "Counter")
+
+	expected := uaDataValue{Value: byte(opcuaAccessRead), ServerTimestamp: testTime}
+	if got := client.read(counter, uaAttrAccessLevel, 0); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	if status := client.write(counter, uaAttrValue, int32(7)); status != uaStatusBadNotWritable {
+		t.Errorf("expected BadNotWritable, got %#08x", uint32(status))
+	}
+	if got := sim.value("Counter"); !bytes.Equal(got, []byte{42, 0, 0, 0}) {
+		t.Errorf("unexpected controller value % x", got)
+	}
+}
+
+func TestOPCUASessionRequired(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	addr := startTestOPCUAServer(t, sim)
+
+	client := dialOPCUA(t, addr, opcuaBufferSize)
+	client.call(uaIDReadRequest, uaIDReadResponse, uaStatusBadSessionIDInvalid, func(e *uaEncoder) {
+		e.double(0)
+		e.uint32(2)
+		e.int32(0)
+	})
+
+	d := client.call(uaIDGetEndpointsRequest, uaIDGetEndpointsResponse, uaStatusGood, func(e *uaEncoder) {
+		e.string("")
+		e.stringArray(nil)
+		e.stringArray(nil)
+	})
+	if n := d.int32(); n != 1 {
+		t.Fatalf("expected 1 endpoint, got %d", n)
+	}
+	if url := d.string(); url != "opc.tcp://"+addr {
+		t.Errorf("unexpected endpoint url %s", url)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultPayloadEncoding = "json"
+
+// payloadCodec encodes the MQTT request and response payloads
+type payloadCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var payloadCodecs = map[string]payloadCodec{
+	"json":         jsonCodec{},
+	"compact_json": compactJSONCodec{},
+	"cbor":         cborCodec{},
+	"msgpack":      msgpackCodec{},
+	"protobuf":     protobufCodec{},
+}
+
+// protobufTopics are the topics below topic_root ethernet-ip-adapter.proto
+// has messages for
+var protobufTopics = map[string]bool{readTopic: true, writeTopic: true, browseTopic: true}
+
+// validatePayloadEncodings checks payload_encoding and topic_encodings name
+// known codecs, and that protobuf is only used for the topics it covers
+func validatePayloadEncodings() error {
+	encodings := []string{adapterSettings.PayloadEncoding}
+	for _, encoding := range adapterSettings.TopicEncodings {
+		encodings = append(encodings, encoding)
+	}
+	for _, encoding := range encodings {
+		if _, ok := payloadCodecs[encoding]; !ok && encoding != "" {
+			return fmt.Errorf("unsupported payload encoding %s", encoding)
+		}
+	}
+
+	for _, topic := range encodedTopics() {
+		encoding := adapterSettings.PayloadEncoding
+		if e, ok := adapterSettings.TopicEncodings[topic]; ok {
+			encoding = e
+		}
+		if encoding == "protobuf" && !protobufTopics[topic] {
+			return fmt.Errorf("protobuf does not cover the %s topic, select another encoding for it in topic_encodings", topic)
+		}
+	}
+	return nil
+}
+
+// encodedTopics returns the topics below topic_root whose payloads are
+// encoded with payload_encoding, for the features that are enabled
+func encodedTopics() []string {
+	topics := []string{readTopic, writeTopic, browseTopic}
+	if len(adapterSettings.Alarms) > 0 || adapterSettings.LogixAlarms {
+		topics = append(topics, eventsTopic, alarmAckTopic)
+	}
+	if adapterSettings.AuditLog != "" {
+		topics = append(topics, auditTopic)
+	}
+	if adapterSettings.RecipeCollection != "" || adapterSettings.RecipeFile != "" {
+		for _, operation := range []string{recipeList, recipeDownload, recipeUpload, recipeDiff} {
+			topics = append(topics, recipesTopic+"/"+operation)
+		}
+	}
+	for topic := range adapterSettings.TopicEncodings {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// codecForTopic returns the codec configured for a request topic or its
+// response topic. topic_encodings is keyed by the topic below topic_root,
+// e.g. "read" also applies to "read/response".
+func codecForTopic(topic string) payloadCodec {
+	encoding := adapterSettings.PayloadEncoding
+	name := strings.TrimSuffix(strings.TrimPrefix(topic, adapterConfig.TopicRoot+"/"), "/response")
+	if e, ok := adapterSettings.TopicEncodings[name]; ok {
+		encoding = e
+	}
+	if codec, ok := payloadCodecs[encoding]; ok {
+		return codec
+	}
+	return payloadCodecs[defaultPayloadEncoding]
+}
+
+func decodePayload(topic string, payload []byte, v interface{}) error {
+	return codecForTopic(topic).Unmarshal(payload, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// toGeneric converts a message to the maps, slices and scalars its JSON
+// encoding describes so the other codecs can reuse the json struct tags.
+// Numbers are kept as json.Number to tell integers from floats.
+func toGeneric(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var generic interface{}
+	err = decoder.Decode(&generic)
+	return generic, err
+}
+
+// fromGeneric populates a message from a decoded generic value
+func fromGeneric(generic interface{}, v interface{}) error {
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// compactJSONCodec shortens the field names and replaces the RFC3339
+// timestamps with epoch milliseconds
+type compactJSONCodec struct{}
+
+var compactKeys = map[string]string{
+	"server_timestamp": "st",
+	"source_timestamp": "t",
+	"timestamp":        "ts",
+	"value":            "v",
+	"data":             "d",
+	"success":          "ok",
+	"status_code":      "sc",
+	"error_message":    "e",
+	"node_id":          "id",
+	"name":             "n",
+	"data_type":        "dt",
+	"type_code":        "tc",
+	"structure":        "s",
+	"dimensions":       "dm",
+	"units":            "u",
+}
+
+var compactTimestampKeys = map[string]bool{"server_timestamp": true, "source_timestamp": true, "timestamp": true}
+
+func (compactJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(compactFields(generic, false))
+}
+
+func (compactJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	return fromGeneric(expandFields(generic, false), v)
+}
+
+// compactFields renames the fields of v. The keys of "data" are tag names
+// and tag values are left as they are.
+func compactFields(v interface{}, tagNames bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			switch {
+			case tagNames:
+				out[key] = compactFields(value, false)
+			case key == "value":
+				out[compactKeys[key]] = value
+			case compactTimestampKeys[key]:
+				out[compactKeys[key]] = epochMillis(value)
+			case compactKeys[key] != "":
+				out[compactKeys[key]] = compactFields(value, key == "data")
+			default:
+				out[key] = compactFields(value, false)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = compactFields(value, false)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func expandFields(v interface{}, tagNames bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			long := key
+			for l, s := range compactKeys {
+				if s == key && !tagNames {
+					long = l
+				}
+			}
+			switch {
+			case tagNames:
+				out[key] = expandFields(value, false)
+			case long == "value":
+				out[long] = value
+			case compactTimestampKeys[long]:
+				out[long] = rfc3339(value)
+			default:
+				out[long] = expandFields(value, long == "data")
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = expandFields(value, false)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// epochMillis converts an RFC3339 timestamp, anything else is returned as is
+func epochMillis(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return v
+	}
+	return t.UnixMilli()
+}
+
+func rfc3339(v interface{}) interface{} {
+	ms, ok := v.(float64)
+	if !ok {
+		return v
+	}
+	return time.UnixMilli(int64(ms)).UTC().Format(time.RFC3339)
+}
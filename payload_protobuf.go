@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// protobufCodec encodes the messages described by ethernet-ip-adapter.proto
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	w := &protoWriter{}
+	var err error
+
+	switch m := v.(type) {
+	case ethernetIpReadResponseMQTTMessage:
+		err = encodeProtoReadResponse(w, &m)
+	case *ethernetIpReadResponseMQTTMessage:
+		err = encodeProtoReadResponse(w, m)
+	case ethernetIpWriteResponseMQTTMessage:
+		err = encodeProtoWriteResponse(w, &m)
+	case *ethernetIpWriteResponseMQTTMessage:
+		err = encodeProtoWriteResponse(w, m)
+	case ethernetIpBrowseResponseMQTTMessage:
+		encodeProtoBrowseResponse(w, &m)
+	case *ethernetIpBrowseResponseMQTTMessage:
+		encodeProtoBrowseResponse(w, m)
+	default:
+		return nil, fmt.Errorf("no protobuf message for %T", v)
+	}
+
+	return w.buf, err
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case *ethernetIpReadRequestMQTTMessage:
+		return decodeProtoReadRequest(data, m)
+	case *ethernetIpWriteRequestMQTTMessage:
+		return decodeProtoWriteRequest(data, m)
+	default:
+		return fmt.Errorf("no protobuf message for %T", v)
+	}
+}
+
+// proto3 leaves fields with their default value out of the message
+
+func protoString(w *protoWriter, field int, v string) {
+	if v != "" {
+		w.string(field, v)
+	}
+}
+
+func protoUint(w *protoWriter, field int, v uint64) {
+	if v != 0 {
+		w.uint(field, v)
+	}
+}
+
+func protoBool(w *protoWriter, field int, v bool) {
+	if v {
+		w.bool(field, v)
+	}
+}
+
+// protoTimestamp writes an RFC3339 timestamp as epoch milliseconds
+func protoTimestamp(w *protoWriter, field int, v string) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err == nil {
+		protoUint(w, field, uint64(t.UnixMilli()))
+	}
+}
+
+func encodeProtoValue(value interface{}) ([]byte, error) {
+	w := &protoWriter{}
+	switch v := value.(type) {
+	case nil:
+	case bool:
+		w.bool(1, v)
+	case int:
+		w.uint(2, zigzag(int64(v)))
+	case int8:
+		w.uint(2, zigzag(int64(v)))
+	case int16:
+		w.uint(2, zigzag(int64(v)))
+	case int32:
+		w.uint(2, zigzag(int64(v)))
+	case int64:
+		w.uint(2, zigzag(v))
+	case uint8:
+		w.uint(2, zigzag(int64(v)))
+	case uint16:
+		w.uint(2, zigzag(int64(v)))
+	case uint32:
+		w.uint(2, zigzag(int64(v)))
+	case float32:
+		w.double(3, float64(v))
+	case float64:
+		w.double(3, v)
+	case string:
+		w.string(4, v)
+	default:
+		return nil, fmt.Errorf("cannot encode %T as a protobuf value", value)
+	}
+	return w.buf, nil
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func encodeProtoReadResponse(w *protoWriter, m *ethernetIpReadResponseMQTTMessage) error {
+	protoTimestamp(w, 1, m.ServerTimestamp)
+
+	names := make([]string, 0, len(m.Data))
+	for name := range m.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := encodeProtoValue(m.Data[name].Value)
+		if err != nil {
+			return err
+		}
+		tagValue := &protoWriter{}
+		tagValue.bytes(1, value)
+		protoTimestamp(tagValue, 2, m.Data[name].SourceTimestamp)
+		protoString(tagValue, 3, m.Data[name].Units)
+
+		entry := &protoWriter{}
+		entry.string(1, name)
+		entry.bytes(2, tagValue.buf)
+		w.bytes(2, entry.buf)
+	}
+
+	protoBool(w, 3, m.Success)
+	protoUint(w, 4, uint64(m.StatusCode))
+	protoString(w, 5, m.ErrorMessage)
+	return nil
+}
+
+func encodeProtoWriteResponse(w *protoWriter, m *ethernetIpWriteResponseMQTTMessage) error {
+	protoString(w, 1, m.NodeID)
+	protoTimestamp(w, 2, m.Timestamp)
+	protoBool(w, 3, m.Success)
+	protoUint(w, 4, uint64(m.StatusCode))
+	protoString(w, 5, m.ErrorMessage)
+	if m.Verified != nil {
+		protoBool(w, 6, *m.Verified)
+	}
+	if m.ObservedValue != nil {
+		value, err := encodeProtoValue(m.ObservedValue)
+		if err != nil {
+			return err
+		}
+		w.bytes(7, value)
+	}
+
+	names := make([]string, 0, len(m.Results))
+	for name := range m.Results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result := &protoWriter{}
+		protoBool(result, 1, m.Results[name].Success)
+		protoString(result, 2, m.Results[name].ErrorMessage)
+		protoBool(result, 3, m.Results[name].RolledBack)
+
+		entry := &protoWriter{}
+		entry.string(1, name)
+		entry.bytes(2, result.buf)
+		w.bytes(8, entry.buf)
+	}
+
+	protoString(w, 9, m.Token)
+	protoTimestamp(w, 10, m.Expires)
+	protoString(w, 11, m.State)
+	if m.Value != nil {
+		value, err := encodeProtoValue(m.Value)
+		if err != nil {
+			return err
+		}
+		w.bytes(12, value)
+	}
+	return nil
+}
+
+func encodeProtoBrowseResponse(w *protoWriter, m *ethernetIpBrowseResponseMQTTMessage) {
+	protoTimestamp(w, 1, m.Timestamp)
+	for _, tag := range m.Tags {
+		info := &protoWriter{}
+		protoString(info, 1, tag.Name)
+		protoString(info, 2, tag.DataType)
+		protoUint(info, 3, uint64(tag.TypeCode))
+		protoBool(info, 4, tag.Structure)
+		protoUint(info, 5, uint64(tag.Dimensions))
+		protoString(info, 6, tag.Units)
+		protoBool(info, 7, tag.Virtual)
+		protoString(info, 8, tag.Expression)
+		for _, alias := range tag.Aliases {
+			info.string(9, alias)
+		}
+		w.bytes(2, info.buf)
+	}
+	protoBool(w, 3, m.Success)
+	protoUint(w, 4, uint64(m.StatusCode))
+	protoString(w, 5, m.ErrorMessage)
+}
+
+func decodeProtoReadRequest(data []byte, m *ethernetIpReadRequestMQTTMessage) error {
+	r := &protoReader{buf: data}
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			break
+		}
+		if field == 1 && wireType == protoBytes {
+			m.Tags = append(m.Tags, string(r.bytes()))
+		} else if field == 2 && wireType == protoVarint {
+			m.MaxAge = uint(r.varint())
+		} else {
+			r.skip(wireType)
+		}
+	}
+	return r.err
+}
+
+func decodeProtoWriteRequest(data []byte, m *ethernetIpWriteRequestMQTTMessage) error {
+	r := &protoReader{buf: data}
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			break
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			m.NodeID = string(r.bytes())
+		case field == 2 && wireType == protoBytes:
+			m.Value = decodeProtoValue(r, r.bytes())
+		case field == 3 && wireType == protoBytes:
+			m.User = string(r.bytes())
+		case field == 4 && wireType == protoVarint:
+			m.Verify = r.varint() != 0
+		case field == 5 && wireType == protoBytes:
+			name, value := decodeProtoValueEntry(r, r.bytes())
+			if m.Values == nil {
+				m.Values = map[string]interface{}{}
+			}
+			m.Values[name] = value
+		case field == 6 && wireType == protoVarint:
+			m.Atomic = r.varint() != 0
+		case field == 7 && wireType == protoBytes:
+			m.Token = string(r.bytes())
+		case field == 8 && wireType == protoVarint:
+			m.Cancel = r.varint() != 0
+		case field == 9 && wireType == protoBytes:
+			m.Operation = string(r.bytes())
+		case field == 10 && wireType == protoBytes:
+			m.ResetValue = decodeProtoValue(r, r.bytes())
+		case field == 11 && wireType == protoVarint:
+			m.Duration = uint(r.varint())
+		case field == 12 && wireType == protoVarint:
+			m.Interval = uint(r.varint())
+		default:
+			r.skip(wireType)
+		}
+	}
+	return r.err
+}
+
+// decodeProtoValueEntry decodes an entry of a map<string, Value>, errors are
+// reported on parent
+func decodeProtoValueEntry(parent *protoReader, data []byte) (string, interface{}) {
+	var name string
+	var value interface{}
+	r := &protoReader{buf: data}
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			break
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			name = string(r.bytes())
+		case field == 2 && wireType == protoBytes:
+			value = decodeProtoValue(r, r.bytes())
+		default:
+			r.skip(wireType)
+		}
+	}
+	if r.err != nil && parent.err == nil {
+		parent.err = r.err
+	}
+	return name, value
+}
+
+// decodeProtoValue returns the value as its JSON request equivalent, integers
+// become float64. Errors are reported on parent.
+func decodeProtoValue(parent *protoReader, data []byte) interface{} {
+	var value interface{}
+	r := &protoReader{buf: data}
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			break
+		}
+		switch {
+		case field == 1 && wireType == protoVarint:
+			value = r.varint() != 0
+		case field == 2 && wireType == protoVarint:
+			v := r.varint()
+			value = float64(int64(v>>1) ^ -int64(v&1))
+		case field == 3 && wireType == protoFixed64:
+			value = r.double()
+		case field == 4 && wireType == protoBytes:
+			value = string(r.bytes())
+		default:
+			r.skip(wireType)
+		}
+	}
+	if r.err != nil && parent.err == nil {
+		parent.err = r.err
+	}
+	return value
+}
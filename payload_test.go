@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPayloadCodecEncoding(t *testing.T) {
+	generic := map[string]interface{}{"a": -1, "b": []interface{}{true, nil, 1.5}, "c": 300}
+
+	tests := []struct {
+		encoding string
+		expected []byte
+	}{
+		{
+			encoding: "json",
+			expected: []byte(`{"a":-1,"b":[true,null,1.5],"c":300}`),
+		},
+		{
+			encoding: "cbor",
+			expected: []byte{
+				0xa3,
+				0x61, 'a', 0x20,
+				0x61, 'b', 0x83, 0xf5, 0xf6, 0xfb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x61, 'c', 0x19, 0x01, 0x2c,
+			},
+		},
+		{
+			encoding: "msgpack",
+			expected: []byte{
+				0x83,
+				0xa1, 'a', 0xff,
+				0xa1, 'b', 0x93, 0xc3, 0xc0, 0xcb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0xa1, 'c', 0xcd, 0x01, 0x2c,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.encoding, func(t *testing.T) {
+			codec := payloadCodecs[test.encoding]
+			got, err := codec.Marshal(generic)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !bytes.Equal(got, test.expected) {
+				t.Fatalf("unexpected encoding\nexpected: % x\n     got: % x", test.expected, got)
+			}
+
+			decoded := map[string]interface{}{}
+			if err := codec.Unmarshal(got, &decoded); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			expected := map[string]interface{}{"a": float64(-1), "b": []interface{}{true, nil, 1.5}, "c": float64(300)}
+			if !reflect.DeepEqual(decoded, expected) {
+				t.Fatalf("unexpected round trip %#v", decoded)
+			}
+
+			if err := codec.Unmarshal(got[:len(got)-1], &decoded); err == nil {
+				t.Fatal("expected an error for a truncated payload")
+			}
+		})
+	}
+}
+
+func TestCompactJSONCodec(t *testing.T) {
+	codec := compactJSONCodec{}
+	timestamp := testTime.Format(time.RFC3339)
+
+	got, err := codec.Marshal(ethernetIpReadResponseMQTTMessage{
+		ServerTimestamp: timestamp,
+		Data:            map[string]ethernetIpReadResponseData{"value": {Value: int32(42), SourceTimestamp: timestamp}},
+		Success:         true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := `{"d":{"value":{"t":1662035400000,"v":42}},"e":"","ok":true,"sc":0,"st":1662035400000}`
+	if string(got) != expected {
+		t.Fatalf("unexpected encoding\nexpected: %s\n     got: %s", expected, got)
+	}
+
+	response := ethernetIpReadResponseMQTTMessage{}
+	if err := codec.Unmarshal(got, &response); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if response.ServerTimestamp != timestamp || response.Data["value"].Value != float64(42) || !response.Success {
+		t.Fatalf("unexpected round trip %+v", response)
+	}
+
+	request := ethernetIpWriteRequestMQTTMessage{}
+	if err := codec.Unmarshal([]byte(`{"id": "Setpoint", "v": -250}`), &request); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if request.NodeID != "Setpoint" || request.Value != float64(-250) {
+		t.Fatalf("unexpected write request %+v", request)
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec := protobufCodec{}
+
+	got, err := codec.Marshal(&ethernetIpWriteResponseMQTTMessage{NodeID: "A", Timestamp: testTime.Format(time.RFC3339), Success: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := []byte{
+		0x0a, 0x01, 'A', // node_id
+		0x10, 0xc0, 0xaa, 0x9e, 0xc8, 0xaf, 0x30, // timestamp
+		0x18, 0x01, // success
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("unexpected encoding\nexpected: % x\n     got: % x", expected, got)
+	}
+
+	request := ethernetIpWriteRequestMQTTMessage{}
+	payload := append([]byte{0x0a, 0x08}, "Setpoint"...)
+	payload = append(payload, 0x12, 0x03, 0x10, 0xf3, 0x03)
+	if err := codec.Unmarshal(payload, &request); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if request.NodeID != "Setpoint" || request.Value != float64(-250) {
+		t.Fatalf("unexpected write request %+v", request)
+	}
+
+	request = ethernetIpWriteRequestMQTTMessage{}
+	payload = []byte{0x2a, 0x08, 0x0a, 0x01, 'A', 0x12, 0x03, 0x10, 0xf3, 0x03, 0x30, 0x01}
+	if err := codec.Unmarshal(payload, &request); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(request.Values) != 1 || request.Values["A"] != float64(-250) || !request.Atomic {
+		t.Fatalf("unexpected batch write request %+v", request)
+	}
+
+	readRequest := ethernetIpReadRequestMQTTMessage{}
+	if err := codec.Unmarshal([]byte{0x0a, 0x01, 'A', 0x10, 0xe8, 0x07}, &readRequest); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(readRequest.Tags) != 1 || readRequest.Tags[0] != "A" || readRequest.MaxAge != 1000 {
+		t.Fatalf("unexpected read request %+v", readRequest)
+	}
+
+	if _, err := codec.Marshal(ethernetIpTagInfo{}); err == nil {
+		t.Fatal("expected an error for a message without a protobuf schema")
+	}
+}
+
+func TestTopicEncodings(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addDINT("Setpoint", 10)
+	transport := startTestAdapter(t, sim)
+	adapterSettings.PayloadEncoding = "cbor"
+	adapterSettings.TopicEncodings = map[string]string{"write": "protobuf", "browse": "json"}
+
+	if err := validatePayloadEncodings(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	request, _ := cborCodec{}.Marshal(ethernetIpReadRequestMQTTMessage{Tags: []string{"Counter"}})
+	transport.send(testTopicRoot+"/read", string(request))
+	msg := transport.next(t, testTopicRoot+"/read/response")
+	response := ethernetIpReadResponseMQTTMessage{}
+	if err := (cborCodec{}).Unmarshal(msg.payload, &response); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if response.Data["Counter"].Value != float64(42) {
+		t.Fatalf("unexpected read response %+v", response)
+	}
+
+	payload := append([]byte{0x0a, 0x08}, "Setpoint"...)
+	payload = append(payload, 0x12, 0x03, 0x10, 0xf3, 0x03)
+	transport.send(testTopicRoot+"/write", string(payload))
+	msg = transport.next(t, testTopicRoot+"/write/response")
+	expected := append([]byte{0x0a, 0x08}, "Setpoint"...)
+	expected = append(expected, 0x10, 0xc0, 0xaa, 0x9e, 0xc8, 0xaf, 0x30, 0x18, 0x01)
+	if !bytes.Equal(msg.payload, expected) {
+		t.Fatalf("unexpected write response % x", msg.payload)
+	}
+	if got := sim.value("Setpoint"); !bytes.Equal(got, []byte{0x06, 0xff, 0xff, 0xff}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+
+	transport.send(testTopicRoot+"/browse", `{}`)
+	transport.expect(t, testTopicRoot+"/browse/response", `{
+		"timestamp": "2022-09-01T12:30:00Z",
+		"tags": [
+			{"name": "Counter", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0},
+			{"name": "Setpoint", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0}
+		],
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	adapterSettings.TopicEncodings["read"] = "xml"
+	if err := validatePayloadEncodings(); err == nil {
+		t.Fatal("expected an error for an unsupported encoding")
+	}
+
+	// topics without protobuf messages are rejected at startup
+	adapterSettings.TopicEncodings = map[string]string{"events": "protobuf"}
+	if err := validatePayloadEncodings(); err == nil {
+		t.Fatal("expected an error for protobuf on the events topic")
+	}
+	adapterSettings.PayloadEncoding = "protobuf"
+	adapterSettings.TopicEncodings = nil
+	adapterSettings.AuditLog = "audit.log"
+	if err := validatePayloadEncodings(); err == nil || err.Error() != "protobuf does not cover the audit topic, select another encoding for it in topic_encodings" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	adapterSettings.TopicEncodings = map[string]string{"audit": "json"}
+	if err := validatePayloadEncodings(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const defaultPollInterval = 1000
+
+// pollResult is handed to the poll listeners after every poll
+//
+// values - every polled tag that could be read, by name
+// changed - sorted names of the tags whose value changed since the last poll,
+// every tag is reported as changed on the first poll after (re)connecting
+// err - set when the controller could not be read, values is empty
+type pollResult struct {
+	timestamp time.Time
+	values    map[string]interface{}
+	changed   []string
+	err       error
+}
+
+type pollListener func(result pollResult)
+
+// tagPoller periodically reads the controller tags for the outputs that
+// publish on change rather than on request. A tag the controller refuses to
+// read, e.g. with a CIP error status, is left out of the poll. A read that
+// does not reach the controller is treated as a lost connection, the
+// listeners are told once and the poller reconnects on the following polls.
+type tagPoller struct {
+	tags         []string
+	values       map[string]interface{}
+	disconnected bool
+	listeners    []pollListener
+}
+
+var poller = &tagPoller{}
+
+func (p *tagPoller) addListener(listener pollListener) {
+	p.listeners = append(p.listeners, listener)
+}
+
+// startPoller polls at poll_interval_ms until the process exits
+func startPoller() {
+	interval := adapterSettings.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	poller.tags = adapterSettings.PollTags
+
+	log.Printf("[INFO] startPoller - Polling controller tags every %dms\n", interval)
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	for {
+		err := scheduler.do(priorityPoll, func() error {
+			poller.poll()
+			return nil
+		})
+		if err != nil {
+			log.Printf("[ERROR] startPoller - Skipped poll: %s\n", err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+func (p *tagPoller) poll() {
+	if p.disconnected {
+		if err := reconnectEIP(); err != nil {
+			log.Printf("[ERROR] poll - Failed to reconnect to EtherNet-IP server: %s\n", err.Error())
+			return
+		}
+		p.disconnected = false
+	}
+
+	result := pollResult{timestamp: timeNow(), values: make(map[string]interface{})}
+	var virtual []string
+	for _, name := range p.tagNames() {
+		if _, ok := virtualTags[resolveTagName(name)]; ok {
+			virtual = append(virtual, name)
+			continue
+		}
+
+		tag, err := lookupTag(name)
+		if err != nil {
+			log.Printf("[ERROR] poll - Cannot poll tag, tag does not exist %s\n", name)
+			continue
+		}
+
+		value, err := cachedReadTag(tag, 0)
+		if errors.Is(err, errUnsupportedType) {
+			continue
+		}
+		if err != nil && controllerConnected() {
+			// the controller replied, only this tag is bad
+			log.Printf("[ERROR] poll - Cannot poll tag: %s\n", err.Error())
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR] poll - Lost connection to EtherNet-IP server: %s\n", err.Error())
+			p.disconnected = true
+			p.values = nil
+			p.notify(pollResult{timestamp: result.timestamp, values: map[string]interface{}{}, err: err})
+			return
+		}
+
+		result.values[name] = value.Value
+	}
+
+	// virtual tags are evaluated from the values of this poll
+	for name, value := range evaluateVirtualTags(virtual, result.values) {
+		result.values[name] = value
+	}
+
+	for name, value := range result.values {
+		if previous, ok := p.values[name]; !ok || !reflect.DeepEqual(previous, value) {
+			result.changed = append(result.changed, name)
+		}
+	}
+
+	sort.Strings(result.changed)
+	p.values = result.values
+	p.notify(result)
+}
+
+// tagNames returns poll_tags, or every controller and virtual tag when not set
+func (p *tagPoller) tagNames() []string {
+	if len(p.tags) > 0 {
+		return p.tags
+	}
+
+	names := make([]string, 0, len(eipTagMap))
+	for name := range eipTagMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append(names, virtualTagNames()...)
+}
+
+func (p *tagPoller) notify(result pollResult) {
+	for _, listener := range p.listeners {
+		listener(result)
+	}
+}
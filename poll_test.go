@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPollReadErrors(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 1)
+	sim.addDINT("Removed", 2)
+	startTestAdapter(t, sim)
+
+	prevPoller := poller
+	t.Cleanup(func() { poller = prevPoller })
+	poller = &tagPoller{tags: []string{"Counter", "Removed"}}
+	var results []pollResult
+	poller.addListener(func(result pollResult) { results = append(results, result) })
+
+	// a tag the controller no longer knows is left out, the poll goes on
+	sim.mu.Lock()
+	delete(sim.tags, "Removed")
+	sim.mu.Unlock()
+	poller.poll()
+	if len(results) != 1 || results[0].err != nil || len(results[0].values) != 1 || results[0].values["Counter"] != int32(1) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if poller.disconnected {
+		t.Fatal("a CIP error status must not disconnect the poller")
+	}
+
+	// a read that does not reach the controller is a lost connection
+	sim.setOffline(true)
+	poller.poll()
+	if len(results) != 2 || results[1].err == nil || !poller.disconnected {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	sim.setOffline(false)
+	poller.poll()
+	if len(results) != 3 || results[2].err != nil || results[2].values["Counter"] != int32(1) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// Protocol Buffers wire format, https://protobuf.dev/programming-guides/encoding/
+//
+// The adapter only needs to encode and decode a handful of fixed messages, so
+// they are written by hand rather than generated.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf message truncated")
+
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) varint(v uint64) {
+	for v >= 0x80 {
+		w.buf = append(w.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	w.buf = append(w.buf, byte(v))
+}
+
+func (w *protoWriter) key(field int, wireType int) {
+	w.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (w *protoWriter) uint(field int, v uint64) {
+	w.key(field, protoVarint)
+	w.varint(v)
+}
+
+func (w *protoWriter) bool(field int, v bool) {
+	if v {
+		w.uint(field, 1)
+	} else {
+		w.uint(field, 0)
+	}
+}
+
+func (w *protoWriter) float(field int, v float32) {
+	w.key(field, protoFixed32)
+	b := math.Float32bits(v)
+	w.buf = append(w.buf, byte(b), byte(b>>8), byte(b>>16), byte(b>>24))
+}
+
+func (w *protoWriter) double(field int, v float64) {
+	w.key(field, protoFixed64)
+	b := math.Float64bits(v)
+	for i := 0; i < 64; i += 8 {
+		w.buf = append(w.buf, byte(b>>i))
+	}
+}
+
+func (w *protoWriter) bytes(field int, v []byte) {
+	w.key(field, protoBytes)
+	w.varint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *protoWriter) string(field int, v string) {
+	w.bytes(field, []byte(v))
+}
+
+// protoReader walks the fields of a message. Errors are sticky, next returns
+// false once the message is exhausted or malformed and err says which.
+type protoReader struct {
+	buf []byte
+	err error
+}
+
+func (r *protoReader) next() (field int, wireType int, ok bool) {
+	if r.err != nil || len(r.buf) == 0 {
+		return 0, 0, false
+	}
+	key := r.varint()
+	return int(key >> 3), int(key & 0x07), r.err == nil
+}
+
+func (r *protoReader) varint() uint64 {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		if i >= len(r.buf) {
+			break
+		}
+		b := r.buf[i]
+		v |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			r.buf = r.buf[i+1:]
+			return v
+		}
+	}
+	r.err = errProtoTruncated
+	return 0
+}
+
+func (r *protoReader) fixed(size int) uint64 {
+	if len(r.buf) < size {
+		r.err = errProtoTruncated
+		return 0
+	}
+	var v uint64
+	for i := 0; i < size; i++ {
+		v |= uint64(r.buf[i]) << (8 * i)
+	}
+	r.buf = r.buf[size:]
+	return v
+}
+
+func (r *protoReader) float() float32 {
+	return math.Float32frombits(uint32(r.fixed(4)))
+}
+
+func (r *protoReader) double() float64 {
+	return math.Float64frombits(r.fixed(8))
+}
+
+func (r *protoReader) bytes() []byte {
+	n := r.varint()
+	if r.err != nil || uint64(len(r.buf)) < n {
+		r.err = errProtoTruncated
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// skip discards the value of a field the decoder does not use
+func (r *protoReader) skip(wireType int) {
+	switch wireType {
+	case protoVarint:
+		r.varint()
+	case protoFixed64:
+		r.fixed(8)
+	case protoBytes:
+		r.bytes()
+	case protoFixed32:
+		r.fixed(4)
+	default:
+		r.err = errors.New("unsupported protobuf wire type")
+	}
+}
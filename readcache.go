@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+)
+
+// tagReadCache keeps the last value read of every tag, so read requests that
+// accept an older value are answered without a controller request. Requests
+// for a tag that is being read wait for that read rather than sending their
+// own.
+type tagReadCache struct {
+	mu       sync.Mutex
+	values   map[string]cachedRead
+	inFlight map[string]*pendingRead
+}
+
+type cachedRead struct {
+	value  ethernetIpReadResponseData
+	readAt time.Time
+}
+
+// pendingRead is a read in progress, stale when the tag was written since
+// the read started so its value is not cached
+type pendingRead struct {
+	done  chan struct{}
+	value ethernetIpReadResponseData
+	err   error
+	stale bool
+}
+
+var readCache = newTagReadCache()
+
+func newTagReadCache() *tagReadCache {
+	return &tagReadCache{values: map[string]cachedRead{}, inFlight: map[string]*pendingRead{}}
+}
+
+// read returns the cached value of a tag when it was read no more than maxAge
+// ago, otherwise the value of a read of the tag in progress or of a new read
+func (c *tagReadCache) read(name string, maxAge time.Duration, read func() (ethernetIpReadResponseData, error)) (ethernetIpReadResponseData, error) {
+	c.mu.Lock()
+	if cached, ok := c.values[name]; ok && maxAge > 0 && timeNow().Sub(cached.readAt) <= maxAge {
+		c.mu.Unlock()
+		return cached.value, nil
+	}
+	if pending, ok := c.inFlight[name]; ok {
+		c.mu.Unlock()
+		<-pending.done
+		return pending.value, pending.err
+	}
+	pending := &pendingRead{done: make(chan struct{})}
+	c.inFlight[name] = pending
+	c.mu.Unlock()
+
+	readAt := timeNow()
+	pending.value, pending.err = read()
+
+	c.mu.Lock()
+	if c.inFlight[name] == pending {
+		delete(c.inFlight, name)
+	}
+	if pending.err == nil && !pending.stale {
+		c.values[name] = cachedRead{value: pending.value, readAt: readAt}
+	}
+	c.mu.Unlock()
+	close(pending.done)
+	return pending.value, pending.err
+}
+
+// invalidate drops the cached value of a written tag and of its bits and
+// members. Reads in progress are marked stale and forgotten, so later reads
+// do not wait for a value from before the write.
+func (c *tagReadCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cached := range c.values {
+		if cached == name || strings.HasPrefix(cached, name+".") {
+			delete(c.values, cached)
+		}
+	}
+	for reading, pending := range c.inFlight {
+		if reading == name || strings.HasPrefix(reading, name+".") {
+			pending.stale = true
+			delete(c.inFlight, reading)
+		}
+	}
+}
+
+// cachedReadTag reads a controller tag through the read cache
+func cachedReadTag(tag *eip.Tag, maxAge time.Duration) (ethernetIpReadResponseData, error) {
+	return readCache.read(tag.Name(), maxAge, func() (ethernetIpReadResponseData, error) {
+		return readTag(tag)
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadCacheMaxAge(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 1)
+	transport := startTestAdapter(t, sim)
+
+	now := testTime
+	timeNow = func() time.Time { return now }
+	expectCounter := func(request string, value string, readAt string) {
+		t.Helper()
+		transport.send(testTopicRoot+"/read", request)
+		transport.expect(t, testTopicRoot+"/read/response", `{"server_timestamp": "`+now.UTC().Format(time.RFC3339)+`", "data": {"Counter": {"value": `+value+`, "source_timestamp": "`+readAt+`"}}, "success": true, "status_code": 0, "error_message": ""}`)
+	}
+
+	expectCounter(`{"tags": ["Counter"]}`, "1", "2022-09-01T12:30:00Z")
+	sim.setValue("Counter", []byte{2, 0, 0, 0})
+
+	// the value read at 12:30:00 is served while it is no older than max_age_ms
+	now = testTime.Add(800 * time.Millisecond)
+	expectCounter(`{"tags": ["Counter"], "max_age_ms": 1000}`, "1", "2022-09-01T12:30:00Z")
+	expectCounter(`{"tags": ["Counter"]}`, "2", "2022-09-01T12:30:00Z")
+	sim.setValue("Counter", []byte{3, 0, 0, 0})
+	now = testTime.Add(1500 * time.Millisecond)
+	expectCounter(`{"tags": ["Counter"], "max_age_ms": 1000}`, "2", "2022-09-01T12:30:00Z")
+	now = testTime.Add(2500 * time.Millisecond)
+	expectCounter(`{"tags": ["Counter"], "max_age_ms": 1000}`, "3", "2022-09-01T12:30:02Z")
+
+	// writes drop the cached value
+	transport.send(testTopicRoot+"/write", `{"node_id": "Counter", "value": 4}`)
+	transport.next(t, testTopicRoot+"/write/response")
+	expectCounter(`{"tags": ["Counter"], "max_age_ms": 1000}`, "4", "2022-09-01T12:30:02Z")
+}
+
+func TestReadCacheCoalescing(t *testing.T) {
+	prevNow := timeNow
+	t.Cleanup(func() { timeNow = prevNow })
+	timeNow = func() time.Time { return testTime }
+
+	cache := newTagReadCache()
+	release := make(chan struct{})
+	var reads int32
+	read := func() (ethernetIpReadResponseData, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return ethernetIpReadResponseData{Value: int32(42)}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, _ := cache.read("Counter", 0, read)
+			results[i] = value.Value
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if reads != 1 {
+		t.Fatalf("expected the concurrent reads to share one controller read, got %d", reads)
+	}
+	for _, result := range results {
+		if result != int32(42) {
+			t.Fatalf("unexpected results %v", results)
+		}
+	}
+
+	// a write during the read keeps its value out of the cache
+	release = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		cache.read("Flags.3", 0, read)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cache.invalidate("Flags")
+	close(release)
+	<-done
+	if _, ok := cache.values["Flags.3"]; ok {
+		t.Fatal("a value read before the write was cached")
+	}
+
+	// and reads after the write do not wait for the read from before it
+	release = make(chan struct{})
+	before := make(chan interface{})
+	go func() {
+		value, _ := cache.read("Setpoint", 0, read)
+		before <- value.Value
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cache.invalidate("Setpoint")
+	after := make(chan interface{})
+	go func() {
+		value, _ := cache.read("Setpoint", 0, func() (ethernetIpReadResponseData, error) {
+			return ethernetIpReadResponseData{Value: int32(7)}, nil
+		})
+		after <- value.Value
+	}()
+	select {
+	case value := <-after:
+		if value != int32(7) {
+			t.Fatalf("unexpected read after the write %v", value)
+		}
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("the read after the write waited for the read before it")
+	}
+	close(release)
+	if value := <-before; value != int32(42) {
+		t.Fatalf("unexpected read before the write %v", value)
+	}
+	if cached := cache.values["Setpoint"]; cached.value.Value != int32(7) {
+		t.Fatalf("unexpected cached value %v", cached.value.Value)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	adapter_library "github.com/clearblade/adapter-go-library"
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	recipesTopic = "recipes"
+
+	recipeList     = "list"
+	recipeDownload = "download"
+	recipeUpload   = "upload"
+	recipeDiff     = "diff"
+)
+
+var errRecipeNotFound = errors.New("recipe does not exist")
+
+// recipeStore keeps the recipe definitions, a recipe is a named set of tag
+// values
+type recipeStore interface {
+	load() (map[string]map[string]interface{}, error)
+	save(name string, values map[string]interface{}) error
+}
+
+var recipes recipeStore
+
+// initializeRecipes selects where the recipes are stored, the recipe topics
+// are rejected when neither recipe_collection nor recipe_file is set
+func initializeRecipes() error {
+	switch {
+	case adapterSettings.RecipeCollection != "" && adapterSettings.RecipeFile != "":
+		return fmt.Errorf("recipe_collection and recipe_file cannot both be set")
+	case adapterSettings.RecipeCollection != "":
+		log.Printf("[INFO] initializeRecipes - Storing recipes in collection %s\n", adapterSettings.RecipeCollection)
+		recipes = &recipeCollection{name: adapterSettings.RecipeCollection}
+	case adapterSettings.RecipeFile != "":
+		log.Printf("[INFO] initializeRecipes - Storing recipes in %s\n", adapterSettings.RecipeFile)
+		recipes = &recipeFile{path: adapterSettings.RecipeFile}
+	default:
+		recipes = nil
+	}
+	return nil
+}
+
+// recipeFile stores the recipes in a local JSON file, an object of tag
+// values per recipe name
+type recipeFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *recipeFile) load() (map[string]map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.read()
+}
+
+func (f *recipeFile) read() (map[string]map[string]interface{}, error) {
+	all := map[string]map[string]interface{}{}
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipe_file: %w", err)
+	}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse recipe_file: %w", err)
+	}
+	return all, nil
+}
+
+// save replaces the file so it is never left partially written
+func (f *recipeFile) save(name string, values map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	all, err := f.read()
+	if err != nil {
+		return err
+	}
+	all[name] = values
+
+	b, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write recipe_file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write recipe_file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write recipe_file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to write recipe_file: %w", err)
+	}
+	return nil
+}
+
+// recipeCollection stores the recipes in a collection with a unique name
+// column and a tag_values column holding the JSON object of tag values
+type recipeCollection struct {
+	name string
+}
+
+func (c *recipeCollection) load() (map[string]map[string]interface{}, error) {
+	rows, err := fetchCollection(c.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch recipe_collection %s: %w", c.name, err)
+	}
+
+	all := map[string]map[string]interface{}{}
+	for _, row := range rows {
+		columns, _ := row.(map[string]interface{})
+		name, _ := columns["name"].(string)
+		tagValues, _ := columns["tag_values"].(string)
+		if name == "" {
+			log.Printf("[ERROR] load - Ignoring recipe row without a name: %v\n", row)
+			continue
+		}
+		values := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(tagValues), &values); err != nil {
+			log.Printf("[ERROR] load - Ignoring recipe %s, invalid tag_values: %s\n", name, err.Error())
+			continue
+		}
+		all[name] = values
+	}
+	return all, nil
+}
+
+func (c *recipeCollection) save(name string, values map[string]interface{}) error {
+	client, err := systemClient()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	_, err = client.UpsertDataByName(adapter_library.Args.SystemKey, c.name, map[string]interface{}{"name": name, "tag_values": string(b)}, "name")
+	if err != nil {
+		return fmt.Errorf("failed to save recipe %s to recipe_collection %s: %w", name, c.name, err)
+	}
+	return nil
+}
+
+// loadRecipe returns the tag values of a recipe
+func loadRecipe(name string) (map[string]interface{}, error) {
+	all, err := recipes.load()
+	if err != nil {
+		return nil, err
+	}
+	values, ok := all[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errRecipeNotFound, name)
+	}
+	return values, nil
+}
+
+// uploadRecipe captures the current values of the tags as the recipe name,
+// the tags of the existing recipe are captured when none are given
+func uploadRecipe(name string, tags []string) (map[string]interface{}, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: a recipe name is required", errInvalidValue)
+	}
+	if len(tags) == 0 {
+		existing, err := loadRecipe(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w, tags to capture are required", err)
+		}
+		for tag := range existing {
+			tags = append(tags, tag)
+		}
+	}
+
+	// downloads are batch writes, which cannot write bits or virtual tags
+	for _, tag := range tags {
+		if _, _, ok := bitAddress(tag); ok {
+			return nil, fmt.Errorf("%w in recipes: %s is a bit", errUnsupportedType, tag)
+		}
+		if _, ok := virtualTags[resolveTagName(tag)]; ok {
+			return nil, fmt.Errorf("%w: %s is a virtual tag", errReadOnlyTag, tag)
+		}
+	}
+
+	data := map[string]ethernetIpReadResponseData{}
+	if err := readTags(tags, data); err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(data))
+	for tag, value := range data {
+		values[tag] = value.Value
+	}
+	if err := recipes.save(name, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// diffRecipe returns the tags whose controller values do not match the recipe
+func diffRecipe(values map[string]interface{}) map[string]ethernetIpRecipeDifference {
+	differences := map[string]ethernetIpRecipeDifference{}
+	for tag, value := range values {
+		data := map[string]ethernetIpReadResponseData{}
+		if err := readTags([]string{tag}, data); err != nil {
+			differences[tag] = ethernetIpRecipeDifference{RecipeValue: value, ErrorMessage: err.Error()}
+			continue
+		}
+		if !valuesMatch(tag, value, data[tag].Value) {
+			differences[tag] = ethernetIpRecipeDifference{RecipeValue: value, ControllerValue: data[tag].Value}
+		}
+	}
+	return differences
+}
+
+// listRecipes returns every recipe sorted by name
+func listRecipes() ([]ethernetIpRecipe, error) {
+	all, err := recipes.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ethernetIpRecipe, 0, len(all))
+	for name, values := range all {
+		list = append(list, ethernetIpRecipe{Name: name, Values: values})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// recipePriority schedules downloads with the writes and the other recipe
+// operations with the reads
+func recipePriority(message *mqttTypes.Publish) int {
+	if strings.HasSuffix(message.Topic.Whole, "/"+recipeDownload) {
+		return priorityWrite
+	}
+	return priorityRead
+}
+
+// rejectRecipeRequest answers a recipe request the scheduler rejected
+func rejectRecipeRequest(message *mqttTypes.Publish, err error) {
+	recipeReq := ethernetIpRecipeMQTTMessage{}
+	decodePayload(message.Topic.Whole, message.Payload, &recipeReq)
+	publishPayload(message.Topic.Whole+"/response", ethernetIpRecipeResponseMQTTMessage{
+		Name:         recipeReq.Name,
+		Timestamp:    timeNow().UTC().Format(time.RFC3339),
+		ErrorMessage: err.Error(),
+	})
+}
+
+// handleRecipeRequest serves {topic_root}/recipes/<operation> and publishes
+// the result to .../response
+func handleRecipeRequest(message *mqttTypes.Publish) {
+	operation := strings.TrimPrefix(message.Topic.Whole, adapterConfig.TopicRoot+"/"+recipesTopic+"/")
+	mqttResp := ethernetIpRecipeResponseMQTTMessage{
+		Success: true,
+	}
+
+	recipeReq := ethernetIpRecipeMQTTMessage{}
+	err := decodePayload(message.Topic.Whole, message.Payload, &recipeReq)
+	mqttResp.Name = recipeReq.Name
+	if err == nil && recipes == nil {
+		err = fmt.Errorf("recipes are not configured, set recipe_collection or recipe_file")
+	}
+
+	var values map[string]interface{}
+	if err == nil {
+		switch operation {
+		case recipeList:
+			mqttResp.Recipes, err = listRecipes()
+		case recipeDownload:
+			if values, err = loadRecipe(recipeReq.Name); err == nil {
+				mqttResp.Results, err = auditedBatchWrite(values, recipeReq.Atomic, recipeReq.User, auditSourceRecipe)
+			}
+		case recipeUpload:
+			mqttResp.Values, err = uploadRecipe(recipeReq.Name, recipeReq.Tags)
+		case recipeDiff:
+			if values, err = loadRecipe(recipeReq.Name); err == nil {
+				mqttResp.Differences = diffRecipe(values)
+			}
+		default:
+			err = fmt.Errorf("unknown recipe operation %s", operation)
+		}
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Recipe %s of %s failed: %s\n", operation, recipeReq.Name, err.Error())
+		mqttResp.Success = false
+		mqttResp.ErrorMessage = err.Error()
+	} else {
+		log.Printf("[INFO] Recipe %s of %s successful\n", operation, recipeReq.Name)
+	}
+
+	mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(message.Topic.Whole+"/response", mqttResp)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecipes(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Speed_SP", 55)
+	sim.addDINT("Temp_SP", 120)
+	sim.addDINT("Counter", 0)
+	transport := startTestAdapter(t, sim)
+
+	prevRecipes := recipes
+	t.Cleanup(func() { recipes = prevRecipes })
+	file := filepath.Join(t.TempDir(), "recipes.json")
+	if err := os.WriteFile(file, []byte(`{"Cola": {"Speed_SP": 40, "Temp_SP": 90}}`), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	adapterSettings.RecipeFile = file
+	if err := initializeRecipes(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// the current controller values are captured as a new recipe
+	transport.send(testTopicRoot+"/recipes/upload", `{"name": "Lemonade", "tags": ["Speed_SP", "Temp_SP"]}`)
+	transport.expect(t, testTopicRoot+"/recipes/upload/response", `{"name": "Lemonade", "timestamp": "2022-09-01T12:30:00Z", "values": {"Speed_SP": 55, "Temp_SP": 120}, "success": true, "status_code": 0, "error_message": ""}`)
+
+	transport.send(testTopicRoot+"/recipes/list", `{}`)
+	transport.expect(t, testTopicRoot+"/recipes/list/response", `{"timestamp": "2022-09-01T12:30:00Z", "recipes": [
+		{"name": "Cola", "values": {"Speed_SP": 40, "Temp_SP": 90}},
+		{"name": "Lemonade", "values": {"Speed_SP": 55, "Temp_SP": 120}}
+	], "success": true, "status_code": 0, "error_message": ""}`)
+
+	transport.send(testTopicRoot+"/recipes/diff", `{"name": "Cola"}`)
+	transport.expect(t, testTopicRoot+"/recipes/diff/response", `{"name": "Cola", "timestamp": "2022-09-01T12:30:00Z", "differences": {
+		"Speed_SP": {"recipe_value": 40, "controller_value": 55},
+		"Temp_SP": {"recipe_value": 90, "controller_value": 120}
+	}, "success": true, "status_code": 0, "error_message": ""}`)
+
+	transport.send(testTopicRoot+"/recipes/download", `{"name": "Cola", "atomic": true}`)
+	transport.expect(t, testTopicRoot+"/recipes/download/response", `{"name": "Cola", "timestamp": "2022-09-01T12:30:00Z", "results": {
+		"Speed_SP": {"success": true, "error_message": ""},
+		"Temp_SP": {"success": true, "error_message": ""}
+	}, "success": true, "status_code": 0, "error_message": ""}`)
+	if got := sim.value("Speed_SP"); !bytes.Equal(got, []byte{40, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+
+	transport.send(testTopicRoot+"/recipes/diff", `{"name": "Cola"}`)
+	transport.expect(t, testTopicRoot+"/recipes/diff/response", `{"name": "Cola", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+
+	// uploading an existing recipe captures its tags again
+	sim.setValue("Temp_SP", []byte{95, 0, 0, 0})
+	transport.send(testTopicRoot+"/recipes/upload", `{"name": "Cola"}`)
+	transport.expect(t, testTopicRoot+"/recipes/upload/response", `{"name": "Cola", "timestamp": "2022-09-01T12:30:00Z", "values": {"Speed_SP": 40, "Temp_SP": 95}, "success": true, "status_code": 0, "error_message": ""}`)
+
+	transport.send(testTopicRoot+"/recipes/download", `{"name": "Cider"}`)
+	transport.expect(t, testTopicRoot+"/recipes/download/response", `{"name": "Cider", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "recipe does not exist: Cider"}`)
+	transport.send(testTopicRoot+"/recipes/upload", `{"name": "Cider"}`)
+	transport.expect(t, testTopicRoot+"/recipes/upload/response", `{"name": "Cider", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "recipe does not exist: Cider, tags to capture are required"}`)
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	stored := map[string]map[string]interface{}{}
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(stored) != 2 || stored["Cola"]["Temp_SP"] != float64(95) || stored["Lemonade"]["Speed_SP"] != float64(55) {
+		t.Fatalf("unexpected recipe file %s", b)
+	}
+
+	adapterSettings.RecipeCollection = "recipes"
+	if err := initializeRecipes(); err == nil {
+		t.Fatal("expected an error for both recipe_collection and recipe_file")
+	}
+}
+
+func TestRecipesMixedTypes(t *testing.T) {
+	sim := newSimController(t)
+	sim.addTag("Running", 0xc1, []byte{1})
+	sim.addTag("Batch_Size", 0xc3, []byte{0xf4, 0x01})
+	sim.addDINT("Temp_SP", 120)
+	sim.addString("Product", "Cola")
+	transport := startTestAdapter(t, sim)
+
+	prevRecipes := recipes
+	t.Cleanup(func() { recipes = prevRecipes })
+	adapterSettings.RecipeFile = filepath.Join(t.TempDir(), "recipes.json")
+	if err := initializeRecipes(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	transport.send(testTopicRoot+"/recipes/upload", `{"name": "Cola", "tags": ["Running", "Batch_Size", "Temp_SP", "Product"]}`)
+	transport.expect(t, testTopicRoot+"/recipes/upload/response", `{"name": "Cola", "timestamp": "2022-09-01T12:30:00Z", "values": {"Batch_Size": 500, "Product": "Cola", "Running": true, "Temp_SP": 120}, "success": true, "status_code": 0, "error_message": ""}`)
+
+	sim.setValue("Running", []byte{0})
+	sim.setValue("Batch_Size", []byte{0x18, 0xfc})
+	sim.setValue("Temp_SP", []byte{90, 0, 0, 0})
+	product := make([]byte, len(sim.value("Product")))
+	binary.LittleEndian.PutUint32(product, 8)
+	copy(product[4:], "Lemonade")
+	sim.setValue("Product", product)
+
+	transport.send(testTopicRoot+"/recipes/download", `{"name": "Cola", "atomic": true}`)
+	transport.expect(t, testTopicRoot+"/recipes/download/response", `{"name": "Cola", "timestamp": "2022-09-01T12:30:00Z", "results": {
+		"Batch_Size": {"success": true, "error_message": ""},
+		"Product": {"success": true, "error_message": ""},
+		"Running": {"success": true, "error_message": ""},
+		"Temp_SP": {"success": true, "error_message": ""}
+	}, "success": true, "status_code": 0, "error_message": ""}`)
+
+	if got := sim.value("Running"); !bytes.Equal(got, []byte{1}) {
+		t.Fatalf("unexpected BOOL value % x", got)
+	}
+	if got := sim.value("Batch_Size"); !bytes.Equal(got, []byte{0xf4, 0x01}) {
+		t.Fatalf("unexpected INT value % x", got)
+	}
+	if got := sim.value("Temp_SP"); !bytes.Equal(got, []byte{120, 0, 0, 0}) {
+		t.Fatalf("unexpected DINT value % x", got)
+	}
+	got := sim.value("Product")
+	if binary.LittleEndian.Uint32(got) != 4 || string(got[4:12]) != "Cola\x00\x00\x00\x00" {
+		t.Fatalf("unexpected STRING value % x", got)
+	}
+
+	transport.send(testTopicRoot+"/recipes/diff", `{"name": "Cola"}`)
+	transport.expect(t, testTopicRoot+"/recipes/diff/response", `{"name": "Cola", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+
+	// bits cannot be downloaded, so they are rejected at upload
+	transport.send(testTopicRoot+"/recipes/upload", `{"name": "Flags", "tags": ["Batch_Size.3"]}`)
+	transport.expect(t, testTopicRoot+"/recipes/upload/response", `{"name": "Flags", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "unsupported data type in recipes: Batch_Size.3 is a bit"}`)
+}
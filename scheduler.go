@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+// Request priorities, a request is started before every request of a lower
+// priority that is waiting
+const (
+	priorityWrite = iota
+	priorityRead
+	priorityPoll
+	priorityCount
+)
+
+const (
+	defaultMaxOutstandingRequests = 1
+	defaultRequestQueueSize       = 100
+	defaultRequestTimeout         = 10000
+	defaultRequestDeadline        = 30000
+)
+
+var (
+	errQueueFull      = errors.New("request queue is full")
+	errRequestTimeout = errors.New("request timed out")
+)
+
+// requestScheduler bounds the number of requests the adapter works on at the
+// same time, so the controller and the shared EtherNet/IP connection are not
+// flooded. Requests above the limit wait in a queue by priority, and are
+// rejected when the queue is full or they waited longer than the timeout. A
+// request that runs past the deadline gives up its slot.
+type requestScheduler struct {
+	mu      sync.Mutex
+	queues  [priorityCount][]*scheduledRequest
+	queued  int
+	running int
+
+	maxOutstanding int
+	queueSize      int
+	timeout        time.Duration
+	deadline       time.Duration
+}
+
+type scheduledRequest struct {
+	priority int
+	run      func()
+	reject   func(err error)
+	timer    *time.Timer
+}
+
+var scheduler = newRequestScheduler(defaultMaxOutstandingRequests, defaultRequestQueueSize, defaultRequestTimeout*time.Millisecond, defaultRequestDeadline*time.Millisecond)
+
+func newRequestScheduler(maxOutstanding int, queueSize int, timeout time.Duration, deadline time.Duration) *requestScheduler {
+	return &requestScheduler{maxOutstanding: maxOutstanding, queueSize: queueSize, timeout: timeout, deadline: deadline}
+}
+
+// initializeScheduler applies max_outstanding_requests, request_queue_size,
+// request_timeout_ms and request_deadline_ms
+func initializeScheduler() {
+	maxOutstanding := int(adapterSettings.MaxOutstandingRequests)
+	if maxOutstanding == 0 {
+		maxOutstanding = defaultMaxOutstandingRequests
+	}
+	queueSize := int(adapterSettings.RequestQueueSize)
+	if queueSize == 0 {
+		queueSize = defaultRequestQueueSize
+	}
+	timeout := adapterSettings.RequestTimeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+	deadline := adapterSettings.RequestDeadline
+	if deadline == 0 {
+		deadline = defaultRequestDeadline
+	}
+	scheduler = newRequestScheduler(maxOutstanding, queueSize, time.Duration(timeout)*time.Millisecond, time.Duration(deadline)*time.Millisecond)
+	log.Printf("[INFO] initializeScheduler - Running up to %d requests at a time, queueing up to %d\n", maxOutstanding, queueSize)
+}
+
+// scheduleRequest runs the handler of an MQTT request through the scheduler,
+// reject answers the request when it is not run
+func scheduleRequest(priority int, message *mqttTypes.Publish, handle func(*mqttTypes.Publish), reject func(*mqttTypes.Publish, error)) {
+	scheduler.submit(priority, func() { handle(message) }, func(err error) {
+		log.Printf("[ERROR] scheduleRequest - Rejected request on %s: %s\n", message.Topic.Whole, err.Error())
+		if reject != nil {
+			reject(message, err)
+		}
+	})
+}
+
+// submit runs the request when fewer than max_outstanding_requests are
+// running, otherwise queues it. reject is called instead of run when the
+// queue is full or the request is not started within the timeout.
+func (s *requestScheduler) submit(priority int, run func(), reject func(err error)) {
+	s.add(&scheduledRequest{priority: priority, run: run, reject: reject})
+}
+
+func (s *requestScheduler) add(r *scheduledRequest) {
+	s.mu.Lock()
+	if s.running < s.maxOutstanding {
+		s.running++
+		s.mu.Unlock()
+		go s.work(r)
+		return
+	}
+	if s.queued >= s.queueSize {
+		s.mu.Unlock()
+		r.reject(fmt.Errorf("%w, %d requests are waiting", errQueueFull, s.queueSize))
+		return
+	}
+	s.queues[r.priority] = append(s.queues[r.priority], r)
+	s.queued++
+	r.timer = time.AfterFunc(s.timeout, func() { s.expire(r) })
+	s.mu.Unlock()
+}
+
+// do runs the request through the scheduler and waits for it to complete,
+// the error is the request's or the reason it was rejected. It must not be
+// called by a request the scheduler runs, which would wait for its own slot.
+func (s *requestScheduler) do(priority int, run func() error) error {
+	done := make(chan error, 1)
+	s.submit(priority, func() { done <- run() }, func(err error) { done <- err })
+	return <-done
+}
+
+// work runs the request and then the queued requests, highest priority
+// first, until the queue is empty
+func (s *requestScheduler) work(r *scheduledRequest) {
+	for r != nil {
+		s.run(r)
+
+		s.mu.Lock()
+		r = s.next()
+		if r == nil {
+			s.running--
+		}
+		s.mu.Unlock()
+	}
+}
+
+// run runs a request until it completes or runs past the deadline. A
+// request that overruns is left to complete on its own and the next request
+// is started, its controller calls are still made one at a time.
+func (s *requestScheduler) run(r *scheduledRequest) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run()
+	}()
+
+	timer := time.NewTimer(s.deadline)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("[ERROR] run - Request still running after %s, starting the next request\n", s.deadline)
+	}
+}
+
+// next takes the first request of the highest priority from the queue, the
+// caller holds s.mu
+func (s *requestScheduler) next() *scheduledRequest {
+	for priority, queue := range s.queues {
+		if len(queue) > 0 {
+			r := queue[0]
+			s.queues[priority] = queue[1:]
+			s.queued--
+			r.timer.Stop()
+			return r
+		}
+	}
+	return nil
+}
+
+// expire rejects a request that is still queued when its timeout passes
+func (s *requestScheduler) expire(r *scheduledRequest) {
+	s.mu.Lock()
+	queue := s.queues[r.priority]
+	for i, queued := range queue {
+		if queued == r {
+			s.queues[r.priority] = append(queue[:i:i], queue[i+1:]...)
+			s.queued--
+			s.mu.Unlock()
+			r.reject(fmt.Errorf("%w after waiting %s for the controller", errRequestTimeout, s.timeout))
+			return
+		}
+	}
+	s.mu.Unlock()
+}
+
+// controllerGate lets one call at a time use eipClient, the library neither
+// supports concurrent requests on its connection nor times out a request the
+// controller does not answer
+var controllerGate = make(chan struct{}, 1)
+
+// callController makes a call over eipClient once no other call is using it,
+// and fails with errRequestTimeout when the call cannot start or does not
+// complete within request_timeout_ms. A call that times out keeps the gate
+// until the library returns, so the calls after it time out as well rather
+// than share the connection.
+func callController(call func() error) error {
+	timeout := scheduler.timeout
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case controllerGate <- struct{}{}:
+	case <-timer.C:
+		return fmt.Errorf("%w after waiting %s for the controller", errRequestTimeout, timeout)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-controllerGate }()
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		setControllerConnected(false)
+		return fmt.Errorf("%w, the controller did not reply within %s", errRequestTimeout, timeout)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestScheduler(t *testing.T) {
+	s := newRequestScheduler(1, 3, time.Second, time.Minute)
+
+	// occupy the only slot so the following requests are queued
+	release := make(chan struct{})
+	s.submit(priorityPoll, func() { <-release }, nil)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	submit := func(priority int, name string) {
+		wg.Add(1)
+		s.submit(priority, func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			wg.Done()
+		}, func(err error) {
+			t.Errorf("%s was rejected: %s", name, err.Error())
+			wg.Done()
+		})
+	}
+	submit(priorityPoll, "poll")
+	submit(priorityRead, "read")
+	submit(priorityWrite, "write")
+
+	var rejected error
+	s.submit(priorityWrite, func() { t.Error("request beyond the queue size was run") }, func(err error) { rejected = err })
+	if !errors.Is(rejected, errQueueFull) || rejected.Error() != "request queue is full, 3 requests are waiting" {
+		t.Fatalf("unexpected rejection %v", rejected)
+	}
+
+	close(release)
+	wg.Wait()
+	if expected := []string{"write", "read", "poll"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected the requests to run in the order %v, got %v", expected, order)
+	}
+}
+
+func TestRequestSchedulerTimeout(t *testing.T) {
+	s := newRequestScheduler(1, 10, 20*time.Millisecond, time.Minute)
+	release := make(chan struct{})
+	defer close(release)
+	s.submit(priorityPoll, func() { <-release }, nil)
+
+	err := s.do(priorityWrite, func() error {
+		t.Error("request was run after it timed out")
+		return nil
+	})
+	if !errors.Is(err, errRequestTimeout) || err.Error() != "request timed out after waiting 20ms for the controller" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	transport := startTestAdapter(t, sim)
+
+	prevScheduler := scheduler
+	t.Cleanup(func() { scheduler = prevScheduler })
+	scheduler = newRequestScheduler(1, 2, 50*time.Millisecond, time.Minute)
+	release := make(chan struct{})
+	defer close(release)
+	scheduler.submit(priorityWrite, func() { <-release }, nil)
+
+	// a queued request that is not started in time is answered with an error
+	transport.send(testTopicRoot+"/write", `{"node_id": "Counter", "value": 1}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Counter", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "request timed out after waiting 50ms for the controller"}`)
+	if got := sim.value("Counter"); got[0] != 42 {
+		t.Fatalf("timed out write was run: % x", got)
+	}
+
+	scheduler.submit(priorityPoll, func() {}, func(error) {})
+	scheduler.submit(priorityPoll, func() {}, func(error) {})
+	transport.send(testTopicRoot+"/read", `{"tags": ["Counter"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{"server_timestamp": "2022-09-01T12:30:00Z", "data": {}, "success": false, "status_code": 0, "error_message": "request queue is full, 2 requests are waiting"}`)
+}
+
+func TestRequestSchedulerDeadline(t *testing.T) {
+	s := newRequestScheduler(1, 10, time.Second, 20*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	s.submit(priorityPoll, func() { <-release }, nil)
+
+	// the request that overran gives up its slot
+	ran := false
+	if err := s.do(priorityWrite, func() error {
+		ran = true
+		return nil
+	}); err != nil || !ran {
+		t.Fatalf("expected the request to run, got %v", err)
+	}
+}
+
+func TestCallControllerTimeout(t *testing.T) {
+	prevScheduler := scheduler
+	t.Cleanup(func() { scheduler = prevScheduler })
+	scheduler = newRequestScheduler(1, 10, 20*time.Millisecond, time.Minute)
+
+	release := make(chan struct{})
+	err := callController(func() error {
+		<-release
+		return nil
+	})
+	if !errors.Is(err, errRequestTimeout) || err.Error() != "request timed out, the controller did not reply within 20ms" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the next call does not share the connection with the one not answered
+	err = callController(func() error {
+		t.Error("call was made while another call was using the connection")
+		return nil
+	})
+	if !errors.Is(err, errRequestTimeout) || err.Error() != "request timed out after waiting 20ms for the controller" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for callController(func() error { return nil }) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection was not released")
+		}
+	}
+}
+
+func TestPulseReleasesSlot(t *testing.T) {
+	sim := newSimController(t)
+	sim.addTag("Start_PB", 0xc1, []byte{0})
+	sim.addDINT("Counter", 42)
+	transport := startTestAdapter(t, sim)
+
+	prevScheduler := scheduler
+	t.Cleanup(func() { scheduler = prevScheduler })
+	scheduler = newRequestScheduler(1, 10, 100*time.Millisecond, time.Minute)
+
+	// the read is answered while the pulse waits for duration_ms
+	transport.send(testTopicRoot+"/write", `{"node_id": "Start_PB", "value": true, "operation": "pulse", "duration_ms": 300}`)
+	transport.send(testTopicRoot+"/read", `{"tags": ["Counter"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{"server_timestamp": "2022-09-01T12:30:00Z", "data": {"Counter": {"value": 42, "source_timestamp": "2022-09-01T12:30:00Z"}}, "success": true, "status_code": 0, "error_message": ""}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Start_PB", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "value": false}`)
+}
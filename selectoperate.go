@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSelectTimeout = 10000
+
+	selectStateSelected  = "selected"
+	selectStateOperated  = "operated"
+	selectStateCancelled = "cancelled"
+	selectStateExpired   = "expired"
+)
+
+var (
+	errSelectRequired   = errors.New("tag requires select before operate")
+	errSelectionUnknown = errors.New("no selection for token")
+)
+
+// writeSelection is a write to a critical tag that is waiting for its
+// confirmation
+type writeSelection struct {
+	token   string
+	name    string
+	value   interface{}
+	user    string
+	expires time.Time
+	timer   *time.Timer
+}
+
+// writeSelections holds the pending selections by token, a tag can only be
+// selected once at a time
+type writeSelections struct {
+	mu     sync.Mutex
+	tokens map[string]*writeSelection
+	tags   map[string]*writeSelection
+}
+
+var selections = &writeSelections{tokens: map[string]*writeSelection{}, tags: map[string]*writeSelection{}}
+
+// handleSelectBeforeOperate serves write requests for critical tags. A write
+// without a token selects the tag and returns a token, the value is only
+// written when the token is sent back before the selection expires.
+func handleSelectBeforeOperate(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) {
+	var err error
+	switch {
+	case writeReq.Token == "":
+		err = selections.selectTag(writeReq, mqttResp)
+	case writeReq.Cancel:
+		err = selections.cancel(writeReq, mqttResp)
+	default:
+		err = selections.operate(writeReq, mqttResp)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to %s tag %s: %s\n", selectAction(writeReq), writeReq.NodeID, err.Error())
+		returnWriteError(err.Error(), mqttResp)
+		return
+	}
+
+	log.Printf("[INFO] Ethernet-IP %s successful: %s\n", selectAction(writeReq), writeReq.NodeID)
+	mqttResp.Timestamp = timeNow().UTC().Format(time.RFC3339)
+	publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", mqttResp)
+}
+
+func selectAction(writeReq ethernetIpWriteRequestMQTTMessage) string {
+	switch {
+	case writeReq.Token == "":
+		return "select"
+	case writeReq.Cancel:
+		return "cancel"
+	}
+	return "operate"
+}
+
+func (s *writeSelections) selectTag(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) error {
+	symbol := resolveTagName(writeReq.NodeID)
+	if _, _, ok := bitAddress(writeReq.NodeID); !ok {
+		if _, err := lookupTag(writeReq.NodeID); err != nil {
+			return err
+		}
+	}
+	// a selection is not granted for a write the policy refuses
+	if err := writePolicy.check(writeReq.NodeID, writeReq.Value); err != nil {
+		return err
+	}
+
+	token, err := newSelectToken()
+	if err != nil {
+		return err
+	}
+	timeout := writePolicy.selectTimeout()
+	selection := &writeSelection{
+		token:   token,
+		name:    writeReq.NodeID,
+		value:   writeReq.Value,
+		user:    writeReq.User,
+		expires: timeNow().Add(timeout),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tags[symbol]; ok {
+		return fmt.Errorf("%s is already selected", writeReq.NodeID)
+	}
+	s.tokens[token] = selection
+	s.tags[symbol] = selection
+	selection.timer = time.AfterFunc(timeout, func() { s.expire(selection) })
+
+	mqttResp.Token = token
+	mqttResp.Expires = selection.expires.UTC().Format(time.RFC3339)
+	mqttResp.State = selectStateSelected
+	return nil
+}
+
+// take removes the selection for a token, it must be for the same tag
+func (s *writeSelections) take(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) (*writeSelection, error) {
+	mqttResp.Token = writeReq.Token
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	selection, ok := s.tokens[writeReq.Token]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errSelectionUnknown, writeReq.Token)
+	}
+	if resolveTagName(selection.name) != resolveTagName(writeReq.NodeID) {
+		return nil, fmt.Errorf("%w: %s was selected with the token, not %s", errInvalidValue, selection.name, writeReq.NodeID)
+	}
+	selection.timer.Stop()
+	s.remove(selection)
+	return selection, nil
+}
+
+// remove drops a selection, the caller holds s.mu
+func (s *writeSelections) remove(selection *writeSelection) {
+	delete(s.tokens, selection.token)
+	delete(s.tags, resolveTagName(selection.name))
+}
+
+// operate writes the selected value, the user confirming the write is
+// recorded in the audit log
+func (s *writeSelections) operate(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) error {
+	selection, err := s.take(writeReq, mqttResp)
+	if err != nil {
+		return err
+	}
+
+	user := writeReq.User
+	if user == "" {
+		user = selection.user
+	}
+	if err := audited(selection.name, selection.value, user, auditSourceMQTT, operateTag); err != nil {
+		return err
+	}
+	mqttResp.State = selectStateOperated
+	return nil
+}
+
+func (s *writeSelections) cancel(writeReq ethernetIpWriteRequestMQTTMessage, mqttResp *ethernetIpWriteResponseMQTTMessage) error {
+	if _, err := s.take(writeReq, mqttResp); err != nil {
+		return err
+	}
+	mqttResp.State = selectStateCancelled
+	return nil
+}
+
+// expire drops a selection that was not confirmed in time and reports it on
+// the write response topic
+func (s *writeSelections) expire(selection *writeSelection) {
+	s.mu.Lock()
+	if s.tokens[selection.token] != selection {
+		s.mu.Unlock()
+		return
+	}
+	s.remove(selection)
+	s.mu.Unlock()
+
+	log.Printf("[INFO] expire - Selection of %s expired\n", selection.name)
+	publishPayload(adapterConfig.TopicRoot+"/"+writeTopic+"/response", ethernetIpWriteResponseMQTTMessage{
+		NodeID:       selection.name,
+		Timestamp:    timeNow().UTC().Format(time.RFC3339),
+		ErrorMessage: fmt.Sprintf("selection of %s expired before it was operated", selection.name),
+		Token:        selection.token,
+		State:        selectStateExpired,
+	})
+}
+
+func newSelectToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to create a select token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSelectBeforeOperate(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Pump1_Start", 0)
+	sim.addDINT("Pump2_Start", 0)
+	sim.addDINT("Speed_SP", 0)
+	sim.addDINT("Valves", 0)
+	sim.addDINT("Bypass", 0)
+	transport := startTestAdapter(t, sim)
+
+	prevPolicy := writePolicy
+	t.Cleanup(func() { writePolicy = prevPolicy })
+	adapterSettings.WritePolicy = &writePolicySettings{Critical: []string{"Pump*_Start", "Valves", "Bypass"}, Deny: []string{"Bypass"}, SelectTimeout: 100}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	selectTag := func(name string) string {
+		t.Helper()
+		transport.send(testTopicRoot+"/write", `{"node_id": "`+name+`", "value": 1, "user": "operator"}`)
+		msg := transport.next(t, testTopicRoot+"/write/response")
+		resp := ethernetIpWriteResponseMQTTMessage{}
+		if err := json.Unmarshal(msg.payload, &resp); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if !resp.Success || resp.State != "selected" || len(resp.Token) != 32 || resp.Expires != "2022-09-01T12:30:00Z" {
+			t.Fatalf("unexpected select response %s", msg.payload)
+		}
+		return resp.Token
+	}
+
+	// selecting does not write the tag, operating with the token does
+	token := selectTag("Pump1_Start")
+	if got := sim.value("Pump1_Start"); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Fatalf("selected tag was written: % x", got)
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Pump1_Start", "value": 1}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Pump1_Start", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "Pump1_Start is already selected"}`)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Pump2_Start", "token": "`+token+`"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Pump2_Start", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "invalid value: Pump1_Start was selected with the token, not Pump2_Start", "token": "`+token+`"}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Pump1_Start", "token": "`+token+`"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Pump1_Start", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "token": "`+token+`", "state": "operated"}`)
+	if got := sim.value("Pump1_Start"); !bytes.Equal(got, []byte{1, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+	transport.send(testTopicRoot+"/write", `{"node_id": "Pump1_Start", "token": "`+token+`"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Pump1_Start", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "no selection for token: `+token+`", "token": "`+token+`"}`)
+
+	token = selectTag("Pump2_Start")
+	transport.send(testTopicRoot+"/write", `{"node_id": "Pump2_Start", "token": "`+token+`", "cancel": true}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Pump2_Start", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "token": "`+token+`", "state": "cancelled"}`)
+
+	// selections that are not operated in time expire
+	token = selectTag("Pump2_Start")
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Pump2_Start", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "selection of Pump2_Start expired before it was operated", "token": "`+token+`", "state": "expired"}`)
+	if got := sim.value("Pump2_Start"); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Fatalf("expired selection was written: % x", got)
+	}
+
+	// other tags are written directly, critical ones only through select
+	// before operate
+	transport.send(testTopicRoot+"/write", `{"node_id": "Speed_SP", "value": 5}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Speed_SP", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	if err := writeTagByName("Pump1_Start", float64(0)); !errors.Is(err, errSelectRequired) {
+		t.Fatalf("expected a select required error, got %v", err)
+	}
+	results, _ := writeTagBatch(map[string]interface{}{"Pump1_Start": float64(0)}, false)
+	if results["Pump1_Start"].ErrorMessage != "tag requires select before operate: Pump1_Start is critical" {
+		t.Fatalf("unexpected batch result %+v", results)
+	}
+
+	// bits of critical words are selected like the words
+	token = selectTag("Valves.2")
+	transport.send(testTopicRoot+"/write", `{"node_id": "Valves.2", "token": "`+token+`"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Valves.2", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", "token": "`+token+`", "state": "operated"}`)
+	if got := sim.value("Valves"); !bytes.Equal(got, []byte{0x04, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+
+	// and a write the policy refuses is not selected
+	transport.send(testTopicRoot+"/write", `{"node_id": "Bypass", "value": 1}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Bypass", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "tag is read only: writes to Bypass are denied"}`)
+}
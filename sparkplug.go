@@ -0,0 +1,506 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+// Sparkplug B, https://sparkplug.eclipse.org/specification/version/3.0/documents/sparkplug-specification-3.0.0.pdf
+//
+// The adapter is the edge node and the controller is its single device.
+// Polled tags become device metrics: DBIRTH once the controller has been
+// read, DDATA for the tags that changed and DDEATH when the controller
+// can no longer be read.
+const (
+	sparkplugNamespace     = "spBv1.0"
+	sparkplugDefaultDevice = "controller"
+	sparkplugRebirthMetric = "Node Control/Rebirth"
+	sparkplugBdSeqMetric   = "bdSeq"
+)
+
+// Sparkplug B metric data types
+const (
+	sparkplugInt8    uint32 = 1
+	sparkplugInt16   uint32 = 2
+	sparkplugInt32   uint32 = 3
+	sparkplugInt64   uint32 = 4
+	sparkplugUInt8   uint32 = 5
+	sparkplugUInt16  uint32 = 6
+	sparkplugUInt32  uint32 = 7
+	sparkplugUInt64  uint32 = 8
+	sparkplugFloat   uint32 = 9
+	sparkplugDouble  uint32 = 10
+	sparkplugBoolean uint32 = 11
+	sparkplugString  uint32 = 12
+)
+
+var sparkplugDataTypes = map[types.UInt]uint32{
+	eip.BOOL:   sparkplugBoolean,
+	eip.SINT:   sparkplugInt8,
+	eip.INT:    sparkplugInt16,
+	eip.DINT:   sparkplugInt32,
+	eip.LINT:   sparkplugInt64,
+	eip.USINT:  sparkplugUInt8,
+	eip.UINT:   sparkplugUInt16,
+	eip.UDINT:  sparkplugUInt32,
+	eip.ULINT:  sparkplugUInt64,
+	eip.REAL:   sparkplugFloat,
+	eip.LREAL:  sparkplugDouble,
+	eip.STRING: sparkplugString,
+}
+
+// sparkplugMetric is the subset of the Sparkplug B Metric message the
+// adapter uses, aliases, metadata, properties and complex types are not
+// supported.
+type sparkplugMetric struct {
+	name      string
+	timestamp uint64
+	dataType  uint32
+	isNull    bool
+	value     interface{}
+}
+
+type sparkplugPayload struct {
+	timestamp uint64
+	metrics   []sparkplugMetric
+	seq       uint64
+	hasSeq    bool
+}
+
+func (p *sparkplugPayload) encode() []byte {
+	w := &protoWriter{}
+	w.uint(1, p.timestamp)
+	for _, m := range p.metrics {
+		w.bytes(2, m.encode())
+	}
+	if p.hasSeq {
+		w.uint(3, p.seq)
+	}
+	return w.buf
+}
+
+func (m *sparkplugMetric) encode() []byte {
+	w := &protoWriter{}
+	w.string(1, m.name)
+	w.uint(3, m.timestamp)
+	w.uint(4, uint64(m.dataType))
+	if m.isNull || m.value == nil {
+		w.bool(7, true)
+		return w.buf
+	}
+
+	switch m.dataType {
+	case sparkplugInt8, sparkplugInt16, sparkplugInt32,
+		sparkplugUInt8, sparkplugUInt16, sparkplugUInt32:
+		w.uint(10, uint64(uint32(sparkplugInteger(m.value))))
+	case sparkplugInt64, sparkplugUInt64:
+		w.uint(11, uint64(sparkplugInteger(m.value)))
+	case sparkplugFloat:
+		v, _ := m.value.(float32)
+		w.float(12, v)
+	case sparkplugDouble:
+		v, _ := m.value.(float64)
+		w.double(13, v)
+	case sparkplugBoolean:
+		v, _ := m.value.(bool)
+		w.bool(14, v)
+	case sparkplugString:
+		v, _ := m.value.(string)
+		w.string(15, v)
+	}
+	return w.buf
+}
+
+// sparkplugInteger widens the integer values read from the controller, the
+// unsigned types keep their bit pattern
+func sparkplugInteger(value interface{}) int64 {
+	switch v := value.(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
+
+func decodeSparkplugPayload(b []byte) (*sparkplugPayload, error) {
+	p := &sparkplugPayload{}
+	r := &protoReader{buf: b}
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			break
+		}
+		switch {
+		case field == 1 && wireType == protoVarint:
+			p.timestamp = r.varint()
+		case field == 2 && wireType == protoBytes:
+			m, err := decodeSparkplugMetric(r.bytes())
+			if err != nil {
+				return nil, err
+			}
+			p.metrics = append(p.metrics, *m)
+		case field == 3 && wireType == protoVarint:
+			p.seq, p.hasSeq = r.varint(), true
+		default:
+			r.skip(wireType)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid Sparkplug B payload: %s", r.err.Error())
+	}
+	return p, nil
+}
+
+func decodeSparkplugMetric(b []byte) (*sparkplugMetric, error) {
+	m := &sparkplugMetric{}
+	r := &protoReader{buf: b}
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			break
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			m.name = string(r.bytes())
+		case field == 3 && wireType == protoVarint:
+			m.timestamp = r.varint()
+		case field == 4 && wireType == protoVarint:
+			m.dataType = uint32(r.varint())
+		case field == 7 && wireType == protoVarint:
+			m.isNull = r.varint() != 0
+		case field == 10 && wireType == protoVarint:
+			m.value = uint32(r.varint())
+		case field == 11 && wireType == protoVarint:
+			m.value = r.varint()
+		case field == 12 && wireType == protoFixed32:
+			m.value = r.float()
+		case field == 13 && wireType == protoFixed64:
+			m.value = r.double()
+		case field == 14 && wireType == protoVarint:
+			m.value = r.varint() != 0
+		case field == 15 && wireType == protoBytes:
+			m.value = string(r.bytes())
+		default:
+			r.skip(wireType)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid Sparkplug B metric: %s", r.err.Error())
+	}
+	return m, nil
+}
+
+// writeValue converts a command metric to the JSON style value writeTag
+// accepts, numbers become float64
+func (m *sparkplugMetric) writeValue() (interface{}, error) {
+	if m.isNull || m.value == nil {
+		return nil, fmt.Errorf("%w: metric %s has no value", errInvalidValue, m.name)
+	}
+
+	switch m.dataType {
+	case sparkplugInt8, sparkplugInt16, sparkplugInt32:
+		v, _ := m.value.(uint32)
+		return float64(int32(v)), nil
+	case sparkplugUInt8, sparkplugUInt16, sparkplugUInt32:
+		v, _ := m.value.(uint32)
+		return float64(v), nil
+	case sparkplugInt64:
+		v, _ := m.value.(uint64)
+		return float64(int64(v)), nil
+	case sparkplugUInt64:
+		v, _ := m.value.(uint64)
+		return float64(v), nil
+	case sparkplugFloat:
+		v, _ := m.value.(float32)
+		return float64(v), nil
+	default:
+		return m.value, nil
+	}
+}
+
+// sparkplugNode tracks the edge node session. bdSeq identifies the MQTT
+// session the NBIRTH and NDEATH belong to and is incremented on every
+// connect, seq numbers every other message and restarts at 0 with each
+// NBIRTH.
+type sparkplugNode struct {
+	settings sparkplugSettings
+
+	mu           sync.Mutex
+	bdSeq        uint64
+	hasSession   bool
+	seq          uint64
+	deviceOnline bool
+	values       map[string]interface{}
+	timestamp    time.Time
+}
+
+var sparkplugEdgeNode *sparkplugNode
+
+// initializeSparkplug registers the NDEATH will, the command subscriptions
+// and the poll listener. It must run before the transport connects.
+func initializeSparkplug() {
+	settings := *adapterSettings.Sparkplug
+	if settings.GroupID == "" || settings.EdgeNodeID == "" {
+		log.Fatalln("[FATAL] initializeSparkplug - sparkplug group_id and edge_node_id are required")
+	}
+	if settings.DeviceID == "" {
+		settings.DeviceID = sparkplugDefaultDevice
+	}
+
+	node := &sparkplugNode{settings: settings}
+	node.loadBdSeq()
+	log.Printf("[INFO] initializeSparkplug - Publishing as Sparkplug B edge node %s/%s\n", settings.GroupID, settings.EdgeNodeID)
+
+	if session, ok := mqttClient.(mqttSessionTransport); ok {
+		session.SetWill(node.topic("NDEATH", false), node.nextDeath)
+		session.AddSubscription(node.topic("NCMD", false))
+		session.AddSubscription(node.topic("DCMD", true))
+		session.OnConnect(node.birth)
+	} else {
+		log.Println("[ERROR] initializeSparkplug - The MQTT connection does not support a last will or additional subscriptions, NDEATH is only published on shutdown and NCMD/DCMD are not received")
+	}
+
+	poller.addListener(node.handlePoll)
+	sparkplugEdgeNode = node
+}
+
+// startSparkplug publishes NBIRTH for transports that do not call back on
+// connect, the adapter's connection is a single session
+func startSparkplug() {
+	if _, ok := mqttClient.(mqttSessionTransport); !ok {
+		sparkplugEdgeNode.mu.Lock()
+		sparkplugEdgeNode.nextSession()
+		sparkplugEdgeNode.mu.Unlock()
+		sparkplugEdgeNode.birth()
+	}
+}
+
+func (n *sparkplugNode) topic(messageType string, device bool) string {
+	topic := sparkplugNamespace + "/" + n.settings.GroupID + "/" + messageType + "/" + n.settings.EdgeNodeID
+	if device {
+		topic += "/" + n.settings.DeviceID
+	}
+	return topic
+}
+
+func sparkplugTimestamp(t time.Time) uint64 {
+	return uint64(t.UnixMilli())
+}
+
+// loadBdSeq continues from the bdSeq of the last session before a restart
+func (n *sparkplugNode) loadBdSeq() {
+	if n.settings.BdSeqFile == "" {
+		return
+	}
+	b, err := os.ReadFile(n.settings.BdSeqFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		n.bdSeq, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 8)
+	}
+	if err != nil {
+		log.Printf("[ERROR] loadBdSeq - Failed to read %s, bdSeq starts at 0: %s\n", n.settings.BdSeqFile, err.Error())
+		n.bdSeq = 0
+		return
+	}
+	n.hasSession = true
+}
+
+// nextSession increments bdSeq for a new MQTT session and saves it to
+// bdseq_file, the caller holds n.mu
+func (n *sparkplugNode) nextSession() {
+	if n.hasSession {
+		n.bdSeq = (n.bdSeq + 1) % 256
+	}
+	n.hasSession = true
+
+	if n.settings.BdSeqFile == "" {
+		return
+	}
+	if err := os.WriteFile(n.settings.BdSeqFile, []byte(strconv.FormatUint(n.bdSeq, 10)), 0644); err != nil {
+		log.Printf("[ERROR] nextSession - Failed to save bdSeq to %s: %s\n", n.settings.BdSeqFile, err.Error())
+	}
+}
+
+// nextDeath starts the session of the next MQTT connect and returns its
+// NDEATH will, NBIRTH on that connection carries the same bdSeq
+func (n *sparkplugNode) nextDeath() []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nextSession()
+	return n.deathPayload()
+}
+
+func (n *sparkplugNode) deathPayload() []byte {
+	payload := sparkplugPayload{
+		timestamp: sparkplugTimestamp(timeNow()),
+		metrics: []sparkplugMetric{
+			{name: sparkplugBdSeqMetric, dataType: sparkplugUInt64, value: n.bdSeq},
+		},
+	}
+	return payload.encode()
+}
+
+// publish sends a payload numbered with the next seq, the caller holds n.mu
+func (n *sparkplugNode) publish(topic string, payload *sparkplugPayload) {
+	payload.seq, payload.hasSeq = n.seq, true
+	n.seq = (n.seq + 1) % 256
+
+	log.Printf("[DEBUG] publish - Publishing Sparkplug B message to topic %s\n", topic)
+	if err := mqttClient.Publish(topic, payload.encode()); err != nil {
+		log.Printf("[ERROR] Failed to publish MQTT message to topic %s: %s\n", topic, err.Error())
+	}
+}
+
+// birth publishes NBIRTH, followed by DBIRTH when the controller is online.
+// It runs on every MQTT (re)connect and when a rebirth is requested.
+func (n *sparkplugNode) birth() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.seq = 0
+	now := sparkplugTimestamp(timeNow())
+	n.publish(n.topic("NBIRTH", false), &sparkplugPayload{
+		timestamp: now,
+		metrics: []sparkplugMetric{
+			{name: sparkplugBdSeqMetric, timestamp: now, dataType: sparkplugUInt64, value: n.bdSeq},
+			{name: sparkplugRebirthMetric, timestamp: now, dataType: sparkplugBoolean, value: false},
+		},
+	})
+
+	if n.deviceOnline {
+		n.deviceBirth()
+	}
+}
+
+// deviceBirth publishes DBIRTH with every polled tag, the caller holds n.mu
+func (n *sparkplugNode) deviceBirth() {
+	names := make([]string, 0, len(n.values))
+	for name := range n.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	n.publish(n.topic("DBIRTH", true), n.metrics(names))
+}
+
+// metrics builds a payload with the last polled value of each tag, tags
+// without a Sparkplug data type are left out
+func (n *sparkplugNode) metrics(names []string) *sparkplugPayload {
+	timestamp := sparkplugTimestamp(n.timestamp)
+	payload := &sparkplugPayload{timestamp: timestamp}
+	for _, name := range names {
+		tagType, ok := tagDataType(name)
+		if !ok {
+			continue
+		}
+		dataType, ok := sparkplugDataTypes[tagType]
+		if !ok {
+			continue
+		}
+		if scaledTag(name, tagType) {
+			dataType = sparkplugDouble
+		}
+		payload.metrics = append(payload.metrics, sparkplugMetric{
+			name:      name,
+			timestamp: timestamp,
+			dataType:  dataType,
+			value:     n.values[name],
+		})
+	}
+	return payload
+}
+
+func (n *sparkplugNode) handlePoll(result pollResult) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if result.err != nil {
+		if n.deviceOnline {
+			n.deviceOnline = false
+			n.publish(n.topic("DDEATH", true), &sparkplugPayload{timestamp: sparkplugTimestamp(result.timestamp)})
+		}
+		return
+	}
+
+	n.values, n.timestamp = result.values, result.timestamp
+	if !n.deviceOnline {
+		n.deviceOnline = true
+		n.deviceBirth()
+	} else if len(result.changed) > 0 {
+		n.publish(n.topic("DDATA", true), n.metrics(result.changed))
+	}
+}
+
+// shutdown publishes NDEATH, the broker only sends the will when the
+// connection drops without a disconnect
+func (n *sparkplugNode) shutdown() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	topic := n.topic("NDEATH", false)
+	if err := mqttClient.Publish(topic, n.deathPayload()); err != nil {
+		log.Printf("[ERROR] Failed to publish MQTT message to topic %s: %s\n", topic, err.Error())
+	}
+}
+
+// handleSparkplugCommand handles NCMD rebirth requests and DCMD metric writes
+func handleSparkplugCommand(message *mqttTypes.Publish) {
+	node := sparkplugEdgeNode
+	if node == nil {
+		return
+	}
+
+	payload, err := decodeSparkplugPayload(message.Payload)
+	if err != nil {
+		log.Printf("[ERROR] handleSparkplugCommand - %s\n", err.Error())
+		return
+	}
+
+	switch message.Topic.Whole {
+	case node.topic("NCMD", false):
+		for _, m := range payload.metrics {
+			if m.name == sparkplugRebirthMetric && m.value == true {
+				log.Println("[INFO] handleSparkplugCommand - Rebirth requested")
+				node.birth()
+			} else {
+				log.Printf("[ERROR] handleSparkplugCommand - Unsupported node command %s\n", m.name)
+			}
+		}
+	case node.topic("DCMD", true):
+		for _, m := range payload.metrics {
+			value, err := m.writeValue()
+			if err == nil {
+				err = auditedWrite(m.name, value, "", auditSourceSparkplug)
+			}
+			if err != nil {
+				log.Printf("[ERROR] handleSparkplugCommand - Failed to write metric %s: %s\n", m.name, err.Error())
+				continue
+			}
+			log.Printf("[INFO] handleSparkplugCommand - Ethernet-IP write successful: %s\n", m.name)
+		}
+	default:
+		log.Printf("[DEBUG] handleSparkplugCommand - Ignoring Sparkplug B message on %s\n", message.Topic.Whole)
+	}
+}
+
+func isSparkplugTopic(topic string) bool {
+	return strings.HasPrefix(topic, sparkplugNamespace+"/")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSparkplugPayloadEncoding(t *testing.T) {
+	payload := sparkplugPayload{
+		timestamp: 1,
+		metrics:   []sparkplugMetric{{name: "a", timestamp: 1, dataType: sparkplugInt32, value: int32(-1)}},
+		seq:       2,
+		hasSeq:    true,
+	}
+
+	expected := []byte{
+		0x08, 0x01, // timestamp
+		0x12, 0x0d, // metric
+		0x0a, 0x01, 'a', // name
+		0x18, 0x01, // timestamp
+		0x20, 0x03, // datatype
+		0x50, 0xff, 0xff, 0xff, 0xff, 0x0f, // int_value
+		0x18, 0x02, // seq
+	}
+	if got := payload.encode(); !bytes.Equal(got, expected) {
+		t.Fatalf("unexpected encoding\nexpected: % x\n     got: % x", expected, got)
+	}
+
+	decoded, err := decodeSparkplugPayload(expected)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	metric := decoded.metrics[0]
+	if decoded.seq != 2 || metric.name != "a" || metric.value != uint32(0xffffffff) {
+		t.Fatalf("unexpected payload %+v", decoded)
+	}
+	if value, _ := metric.writeValue(); value != float64(-1) {
+		t.Fatalf("unexpected write value %v", value)
+	}
+
+	if _, err := decodeSparkplugPayload([]byte{0x12, 0x0d, 0x0a}); err == nil {
+		t.Fatal("expected an error for a truncated payload")
+	}
+}
+
+// sparkplugTestTransport adds the session options to the in-memory transport
+type sparkplugTestTransport struct {
+	*memoryTransport
+	mqttSession
+}
+
+// expectSparkplug waits for the next published message and asserts its topic
+// and decoded Sparkplug B payload
+func expectSparkplug(t *testing.T, transport *memoryTransport, topic string, expected sparkplugPayload) {
+	t.Helper()
+
+	msg := transport.next(t, topic)
+	payload, err := decodeSparkplugPayload(msg.payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(*payload, expected) {
+		t.Fatalf("unexpected payload on %s\nexpected: %+v\n     got: %+v", topic, expected, *payload)
+	}
+}
+
+func TestSparkplugEdgeNode(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addDINT("Setpoint", 10)
+	sim.addTag("Temperature", 0xca, []byte{0x00, 0x00, 0xc8, 0x41})
+	memory := startTestAdapter(t, sim)
+
+	prevPoller, prevNode := poller, sparkplugEdgeNode
+	t.Cleanup(func() { poller, sparkplugEdgeNode = prevPoller, prevNode })
+	poller = &tagPoller{}
+
+	transport := &sparkplugTestTransport{memoryTransport: memory}
+	mqttClient = transport
+	adapterSettings.Sparkplug = &sparkplugSettings{GroupID: "Plant", EdgeNodeID: "Line1"}
+	initializeSparkplug()
+
+	now := uint64(testTime.UnixMilli())
+	bdSeq := sparkplugMetric{name: "bdSeq", dataType: sparkplugUInt64, value: uint64(0)}
+	if transport.willTopic != "spBv1.0/Plant/NDEATH/Line1" {
+		t.Fatalf("unexpected will topic %s", transport.willTopic)
+	}
+	will, err := decodeSparkplugPayload(transport.will())
+	if err != nil || !reflect.DeepEqual(*will, sparkplugPayload{timestamp: now, metrics: []sparkplugMetric{bdSeq}}) {
+		t.Fatalf("unexpected will payload %+v (%v)", will, err)
+	}
+	if expected := []string{"spBv1.0/Plant/NCMD/Line1", "spBv1.0/Plant/DCMD/Line1/controller"}; !reflect.DeepEqual(transport.topics, expected) {
+		t.Fatalf("unexpected subscriptions %v", transport.topics)
+	}
+
+	bdSeq.timestamp = now
+	nbirth := sparkplugPayload{timestamp: now, metrics: []sparkplugMetric{
+		bdSeq,
+		{name: "Node Control/Rebirth", timestamp: now, dataType: sparkplugBoolean, value: false},
+	}, hasSeq: true}
+	dbirth := sparkplugPayload{timestamp: now, metrics: []sparkplugMetric{
+		{name: "Counter", timestamp: now, dataType: sparkplugInt32, value: uint32(42)},
+		{name: "Setpoint", timestamp: now, dataType: sparkplugInt32, value: uint32(10)},
+	}, seq: 1, hasSeq: true}
+
+	transport.connected()
+	expectSparkplug(t, memory, "spBv1.0/Plant/NBIRTH/Line1", nbirth)
+
+	poller.poll()
+	expectSparkplug(t, memory, "spBv1.0/Plant/DBIRTH/Line1/controller", dbirth)
+
+	poller.poll()
+	memory.expectNone(t)
+
+	// DCMD writes the tag, the next poll reports the change
+	command := sparkplugPayload{timestamp: now, metrics: []sparkplugMetric{
+		{name: "Setpoint", dataType: sparkplugInt32, value: int32(-250)},
+	}}
+	memory.send("spBv1.0/Plant/DCMD/Line1/controller", string(command.encode()))
+	deadline := time.Now().Add(2 * time.Second)
+	for !bytes.Equal(sim.value("Setpoint"), []byte{0x06, 0xff, 0xff, 0xff}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected controller value % x", sim.value("Setpoint"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	poller.poll()
+	expectSparkplug(t, memory, "spBv1.0/Plant/DDATA/Line1/controller", sparkplugPayload{timestamp: now, metrics: []sparkplugMetric{
+		{name: "Setpoint", timestamp: now, dataType: sparkplugInt32, value: uint32(0xffffff06)},
+	}, seq: 2, hasSeq: true})
+
+	// NCMD rebirth restarts seq at 0
+	rebirth := sparkplugPayload{timestamp: now, metrics: []sparkplugMetric{
+		{name: "Node Control/Rebirth", dataType: sparkplugBoolean, value: true},
+	}}
+	memory.send("spBv1.0/Plant/NCMD/Line1", string(rebirth.encode()))
+	expectSparkplug(t, memory, "spBv1.0/Plant/NBIRTH/Line1", nbirth)
+	dbirth.metrics[1].value = uint32(0xffffff06)
+	expectSparkplug(t, memory, "spBv1.0/Plant/DBIRTH/Line1/controller", dbirth)
+
+	// losing the controller publishes DDEATH once, DBIRTH follows the reconnect
+	sim.setOffline(true)
+	poller.poll()
+	expectSparkplug(t, memory, "spBv1.0/Plant/DDEATH/Line1/controller", sparkplugPayload{timestamp: now, seq: 2, hasSeq: true})
+	poller.poll()
+	memory.expectNone(t)
+
+	sim.setOffline(false)
+	poller.poll()
+	dbirth.seq = 3
+	expectSparkplug(t, memory, "spBv1.0/Plant/DBIRTH/Line1/controller", dbirth)
+
+	// a reconnect is a new session with the next bdSeq in the will and NBIRTH
+	will, err = decodeSparkplugPayload(transport.will())
+	if err != nil || !reflect.DeepEqual(will.metrics, []sparkplugMetric{{name: "bdSeq", dataType: sparkplugUInt64, value: uint64(1)}}) {
+		t.Fatalf("unexpected will payload %+v (%v)", will, err)
+	}
+	transport.connected()
+	nbirth.metrics[0].value = uint64(1)
+	expectSparkplug(t, memory, "spBv1.0/Plant/NBIRTH/Line1", nbirth)
+	dbirth.seq = 1
+	expectSparkplug(t, memory, "spBv1.0/Plant/DBIRTH/Line1/controller", dbirth)
+
+	sparkplugEdgeNode.shutdown()
+	expectSparkplug(t, memory, "spBv1.0/Plant/NDEATH/Line1", sparkplugPayload{timestamp: now, metrics: []sparkplugMetric{
+		{name: "bdSeq", dataType: sparkplugUInt64, value: uint64(1)},
+	}})
+}
+
+func TestSparkplugBdSeqFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bdseq")
+	settings := sparkplugSettings{GroupID: "Plant", EdgeNodeID: "Line1", BdSeqFile: file}
+	bdSeq := func(payload []byte) interface{} {
+		t.Helper()
+		decoded, err := decodeSparkplugPayload(payload)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		return decoded.metrics[0].value
+	}
+
+	node := &sparkplugNode{settings: settings}
+	node.loadBdSeq()
+	if got := bdSeq(node.nextDeath()); got != uint64(0) {
+		t.Fatalf("expected the first session to use bdSeq 0, got %v", got)
+	}
+	if got := bdSeq(node.nextDeath()); got != uint64(1) {
+		t.Fatalf("expected bdSeq 1, got %v", got)
+	}
+
+	// a restart continues after the last session
+	node = &sparkplugNode{settings: settings}
+	node.loadBdSeq()
+	if got := bdSeq(node.nextDeath()); got != uint64(2) {
+		t.Fatalf("expected bdSeq 2 after a restart, got %v", got)
+	}
+
+	if err := os.WriteFile(file, []byte("255"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	node = &sparkplugNode{settings: settings}
+	node.loadBdSeq()
+	if got := bdSeq(node.nextDeath()); got != uint64(0) {
+		t.Fatalf("expected bdSeq to wrap to 0, got %v", got)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	adapter_library "github.com/clearblade/adapter-go-library"
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/hashicorp/logutils"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	standaloneCommand    = "standalone"
+	defaultMQTTVersion   = "3.1.1"
+	defaultMQTTKeepAlive = 30
+	mqttConnectTimeout   = 30 * time.Second
+	// mqttMaxReconnectDelay is the longest wait between reconnect attempts
+	mqttMaxReconnectDelay = 2 * time.Minute
+)
+
+// initializeStandalone configures the adapter from a local settings file and
+// a plain MQTT broker instead of a ClearBlade system
+func initializeStandalone(args []string) error {
+	flags := flag.NewFlagSet(adapterName+" "+standaloneCommand, flag.ExitOnError)
+	settingsFile := flags.String("settings", "", "path to the JSON or YAML settings file (required)")
+	logLevel := flags.String("logLevel", "info", "The level of logging to use. Available levels are 'debug, 'info', 'error', 'fatal' (optional)")
+	flags.Parse(args)
+
+	setLogLevel(*logLevel, os.Stdout)
+
+	if *settingsFile == "" {
+		return fmt.Errorf("a settings file is required, can be supplied with --settings flag")
+	}
+
+	config, err := loadStandaloneConfig(*settingsFile)
+	if err != nil {
+		return err
+	}
+
+	adapterSettings = &config.AdapterSettings
+	adapterConfig = &adapter_library.AdapterConfig{TopicRoot: config.TopicRoot}
+	if adapterConfig.TopicRoot == "" {
+		adapterConfig.TopicRoot = adapterName
+	}
+
+	mqttClient, err = newBrokerTransport(&config.Broker)
+	return err
+}
+
+// setLogLevel mirrors the logging setup adapter_library applies in ParseArguments
+func setLogLevel(logLevel string, w io.Writer) {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.SetOutput(&logutils.LevelFilter{
+		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "ERROR", "FATAL"},
+		MinLevel: logutils.LogLevel(strings.ToUpper(logLevel)),
+		Writer:   w,
+	})
+}
+
+// loadStandaloneConfig reads a JSON or YAML settings file. YAML is a superset
+// of JSON, so the file is parsed as YAML and re-encoded as JSON to reuse the
+// json struct tags of the settings types.
+func loadStandaloneConfig(fileName string) (*standaloneConfig, error) {
+	log.Printf("[INFO] loadStandaloneConfig - Loading settings from %s\n", fileName)
+
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings file: %s", err.Error())
+	}
+
+	var parsed interface{}
+	if err := yaml.Unmarshal(raw, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse settings file: %s", err.Error())
+	}
+
+	b, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse settings file: %s", err.Error())
+	}
+
+	config := &standaloneConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("failed to parse settings file: %s", err.Error())
+	}
+
+	log.Printf("[DEBUG] loadStandaloneConfig - Settings loaded: %+v\n", config.AdapterSettings)
+	return config, nil
+}
+
+// newBrokerTransport creates the MQTT client for the protocol version requested
+func newBrokerTransport(settings *mqttBrokerSettings) (mqttTransport, error) {
+	if settings.URL == "" {
+		return nil, fmt.Errorf("broker url is required")
+	}
+
+	tlsConfig, err := settings.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.ClientID == "" {
+		settings.ClientID = adapterName + "-" + strconv.Itoa(rand.Intn(10000))
+	}
+	if settings.KeepAlive == 0 {
+		settings.KeepAlive = defaultMQTTKeepAlive
+	}
+
+	switch settings.Version {
+	case "", defaultMQTTVersion:
+		return &mqtt311Transport{settings: settings, tlsConfig: tlsConfig}, nil
+	case "5":
+		return &mqtt5Transport{settings: settings, tlsConfig: tlsConfig}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mqtt_version %s, must be %s or 5", settings.Version, defaultMQTTVersion)
+	}
+}
+
+func (s *mqttBrokerSettings) tlsConfig() (*tls.Config, error) {
+	if s.CAFile == "" && s.CertFile == "" && !s.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: s.InsecureSkipVerify}
+
+	if s.CAFile != "" {
+		ca, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", s.CAFile)
+		}
+	}
+
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func newPublish(topic string, payload []byte) *mqttTypes.Publish {
+	path, _ := mqttTypes.NewTopicPath(topic)
+	return &mqttTypes.Publish{Topic: path, Payload: payload}
+}
+
+// mqtt311Transport connects to an MQTT 3.1.1 broker. The client does not
+// reconnect by itself, a new client is connected when the connection is lost
+// so the will is built again for the new session.
+type mqtt311Transport struct {
+	mqttSession
+	settings  *mqttBrokerSettings
+	tlsConfig *tls.Config
+	filters   map[string]byte
+	handler   adapter_library.MQTTMessageReceived
+
+	mu     sync.Mutex
+	client mqtt.Client
+}
+
+func (m *mqtt311Transport) Subscribe(topic string, handler adapter_library.MQTTMessageReceived) error {
+	log.Printf("[INFO] Subscribe - Connecting to MQTT 3.1.1 broker %s\n", m.settings.URL)
+
+	m.filters = map[string]byte{topic: 0}
+	for _, t := range m.topics {
+		m.filters[t] = 0
+	}
+	m.handler = handler
+
+	token := m.connect()
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return fmt.Errorf("timed out connecting to %s", m.settings.URL)
+	}
+	return token.Error()
+}
+
+// connect starts connecting a new client, it replaces the current client
+// before connecting so the connect callbacks publish through it
+func (m *mqtt311Transport) connect() mqtt.Token {
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.settings.URL).
+		SetClientID(m.settings.ClientID).
+		SetUsername(m.settings.Username).
+		SetPassword(m.settings.Password).
+		SetKeepAlive(time.Duration(m.settings.KeepAlive) * time.Second).
+		SetProtocolVersion(4).
+		SetAutoReconnect(false)
+
+	if m.tlsConfig != nil {
+		opts.SetTLSConfig(m.tlsConfig)
+	}
+	if m.willTopic != "" {
+		opts.SetBinaryWill(m.willTopic, m.will(), 1, false)
+	}
+
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Printf("[INFO] onConnect - Connected to MQTT broker, subscribing to %d topics\n", len(m.filters))
+		token := client.SubscribeMultiple(m.filters, func(client mqtt.Client, msg mqtt.Message) {
+			m.handler(newPublish(msg.Topic(), msg.Payload()))
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Printf("[ERROR] onConnect - Failed to subscribe: %s\n", token.Error().Error())
+		}
+		m.connected()
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Printf("[ERROR] onConnectLost - Connection to MQTT broker was lost: %s\n", err.Error())
+		go m.reconnect()
+	})
+
+	client := mqtt.NewClient(opts)
+	m.mu.Lock()
+	m.client = client
+	m.mu.Unlock()
+	return client.Connect()
+}
+
+// reconnect connects new clients until one succeeds, waiting up to
+// mqttMaxReconnectDelay between the attempts
+func (m *mqtt311Transport) reconnect() {
+	delay := time.Second
+	for {
+		token := m.connect()
+		if !token.WaitTimeout(mqttConnectTimeout) {
+			log.Printf("[ERROR] reconnect - Timed out connecting to %s\n", m.settings.URL)
+		} else if err := token.Error(); err != nil {
+			log.Printf("[ERROR] reconnect - Failed to connect to %s: %s\n", m.settings.URL, err.Error())
+		} else {
+			return
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > mqttMaxReconnectDelay {
+			delay = mqttMaxReconnectDelay
+		}
+	}
+}
+
+func (m *mqtt311Transport) Publish(topic string, payload []byte) error {
+	return m.publish(topic, payload, false)
+}
+
+func (m *mqtt311Transport) PublishRetained(topic string, payload []byte) error {
+	return m.publish(topic, payload, true)
+}
+
+func (m *mqtt311Transport) publish(topic string, payload []byte, retain bool) error {
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+	// a QoS 0 publish is not reported as failed while the client is
+	// reconnecting, so the store and forward queue would never see it
+	if client == nil || !client.IsConnected() {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	token := client.Publish(topic, 0, retain, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// mqtt5Transport connects to an MQTT 5 broker. up is cleared by the error
+// callbacks, so publishes fail from then on rather than going to the client
+// of a connection that is being torn down.
+type mqtt5Transport struct {
+	mqttSession
+	settings  *mqttBrokerSettings
+	tlsConfig *tls.Config
+	conn      *autopaho.ConnectionManager
+
+	mu sync.Mutex
+	up bool
+}
+
+func (m *mqtt5Transport) Subscribe(topic string, handler adapter_library.MQTTMessageReceived) error {
+	log.Printf("[INFO] Subscribe - Connecting to MQTT 5 broker %s\n", m.settings.URL)
+
+	brokerURL, err := url.Parse(m.settings.URL)
+	if err != nil {
+		return fmt.Errorf("invalid broker url: %s", err.Error())
+	}
+
+	subscriptions := map[string]paho.SubscribeOptions{topic: {QoS: 0}}
+	for _, t := range m.topics {
+		subscriptions[t] = paho.SubscribeOptions{QoS: 0}
+	}
+
+	// the connect callbacks publish through m.conn, hold them until it is set
+	ready := make(chan struct{})
+
+	config := autopaho.ClientConfig{
+		BrokerUrls:     []*url.URL{brokerURL},
+		TlsCfg:         m.tlsConfig,
+		KeepAlive:      uint16(m.settings.KeepAlive),
+		ConnectTimeout: mqttConnectTimeout,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			log.Printf("[INFO] onConnect - Connected to MQTT broker, subscribing to %s\n", topic)
+			_, err := cm.Subscribe(context.Background(), &paho.Subscribe{
+				Subscriptions: subscriptions,
+			})
+			if err != nil {
+				log.Printf("[ERROR] onConnect - Failed to subscribe to %s: %s\n", topic, err.Error())
+			}
+			m.setUp(true)
+			go func() {
+				<-ready
+				m.connected()
+			}()
+		},
+		OnConnectError: func(err error) {
+			log.Printf("[ERROR] onConnectError - Failed to connect to MQTT broker: %s\n", err.Error())
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: m.settings.ClientID,
+			Router: paho.NewSingleHandlerRouter(func(p *paho.Publish) {
+				handler(newPublish(p.Topic, p.Payload))
+			}),
+			OnClientError: func(err error) {
+				log.Printf("[ERROR] onClientError - MQTT client error: %s\n", err.Error())
+				m.setUp(false)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				log.Printf("[ERROR] onServerDisconnect - Disconnected by MQTT broker, reason %d\n", disconnect.ReasonCode)
+				m.setUp(false)
+			},
+		},
+	}
+	config.SetUsernamePassword(m.settings.Username, []byte(m.settings.Password))
+	if m.willTopic != "" {
+		config.SetConnectPacketConfigurator(func(connect *paho.Connect) *paho.Connect {
+			connect.WillMessage = &paho.WillMessage{Topic: m.willTopic, Payload: m.will(), QoS: 1}
+			return connect
+		})
+	}
+
+	m.conn, err = autopaho.NewConnection(context.Background(), config)
+	close(ready)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttConnectTimeout)
+	defer cancel()
+	return m.conn.AwaitConnection(ctx)
+}
+
+func (m *mqtt5Transport) Publish(topic string, payload []byte) error {
+	return m.publish(topic, payload, false)
+}
+
+func (m *mqtt5Transport) PublishRetained(topic string, payload []byte) error {
+	return m.publish(topic, payload, true)
+}
+
+func (m *mqtt5Transport) setUp(up bool) {
+	m.mu.Lock()
+	m.up = up
+	m.mu.Unlock()
+}
+
+func (m *mqtt5Transport) publish(topic string, payload []byte, retain bool) error {
+	m.mu.Lock()
+	up := m.up
+	m.mu.Unlock()
+	if m.conn == nil || !up {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	_, err := m.conn.Publish(context.Background(), &paho.Publish{Topic: topic, Payload: payload, Retain: retain})
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadStandaloneConfig(t *testing.T) {
+	files := map[string]string{
+		"settings.yaml": `
+topic_root: plant/eip
+broker:
+  url: ssl://broker.local:8883
+  mqtt_version: "5"
+  username: adapter
+  password: secret
+adapter_settings:
+  endpoint_ip: 10.0.0.5
+  endpoint_tcp_port: 44818
+`,
+		"settings.json": `{
+  "topic_root": "plant/eip",
+  "broker": {"url": "ssl://broker.local:8883", "mqtt_version": "5", "username": "adapter", "password": "secret"},
+  "adapter_settings": {"endpoint_ip": "10.0.0.5", "endpoint_tcp_port": 44818}
+}`,
+	}
+
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(fileName, []byte(contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := loadStandaloneConfig(fileName)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if config.TopicRoot != "plant/eip" {
+				t.Errorf("unexpected topic root %q", config.TopicRoot)
+			}
+			if config.Broker.URL != "ssl://broker.local:8883" || config.Broker.Version != "5" ||
+				config.Broker.Username != "adapter" || config.Broker.Password != "secret" {
+				t.Errorf("unexpected broker settings %+v", config.Broker)
+			}
+			if config.AdapterSettings.EndpointIp != "10.0.0.5" || config.AdapterSettings.EndpointPort != 44818 {
+				t.Errorf("unexpected adapter settings %+v", config.AdapterSettings)
+			}
+		})
+	}
+}
+
+func TestNewBrokerTransport(t *testing.T) {
+	transport, err := newBrokerTransport(&mqttBrokerSettings{URL: "tcp://localhost:1883"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, ok := transport.(*mqtt311Transport); !ok {
+		t.Errorf("expected an MQTT 3.1.1 transport by default, got %T", transport)
+	}
+
+	transport, err = newBrokerTransport(&mqttBrokerSettings{URL: "tcp://localhost:1883", Version: "5"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, ok := transport.(*mqtt5Transport); !ok {
+		t.Errorf("expected an MQTT 5 transport, got %T", transport)
+	}
+
+	if _, err := newBrokerTransport(&mqttBrokerSettings{URL: "tcp://localhost:1883", Version: "3.1"}); err == nil {
+		t.Error("expected an error for an unsupported MQTT version")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueMaxBytes      = 10 * 1024 * 1024
+	defaultQueueMaxAge        = 24 * 60 * 60
+	storeAndForwardRetryDelay = time.Second
+	queuedMessageExt          = ".msg"
+	queuedMessageHeaderSize   = 10
+)
+
+// queuedMessage is the in-memory index entry of a message file on disk
+type queuedMessage struct {
+	file   string
+	size   int64
+	queued time.Time
+}
+
+// storeAndForwardTransport queues the publishes that fail while the broker
+// is unreachable in a directory, one file per message, and replays them in
+// order once publishing succeeds again. Payloads are stored as encoded so
+// they keep the timestamps of when they were produced. While messages are
+// queued new publishes are queued behind them to preserve the order.
+//
+// Sparkplug B messages are not queued, the edge node republishes its births
+// when it reconnects and stale seq numbers would break the session.
+type storeAndForwardTransport struct {
+	mqttTransport
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu       sync.Mutex
+	drainMu  sync.Mutex
+	messages []queuedMessage
+	bytes    int64
+	dropped  uint64
+	nextSeq  uint64
+}
+
+var outboundQueue *storeAndForwardTransport
+
+// initializeStoreAndForward wraps mqttClient with the outbound queue when a
+// store_and_forward directory is configured
+func initializeStoreAndForward() {
+	settings := adapterSettings.StoreAndForward
+	if settings == nil || settings.Directory == "" {
+		return
+	}
+
+	queue, err := newStoreAndForwardTransport(mqttClient, settings)
+	if err != nil {
+		log.Fatalf("[FATAL] initializeStoreAndForward - Failed to open outbound queue: %s\n", err.Error())
+	}
+	log.Printf("[INFO] initializeStoreAndForward - Queueing undelivered messages in %s, %d messages pending\n", settings.Directory, len(queue.messages))
+
+	outboundQueue = queue
+	mqttClient = queue
+	go queue.replay()
+}
+
+func newStoreAndForwardTransport(transport mqttTransport, settings *storeAndForwardSettings) (*storeAndForwardTransport, error) {
+	q := &storeAndForwardTransport{
+		mqttTransport: transport,
+		dir:           settings.Directory,
+		maxBytes:      int64(settings.MaxBytes),
+		maxAge:        time.Duration(settings.MaxAge) * time.Second,
+	}
+	if q.maxBytes == 0 {
+		q.maxBytes = defaultQueueMaxBytes
+	}
+	if q.maxAge == 0 {
+		q.maxAge = defaultQueueMaxAge * time.Second
+	}
+
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+	return q, q.load()
+}
+
+// load indexes the messages left over from a previous run
+func (q *storeAndForwardTransport) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), queuedMessageExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), queuedMessageExt), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		file := filepath.Join(q.dir, entry.Name())
+		b, err := os.ReadFile(file)
+		if err != nil || len(b) < queuedMessageHeaderSize {
+			log.Printf("[ERROR] load - Discarding unreadable queued message %s\n", file)
+			os.Remove(file)
+			continue
+		}
+
+		q.messages = append(q.messages, queuedMessage{
+			file:   file,
+			size:   int64(len(b)),
+			queued: time.UnixMilli(int64(binary.BigEndian.Uint64(b))),
+		})
+		q.bytes += int64(len(b))
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+
+	// the file names are fixed width hex, so they sort in queue order
+	sort.Slice(q.messages, func(i, j int) bool { return q.messages[i].file < q.messages[j].file })
+	return nil
+}
+
+func (q *storeAndForwardTransport) Publish(topic string, payload []byte) error {
+	if isSparkplugTopic(topic) {
+		return q.mqttTransport.Publish(topic, payload)
+	}
+
+	q.mu.Lock()
+	pending := len(q.messages) > 0
+	q.mu.Unlock()
+
+	if !pending {
+		err := q.mqttTransport.Publish(topic, payload)
+		if err == nil {
+			return nil
+		}
+		log.Printf("[ERROR] Publish - Failed to publish to %s, queueing message: %s\n", topic, err.Error())
+	}
+
+	return q.enqueue(topic, payload)
+}
+
+// PublishRetained bypasses the queue, retained messages carry the current
+// state and are published again by their producer after a reconnect
+func (q *storeAndForwardTransport) PublishRetained(topic string, payload []byte) error {
+	if transport, ok := q.mqttTransport.(mqttRetainTransport); ok {
+		return transport.PublishRetained(topic, payload)
+	}
+	return q.mqttTransport.Publish(topic, payload)
+}
+
+// enqueue writes a message file, dropping the oldest messages when the queue
+// would grow past max_bytes
+func (q *storeAndForwardTransport) enqueue(topic string, payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := timeNow()
+	record := make([]byte, queuedMessageHeaderSize, queuedMessageHeaderSize+len(topic)+len(payload))
+	binary.BigEndian.PutUint64(record, uint64(now.UnixMilli()))
+	binary.BigEndian.PutUint16(record[8:], uint16(len(topic)))
+	record = append(append(record, topic...), payload...)
+
+	size := int64(len(record))
+	if size > q.maxBytes {
+		q.dropped++
+		return fmt.Errorf("message of %d bytes exceeds the outbound queue size", size)
+	}
+	q.expire(now)
+	for q.bytes+size > q.maxBytes {
+		q.drop("outbound queue is full")
+	}
+
+	file := filepath.Join(q.dir, fmt.Sprintf("%016x%s", q.nextSeq, queuedMessageExt))
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, record, 0600); err != nil {
+		q.dropped++
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		q.dropped++
+		return err
+	}
+
+	q.nextSeq++
+	q.messages = append(q.messages, queuedMessage{file: file, size: size, queued: now})
+	q.bytes += size
+	return nil
+}
+
+// expire drops the messages older than max_age, the caller holds q.mu
+func (q *storeAndForwardTransport) expire(now time.Time) {
+	for len(q.messages) > 0 && now.Sub(q.messages[0].queued) > q.maxAge {
+		q.drop("queued message expired")
+	}
+}
+
+// drop removes the oldest message, the caller holds q.mu
+func (q *storeAndForwardTransport) drop(reason string) {
+	oldest := q.messages[0]
+	log.Printf("[ERROR] drop - Dropping queued message %s: %s\n", filepath.Base(oldest.file), reason)
+	q.remove(oldest.file)
+	q.dropped++
+}
+
+// remove deletes a message, the caller holds q.mu. Nothing is removed when
+// the message was dropped meanwhile.
+func (q *storeAndForwardTransport) remove(file string) {
+	for i, m := range q.messages {
+		if m.file != file {
+			continue
+		}
+		if err := os.Remove(m.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[ERROR] remove - Failed to remove queued message %s: %s\n", m.file, err.Error())
+		}
+		q.messages = append(q.messages[:i:i], q.messages[i+1:]...)
+		q.bytes -= m.size
+		return
+	}
+}
+
+// replay retries the queued messages until the process exits
+func (q *storeAndForwardTransport) replay() {
+	for {
+		q.drain()
+		time.Sleep(storeAndForwardRetryDelay)
+	}
+}
+
+// drain publishes the queued messages in order, stopping at the first failure
+func (q *storeAndForwardTransport) drain() {
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+
+	for {
+		q.mu.Lock()
+		q.expire(timeNow())
+		if len(q.messages) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		next, depth := q.messages[0], len(q.messages)
+		q.mu.Unlock()
+
+		topic, payload, err := readQueuedMessage(next.file)
+		if err != nil {
+			q.mu.Lock()
+			if len(q.messages) > 0 && q.messages[0].file == next.file {
+				q.drop(err.Error())
+			}
+			q.mu.Unlock()
+			continue
+		}
+
+		if err := q.mqttTransport.Publish(topic, payload); err != nil {
+			log.Printf("[DEBUG] drain - Broker still unavailable, %d messages queued: %s\n", depth, err.Error())
+			return
+		}
+
+		// the message may have been dropped while it was published, when
+		// the queue was full or it expired
+		q.mu.Lock()
+		q.remove(next.file)
+		q.mu.Unlock()
+	}
+}
+
+func readQueuedMessage(file string) (string, []byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(b) < queuedMessageHeaderSize {
+		return "", nil, fmt.Errorf("queued message %s is truncated", file)
+	}
+	topicEnd := queuedMessageHeaderSize + int(binary.BigEndian.Uint16(b[8:]))
+	if len(b) < topicEnd {
+		return "", nil, fmt.Errorf("queued message %s is truncated", file)
+	}
+	return string(b[queuedMessageHeaderSize:topicEnd]), b[topicEnd:], nil
+}
+
+func (q *storeAndForwardTransport) status() *ethernetIpQueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return &ethernetIpQueueStatus{Depth: len(q.messages), Bytes: q.bytes, Dropped: q.dropped}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	adapter_library "github.com/clearblade/adapter-go-library"
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+// offlineTransport fails every publish while offline is set
+type offlineTransport struct {
+	*memoryTransport
+
+	mu      sync.Mutex
+	offline bool
+}
+
+func (o *offlineTransport) setOffline(offline bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.offline = offline
+}
+
+func (o *offlineTransport) Publish(topic string, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.offline {
+		return errors.New("not connected")
+	}
+	return o.memoryTransport.Publish(topic, payload)
+}
+
+func TestStoreAndForward(t *testing.T) {
+	prevNow := timeNow
+	t.Cleanup(func() { timeNow = prevNow })
+	now := testTime
+	timeNow = func() time.Time { return now }
+
+	broker := &offlineTransport{memoryTransport: newMemoryTransport()}
+	settings := &storeAndForwardSettings{Directory: t.TempDir(), MaxBytes: 1000, MaxAge: 60}
+	queue, err := newStoreAndForwardTransport(broker, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	queue.Publish("eip/read/response", []byte(`{"n":1}`))
+	broker.expect(t, "eip/read/response", `{"n":1}`)
+
+	broker.setOffline(true)
+	for _, payload := range []string{`{"n":2}`, `{"n":3}`} {
+		if err := queue.Publish("eip/read/response", []byte(payload)); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	queue.Publish("spBv1.0/Plant/DDATA/Line1/controller", []byte{0x08, 0x01})
+	if status := queue.status(); status.Depth != 2 || status.Bytes != 2*(10+17+7) || status.Dropped != 0 {
+		t.Fatalf("unexpected queue status %+v", status)
+	}
+
+	// replay still fails, the queue is kept
+	queue.drain()
+	broker.expectNone(t)
+
+	// the queue survives a restart
+	queue, err = newStoreAndForwardTransport(broker, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// once reconnected new messages queue behind the pending ones
+	broker.setOffline(false)
+	queue.Publish("eip/write/response", []byte(`{"n":4}`))
+	broker.expectNone(t)
+
+	queue.drain()
+	broker.expect(t, "eip/read/response", `{"n":2}`)
+	broker.expect(t, "eip/read/response", `{"n":3}`)
+	broker.expect(t, "eip/write/response", `{"n":4}`)
+	if status := queue.status(); status.Depth != 0 || status.Bytes != 0 {
+		t.Fatalf("unexpected queue status %+v", status)
+	}
+
+	queue.Publish("eip/read/response", []byte(`{"n":5}`))
+	broker.expect(t, "eip/read/response", `{"n":5}`)
+}
+
+func TestStoreAndForwardLimits(t *testing.T) {
+	prevNow := timeNow
+	t.Cleanup(func() { timeNow = prevNow })
+	now := testTime
+	timeNow = func() time.Time { return now }
+
+	broker := &offlineTransport{memoryTransport: newMemoryTransport(), offline: true}
+	queue, err := newStoreAndForwardTransport(broker, &storeAndForwardSettings{Directory: t.TempDir(), MaxBytes: 100, MaxAge: 60})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// each message takes 34 bytes, the fourth pushes out the first
+	for _, payload := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`} {
+		queue.Publish("eip/read/response", []byte(payload))
+		now = now.Add(20 * time.Second)
+	}
+	if status := queue.status(); status.Depth != 2 || status.Dropped != 2 {
+		t.Fatalf("unexpected queue status %+v", status)
+	}
+
+	if err := queue.Publish("eip/read/response", make([]byte, 100)); err == nil {
+		t.Fatal("expected an error for a message larger than the queue")
+	}
+
+	// {"n":3} is now 70s old and expires, {"n":4} is 50s old
+	now = now.Add(30 * time.Second)
+	broker.setOffline(false)
+	queue.drain()
+	broker.expect(t, "eip/read/response", `{"n":4}`)
+	broker.expectNone(t)
+	if status := queue.status(); status.Depth != 0 || status.Dropped != 4 {
+		t.Fatalf("unexpected queue status %+v", status)
+	}
+}
+
+// blockingTransport holds the first publish until release is closed
+type blockingTransport struct {
+	*memoryTransport
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingTransport) Publish(topic string, payload []byte) error {
+	b.once.Do(func() {
+		close(b.started)
+		<-b.release
+	})
+	return b.memoryTransport.Publish(topic, payload)
+}
+
+func TestStoreAndForwardDropDuringDrain(t *testing.T) {
+	prevNow := timeNow
+	t.Cleanup(func() { timeNow = prevNow })
+	timeNow = func() time.Time { return testTime }
+
+	broker := &offlineTransport{memoryTransport: newMemoryTransport(), offline: true}
+	settings := &storeAndForwardSettings{Directory: t.TempDir(), MaxBytes: 100, MaxAge: 60}
+	queue, err := newStoreAndForwardTransport(broker, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	queue.Publish("eip/read/response", []byte(`{"n":1}`))
+	queue.Publish("eip/read/response", []byte(`{"n":2}`))
+
+	blocking := &blockingTransport{memoryTransport: broker.memoryTransport, started: make(chan struct{}), release: make(chan struct{})}
+	queue.mqttTransport = blocking
+	drained := make(chan struct{})
+	go func() {
+		queue.drain()
+		close(drained)
+	}()
+
+	// {"n":3} pushes {"n":1} out of the full queue while it is being published
+	<-blocking.started
+	queue.Publish("eip/read/response", []byte(`{"n":3}`))
+	close(blocking.release)
+	<-drained
+
+	broker.expect(t, "eip/read/response", `{"n":1}`)
+	broker.expect(t, "eip/read/response", `{"n":2}`)
+	broker.expect(t, "eip/read/response", `{"n":3}`)
+	if status := queue.status(); status.Depth != 0 || status.Bytes != 0 || status.Dropped != 1 {
+		t.Fatalf("unexpected queue status %+v", status)
+	}
+}
+
+// startTestBroker accepts a single MQTT 3.1.1 client and acknowledges its
+// CONNECT and SUBSCRIBE, closing the returned channel drops the connection
+// and stops accepting new ones
+func startTestBroker(t *testing.T) (string, chan struct{}) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			<-down
+			listener.Close()
+			conn.Close()
+		}()
+
+		r := bufio.NewReader(conn)
+		for {
+			header, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return
+			}
+			body := make([]byte, length)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			switch header & 0xf0 {
+			case 0x10:
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+			case 0x80:
+				// one granted QoS 0 per topic filter
+				ack := []byte{0x90, 0, body[0], body[1]}
+				for i := 2; i+2 <= len(body); {
+					i += 2 + int(binary.BigEndian.Uint16(body[i:])) + 1
+					ack = append(ack, 0x00)
+				}
+				ack[1] = byte(len(ack) - 2)
+				conn.Write(ack)
+			case 0xc0:
+				conn.Write([]byte{0xd0, 0x00})
+			}
+		}
+	}()
+	return "tcp://" + listener.Addr().String(), down
+}
+
+func TestStoreAndForwardBrokerDown(t *testing.T) {
+	url, down := startTestBroker(t)
+	transport := &mqtt311Transport{settings: &mqttBrokerSettings{URL: url, ClientID: "test"}}
+	if err := transport.Subscribe("eip/+", func(*mqttTypes.Publish) {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	queue, err := newStoreAndForwardTransport(transport, &storeAndForwardSettings{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := queue.Publish("eip/read/response", []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if status := queue.status(); status.Depth != 0 {
+		t.Fatalf("expected the message to be published, got %+v", status)
+	}
+
+	connected := func() bool {
+		transport.mu.Lock()
+		defer transport.mu.Unlock()
+		return transport.client.IsConnected()
+	}
+	close(down)
+	deadline := time.Now().Add(5 * time.Second)
+	for connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("the client did not notice the broker went down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the QoS 0 publish fails rather than being discarded, so it is queued
+	if err := queue.Publish("eip/read/response", []byte(`{"n":2}`)); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if status := queue.status(); status.Depth != 1 {
+		t.Fatalf("expected the message to be queued, got %+v", status)
+	}
+}
+
+func TestStoreAndForwardClearBladeBrokerDown(t *testing.T) {
+	url, down := startTestBroker(t)
+	prevArgs := adapter_library.Args
+	t.Cleanup(func() { adapter_library.Args = prevArgs })
+	adapter_library.Args.MessagingURL = strings.TrimPrefix(url, "tcp://")
+	adapter_library.Args.SystemKey = "key"
+	adapter_library.Args.SystemSecret = "secret"
+	adapter_library.Args.ServiceAccount = "adapter"
+	adapter_library.Args.ServiceAccountToken = "token"
+
+	transport := &clearBladeTransport{}
+	if err := transport.Subscribe("eip/+", func(*mqttTypes.Publish) {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	queue, err := newStoreAndForwardTransport(transport, &storeAndForwardSettings{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := queue.Publish("eip/read/response", []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if status := queue.status(); status.Depth != 0 {
+		t.Fatalf("expected the message to be published, got %+v", status)
+	}
+
+	connected := func() bool {
+		transport.mu.Lock()
+		defer transport.mu.Unlock()
+		return transport.connected
+	}
+	close(down)
+	deadline := time.Now().Add(5 * time.Second)
+	for connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("the client did not notice the broker went down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the client reconnects by itself and would report the QoS 0 publish as
+	// sent, the transport fails it so it is queued
+	if err := queue.Publish("eip/read/response", []byte(`{"n":2}`)); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if status := queue.status(); status.Depth != 1 {
+		t.Fatalf("expected the message to be queued, got %+v", status)
+	}
+}
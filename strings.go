@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+const (
+	stringEncodingASCII  = "ascii"
+	stringEncodingLatin1 = "latin1"
+	stringEncodingUTF8   = "utf8"
+
+	// the predefined STRING type holds up to 82 characters
+	logixStringLength = 82
+)
+
+// stringLayout locates the length and the characters of a string structure,
+// the predefined STRING type, STRING20 or any UDT with a DINT LEN and a SINT
+// array DATA member
+type stringLayout struct {
+	lengthOffset uint32
+	dataOffset   uint32
+	capacity     int
+}
+
+// stringLayouts caches the layout of every structure type looked up, nil for
+// the types that are not strings. It is cleared when the tags are retrieved.
+var stringLayouts = struct {
+	mu      sync.Mutex
+	layouts map[types.UInt]*stringLayout
+}{layouts: map[types.UInt]*stringLayout{}}
+
+// validateStringEncoding checks string_encoding names a supported encoding
+func validateStringEncoding() error {
+	switch adapterSettings.StringEncoding {
+	case "", stringEncodingASCII, stringEncodingLatin1, stringEncodingUTF8:
+		return nil
+	}
+	return fmt.Errorf("unsupported string encoding %s", adapterSettings.StringEncoding)
+}
+
+func resetStringLayouts() {
+	stringLayouts.mu.Lock()
+	stringLayouts.layouts = map[types.UInt]*stringLayout{}
+	stringLayouts.mu.Unlock()
+}
+
+// stringLayoutFor returns the layout of a string structure type, reading the
+// type's template the first time it is looked up
+func stringLayoutFor(tagType types.UInt) (*stringLayout, bool) {
+	if tagType&0x8000 == 0 || tagType&0x6000 != 0 {
+		return nil, false
+	}
+	if tagType&0x0fff == eip.STRING {
+		return &stringLayout{lengthOffset: 0, dataOffset: 4, capacity: logixStringLength}, true
+	}
+
+	stringLayouts.mu.Lock()
+	defer stringLayouts.mu.Unlock()
+	if layout, ok := stringLayouts.layouts[tagType]; ok {
+		return layout, layout != nil
+	}
+
+	template, err := readTemplate(tagType)
+	if err != nil {
+		// not cached, the template is read again on the next lookup
+		log.Printf("[DEBUG] stringLayoutFor - %s\n", err.Error())
+		return nil, false
+	}
+	layout := template.stringLayout()
+	stringLayouts.layouts[tagType] = layout
+	return layout, layout != nil
+}
+
+// stringLayout matches the LEN+SINT[] pattern of Logix string types, nil
+// for other structures
+func (t *cipTemplate) stringLayout() *stringLayout {
+	length, ok := t.members["LEN"]
+	if !ok || length.dataType != eip.DINT {
+		return nil
+	}
+	data, ok := t.members["DATA"]
+	if !ok || data.dataType&0x0fff != eip.SINT || data.info == 0 || len(t.members) != 2 {
+		return nil
+	}
+	return &stringLayout{lengthOffset: length.offset, dataOffset: data.offset, capacity: int(data.info)}
+}
+
+// readString reads a string structure and decodes its characters
+func readString(tag *eip.Tag, layout *stringLayout) (string, error) {
+	_, data, err := readSymbol(tag.Name())
+	if err != nil {
+		return "", err
+	}
+	if int(layout.lengthOffset)+4 > len(data) {
+		return "", fmt.Errorf("short read reply for %s", tag.Name())
+	}
+
+	length := int(binary.LittleEndian.Uint32(data[layout.lengthOffset:]))
+	if length > layout.capacity || int(layout.dataOffset)+length > len(data) {
+		return "", fmt.Errorf("%s has an invalid string length %d", tag.Name(), length)
+	}
+	return decodeString(data[layout.dataOffset : int(layout.dataOffset)+length]), nil
+}
+
+// writeString encodes the value and writes DATA, padded with NUL characters,
+// and LEN in a single message so the controller does not run a scan with
+// only one of them written
+func writeString(tag *eip.Tag, layout *stringLayout, value interface{}) error {
+	structure, err := encodeStringStructure(tag, layout, value)
+	if err != nil {
+		return err
+	}
+	for _, reply := range sendMultipleCIP(layout.writeRequests(tag.Name(), structure)) {
+		if reply.err != nil {
+			return fmt.Errorf("failed to write %s: %w", tag.Name(), reply.err)
+		}
+	}
+	return nil
+}
+
+// size is the number of bytes of the structure up to the end of LEN and DATA
+func (l *stringLayout) size() int {
+	size := int(l.dataOffset) + l.capacity
+	if end := int(l.lengthOffset) + 4; end > size {
+		size = end
+	}
+	return size
+}
+
+// encodeStringStructure encodes the value as the bytes of the string
+// structure, DATA padded with NUL characters
+func encodeStringStructure(tag *eip.Tag, layout *stringLayout, value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w for string tag: %v", errInvalidValue, value)
+	}
+	encoded, err := encodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > layout.capacity {
+		return nil, fmt.Errorf("%w for %s: %d characters do not fit in %d", errInvalidValue, tag.Name(), len(encoded), layout.capacity)
+	}
+
+	structure := make([]byte, layout.size())
+	copy(structure[layout.dataOffset:], encoded)
+	binary.LittleEndian.PutUint32(structure[layout.lengthOffset:], uint32(len(encoded)))
+	return structure, nil
+}
+
+// writeRequests writes DATA and then LEN of a string structure, taken from
+// the structure's bytes
+func (l *stringLayout) writeRequests(name string, structure []byte) []cipRequest {
+	return []cipRequest{
+		writeArrayRequest(name+".DATA", eip.SINT, uint16(l.capacity), structure[l.dataOffset:int(l.dataOffset)+l.capacity]),
+		writeRequest(name+".LEN", eip.DINT, structure[l.lengthOffset:l.lengthOffset+4]),
+	}
+}
+
+// decodeString converts the characters of a string tag with string_encoding,
+// characters the encoding does not allow are replaced with U+FFFD
+func decodeString(data []byte) string {
+	switch adapterSettings.StringEncoding {
+	case stringEncodingUTF8:
+		return strings.ToValidUTF8(string(data), string(utf8.RuneError))
+	case stringEncodingLatin1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+		if b > 0x7f {
+			runes[i] = utf8.RuneError
+		}
+	}
+	return string(runes)
+}
+
+// encodeString converts a string to the characters written to a string tag
+// with string_encoding
+func encodeString(s string) ([]byte, error) {
+	if adapterSettings.StringEncoding == stringEncodingUTF8 {
+		return []byte(s), nil
+	}
+
+	limit, name := rune(0x7f), "ASCII"
+	if adapterSettings.StringEncoding == stringEncodingLatin1 {
+		limit, name = 0xff, "Latin-1"
+	}
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > limit {
+			return nil, fmt.Errorf("%w: %q cannot be encoded as %s", errInvalidValue, r, name)
+		}
+		encoded = append(encoded, byte(r))
+	}
+	return encoded, nil
+}
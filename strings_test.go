@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestStringTags(t *testing.T) {
+	sim := newSimController(t)
+	sim.addString("Recipe", "IPA")
+	sim.addTemplate(0x0123, "STRING20", 24,
+		simMember{name: "LEN", dataType: 0xc4, offset: 0},
+		simMember{name: "DATA", dataType: 0xc2, info: 20, offset: 4},
+	)
+	sim.addTemplate(0x0124, "Batch_Info", 8,
+		simMember{name: "Count", dataType: 0xc4, offset: 0},
+		simMember{name: "Size", dataType: 0xc4, offset: 4},
+	)
+	sim.addTag("Operator", 0x8123, make([]byte, 24))
+	sim.addTag("Batch", 0x8124, make([]byte, 8))
+	transport := startTestAdapter(t, sim)
+
+	expectString := func(name string, value string, size int) {
+		t.Helper()
+		expected := make([]byte, 4+size)
+		binary.LittleEndian.PutUint32(expected, uint32(len(value)))
+		copy(expected[4:], value)
+		if got := sim.value(name); !bytes.Equal(got[:4+size], expected) {
+			t.Fatalf("unexpected controller value for %s: % x", name, got)
+		}
+	}
+
+	// writes replace the whole DATA array so shorter strings leave no stale
+	// characters behind
+	transport.send(testTopicRoot+"/write", `{"node_id": "Recipe", "value": "Pale Ale"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Recipe", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	expectString("Recipe", "Pale Ale", simStringDataLength)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Operator", "value": "J. Smith"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Operator", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Operator", "value": "Ann"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Operator", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+	expectString("Operator", "Ann", 20)
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Recipe", "Operator"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"Operator": {"value": "Ann", "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Recipe": {"value": "Pale Ale", "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Operator", "value": "A name of 21 letters."}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Operator", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "invalid value for Operator: 21 characters do not fit in 20"}`)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Operator", "value": "Zoë"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Operator", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "invalid value: 'ë' cannot be encoded as ASCII"}`)
+	transport.send(testTopicRoot+"/write", `{"node_id": "Operator", "value": 7}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Operator", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "invalid value for string tag: 7"}`)
+	expectString("Operator", "Ann", 20)
+
+	// structures other than strings remain unsupported
+	transport.send(testTopicRoot+"/write", `{"node_id": "Batch", "value": "B-1"}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Batch", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "unsupported data type: 33060"}`)
+}
+
+func TestStringEncodings(t *testing.T) {
+	prevSettings := adapterSettings
+	t.Cleanup(func() { adapterSettings = prevSettings })
+
+	tests := []struct {
+		encoding string
+		value    string
+		encoded  []byte
+	}{
+		{"", "Zoe", []byte("Zoe")},
+		{"latin1", "Zoë", []byte{'Z', 'o', 0xeb}},
+		{"utf8", "Zoë", []byte{'Z', 'o', 0xc3, 0xab}},
+	}
+	for _, test := range tests {
+		adapterSettings = &ethernetIpAdapterSettings{StringEncoding: test.encoding}
+		encoded, err := encodeString(test.value)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.encoding, err.Error())
+		}
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("%s: expected % x, got % x", test.encoding, test.encoded, encoded)
+		}
+		if decoded := decodeString(encoded); decoded != test.value {
+			t.Errorf("%s: expected %q, got %q", test.encoding, test.value, decoded)
+		}
+	}
+
+	adapterSettings = &ethernetIpAdapterSettings{}
+	if decoded := decodeString([]byte{'Z', 'o', 0xeb}); decoded != "Zo�" {
+		t.Errorf("unexpected ASCII decoding %q", decoded)
+	}
+	adapterSettings = &ethernetIpAdapterSettings{StringEncoding: "latin1"}
+	if _, err := encodeString("€"); err == nil {
+		t.Errorf("expected an error encoding € as Latin-1")
+	}
+	adapterSettings = &ethernetIpAdapterSettings{StringEncoding: "ebcdic"}
+	if err := validateStringEncoding(); err == nil || err.Error() != "unsupported string encoding ebcdic" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+
+	cb "github.com/clearblade/Go-SDK"
+	adapter_library "github.com/clearblade/adapter-go-library"
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+// tagConfigs holds the per tag configuration from the adapter settings and
+// the tag_config_collection, keyed by tag name
+var tagConfigs map[string]*tagConfig
+
+// initializeTagConfig merges the tag_config_collection rows with the
+// tag_config adapter setting, the adapter setting wins for tags in both
+func initializeTagConfig() error {
+	configs := map[string]*tagConfig{}
+
+	if adapterSettings.TagConfigCollection != "" {
+		rows, err := fetchCollection(adapterSettings.TagConfigCollection)
+		if err != nil {
+			return fmt.Errorf("failed to fetch tag_config_collection %s: %w", adapterSettings.TagConfigCollection, err)
+		}
+		collection, err := parseTagConfigRows(rows)
+		if err != nil {
+			return err
+		}
+		for name, config := range collection {
+			configs[name] = config
+		}
+	}
+
+	for name, config := range adapterSettings.TagConfig {
+		configs[name] = config
+	}
+
+	for name, config := range configs {
+		if err := config.validate(); err != nil {
+			return fmt.Errorf("invalid tag_config for %s: %w", name, err)
+		}
+	}
+
+	log.Printf("[INFO] initializeTagConfig - Loaded configuration for %d tags\n", len(configs))
+	tagConfigs = configs
+	return nil
+}
+
+// fetchCollection returns every row of a collection in the adapter's system.
+// Collections are only available when the adapter runs against ClearBlade.
+func fetchCollection(name string) ([]interface{}, error) {
+	client, err := systemClient()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[DEBUG] fetchCollection - Executing query against table %s\n", name)
+	results, err := client.GetDataByName(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, ok := results["DATA"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response from collection %s", name)
+	}
+	return rows, nil
+}
+
+// systemClient authenticates with the adapter's system for collection and
+// MQTT access
+func systemClient() (*cb.DeviceClient, error) {
+	args := adapter_library.Args
+	if args.SystemKey == "" {
+		return nil, fmt.Errorf("collections are not available in standalone mode")
+	}
+
+	if args.ServiceAccount != "" {
+		return cb.NewDeviceClientWithServiceAccountAndAddrs(args.PlatformURL, args.MessagingURL, args.SystemKey, args.SystemSecret, args.ServiceAccount, args.ServiceAccountToken), nil
+	}
+	client := cb.NewDeviceClientWithAddrs(args.PlatformURL, args.MessagingURL, args.SystemKey, args.SystemSecret, args.DeviceName, args.ActiveKey)
+	if _, err := client.Authenticate(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// parseTagConfigRows reads tag_config_collection rows, the tag_name column
+// names the tag and the remaining columns match the tag_config keys
+func parseTagConfigRows(rows []interface{}) (map[string]*tagConfig, error) {
+	configs := map[string]*tagConfig{}
+	for _, row := range rows {
+		b, err := json.Marshal(row)
+		if err != nil {
+			return nil, err
+		}
+		entry := struct {
+			TagName string `json:"tag_name"`
+			tagConfig
+		}{}
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return nil, fmt.Errorf("invalid tag_config_collection row %s: %w", b, err)
+		}
+		if entry.TagName == "" {
+			log.Printf("[ERROR] parseTagConfigRows - Ignoring row without a tag_name: %s\n", b)
+			continue
+		}
+		config := entry.tagConfig
+		configs[entry.TagName] = &config
+	}
+	return configs, nil
+}
+
+func (c *tagConfig) validate() error {
+	if c.RawMin != c.RawMax && c.EUMin == c.EUMax {
+		return fmt.Errorf("eu_min and eu_max must differ when a raw range is set")
+	}
+	if c.Clamp && !c.scaled() {
+		return fmt.Errorf("clamp requires raw_min/raw_max and eu_min/eu_max")
+	}
+	return nil
+}
+
+// scaled reports whether the raw range is linearly mapped onto the EU range
+func (c *tagConfig) scaled() bool {
+	return c != nil && c.RawMin != c.RawMax && c.EUMin != c.EUMax
+}
+
+// transforms reports whether the tag's values are converted at all, the
+// converted values are always float64
+func (c *tagConfig) transforms() bool {
+	return c.scaled() || c != nil && c.Offset != 0
+}
+
+func (c *tagConfig) units() string {
+	if c == nil {
+		return ""
+	}
+	return c.Units
+}
+
+// toEU converts a raw controller value to engineering units
+func (c *tagConfig) toEU(raw float64) float64 {
+	eu := raw
+	if c.scaled() {
+		eu = (raw-c.RawMin)*(c.EUMax-c.EUMin)/(c.RawMax-c.RawMin) + c.EUMin
+		if c.Clamp {
+			eu = clampRange(eu, c.EUMin, c.EUMax)
+		}
+	}
+	return eu + c.Offset
+}
+
+// toRaw is the inverse of toEU
+func (c *tagConfig) toRaw(eu float64) float64 {
+	raw := eu - c.Offset
+	if c.scaled() {
+		raw = (raw-c.EUMin)*(c.RawMax-c.RawMin)/(c.EUMax-c.EUMin) + c.RawMin
+		if c.Clamp {
+			raw = clampRange(raw, c.RawMin, c.RawMax)
+		}
+	}
+	return raw
+}
+
+// clampRange limits v to the range between a and b in either order
+func clampRange(v, a, b float64) float64 {
+	return math.Max(math.Min(v, math.Max(a, b)), math.Min(a, b))
+}
+
+// scaleReadValue applies the tag's configuration to a value returned by readTag
+func scaleReadValue(tag *eip.Tag, value interface{}) interface{} {
+	config := tagConfigs[tag.Name()]
+	if !config.transforms() {
+		return value
+	}
+
+	switch v := value.(type) {
+	case int32:
+		return config.toEU(float64(v))
+	case uint32:
+		return config.toEU(float64(v))
+	}
+	return value
+}
+
+// scaleWriteValue converts an engineering value supplied to writeTag back to
+// the raw value, rounded for the integer tags
+func scaleWriteValue(tag *eip.Tag, value interface{}) (interface{}, error) {
+	config := tagConfigs[tag.Name()]
+	if !config.transforms() || !isScalableType(tag.Type) {
+		return value, nil
+	}
+
+	eu, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w for %s tag: %v", errInvalidValue, eip.TypeMap[tag.Type], value)
+	}
+	return math.Round(config.toRaw(eu)), nil
+}
+
+// isScalableType reports whether the tag's values are numbers scaling applies to
+func isScalableType(tagType types.UInt) bool {
+	switch tagType {
+	case eip.SINT, eip.INT, eip.DINT, eip.USINT, eip.UINT, eip.UDINT:
+		return true
+	}
+	return false
+}
+
+// scaledTag reports whether a tag's values are converted to float64
+func scaledTag(name string, tagType types.UInt) bool {
+	return isScalableType(tagType) && tagConfigs[resolveTagName(name)].transforms()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTagScaling(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Level", 13824)
+	sim.addDINT("Temperature", 65)
+	sim.addDINT("Counter", 42)
+	transport := startTestAdapter(t, sim)
+
+	adapterSettings.TagConfig = map[string]*tagConfig{
+		"Level":       {RawMin: 0, RawMax: 27648, EUMin: 0, EUMax: 100, Clamp: true, Units: "%"},
+		"Temperature": {Offset: -40, Units: "degC"},
+	}
+	if err := initializeTagConfig(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Level", "Temperature", "Counter"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"Counter": {"value": 42, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Level": {"value": 50, "units": "%", "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Temperature": {"value": 25, "units": "degC", "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	tests := []struct {
+		tag      string
+		value    string
+		expected []byte
+	}{
+		{tag: "Level", value: "25", expected: []byte{0x00, 0x1b, 0x00, 0x00}},
+		{tag: "Level", value: "150", expected: []byte{0x00, 0x6c, 0x00, 0x00}},
+		{tag: "Level", value: "0.01", expected: []byte{0x03, 0x00, 0x00, 0x00}},
+		{tag: "Temperature", value: "-10.5", expected: []byte{0x1e, 0x00, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		transport.send(testTopicRoot+"/write", `{"node_id": "`+test.tag+`", "value": `+test.value+`}`)
+		transport.expect(t, testTopicRoot+"/write/response", `{
+			"node_id": "`+test.tag+`",
+			"timestamp": "2022-09-01T12:30:00Z",
+			"success": true,
+			"status_code": 0,
+			"error_message": ""
+		}`)
+		if got := sim.value(test.tag); !bytes.Equal(got, test.expected) {
+			t.Fatalf("unexpected controller value for %s = %s: % x", test.tag, test.value, got)
+		}
+	}
+
+	var units []string
+	for _, tag := range browseTags() {
+		units = append(units, tag.Units)
+	}
+	if len(units) != 3 || units[0] != "" || units[1] != "%" || units[2] != "degC" {
+		t.Fatalf("unexpected browse units %q", units)
+	}
+}
+
+func TestTagScalingSmallIntegers(t *testing.T) {
+	sim := newSimController(t)
+	sim.addTag("Pressure", 0xc3, []byte{0x00, 0x6c})
+	sim.addTag("Valve", 0xc6, []byte{0x80})
+	transport := startTestAdapter(t, sim)
+
+	adapterSettings.TagConfig = map[string]*tagConfig{
+		"Pressure": {RawMin: -27648, RawMax: 27648, EUMin: -10, EUMax: 10, Units: "bar"},
+		"Valve":    {RawMin: 0, RawMax: 255, EUMin: 0, EUMax: 100, Clamp: true, Units: "%"},
+	}
+	if err := initializeTagConfig(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Pressure", "Valve"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"Pressure": {"value": 10, "units": "bar", "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Valve": {"value": 50.19607843137255, "units": "%", "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	tests := []struct {
+		tag      string
+		value    string
+		expected []byte
+		err      string
+	}{
+		{tag: "Pressure", value: "-5", expected: []byte{0x00, 0xca}},
+		{tag: "Pressure", value: "2.5", expected: []byte{0x00, 0x1b}},
+		{tag: "Pressure", value: "20", expected: []byte{0x00, 0x1b}, err: "invalid value for INT tag, out of range: 55296"},
+		{tag: "Valve", value: "100", expected: []byte{0xff}},
+		{tag: "Valve", value: "150", expected: []byte{0xff}},
+		{tag: "Valve", value: "0", expected: []byte{0x00}},
+	}
+	for _, test := range tests {
+		success := "true"
+		if test.err != "" {
+			success = "false"
+		}
+		transport.send(testTopicRoot+"/write", `{"node_id": "`+test.tag+`", "value": `+test.value+`}`)
+		transport.expect(t, testTopicRoot+"/write/response", `{
+			"node_id": "`+test.tag+`",
+			"timestamp": "2022-09-01T12:30:00Z",
+			"success": `+success+`,
+			"status_code": 0,
+			"error_message": "`+test.err+`"
+		}`)
+		if got := sim.value(test.tag); !bytes.Equal(got, test.expected) {
+			t.Fatalf("unexpected controller value for %s = %s: % x", test.tag, test.value, got)
+		}
+	}
+}
+
+func TestTagConfigRows(t *testing.T) {
+	rows := []interface{}{
+		map[string]interface{}{"tag_name": "Level", "raw_min": 4000.0, "raw_max": 20000.0, "eu_min": 0.0, "eu_max": 10.0, "offset": nil, "clamp": true, "units": "bar"},
+		map[string]interface{}{"tag_name": "", "units": "m"},
+	}
+	configs, err := parseTagConfigRows(rows)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	level := configs["Level"]
+	if len(configs) != 1 || level == nil || *level != (tagConfig{RawMin: 4000, RawMax: 20000, EUMax: 10, Clamp: true, Units: "bar"}) {
+		t.Fatalf("unexpected tag config %+v", configs)
+	}
+	if eu := level.toEU(12000); eu != 5 {
+		t.Fatalf("unexpected engineering value %v", eu)
+	}
+	if eu := level.toEU(0); eu != 0 {
+		t.Fatalf("unexpected clamped engineering value %v", eu)
+	}
+	if raw := level.toRaw(2.5); raw != 8000 {
+		t.Fatalf("unexpected raw value %v", raw)
+	}
+
+	if err := (&tagConfig{RawMax: 100}).validate(); err == nil {
+		t.Fatal("expected an error for a raw range without an engineering range")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	tagsTopic      = "tags"
+	tagSetTopicEnd = "/set"
+)
+
+// tagTopicPublisher publishes every polled tag to its own retained topic,
+// {topic_root}/tags/<tag>, with the plain JSON value as payload
+type tagTopicPublisher struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+var tagTopics *tagTopicPublisher
+
+// initializeTagTopics registers the per tag publisher with the poller. It
+// must run before the MQTT connection is made so the values are published
+// again on every reconnect.
+func initializeTagTopics() {
+	publisher := &tagTopicPublisher{}
+	log.Printf("[INFO] initializeTagTopics - Publishing polled tags to %s/%s/<tag>\n", adapterConfig.TopicRoot, tagsTopic)
+
+	if session, ok := mqttClient.(mqttSessionTransport); ok {
+		session.OnConnect(publisher.republish)
+	}
+	poller.addListener(publisher.handlePoll)
+	tagTopics = publisher
+}
+
+func tagTopic(name string) string {
+	return adapterConfig.TopicRoot + "/" + tagsTopic + "/" + name
+}
+
+// isTagTopic reports whether topic is below {topic_root}/tags/
+func isTagTopic(topic string) bool {
+	return tagTopics != nil && strings.HasPrefix(topic, adapterConfig.TopicRoot+"/"+tagsTopic+"/")
+}
+
+func (p *tagTopicPublisher) handlePoll(result pollResult) {
+	if result.err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.values = result.values
+	for _, name := range result.changed {
+		p.publish(name, result.values[name])
+	}
+}
+
+// republish sends every value again after a reconnect, messages published
+// while the broker was unreachable are not queued
+func (p *tagTopicPublisher) republish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.values))
+	for name := range p.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.publish(name, p.values[name])
+	}
+}
+
+// publish sends a tag value as a retained message, the caller holds p.mu
+func (p *tagTopicPublisher) publish(name string, value interface{}) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("[ERROR] publish - Failed to encode value of tag %s: %s\n", name, err.Error())
+		return
+	}
+
+	topic := tagTopic(name)
+	log.Printf("[DEBUG] publish - Publishing to topic %s\n", topic)
+	if err := publishRetained(topic, payload); err != nil {
+		log.Printf("[ERROR] Failed to publish MQTT message to topic %s: %s\n", topic, err.Error())
+	}
+}
+
+// publishRetained publishes a retained message when the transport supports
+// it and a regular message otherwise
+func publishRetained(topic string, payload []byte) error {
+	if transport, ok := mqttClient.(mqttRetainTransport); ok {
+		return transport.PublishRetained(topic, payload)
+	}
+	return mqttClient.Publish(topic, payload)
+}
+
+// handleTagSetRequest writes the JSON value published to
+// {topic_root}/tags/<tag>/set. The new value is published by the next poll.
+func handleTagSetRequest(message *mqttTypes.Publish) {
+	topic := message.Topic.Whole
+	name := strings.TrimSuffix(strings.TrimPrefix(topic, adapterConfig.TopicRoot+"/"+tagsTopic+"/"), tagSetTopicEnd)
+
+	var value interface{}
+	if err := json.Unmarshal(message.Payload, &value); err != nil {
+		log.Printf("[ERROR] handleTagSetRequest - Failed to decode value for tag %s: %s\n", name, err.Error())
+		return
+	}
+
+	if err := auditedWrite(name, value, "", auditSourceTagTopic); err != nil {
+		log.Printf("[ERROR] Failed to write tag %s: %s\n", name, err.Error())
+		return
+	}
+	log.Printf("[INFO] Ethernet-IP write successful: %s\n", name)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTagTopics(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 42)
+	sim.addDINT("Setpoint", 10)
+	memory := startTestAdapter(t, sim)
+
+	prevPoller, prevTagTopics := poller, tagTopics
+	t.Cleanup(func() { poller, tagTopics = prevPoller, prevTagTopics })
+	poller = &tagPoller{}
+
+	transport := &sparkplugTestTransport{memoryTransport: memory}
+	mqttClient = transport
+	initializeTagTopics()
+
+	expectRetained := func(topic string, expected string) {
+		t.Helper()
+		msg := memory.next(t, topic)
+		if !msg.retained || string(msg.payload) != expected {
+			t.Fatalf("unexpected message on %s: %s (retained %t)", topic, msg.payload, msg.retained)
+		}
+	}
+
+	poller.poll()
+	expectRetained("eip/tags/Counter", `42`)
+	expectRetained("eip/tags/Setpoint", `10`)
+	poller.poll()
+	memory.expectNone(t)
+
+	// the adapter ignores its own tag values, set writes the tag
+	memory.send("eip/tags/Setpoint", `10`)
+	memory.send("eip/tags/Setpoint/set", `-250`)
+	deadline := time.Now().Add(2 * time.Second)
+	for !bytes.Equal(sim.value("Setpoint"), []byte{0x06, 0xff, 0xff, 0xff}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected controller value % x", sim.value("Setpoint"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	memory.send("eip/tags/Setpoint/set", `not json`)
+	memory.send("eip/tags/Missing/set", `1`)
+
+	poller.poll()
+	expectRetained("eip/tags/Setpoint", `-250`)
+	memory.expectNone(t)
+
+	// every value is published again on reconnect
+	transport.connected()
+	expectRetained("eip/tags/Counter", `42`)
+	expectRetained("eip/tags/Setpoint", `-250`)
+}
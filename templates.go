@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/messages/packet"
+	"github.com/loki-os/go-ethernet-ip/path"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+const (
+	cipGetAttributeList types.USInt = 0x03
+	cipTemplateClass                = 0x6c
+
+	// the template object definition size counts 23 bytes that are not
+	// returned by the read template service
+	cipTemplateHeaderSize = 23
+)
+
+// cipTemplate describes a structure data type, such as a UDT or the ALMD
+// instruction, as read from the controller's template object
+type cipTemplate struct {
+	name    string
+	size    uint32
+	members map[string]cipTemplateMember
+}
+
+// info - bit number of BOOL members, array length of array members
+// offset - byte offset of the member within the structure
+type cipTemplateMember struct {
+	dataType types.UInt
+	info     uint16
+	offset   uint32
+}
+
+// isStructType reports whether a tag type is a structure other than STRING,
+// the low 12 bits of a structure type are its template instance
+func isStructType(tagType types.UInt) bool {
+	return tagType&0x8000 != 0 && tagType&0x0fff != eip.STRING&0x0fff && tagType&0x6000 == 0
+}
+
+// readTemplate reads the definition of the structure type of a tag
+func readTemplate(tagType types.UInt) (*cipTemplate, error) {
+	instance := types.UDInt(tagType & 0x0fff)
+	templatePath := packet.Paths(
+		path.LogicalBuild(path.LogicalTypeClassID, cipTemplateClass, true),
+		path.LogicalBuild(path.LogicalTypeInstanceID, instance, true),
+	)
+
+	// object definition size (4), structure size (5) and member count (2)
+	reply, err := sendCIP(cipGetAttributeList, templatePath, []byte{3, 0, 4, 0, 5, 0, 2, 0})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %d: %w", instance, err)
+	}
+	if len(reply) < 2+8+8+6 {
+		return nil, fmt.Errorf("failed to read template %d: short attribute reply", instance)
+	}
+	definitionSize := binary.LittleEndian.Uint32(reply[6:])
+	size := binary.LittleEndian.Uint32(reply[14:])
+	count := binary.LittleEndian.Uint16(reply[22:])
+
+	want := int(definitionSize)*4 - cipTemplateHeaderSize
+	var definition []byte
+	for len(definition) < want {
+		request := make([]byte, 6)
+		binary.LittleEndian.PutUint32(request, uint32(len(definition)))
+		binary.LittleEndian.PutUint16(request[4:], uint16(want-len(definition)))
+		reply, err := sendCIP(cipReadTag, templatePath, request)
+		if err != nil && !isCIPStatus(err, cipStatusPartialTransfer) {
+			return nil, fmt.Errorf("failed to read template %d: %w", instance, err)
+		}
+		definition = append(definition, reply...)
+		if err == nil || len(reply) == 0 {
+			break
+		}
+	}
+
+	template, err := parseTemplate(definition, count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %d: %w", instance, err)
+	}
+	template.size = size
+	return template, nil
+}
+
+// parseTemplate decodes a template definition, the member descriptions
+// followed by the NUL terminated template and member names. The template
+// name ends at the first ';', e.g. "ALARM_DIGITAL;n".
+func parseTemplate(definition []byte, count uint16) (*cipTemplate, error) {
+	if len(definition) < int(count)*8 {
+		return nil, fmt.Errorf("short template definition")
+	}
+
+	names := strings.Split(string(definition[int(count)*8:]), "\x00")
+	if len(names) < int(count)+1 {
+		return nil, fmt.Errorf("template definition is missing member names")
+	}
+
+	template := &cipTemplate{
+		name:    strings.SplitN(names[0], ";", 2)[0],
+		members: map[string]cipTemplateMember{},
+	}
+	for i := 0; i < int(count); i++ {
+		description := definition[i*8:]
+		template.members[names[i+1]] = cipTemplateMember{
+			info:     binary.LittleEndian.Uint16(description),
+			dataType: types.UInt(binary.LittleEndian.Uint16(description[2:])),
+			offset:   binary.LittleEndian.Uint32(description[4:]),
+		}
+	}
+	return template, nil
+}
+
+// memberValue decodes an atomic member from the raw structure value
+func (t *cipTemplate) memberValue(data []byte, name string) (interface{}, bool) {
+	member, ok := t.members[name]
+	if !ok {
+		return nil, false
+	}
+
+	width := map[types.UInt]uint32{eip.BOOL: 1, eip.SINT: 1, eip.INT: 2, eip.DINT: 4}[member.dataType]
+	if width == 0 || member.offset+width > uint32(len(data)) {
+		return nil, false
+	}
+
+	raw := data[member.offset:]
+	switch member.dataType {
+	case eip.BOOL:
+		return raw[0]&(1<<(member.info&7)) != 0, true
+	case eip.SINT:
+		return int32(int8(raw[0])), true
+	case eip.INT:
+		return int32(int16(binary.LittleEndian.Uint16(raw))), true
+	default:
+		return int32(binary.LittleEndian.Uint32(raw)), true
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	cb "github.com/clearblade/Go-SDK"
+	adapter_library "github.com/clearblade/adapter-go-library"
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+// mqttTransport is the messaging layer the request handlers depend on. It
+// subscribes the adapter to its request topics and publishes the responses.
+type mqttTransport interface {
+	Subscribe(topic string, handler adapter_library.MQTTMessageReceived) error
+	Publish(topic string, payload []byte) error
+}
+
+// clearBladeTransport sends and receives MQTT messages through the ClearBlade
+// platform/edge broker. It connects its own device client rather than the
+// adapter-go-library one to learn when the connection is lost, the client
+// reconnects by itself and reports the QoS 0 publishes made while
+// reconnecting as sent.
+type clearBladeTransport struct {
+	mu        sync.Mutex
+	client    mqtt.Client
+	connected bool
+}
+
+func (c *clearBladeTransport) Subscribe(topic string, handler adapter_library.MQTTMessageReceived) error {
+	log.Println("[INFO] Subscribe - Connecting to ClearBlade MQTT broker")
+	deviceClient, err := systemClient()
+	if err != nil {
+		return err
+	}
+
+	// like adapter-go-library, return once the first connect subscribed
+	subscribed := make(chan struct{})
+	var once sync.Once
+	callbacks := cb.Callbacks{
+		OnConnectCallback: func(client mqtt.Client) {
+			log.Printf("[INFO] onConnect - Connected to ClearBlade MQTT broker, subscribing to %s\n", topic)
+			token := client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
+				handler(newPublish(msg.Topic(), msg.Payload()))
+			})
+			if token.Wait() && token.Error() != nil {
+				log.Printf("[ERROR] onConnect - Failed to subscribe to %s: %s\n", topic, token.Error().Error())
+			}
+			c.setConnected(client, true)
+			once.Do(func() { close(subscribed) })
+		},
+		OnConnectionLostCallback: func(client mqtt.Client, err error) {
+			c.setConnected(client, false)
+			args := adapter_library.Args
+			// without a service account the device token has to be renewed
+			// by restarting the adapter
+			if args.FatalOnDisconnect == "true" || args.ServiceAccount == "" {
+				log.Fatalf("[FATAL] onConnectLost - Connection to MQTT broker was lost: %s\n", err.Error())
+			}
+			log.Printf("[ERROR] onConnectLost - Connection to MQTT broker was lost: %s\n", err.Error())
+		},
+	}
+	clientID := adapter_library.Args.DeviceName + "-" + strconv.Itoa(rand.Intn(10000))
+	if err := deviceClient.InitializeMQTTWithCallback(clientID, "", 30, nil, nil, &callbacks); err != nil {
+		return fmt.Errorf("failed to initialize MQTT connection: %s", err.Error())
+	}
+	<-subscribed
+	return nil
+}
+
+func (c *clearBladeTransport) setConnected(client mqtt.Client, connected bool) {
+	c.mu.Lock()
+	c.client, c.connected = client, connected
+	c.mu.Unlock()
+}
+
+func (c *clearBladeTransport) Publish(topic string, payload []byte) error {
+	c.mu.Lock()
+	client, connected := c.client, c.connected
+	c.mu.Unlock()
+	if client == nil || !connected {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	token := client.Publish(topic, 0, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// mqttRetainTransport is implemented by transports that can publish
+// retained messages
+type mqttRetainTransport interface {
+	PublishRetained(topic string, payload []byte) error
+}
+
+// mqttSessionTransport is implemented by transports that own their broker
+// session. The will, extra subscriptions and connect callbacks must be set
+// before Subscribe connects and are reapplied on every reconnect. The will
+// payload is built again for every connect.
+type mqttSessionTransport interface {
+	SetWill(topic string, payload func() []byte)
+	AddSubscription(topic string)
+	OnConnect(callback func())
+}
+
+// mqttSession holds the session options shared by the broker transports
+type mqttSession struct {
+	willTopic   string
+	willPayload func() []byte
+	topics      []string
+	callbacks   []func()
+}
+
+func (s *mqttSession) SetWill(topic string, payload func() []byte) {
+	s.willTopic, s.willPayload = topic, payload
+}
+
+// will returns the will payload for the next connect
+func (s *mqttSession) will() []byte {
+	return s.willPayload()
+}
+
+func (s *mqttSession) AddSubscription(topic string) {
+	s.topics = append(s.topics, topic)
+}
+
+func (s *mqttSession) OnConnect(callback func()) {
+	s.callbacks = append(s.callbacks, callback)
+}
+
+// connected runs the connect callbacks once the subscriptions are in place
+func (s *mqttSession) connected() {
+	for _, callback := range s.callbacks {
+		callback()
+	}
+}
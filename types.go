@@ -1,12 +1,178 @@
 package main
 
+// http_port - port for the local REST API, the API is disabled when 0
+// http_bearer_token - token clients must supply in an "Authorization: Bearer" header
+// opcua_port - port for the embedded OPC UA server, the server is disabled when 0
+// opcua_bind_address - address the OPC UA server listens on, every interface when empty
+// opcua_writes_enabled - lets sessions authenticated as opcua_username write tag variables, every variable is read only when not set
+// opcua_username - user OPC UA clients authenticate as to write, required with opcua_writes_enabled
+// opcua_password - password of opcua_username, sent in plain text as the server only supports SecurityPolicy None
+// poll_interval_ms - how often tags are polled for the change based outputs, defaults to 1000
+// poll_tags - tags to poll, every tag with a supported data type is polled when empty
+// sparkplug - publishes the polled tags as a Sparkplug B edge node when set
+// payload_encoding - json (default), compact_json, cbor, msgpack or protobuf
+// topic_encodings - payload_encoding per topic below topic_root, "read" applies to read and read/response
+// store_and_forward - queues the messages that cannot be published while the broker is unreachable
+// tag_config - scaling and engineering units per tag name
+// tag_config_collection - collection with a tag_config row per tag, tag_config entries take precedence
+// virtual_tags - read only tags computed from controller tags, expression per tag name
+// tag_aliases - friendly names or asset paths for controller and virtual tags, tag name per alias
+// tag_aliases_collection - collection with an alias and a tag_name column, tag_aliases entries take precedence
+// tag_topics - publishes each polled tag to {topic_root}/tags/<tag> as a retained message and accepts writes on .../set
+// alarms - threshold or boolean alarm per polled tag, events are published to {topic_root}/events
+// logix_alarms - publishes the ALMD/ALMA instruction tags and controller faults to {topic_root}/events
+// write_policy - restricts which tags and values may be written, writes are not restricted when not set
+// audit_log - append-only file every write is recorded in, the records are also published to {topic_root}/audit
+// write_verify_delay_ms - how long writes requested with verify wait before reading the tag back, defaults to 100
+// write_verify_tolerance - largest difference between a written and read back number that counts as verified
+// recipe_collection - collection the recipes are stored in, with a unique name column and a tag_values JSON column
+// recipe_file - local JSON file the recipes are stored in when recipe_collection is not set
+// string_encoding - ascii (default), latin1 or utf8, character encoding of STRING tags and the other LEN/DATA string types
+// max_outstanding_requests - how many requests the adapter works on at the same time, defaults to 1
+// request_queue_size - how many requests may wait for one of those to complete, further requests are rejected, defaults to 100
+// request_timeout_ms - requests waiting longer than this are rejected, and controller calls not answered within it fail, defaults to 10000
+// request_deadline_ms - requests running longer than this give up their place to the next request, defaults to 30000
 type ethernetIpAdapterSettings struct {
-	EndpointIp   string `json:"endpoint_ip"`
-	EndpointPort uint   `json:"endpoint_tcp_port"`
+	EndpointIp             string                    `json:"endpoint_ip"`
+	EndpointPort           uint                      `json:"endpoint_tcp_port"`
+	HTTPPort               uint                      `json:"http_port"`
+	HTTPBearerToken        string                    `json:"http_bearer_token"`
+	OPCUAPort              uint                      `json:"opcua_port"`
+	OPCUABindAddress       string                    `json:"opcua_bind_address"`
+	OPCUAWritesEnabled     bool                      `json:"opcua_writes_enabled"`
+	OPCUAUsername          string                    `json:"opcua_username"`
+	OPCUAPassword          string                    `json:"opcua_password"`
+	PollInterval           uint                      `json:"poll_interval_ms"`
+	PollTags               []string                  `json:"poll_tags"`
+	Sparkplug              *sparkplugSettings        `json:"sparkplug"`
+	PayloadEncoding        string                    `json:"payload_encoding"`
+	TopicEncodings         map[string]string         `json:"topic_encodings"`
+	StoreAndForward        *storeAndForwardSettings  `json:"store_and_forward"`
+	TagConfig              map[string]*tagConfig     `json:"tag_config"`
+	TagConfigCollection    string                    `json:"tag_config_collection"`
+	VirtualTags            map[string]string         `json:"virtual_tags"`
+	TagAliases             map[string]string         `json:"tag_aliases"`
+	TagAliasesCollection   string                    `json:"tag_aliases_collection"`
+	TagTopics              bool                      `json:"tag_topics"`
+	Alarms                 map[string]*alarmSettings `json:"alarms"`
+	LogixAlarms            bool                      `json:"logix_alarms"`
+	WritePolicy            *writePolicySettings      `json:"write_policy"`
+	AuditLog               string                    `json:"audit_log"`
+	WriteVerifyDelay       uint                      `json:"write_verify_delay_ms"`
+	WriteVerifyTolerance   float64                   `json:"write_verify_tolerance"`
+	RecipeCollection       string                    `json:"recipe_collection"`
+	RecipeFile             string                    `json:"recipe_file"`
+	StringEncoding         string                    `json:"string_encoding"`
+	MaxOutstandingRequests uint                      `json:"max_outstanding_requests"`
+	RequestQueueSize       uint                      `json:"request_queue_size"`
+	RequestTimeout         uint                      `json:"request_timeout_ms"`
+	RequestDeadline        uint                      `json:"request_deadline_ms"`
+}
+
+// read_only - rejects every write
+// allow - tag names or patterns that may be written, every tag when empty; * matches any characters, ? a single one
+// deny - tag names or patterns that may not be written, deny takes precedence over allow
+// tag_limits - value limits per tag name or pattern, exact names take precedence over patterns
+// critical - tag names or patterns that are only written with select before operate on the write topic
+// select_timeout_ms - how long a critical tag stays selected waiting for the operate request, defaults to 10000
+type writePolicySettings struct {
+	ReadOnly      bool                       `json:"read_only"`
+	Allow         []string                   `json:"allow"`
+	Deny          []string                   `json:"deny"`
+	TagLimits     map[string]*tagWriteLimits `json:"tag_limits"`
+	Critical      []string                   `json:"critical"`
+	SelectTimeout uint                       `json:"select_timeout_ms"`
+}
+
+// min, max - range of the values that may be written, in engineering units for scaled tags
+// values - the only values that may be written
+// min_interval_ms - writes to the tag sooner than this after the previous write are rejected
+type tagWriteLimits struct {
+	Min         *float64      `json:"min"`
+	Max         *float64      `json:"max"`
+	Values      []interface{} `json:"values"`
+	MinInterval uint          `json:"min_interval_ms"`
+}
+
+// hihi, hi, lo, lolo - analog alarm limits, a level is disabled when not set
+// condition - digital alarm raised while the tag equals this value, cannot be combined with limits
+// deadband - how far the value must return past a limit before the level clears
+// delay_ms - how long a level must be exceeded before the alarm activates
+// severity - event severity from 1 to 1000, defaults to 800 for hihi and lolo and 500 otherwise
+// message - text prepended to the event messages
+type alarmSettings struct {
+	HiHi      *float64 `json:"hihi"`
+	Hi        *float64 `json:"hi"`
+	Lo        *float64 `json:"lo"`
+	LoLo      *float64 `json:"lolo"`
+	Condition *bool    `json:"condition"`
+	Deadband  float64  `json:"deadband"`
+	Delay     uint     `json:"delay_ms"`
+	Severity  uint32   `json:"severity"`
+	Message   string   `json:"message"`
+}
+
+// raw_min, raw_max, eu_min, eu_max - linearly scale the raw controller range to the engineering unit range
+// offset - added to the value after scaling
+// clamp - limits read values to eu_min..eu_max and written values to raw_min..raw_max
+// units - engineering units reported alongside the value
+type tagConfig struct {
+	RawMin float64 `json:"raw_min"`
+	RawMax float64 `json:"raw_max"`
+	EUMin  float64 `json:"eu_min"`
+	EUMax  float64 `json:"eu_max"`
+	Offset float64 `json:"offset"`
+	Clamp  bool    `json:"clamp"`
+	Units  string  `json:"units"`
+}
+
+// directory - where the queued messages are stored, the queue is disabled when empty
+// max_bytes - size of the queue, the oldest messages are dropped when full, defaults to 10 MiB
+// max_age_seconds - queued messages older than this are dropped, defaults to one day
+type storeAndForwardSettings struct {
+	Directory string `json:"directory"`
+	MaxBytes  uint64 `json:"max_bytes"`
+	MaxAge    uint   `json:"max_age_seconds"`
+}
+
+// group_id, edge_node_id - identify the adapter as a Sparkplug B edge node
+// device_id - device the controller tags are published under, defaults to "controller"
+// bdseq_file - file the bdSeq of the last session is kept in, so it keeps incrementing across restarts
+type sparkplugSettings struct {
+	GroupID    string `json:"group_id"`
+	EdgeNodeID string `json:"edge_node_id"`
+	DeviceID   string `json:"device_id"`
+	BdSeqFile  string `json:"bdseq_file"`
+}
+
+// standaloneConfig is the settings file used when the adapter runs against a
+// plain MQTT broker rather than a ClearBlade system
+type standaloneConfig struct {
+	TopicRoot       string                    `json:"topic_root"`
+	Broker          mqttBrokerSettings        `json:"broker"`
+	AdapterSettings ethernetIpAdapterSettings `json:"adapter_settings"`
+}
+
+// url - tcp://, mqtt://, ssl://, tls:// or mqtts:// followed by host:port
+// mqtt_version - "3.1.1" (default) or "5"
+// keepalive - seconds between pings, defaults to 30
+// ca_file, cert_file, key_file - PEM files used for TLS server verification and client certificate authentication
+type mqttBrokerSettings struct {
+	URL                string `json:"url"`
+	Version            string `json:"mqtt_version"`
+	ClientID           string `json:"client_id"`
+	Username           string `json:"username"`
+	Password           string `json:"password"`
+	KeepAlive          uint16 `json:"keepalive"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
 }
 
 type ethernetIpReadRequestMQTTMessage struct {
-	Tags []string `json:"tags"`
+	Tags   []string `json:"tags"`
+	MaxAge uint     `json:"max_age_ms"`
 }
 
 type ethernetIpReadResponseMQTTMessage struct {
@@ -19,20 +185,102 @@ type ethernetIpReadResponseMQTTMessage struct {
 
 type ethernetIpReadResponseData struct {
 	Value           interface{} `json:"value"`
+	Units           string      `json:"units,omitempty"`
 	SourceTimestamp string      `json:"source_timestamp"`
 }
 
 type ethernetIpWriteRequestMQTTMessage struct {
-	NodeID string      `json:"node_id"`
-	Value  interface{} `json:"value"`
+	NodeID     string                 `json:"node_id"`
+	Value      interface{}            `json:"value"`
+	User       string                 `json:"user"`
+	Verify     bool                   `json:"verify"`
+	Values     map[string]interface{} `json:"values"`
+	Atomic     bool                   `json:"atomic"`
+	Token      string                 `json:"token"`
+	Cancel     bool                   `json:"cancel"`
+	Operation  string                 `json:"operation"`
+	ResetValue interface{}            `json:"reset_value"`
+	Duration   uint                   `json:"duration_ms"`
+	Interval   uint                   `json:"interval_ms"`
 }
 
 type ethernetIpWriteResponseMQTTMessage struct {
-	NodeID       string `json:"node_id"`
-	Timestamp    string `json:"timestamp"`
+	NodeID        string                           `json:"node_id"`
+	Timestamp     string                           `json:"timestamp"`
+	Success       bool                             `json:"success"`
+	StatusCode    uint32                           `json:"status_code"`
+	ErrorMessage  string                           `json:"error_message"`
+	Verified      *bool                            `json:"verified,omitempty"`
+	ObservedValue interface{}                      `json:"observed_value,omitempty"`
+	Results       map[string]ethernetIpWriteResult `json:"results,omitempty"`
+	Token         string                           `json:"token,omitempty"`
+	Expires       string                           `json:"expires,omitempty"`
+	State         string                           `json:"state,omitempty"`
+	Value         interface{}                      `json:"value,omitempty"`
+}
+
+// ethernetIpWriteResult is the outcome of one tag of a batch write
+type ethernetIpWriteResult struct {
 	Success      bool   `json:"success"`
-	StatusCode   uint32 `json:"status_code"`
 	ErrorMessage string `json:"error_message"`
+	RolledBack   bool   `json:"rolled_back,omitempty"`
+}
+
+type ethernetIpAuditRecord struct {
+	Timestamp     string      `json:"timestamp"`
+	User          string      `json:"user"`
+	Source        string      `json:"source"`
+	Tag           string      `json:"tag"`
+	PreviousValue interface{} `json:"previous_value"`
+	NewValue      interface{} `json:"new_value"`
+	Success       bool        `json:"success"`
+	ErrorMessage  string      `json:"error_message"`
+}
+
+type ethernetIpTagInfo struct {
+	Name       string   `json:"name"`
+	DataType   string   `json:"data_type"`
+	TypeCode   uint16   `json:"type_code"`
+	Structure  bool     `json:"structure"`
+	Dimensions uint8    `json:"dimensions"`
+	Units      string   `json:"units,omitempty"`
+	Aliases    []string `json:"aliases,omitempty"`
+	Virtual    bool     `json:"virtual,omitempty"`
+	Expression string   `json:"expression,omitempty"`
+}
+
+type ethernetIpBrowseResponseMQTTMessage struct {
+	Timestamp    string              `json:"timestamp"`
+	Tags         []ethernetIpTagInfo `json:"tags"`
+	Success      bool                `json:"success"`
+	StatusCode   uint32              `json:"status_code"`
+	ErrorMessage string              `json:"error_message"`
+}
+
+type ethernetIpStatusResponse struct {
+	Timestamp     string                 `json:"timestamp"`
+	Endpoint      string                 `json:"endpoint"`
+	Connected     bool                   `json:"connected"`
+	TagCount      int                    `json:"tag_count"`
+	OutboundQueue *ethernetIpQueueStatus `json:"outbound_queue,omitempty"`
+}
+
+type ethernetIpQueueStatus struct {
+	Depth   int    `json:"depth"`
+	Bytes   int64  `json:"bytes"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type ethernetIpIdentity struct {
+	Address      string `json:"address"`
+	VendorID     uint16 `json:"vendor_id"`
+	DeviceType   uint16 `json:"device_type"`
+	ProductCode  uint16 `json:"product_code"`
+	Revision     string `json:"revision"`
+	Status       uint16 `json:"status"`
+	SerialNumber string `json:"serial_number"`
+	ProductName  string `json:"product_name"`
+	State        uint8  `json:"state"`
 }
 
 type ethernetIpMethodRequestMQTTMessage struct {
@@ -133,11 +381,64 @@ type ethernetIpMonitoredItemNotificationMQTTMessage struct {
 
 //eventFieldNames        = []string{"EventId", "EventType", "Severity", "Time", "Message"}
 type ethernetIpEventMessage struct {
-	EventID   string `json:"event_id"`
-	EventType string `json:"event_type"`
-	Severity  uint32 `json:"severity"`
-	Time      string `json:"time"`
-	Message   string `json:"message"`
+	EventID    string      `json:"event_id"`
+	EventType  string      `json:"event_type"`
+	Severity   uint32      `json:"severity"`
+	Time       string      `json:"time"`
+	Message    string      `json:"message"`
+	SourceName string      `json:"source_name,omitempty"`
+	Condition  string      `json:"condition,omitempty"`
+	State      string      `json:"state,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+}
+
+type ethernetIpAlarmAckMQTTMessage struct {
+	Tag       string `json:"tag"`
+	User      string `json:"user"`
+	Comment   string `json:"comment"`
+	Condition string `json:"condition"`
+	ProgAck   bool   `json:"prog_ack"`
+}
+
+type ethernetIpAlarmAckResponseMQTTMessage struct {
+	Tag          string `json:"tag"`
+	Timestamp    string `json:"timestamp"`
+	Success      bool   `json:"success"`
+	StatusCode   uint32 `json:"status_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// ethernetIpRecipeMQTTMessage is the request on the {topic_root}/recipes/<operation> topics
+type ethernetIpRecipeMQTTMessage struct {
+	Name   string   `json:"name"`
+	Tags   []string `json:"tags"`
+	Atomic bool     `json:"atomic"`
+	User   string   `json:"user"`
+}
+
+type ethernetIpRecipeResponseMQTTMessage struct {
+	Name         string                                `json:"name,omitempty"`
+	Timestamp    string                                `json:"timestamp"`
+	Recipes      []ethernetIpRecipe                    `json:"recipes,omitempty"`
+	Values       map[string]interface{}                `json:"values,omitempty"`
+	Results      map[string]ethernetIpWriteResult      `json:"results,omitempty"`
+	Differences  map[string]ethernetIpRecipeDifference `json:"differences,omitempty"`
+	Success      bool                                  `json:"success"`
+	StatusCode   uint32                                `json:"status_code"`
+	ErrorMessage string                                `json:"error_message"`
+}
+
+type ethernetIpRecipe struct {
+	Name   string                 `json:"name"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// ethernetIpRecipeDifference is a tag whose controller value does not match
+// the recipe, or could not be read
+type ethernetIpRecipeDifference struct {
+	RecipeValue     interface{} `json:"recipe_value"`
+	ControllerValue interface{} `json:"controller_value"`
+	ErrorMessage    string      `json:"error_message,omitempty"`
 }
 
 type ethernetIpSubscriptionRequestMQTTMessage struct {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"math"
+	"reflect"
+	"time"
+)
+
+const defaultWriteVerifyDelay = 100
+
+// verifyWrite reads a tag back write_verify_delay_ms after it was written
+// and reports whether the controller still holds the written value, along
+// with the value read. Numbers match within write_verify_tolerance, plus one
+// raw count for scaled tags as the raw value is rounded. The read is
+// scheduled after the delay, so verifyWrite must be called outside of a
+// scheduled request.
+func verifyWrite(name string, written interface{}) (bool, interface{}) {
+	delay := adapterSettings.WriteVerifyDelay
+	if delay == 0 {
+		delay = defaultWriteVerifyDelay
+	}
+	time.Sleep(time.Duration(delay) * time.Millisecond)
+
+	data := map[string]ethernetIpReadResponseData{}
+	err := scheduler.do(priorityWrite, func() error {
+		return readTags([]string{name}, data)
+	})
+	if err != nil {
+		log.Printf("[ERROR] verifyWrite - Failed to read back tag %s: %s\n", name, err.Error())
+		return false, nil
+	}
+	observed := data[name].Value
+	return valuesMatch(name, written, observed), observed
+}
+
+// valuesMatch reports whether a value read from a tag matches the value
+// written or expected, numbers match within write_verify_tolerance
+func valuesMatch(name string, expected interface{}, observed interface{}) bool {
+	e, eOK := verifyNumber(expected)
+	o, oOK := verifyNumber(observed)
+	if !eOK || !oOK {
+		return reflect.DeepEqual(expected, observed)
+	}
+
+	tolerance := adapterSettings.WriteVerifyTolerance
+	if config := tagConfigs[resolveTagName(name)]; config.scaled() {
+		tolerance += math.Abs((config.EUMax - config.EUMin) / (config.RawMax - config.RawMin))
+	}
+	return math.Abs(e-o) <= tolerance
+}
+
+// verifyNumber returns the numbers of written and read values, JSON writes
+// are float64 and unscaled integer tags read as int32, or uint32 for UDINT
+func verifyNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int32:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWriteVerify(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Counter", 0)
+	sim.addDINT("Level", 0)
+	transport := startTestAdapter(t, sim)
+
+	adapterSettings.WriteVerifyDelay = 1
+	adapterSettings.TagConfig = map[string]*tagConfig{
+		"Level": {RawMin: 0, RawMax: 27648, EUMin: 0, EUMax: 100, Clamp: true},
+	}
+	if err := initializeTagConfig(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	tests := []struct {
+		tag      string
+		value    string
+		response string
+	}{
+		{tag: "Counter", value: `42`, response: `"verified": true, "observed_value": 42`},
+		// the raw value is rounded, a scaled tag matches within one raw count
+		{tag: "Level", value: `33.3333`, response: `"verified": true, "observed_value": 33.333333333333336`},
+		// the write is clamped to raw_max so the controller holds another value
+		{tag: "Level", value: `150`, response: `"verified": false, "observed_value": 100`},
+	}
+	for _, test := range tests {
+		transport.send(testTopicRoot+"/write", `{"node_id": "`+test.tag+`", "value": `+test.value+`, "verify": true}`)
+		transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "`+test.tag+`", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": "", `+test.response+`}`)
+	}
+
+	// verification is only done when requested
+	transport.send(testTopicRoot+"/write", `{"node_id": "Counter", "value": 7}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "Counter", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+
+	adapterSettings.WriteVerifyTolerance = 0.5
+	if verified, observed := verifyWrite("Counter", float64(7.4)); !verified || observed != int32(7) {
+		t.Fatalf("unexpected verification %v %v", verified, observed)
+	}
+	if verified, _ := verifyWrite("Counter", float64(8)); verified {
+		t.Fatal("expected the verification to fail")
+	}
+}
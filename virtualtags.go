@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	eip "github.com/loki-os/go-ethernet-ip"
+	"github.com/loki-os/go-ethernet-ip/types"
+)
+
+// virtualTags are the parsed virtual_tags expressions, keyed by tag name.
+// They are read only and evaluated by the adapter from controller tags.
+var virtualTags map[string]*tagExpression
+
+// initializeVirtualTags parses the virtual_tags expressions. It runs once the
+// controller tags are retrieved so the names and references can be checked.
+func initializeVirtualTags() error {
+	tags := map[string]*tagExpression{}
+	for name, source := range adapterSettings.VirtualTags {
+		if _, ok := eipTagMap[name]; ok {
+			return fmt.Errorf("virtual tag %s has the name of a controller tag", name)
+		}
+		expr, err := parseExpression(source)
+		if err != nil {
+			return fmt.Errorf("virtual tag %s: %w", name, err)
+		}
+		for _, ref := range expr.tags {
+			if _, ok := eipTagMap[ref]; ok {
+				continue
+			}
+			if base, ok := containingTag(ref); ok {
+				return fmt.Errorf("virtual tag %s: %w: %s, only whole tags can be referenced, not members or elements of %s", name, errTagNotFound, ref, base)
+			}
+			return fmt.Errorf("virtual tag %s: %w: %s", name, errTagNotFound, ref)
+		}
+		tags[name] = expr
+	}
+
+	if len(tags) > 0 {
+		log.Printf("[INFO] initializeVirtualTags - Loaded %d virtual tags\n", len(tags))
+	}
+	virtualTags = tags
+	return nil
+}
+
+// containingTag returns the controller tag a member, element or bit
+// reference such as Pump[2].Speed belongs to
+func containingTag(ref string) (string, bool) {
+	for i := len(ref) - 1; i > 0; i-- {
+		if ref[i] != '.' && ref[i] != '[' {
+			continue
+		}
+		if _, ok := eipTagMap[ref[:i]]; ok {
+			return ref[:i], true
+		}
+	}
+	return "", false
+}
+
+// virtualTagNames returns the sorted virtual tag names
+func virtualTagNames() []string {
+	names := make([]string, 0, len(virtualTags))
+	for name := range virtualTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dataType is the CIP type the virtual tag is reported as, BOOL or LREAL
+func (e *tagExpression) dataType() types.UInt {
+	if e.boolean() {
+		return eip.BOOL
+	}
+	return eip.LREAL
+}
+
+// readVirtualTag evaluates a virtual tag with the current values of the
+// controller tags it references
+func readVirtualTag(name string) (ethernetIpReadResponseData, error) {
+	value, err := virtualTags[name].eval(readTagValue)
+	if err != nil {
+		return ethernetIpReadResponseData{}, err
+	}
+	return ethernetIpReadResponseData{
+		Value:           value,
+		Units:           tagConfigs[name].units(),
+		SourceTimestamp: timeNow().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func readTagValue(name string) (interface{}, error) {
+	tag, err := lookupTag(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := cachedReadTag(tag, 0)
+	return data.Value, err
+}
+
+// evaluateVirtualTags evaluates the named virtual tags after a poll. The
+// values of the polled tags are reused, references to tags that are not
+// polled are read from the controller. Tags that fail to evaluate are left
+// out of the result.
+func evaluateVirtualTags(names []string, polled map[string]interface{}) map[string]interface{} {
+	lookup := func(name string) (interface{}, error) {
+		if value, ok := polled[name]; ok {
+			return value, nil
+		}
+		return readTagValue(name)
+	}
+
+	values := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		value, err := virtualTags[resolveTagName(name)].eval(lookup)
+		if err != nil {
+			log.Printf("[ERROR] evaluateVirtualTags - Failed to evaluate virtual tag %s: %s\n", name, err.Error())
+			continue
+		}
+		values[name] = value
+	}
+	return values
+}
+
+// browseVirtualTags describes the virtual tags for browse responses
+func browseVirtualTags() []ethernetIpTagInfo {
+	tags := make([]ethernetIpTagInfo, 0, len(virtualTags))
+	for _, name := range virtualTagNames() {
+		expr := virtualTags[name]
+		tags = append(tags, ethernetIpTagInfo{
+			Name:       name,
+			DataType:   eip.TypeMap[expr.dataType()],
+			TypeCode:   uint16(expr.dataType()),
+			Units:      tagConfigs[name].units(),
+			Aliases:    aliasesByTag[name],
+			Virtual:    true,
+			Expression: expr.source,
+		})
+	}
+	return tags
+}
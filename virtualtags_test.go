@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpressions(t *testing.T) {
+	values := map[string]interface{}{
+		"FlowRate":             int32(12),
+		"Density":              1.5,
+		"Running":              true,
+		"Faulted":              false,
+		"Program:Main.Pump[2]": int32(-3),
+		"Recipe":               "A",
+	}
+	lookup := func(name string) (interface{}, error) {
+		return values[name], nil
+	}
+
+	tests := []struct {
+		expression string
+		expected   interface{}
+	}{
+		{expression: "FlowRate * Density", expected: 18.0},
+		{expression: "Running && !Faulted", expected: true},
+		{expression: "FlowRate > 10 || Faulted", expected: true},
+		{expression: "1 + 2 * 3 - 4 / 2", expected: 5.0},
+		{expression: "(1 + 2) * 3 % 4", expected: 1.0},
+		{expression: "-FlowRate + Running", expected: -11.0},
+		{expression: "FlowRate == 12 && Density != 1", expected: true},
+		{expression: "min(FlowRate, Density, 4) + max(1, 2.5e1)", expected: 26.5},
+		{expression: "avg(FlowRate, 0) + abs(Program:Main.Pump[2])", expected: 9.0},
+		{expression: "round(Density)", expected: 2.0},
+		{expression: "FlowRate", expected: 12.0},
+		{expression: "Running == true", expected: true},
+	}
+	for _, test := range tests {
+		expr, err := parseExpression(test.expression)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", test.expression, err.Error())
+		}
+		got, err := expr.eval(lookup)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", test.expression, err.Error())
+		}
+		if got != test.expected {
+			t.Fatalf("%s = %#v, expected %#v", test.expression, got, test.expected)
+		}
+	}
+
+	expr, _ := parseExpression("FlowRate / (Density - 1.5) + Recipe")
+	if _, err := expr.eval(lookup); !errors.Is(err, errDivisionByZero) {
+		t.Fatalf("expected a division by zero, got %v", err)
+	}
+	if expr.tags[0] != "Density" || expr.tags[1] != "FlowRate" || expr.tags[2] != "Recipe" {
+		t.Fatalf("unexpected tag references %v", expr.tags)
+	}
+	expr, _ = parseExpression("Recipe + 1")
+	if _, err := expr.eval(lookup); !errors.Is(err, errInvalidValue) {
+		t.Fatalf("expected an error for a string tag, got %v", err)
+	}
+
+	for _, invalid := range []string{"", "1 +", "(1", "a = b", "a & b", "sum(a)", "abs(a, b)", "min()", "1 2"} {
+		if _, err := parseExpression(invalid); err == nil {
+			t.Fatalf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestVirtualTags(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("FlowRate", 12)
+	sim.addDINT("Density", 3)
+	sim.addDINT("Setpoint", 10)
+	transport := startTestAdapter(t, sim)
+
+	prevPoller, prevVirtual := poller, virtualTags
+	t.Cleanup(func() { poller, virtualTags = prevPoller, prevVirtual })
+	poller = &tagPoller{}
+
+	adapterSettings.VirtualTags = map[string]string{
+		"Mass":     "FlowRate * Density",
+		"HighFlow": "FlowRate > Setpoint",
+	}
+	if err := initializeVirtualTags(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	transport.send(testTopicRoot+"/read", `{"tags": ["Mass", "HighFlow", "FlowRate"]}`)
+	transport.expect(t, testTopicRoot+"/read/response", `{
+		"server_timestamp": "2022-09-01T12:30:00Z",
+		"data": {
+			"FlowRate": {"value": 12, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"HighFlow": {"value": true, "source_timestamp": "2022-09-01T12:30:00Z"},
+			"Mass": {"value": 36, "source_timestamp": "2022-09-01T12:30:00Z"}
+		},
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	transport.send(testTopicRoot+"/browse", `{}`)
+	transport.expect(t, testTopicRoot+"/browse/response", `{
+		"timestamp": "2022-09-01T12:30:00Z",
+		"tags": [
+			{"name": "Density", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0},
+			{"name": "FlowRate", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0},
+			{"name": "HighFlow", "data_type": "BOOL", "type_code": 193, "structure": false, "dimensions": 0, "virtual": true, "expression": "FlowRate \u003e Setpoint"},
+			{"name": "Mass", "data_type": "LREAL", "type_code": 203, "structure": false, "dimensions": 0, "virtual": true, "expression": "FlowRate * Density"},
+			{"name": "Setpoint", "data_type": "DINT", "type_code": 196, "structure": false, "dimensions": 0}
+		],
+		"success": true,
+		"status_code": 0,
+		"error_message": ""
+	}`)
+
+	transport.send(testTopicRoot+"/write", `{"node_id": "Mass", "value": 1}`)
+	transport.expect(t, testTopicRoot+"/write/response", `{
+		"node_id": "Mass",
+		"timestamp": "2022-09-01T12:30:00Z",
+		"success": false,
+		"status_code": 0,
+		"error_message": "tag is read only: Mass is a virtual tag"
+	}`)
+
+	// virtual tags are evaluated after each poll, even when the tags they
+	// reference are not polled
+	var results []pollResult
+	poller.addListener(func(result pollResult) { results = append(results, result) })
+	poller.tags = []string{"FlowRate", "Mass", "HighFlow"}
+	poller.poll()
+	if len(results) != 1 || results[0].values["Mass"] != 36.0 || results[0].values["HighFlow"] != true || len(results[0].changed) != 3 {
+		t.Fatalf("unexpected poll result %+v", results)
+	}
+
+	if err := writeTagByName("Setpoint", float64(20)); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	poller.poll()
+	if len(results) != 2 || results[1].values["HighFlow"] != false || len(results[1].changed) != 1 || results[1].changed[0] != "HighFlow" {
+		t.Fatalf("unexpected poll result %+v", results[1])
+	}
+
+	adapterSettings.VirtualTags = map[string]string{"Setpoint": "FlowRate"}
+	if err := initializeVirtualTags(); err == nil {
+		t.Fatal("expected an error for a virtual tag named after a controller tag")
+	}
+	adapterSettings.VirtualTags = map[string]string{"Total": "FlowRate + Missing"}
+	if err := initializeVirtualTags(); !errors.Is(err, errTagNotFound) {
+		t.Fatalf("expected an error for an unknown tag, got %v", err)
+	}
+	adapterSettings.VirtualTags = map[string]string{"Total": "FlowRate[2].Value + 1"}
+	expected := "virtual tag Total: tag does not exist: FlowRate[2].Value, only whole tags can be referenced, not members or elements of FlowRate"
+	if err := initializeVirtualTags(); err == nil || err.Error() != expected {
+		t.Fatalf("expected an error for an element reference, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errWriteRateLimited = errors.New("write rate limit exceeded")
+
+// tagWritePolicy decides which writes are sent to the controller. It applies to
+// every write, whether it comes from MQTT, the REST API, OPC UA or Sparkplug.
+type tagWritePolicy struct {
+	readOnly bool
+	allow    []*regexp.Regexp
+	deny     []*regexp.Regexp
+	tags     []tagWriteRule
+	critical []*regexp.Regexp
+	timeout  time.Duration
+
+	mu         sync.Mutex
+	lastWrites map[string]time.Time
+}
+
+// tagWriteRule is the tag_limits entry for a tag name or pattern, exact
+// names are listed before patterns
+type tagWriteRule struct {
+	pattern *regexp.Regexp
+	limits  *tagWriteLimits
+}
+
+var writePolicy *tagWritePolicy
+
+// initializeWritePolicy validates the write_policy setting, writes are not
+// restricted when it is not set
+func initializeWritePolicy() error {
+	settings := adapterSettings.WritePolicy
+	if settings == nil {
+		writePolicy = nil
+		return nil
+	}
+
+	policy := &tagWritePolicy{readOnly: settings.ReadOnly, lastWrites: map[string]time.Time{}}
+	policy.timeout = time.Duration(settings.SelectTimeout) * time.Millisecond
+	for _, pattern := range settings.Allow {
+		policy.allow = append(policy.allow, globPattern(pattern))
+	}
+	for _, pattern := range settings.Deny {
+		policy.deny = append(policy.deny, globPattern(pattern))
+	}
+	for _, pattern := range settings.Critical {
+		policy.critical = append(policy.critical, globPattern(pattern))
+	}
+
+	patterns := make([]string, 0, len(settings.TagLimits))
+	for pattern, limits := range settings.TagLimits {
+		if limits.Min != nil && limits.Max != nil && *limits.Min > *limits.Max {
+			return fmt.Errorf("write_policy limits for %s: min is greater than max", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		iGlob, jGlob := isGlob(patterns[i]), isGlob(patterns[j])
+		if iGlob != jGlob {
+			return jGlob
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		policy.tags = append(policy.tags, tagWriteRule{pattern: globPattern(pattern), limits: settings.TagLimits[pattern]})
+	}
+
+	if policy.readOnly {
+		log.Printf("[INFO] initializeWritePolicy - Adapter is read only, writes are rejected\n")
+	} else {
+		log.Printf("[INFO] initializeWritePolicy - Loaded write policy with %d allowed, %d denied, %d limited and %d critical tags\n", len(policy.allow), len(policy.deny), len(policy.tags), len(policy.critical))
+	}
+	writePolicy = policy
+	return nil
+}
+
+// globPattern compiles a tag name pattern where * matches any run of
+// characters and ? a single character, brackets are matched literally so
+// array elements such as Data[3] can be named
+func globPattern(pattern string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, `.*`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
+// matchesAny reports whether the requested name or the tag it resolves to
+// matches one of the patterns, bits such as Flags.3 also match the patterns
+// of their word
+func matchesAny(patterns []*regexp.Regexp, name string, symbol string) bool {
+	word := ""
+	if tag, _, ok := bitAddress(symbol); ok {
+		word = tag.Name()
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) || pattern.MatchString(symbol) || word != "" && pattern.MatchString(word) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error when the policy rejects writing value to the tag
+// name, which may be an alias. Writes only count towards the rate limit once
+// they are recorded.
+func (p *tagWritePolicy) check(name string, value interface{}) error {
+	return p.checkWrite(name, value, true)
+}
+
+// checkRepeat is check for the writes that continue a pulse or hold after
+// its first write was accepted, the rewrites of a hold and the reset. They
+// are not rate limited, so a hold keeps the tag set and the tag is never
+// left set.
+func (p *tagWritePolicy) checkRepeat(name string, value interface{}) error {
+	return p.checkWrite(name, value, false)
+}
+
+func (p *tagWritePolicy) checkWrite(name string, value interface{}, rateLimited bool) error {
+	if p == nil {
+		return nil
+	}
+
+	symbol := resolveTagName(name)
+	switch {
+	case p.readOnly:
+		return fmt.Errorf("%w: the adapter is read only", errReadOnlyTag)
+	case matchesAny(p.deny, name, symbol):
+		return fmt.Errorf("%w: writes to %s are denied", errReadOnlyTag, name)
+	case len(p.allow) > 0 && !matchesAny(p.allow, name, symbol):
+		return fmt.Errorf("%w: writes to %s are not allowed", errReadOnlyTag, name)
+	}
+
+	limits, ofWord := p.limits(name, symbol)
+	if limits == nil {
+		return nil
+	}
+	if ofWord {
+		// a bit changes the word to a value that is not known beforehand
+		if limits.Min != nil || limits.Max != nil || len(limits.Values) > 0 {
+			return fmt.Errorf("%w for %s, the value limits of its word apply to the whole word", errInvalidValue, name)
+		}
+	} else if err := limits.check(name, value); err != nil {
+		return err
+	}
+
+	if limits.MinInterval == 0 || !rateLimited {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if last, ok := p.lastWrites[rateLimitKey(symbol)]; ok && timeNow().Sub(last) < time.Duration(limits.MinInterval)*time.Millisecond {
+		return fmt.Errorf("%w: %s was written less than %d ms ago", errWriteRateLimited, name, limits.MinInterval)
+	}
+	return nil
+}
+
+// record counts a write that reached the controller towards the tag's rate
+// limit
+func (p *tagWritePolicy) record(name string) {
+	if p == nil {
+		return
+	}
+	symbol := resolveTagName(name)
+	if limits, _ := p.limits(name, symbol); limits == nil || limits.MinInterval == 0 {
+		return
+	}
+	p.mu.Lock()
+	p.lastWrites[rateLimitKey(symbol)] = timeNow()
+	p.mu.Unlock()
+}
+
+// rateLimitKey is the tag the rate limit of a write is kept for, the bits of
+// a word share the word's rate limit
+func rateLimitKey(symbol string) string {
+	if tag, _, ok := bitAddress(symbol); ok {
+		return tag.Name()
+	}
+	return symbol
+}
+
+// selectRequired reports whether the tag is critical, critical tags are only
+// written through select before operate
+func (p *tagWritePolicy) selectRequired(name string) bool {
+	return p != nil && matchesAny(p.critical, name, resolveTagName(name))
+}
+
+// selectTimeout is how long a critical tag stays selected
+func (p *tagWritePolicy) selectTimeout() time.Duration {
+	if p == nil || p.timeout == 0 {
+		return defaultSelectTimeout * time.Millisecond
+	}
+	return p.timeout
+}
+
+// limits returns the first tag_limits entry matching the tag. Bits without
+// an entry of their own use the entry of their word, ofWord reports that.
+func (p *tagWritePolicy) limits(name string, symbol string) (limits *tagWriteLimits, ofWord bool) {
+	if limits := p.match(name, symbol); limits != nil {
+		return limits, false
+	}
+	if tag, _, ok := bitAddress(symbol); ok {
+		limits := p.match(tag.Name(), tag.Name())
+		return limits, limits != nil
+	}
+	return nil, false
+}
+
+func (p *tagWritePolicy) match(name string, symbol string) *tagWriteLimits {
+	for _, rule := range p.tags {
+		if rule.pattern.MatchString(name) || rule.pattern.MatchString(symbol) {
+			return rule.limits
+		}
+	}
+	return nil
+}
+
+func (l *tagWriteLimits) check(name string, value interface{}) error {
+	if len(l.Values) > 0 {
+		for _, allowed := range l.Values {
+			if reflect.DeepEqual(allowed, value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w for %s, must be one of %v: %v", errInvalidValue, name, l.Values, value)
+	}
+
+	if l.Min == nil && l.Max == nil {
+		return nil
+	}
+	f, ok := value.(float64)
+	if !ok {
+		return fmt.Errorf("%w for %s, a number is required: %v", errInvalidValue, name, value)
+	}
+	if l.Min != nil && f < *l.Min || l.Max != nil && f > *l.Max {
+		return fmt.Errorf("%w for %s, out of range: %v", errInvalidValue, name, value)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWritePolicy(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Line1_Speed_SP", 10)
+	sim.addDINT("Line1_Mode", 1)
+	sim.addDINT("Line1_Count", 0)
+	sim.addDINT("Safety_Bypass", 0)
+	transport := startTestAdapter(t, sim)
+
+	prevPolicy := writePolicy
+	t.Cleanup(func() { writePolicy = prevPolicy })
+
+	limit := func(v float64) *float64 { return &v }
+	adapterSettings.WritePolicy = &writePolicySettings{
+		Allow: []string{"Line1_*"},
+		Deny:  []string{"Line1_Count"},
+		TagLimits: map[string]*tagWriteLimits{
+			"Line1_Speed_SP": {Min: limit(0), Max: limit(100), MinInterval: 1000},
+			"Line1_*":        {Values: []interface{}{float64(1), float64(2)}},
+		},
+	}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	now := time.Date(2022, 9, 1, 12, 30, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	expectWrite := func(name string, value string, errMsg string) {
+		t.Helper()
+		transport.send(testTopicRoot+"/write", `{"node_id": "`+name+`", "value": `+value+`}`)
+		if errMsg == "" {
+			transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "`+name+`", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+		} else {
+			transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "`+name+`", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "`+errMsg+`"}`)
+		}
+	}
+
+	expectWrite("Line1_Speed_SP", `150`, "invalid value for Line1_Speed_SP, out of range: 150")
+	expectWrite("Line1_Speed_SP", `"fast"`, "invalid value for Line1_Speed_SP, a number is required: fast")
+	expectWrite("Line1_Speed_SP", `55`, "")
+	expectWrite("Line1_Speed_SP", `60`, "write rate limit exceeded: Line1_Speed_SP was written less than 1000 ms ago")
+	expectWrite("Line1_Mode", `3`, "invalid value for Line1_Mode, must be one of [1 2]: 3")
+	expectWrite("Line1_Mode", `2`, "")
+	expectWrite("Line1_Count", `5`, "tag is read only: writes to Line1_Count are denied")
+	expectWrite("Safety_Bypass", `1`, "tag is read only: writes to Safety_Bypass are not allowed")
+
+	if got := sim.value("Line1_Speed_SP"); !bytes.Equal(got, []byte{55, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+	if got := sim.value("Safety_Bypass"); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Fatalf("rejected write reached the controller: % x", got)
+	}
+
+	now = now.Add(time.Second)
+	if err := writeTagByName("Line1_Speed_SP", float64(60)); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	adapterSettings.WritePolicy = &writePolicySettings{ReadOnly: true}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := writeTagByName("Line1_Mode", float64(1)); !errors.Is(err, errReadOnlyTag) {
+		t.Fatalf("expected a read only error, got %v", err)
+	}
+
+	adapterSettings.WritePolicy = &writePolicySettings{TagLimits: map[string]*tagWriteLimits{"Line1_Mode": {Min: limit(5), Max: limit(1)}}}
+	if err := initializeWritePolicy(); err == nil {
+		t.Fatal("expected an error for min greater than max")
+	}
+}
+
+func TestWritePolicyRateLimit(t *testing.T) {
+	sim := newSimController(t)
+	sim.addDINT("Speed_SP", 10)
+	sim.addDINT("Flags", 0)
+	sim.addDINT("Mode", 1)
+	transport := startTestAdapter(t, sim)
+
+	prevPolicy := writePolicy
+	t.Cleanup(func() { writePolicy = prevPolicy })
+	limit := func(v float64) *float64 { return &v }
+	adapterSettings.WritePolicy = &writePolicySettings{TagLimits: map[string]*tagWriteLimits{
+		"Speed_SP": {Max: limit(100), MinInterval: 1000},
+		"Flags":    {MinInterval: 1000},
+		"Mode":     {Values: []interface{}{float64(1), float64(2)}},
+	}}
+	if err := initializeWritePolicy(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expectWrite := func(name string, value string, errMsg string) {
+		t.Helper()
+		transport.send(testTopicRoot+"/write", `{"node_id": "`+name+`", "value": `+value+`}`)
+		if errMsg == "" {
+			transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "`+name+`", "timestamp": "2022-09-01T12:30:00Z", "success": true, "status_code": 0, "error_message": ""}`)
+		} else {
+			transport.expect(t, testTopicRoot+"/write/response", `{"node_id": "`+name+`", "timestamp": "2022-09-01T12:30:00Z", "success": false, "status_code": 0, "error_message": "`+errMsg+`"}`)
+		}
+	}
+
+	// rejected and failed writes do not use up the rate limit
+	expectWrite("Speed_SP", `150`, "invalid value for Speed_SP, out of range: 150")
+	sim.setReadOnly("Speed_SP")
+	expectWrite("Speed_SP", `50`, "failed to write Speed_SP: CIP service 0x4d failed with general status 0x0f")
+	sim.mu.Lock()
+	sim.tags["Speed_SP"].readOnly = false
+	sim.mu.Unlock()
+	expectWrite("Speed_SP", `50`, "")
+	expectWrite("Speed_SP", `60`, "write rate limit exceeded: Speed_SP was written less than 1000 ms ago")
+
+	// bits share the rate limit of their word
+	expectWrite("Flags.3", `true`, "")
+	expectWrite("Flags.4", `true`, "write rate limit exceeded: Flags.4 was written less than 1000 ms ago")
+	expectWrite("Flags", `0`, "write rate limit exceeded: Flags was written less than 1000 ms ago")
+	expectWrite("Mode.1", `true`, "invalid value for Mode.1, the value limits of its word apply to the whole word")
+	if got := sim.value("Flags"); !bytes.Equal(got, []byte{0x08, 0, 0, 0}) {
+		t.Fatalf("unexpected controller value % x", got)
+	}
+}